@@ -40,6 +40,7 @@ func init() {
 			if err != nil {
 				log.Panic("Error while initializing", "error", err)
 			}
+			startBackgroundJobs()
 		},
 	})
 }
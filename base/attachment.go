@@ -7,13 +7,16 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
-	"io/ioutil"
+	"mime"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/hexya-erp/hexya-base/base/extractor"
+	"github.com/hexya-erp/hexya-base/base/storage"
 	"github.com/hexya-erp/hexya/hexya/actions"
 	"github.com/hexya-erp/hexya/hexya/models"
 	"github.com/hexya-erp/hexya/hexya/models/security"
@@ -24,7 +27,51 @@ import (
 	"github.com/spf13/viper"
 )
 
+// storageMigrationWhere returns the SQL condition and its arguments
+// matching the attachments that are not stored in the given location.
+func storageMigrationWhere(location string) (string, []interface{}) {
+	if location == "db" {
+		return "store_fname <> ''", nil
+	}
+	return "db_datas <> '' OR (store_fname <> '' AND COALESCE(NULLIF(store_location, ''), 'file') <> ?)",
+		[]interface{}{location}
+}
+
+// indexBatchSize is the number of attachments indexed in each background transaction
+const indexBatchSize = 20
+
+// indexAsyncSize returns the size in bytes above which
+// attachments are indexed in the background.
+func indexAsyncSize(env models.Environment) int64 {
+	size, err := strconv.ParseInt(h.ConfigParameter().NewSet(env).Sudo().GetParam("attachment.index_async_size", "1048576"), 10, 64)
+	if err != nil {
+		log.Warn("Invalid attachment.index_async_size parameter", "error", err)
+		return 1048576
+	}
+	return size
+}
+
+// indexJobInterval is the time between two runs of the background
+// indexing of the attachments waiting to be indexed.
+const indexJobInterval = 30 * time.Second
+
+// indexPendingAttachments indexes all the committed attachments waiting to
+// be indexed. Each batch of attachments is indexed in its own transaction.
+func indexPendingAttachments() error {
+	for {
+		var count int
+		err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			count = h.Attachment().NewSet(env).ProcessPendingIndexes(indexBatchSize)
+		})
+		if err != nil || count < indexBatchSize {
+			return err
+		}
+	}
+}
+
 func init() {
+	RegisterBackgroundJob("attachment_index", indexJobInterval, indexPendingAttachments)
+
 	attachmentModel := h.Attachment().DeclareModel()
 	attachmentModel.AddFields(map[string]models.FieldDefinition{
 		"Name":        models.CharField{String: "Attachment Name", Required: true},
@@ -46,12 +93,15 @@ func init() {
 
 		"Datas": models.BinaryField{String: "File Content", Compute: h.Attachment().Methods().ComputeDatas(),
 			Inverse: h.Attachment().Methods().InverseDatas()},
-		"DBDatas":      models.CharField{String: "Database Data"},
-		"StoreFname":   models.CharField{String: "Stored Filename"},
+		"DBDatas":    models.CharField{String: "Database Data"},
+		"StoreFname": models.CharField{String: "Stored Filename"},
+		"StoreLocation": models.CharField{String: "Storage Location",
+			Help: "Storage in which the file is saved, as in the 'attachment.location' parameter. Empty for the local filestore."},
 		"FileSize":     models.IntegerField{GoType: new(int)},
 		"CheckSum":     models.CharField{String: "Checksum/SHA1", Size: 40, Index: true},
 		"MimeType":     models.CharField{},
 		"IndexContent": models.TextField{String: "Indexed Content"},
+		"IndexPending": models.BooleanField{Index: true, Help: "The content of this attachment will be indexed in the background"},
 	})
 
 	attachmentModel.Methods().ComputeResName().DeclareMethod(
@@ -66,8 +116,15 @@ func init() {
 		})
 
 	attachmentModel.Methods().Storage().DeclareMethod(
-		`Storage returns the configured storage mechanism for attachments (e.g. database, file, etc.)`,
+		`Storage returns the configured storage mechanism for attachments. It is either
+		'db' for the database, 'file' for the local filestore, or the URL of a storage
+		driver location such as 's3://bucket/prefix'.
+
+		The 'attachment_location' context key overrides the configured storage.`,
 		func(rs h.AttachmentSet) string {
+			if location := rs.Env().Context().GetString("attachment_location"); location != "" {
+				return location
+			}
 			return h.ConfigParameter().NewSet(rs.Env()).GetParam("attachment.location", "file")
 		})
 
@@ -77,23 +134,128 @@ func init() {
 			return filepath.Join(viper.GetString("DataDir"), "filestore")
 		})
 
+	attachmentModel.Methods().StorageDriver().DeclareMethod(
+		`StorageDriver returns the driver of the given storage location, which is
+		either 'file' for the local filestore or a URL such as 's3://bucket/prefix'.
+
+		Files of the local filestore are encrypted if encryption keys are set in
+		the server configuration. Unencrypted files are then refused, unless they
+		are allowed while the filestore is migrated to encryption.`,
+		func(rs h.AttachmentSet, location string) storage.Driver {
+			if location == "" || location == "file" {
+				keyring, err := attachmentKeyring()
+				if err != nil {
+					log.Panic("Invalid attachment encryption configuration", "error", err)
+				}
+				if keyring != nil {
+					driver := storage.NewEncryptedDriver(storage.NewFileDriver(rs.FileStore()), keyring)
+					if attachmentPlaintextAllowed(rs.Env()) {
+						return driver.WithPlaintext()
+					}
+					return driver
+				}
+				return storage.NewFileDriver(rs.FileStore())
+			}
+			driver, err := storage.Open(location)
+			if err != nil {
+				log.Panic("Unable to open attachment storage", "location", location, "error", err)
+			}
+			return driver
+		})
+
+	attachmentModel.Methods().FileLocation().DeclareMethod(
+		`FileLocation returns the storage location of the file of this attachment.
+		If this attachment has no file, it returns the location in which new files are saved.`,
+		func(rs h.AttachmentSet) string {
+			if rs.Len() == 1 && rs.StoreFname() != "" {
+				if rs.StoreLocation() == "" {
+					return "file"
+				}
+				return rs.StoreLocation()
+			}
+			if location := rs.Storage(); location != "db" {
+				return location
+			}
+			return "file"
+		})
+
 	attachmentModel.Methods().ForceStorage().DeclareMethod(
-		`ForceStorage forces all attachments to be stored in the currently configured storage`,
-		func(rs h.AttachmentSet) bool {
+		`ForceStorage forces all attachments to be stored in the currently configured storage.
+		It creates an attachment migration to this storage and queues it, so that the files are
+		moved in the background in batches. It returns the created migration.`,
+		func(rs h.AttachmentSet) h.AttachmentMigrationSet {
 			if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
 				log.Panic(rs.T("Only administrators can execute this action."))
 			}
-			var cond q.AttachmentCondition
-			switch rs.Storage() {
-			case "db":
-				cond = q.Attachment().StoreFname().IsNotNull()
-			case "file":
-				cond = q.Attachment().DBDatas().IsNotNull()
+			migration := h.AttachmentMigration().NewSet(rs.Env()).Sudo().Create(&h.AttachmentMigrationData{
+				Location: rs.Storage(),
+			})
+			migration.ActionRun()
+			return migration
+		})
+
+	attachmentModel.Methods().ToMigrate().DeclareMethod(
+		`ToMigrate returns the attachments with an ID greater than afterID that are not
+		stored in the given location, ordered by ID. If limit is positive, at most limit
+		attachments are returned.`,
+		func(rs h.AttachmentSet, location string, afterID int64, limit int) h.AttachmentSet {
+			where, args := storageMigrationWhere(location)
+			query := fmt.Sprintf("SELECT id FROM attachment WHERE id > ? AND (%s) ORDER BY id", where)
+			args = append([]interface{}{afterID}, args...)
+			if limit > 0 {
+				query += " LIMIT ?"
+				args = append(args, limit)
+			}
+			var ids []int64
+			rs.Env().Cr().Select(&ids, query, args...)
+			return h.Attachment().Browse(rs.Env(), ids)
+		})
+
+	attachmentModel.Methods().MigrationEstimate().DeclareMethod(
+		`MigrationEstimate returns the number of files and bytes that must be moved
+		for all attachments to be stored in the given location.`,
+		func(rs h.AttachmentSet, location string) (int64, int64) {
+			where, args := storageMigrationWhere(location)
+			var res struct {
+				Count int64
+				Size  int64
 			}
-			for _, attach := range h.Attachment().Search(rs.Env(), cond).Records() {
-				attach.SetDatas(attach.Datas())
+			rs.Env().Cr().Get(&res, fmt.Sprintf(`SELECT COUNT(*) AS count, COALESCE(SUM(file_size), 0) AS size
+				FROM attachment WHERE %s`, where), args...)
+			return res.Count, res.Size
+		})
+
+	attachmentModel.Methods().MoveToStorage().DeclareMethod(
+		`MoveToStorage moves the content of this attachment to the given storage location.
+		It returns an error without modifying the attachment if its content cannot be
+		read from its current storage or written to the new one.
+
+		The move is made within a savepoint, so that the current transaction can go on
+		even if a query failed while moving the attachment.`,
+		func(rs h.AttachmentSet, location string) (err error) {
+			rs.EnsureOne()
+			rs.Env().Cr().Execute("SAVEPOINT attachment_move_to_storage")
+			defer func() {
+				if r := recover(); r != nil {
+					rs.Env().Cr().Execute("ROLLBACK TO SAVEPOINT attachment_move_to_storage")
+					rs.InvalidateCache()
+					err = fmt.Errorf("%v", r)
+					return
+				}
+				rs.Env().Cr().Execute("RELEASE SAVEPOINT attachment_move_to_storage")
+			}()
+			datas := rs.DBDatas()
+			if rs.StoreFname() != "" {
+				// read the file directly from the driver, so that missing
+				// files are reported instead of being replaced by empty data.
+				data, err := rs.StorageDriver(rs.FileLocation()).Get(rs.StoreFname())
+				if err != nil {
+					return err
+				}
+				datas = base64.StdEncoding.EncodeToString(data)
 			}
-			return true
+			rs.WithContext("attachment_location", location).SetDatas(datas)
+			return nil
 		})
 
 	attachmentModel.Methods().FullPath().DeclareMethod(
@@ -102,135 +264,161 @@ func init() {
 			return filepath.Join(rs.FileStore(), path)
 		})
 
-	attachmentModel.Methods().GetPath().DeclareMethod(
-		`GetPath returns the relative and full paths of the file with the given sha.
-		This methods creates the directory if it does not exist.`,
-		func(rs h.AttachmentSet, sha string) (string, string) {
-			fName := filepath.Join(sha[:2], sha)
-			fullPath := rs.FullPath(fName)
-			if os.MkdirAll(filepath.Dir(fullPath), 0755) != nil {
-				log.Panic("Unable to create directory for file storage")
-			}
-			return fName, fullPath
-		})
-
 	attachmentModel.Methods().FileRead().DeclareMethod(
-		`FileRead returns the base64 encoded content of the given fileName (relative path).
-		If binSize is true, it returns the file size instead as a human readable string`,
+		`FileRead returns the base64 encoded content of the given fileName (relative path)
+		in the storage of this attachment. If binSize is true, it returns the file size
+		instead as a human readable string`,
 		func(rs h.AttachmentSet, fileName string, binSize bool) string {
-			fullPath := rs.FullPath(fileName)
+			location := rs.FileLocation()
+			driver := rs.StorageDriver(location)
 			if binSize {
-				fInfo, err := os.Stat(fullPath)
+				size, err := driver.Size(fileName)
 				if err != nil {
-					log.Warn("Error while stating file", "file", fullPath, "error", err)
+					log.Warn("Error while stating file", "location", location, "file", fileName, "error", err)
 					return ""
 				}
-				return strutils.HumanSize(fInfo.Size())
+				return strutils.HumanSize(size)
 			}
-			data, err := ioutil.ReadFile(fullPath)
+			data, err := driver.Get(fileName)
 			if err != nil {
-				log.Warn("Unable to read file", "file", fullPath, "error", err)
+				log.Warn("Unable to read file", "location", location, "file", fileName, "error", err)
 				return ""
 			}
 			return base64.StdEncoding.EncodeToString(data)
 		})
 
 	attachmentModel.Methods().FileWrite().DeclareMethod(
-		`FileWrite writes value into the file given by sha. If the file already exists, nothing is done.
+		`FileWrite writes value into the file given by sha in the configured storage.
+		If the file already exists, nothing is done.
 
 		It returns the filename of the written file.`,
 		func(rs h.AttachmentSet, value, sha string) string {
-			fName, fullPath := rs.GetPath(sha)
-			_, err := os.Stat(fullPath)
-			if err == nil {
-				// File already exists
+			location := rs.Storage()
+			driver := rs.StorageDriver(location)
+			fName := storeFname(sha)
+			exists, err := driver.Exists(fName)
+			if err != nil {
+				log.Panic("Unable to access attachment storage", "location", location, "error", err)
+			}
+			if exists {
 				return fName
 			}
 			data, err := base64.StdEncoding.DecodeString(value)
 			if err != nil {
 				log.Warn("Unable to decode file content", "file", sha, "error", err)
 			}
-			ioutil.WriteFile(fullPath, data, 0644)
+			if err = driver.Put(fName, data); err != nil {
+				log.Panic("Unable to write attachment file", "location", location, "file", fName, "error", err)
+			}
 			// add fname to checklist, in case the transaction aborts
-			rs.MarkForGC(fName)
+			rs.MarkForGC(location, fName)
 			return fName
 		})
 
 	attachmentModel.Methods().FileDelete().DeclareMethod(
-		`FileDelete adds the given file name to the checklist for the garbage collector`,
+		`FileDelete adds the given file name of the storage of this
+		attachment to the checklist for the garbage collector`,
 		func(rs h.AttachmentSet, fName string) {
-			rs.MarkForGC(fName)
+			rs.MarkForGC(rs.FileLocation(), fName)
 		})
 
 	attachmentModel.Methods().MarkForGC().DeclareMethod(
-		`MarkForGC adds fName in a checklist for filestore garbage collection.`,
-		func(rs h.AttachmentSet, fName string) {
+		`MarkForGC adds fName in a checklist for the garbage collection of the given storage location.`,
+		func(rs h.AttachmentSet, location, fName string) {
 			// we use a spooldir: add an empty file in the subdirectory 'checklist'
-			fullPath := filepath.Join(rs.FullPath("checklist"), fName)
-			os.MkdirAll(filepath.Dir(fullPath), 0755)
-			ioutil.WriteFile(fullPath, []byte{}, 0644)
+			if err := rs.StorageDriver(location).Put(path.Join("checklist", fName), []byte{}); err != nil {
+				log.Warn("Unable to add file to the GC checklist", "location", location, "file", fName, "error", err)
+			}
 		})
 
 	attachmentModel.Methods().FileGC().DeclareMethod(
-		`FileGC performs the garbage collection of the filestore.`,
+		`FileGC performs the garbage collection of the storages of the attachments.`,
 		func(rs h.AttachmentSet) {
-			if rs.Storage() != "file" {
-				return
-			}
 			// Continue in a new transaction. The LOCK statement below must be the
 			// first one in the current transaction, otherwise the database snapshot
 			// used by it may not contain the most recent changes made to the table
-			// ir_attachment! Indeed, if concurrent transactions create attachments,
+			// attachment! Indeed, if concurrent transactions create attachments,
 			// the LOCK statement will wait until those concurrent transactions end.
 			// But this transaction will not see the new attachements if it has done
-			// other requests before the LOCK (like the method _storage() above).
+			// other requests before the LOCK (like the method Storage() above).
 			models.ExecuteInNewEnvironment(rs.Env().Uid(), func(env models.Environment) {
-				env.Cr().Execute("LOCK ir_attachment IN SHARE MODE")
+				// first delete the revisions beyond their retention policy, in their own transaction,
+				// so that their files are in the checklist and no longer referenced below.
+				h.AttachmentRevision().NewSet(env).Sudo().Prune()
+			})
+			models.ExecuteInNewEnvironment(rs.Env().Uid(), func(env models.Environment) {
+				env.Cr().Execute("LOCK attachment IN SHARE MODE")
 
 				rSet := h.Attachment().NewSet(env)
 
-				//retrieve the file names from the checklist
-				var checklist []string
-				err := filepath.Walk(rSet.FullPath("checklist"), func(path string, info os.FileInfo, err error) error {
-					if info.IsDir() {
-						return nil
+				// collect the locations in which files may be stored
+				var locations []string
+				env.Cr().Select(&locations, `SELECT DISTINCT COALESCE(NULLIF(store_location, ''), 'file')
+					FROM attachment WHERE store_fname IS NOT NULL
+					UNION SELECT DISTINCT COALESCE(NULLIF(store_location, ''), 'file')
+					FROM attachment_revision WHERE store_fname IS NOT NULL`)
+				locations = append(locations, "file", rSet.Storage())
+				seen := make(map[string]bool)
+				for _, location := range locations {
+					if location == "db" || seen[location] {
+						continue
 					}
-					fName := filepath.Join(filepath.Base(filepath.Dir(path)), info.Name())
-					checklist = append(checklist, fName)
-					return nil
-				})
-				if err != nil {
-					log.Panic("Error while walking the checklist directory", "error", err)
+					seen[location] = true
+					rSet.FileGCLocation(location)
 				}
+			})
+		})
 
-				// determine which files to keep among the checklist
-				var whitelistSlice []string
-				env.Cr().Select(&whitelistSlice, "SELECT DISTINCT store_fname FROM ir_attachment WHERE store_fname IN ?", checklist)
-				whitelist := make(map[string]bool)
-				for _, wl := range whitelistSlice {
-					whitelist[wl] = true
-				}
+	attachmentModel.Methods().FileGCLocation().DeclareMethod(
+		`FileGCLocation removes the files of the checklist of the given storage
+		location which are not referenced by any attachment anymore.
 
-				// remove garbage files, and clean up checklist
-				var removed int
-				for _, fName := range checklist {
-					if !whitelist[fName] {
-						err = os.Remove(rSet.FullPath(fName))
-						if err != nil {
-							log.Warn("Unable to FileGC", "file", rSet.FullPath(fName), "error", err)
-							continue
-						}
-						removed++
-					}
-					err = os.Remove(filepath.Join(rSet.FullPath("checklist"), fName))
-					if err != nil {
-						log.Warn("Unable to clean checklist dir", "file", fName, "error", err)
+		It must be called within FileGC, after the attachment table has been locked.`,
+		func(rs h.AttachmentSet, location string) {
+			driver := rs.StorageDriver(location)
+
+			// retrieve the file names from the checklist
+			entries, err := driver.List("checklist/")
+			if err != nil {
+				log.Panic("Error while listing the GC checklist", "location", location, "error", err)
+			}
+			if len(entries) == 0 {
+				return
+			}
+			checklist := make([]string, len(entries))
+			for i, entry := range entries {
+				checklist[i] = strings.TrimPrefix(entry, "checklist/")
+			}
+
+			// determine which files to keep among the checklist
+			// files of attachment revisions are live too
+			var whitelistSlice []string
+			rs.Env().Cr().Select(&whitelistSlice, `SELECT DISTINCT store_fname FROM attachment
+				WHERE store_fname IN (?) AND COALESCE(NULLIF(store_location, ''), 'file') = ?
+				UNION SELECT DISTINCT store_fname FROM attachment_revision
+				WHERE store_fname IN (?) AND COALESCE(NULLIF(store_location, ''), 'file') = ?`,
+				checklist, location, checklist, location)
+			whitelist := make(map[string]bool)
+			for _, wl := range whitelistSlice {
+				whitelist[wl] = true
+			}
+
+			// remove garbage files, and clean up checklist
+			var removed int
+			for _, fName := range checklist {
+				if !whitelist[fName] {
+					if err = driver.Delete(fName); err != nil {
+						log.Warn("Unable to FileGC", "location", location, "file", fName, "error", err)
+						continue
 					}
+					removed++
 				}
+				if err = driver.Delete(path.Join("checklist", fName)); err != nil {
+					log.Warn("Unable to clean checklist", "location", location, "file", fName, "error", err)
+				}
+			}
 
-				log.Info("Filestore garbage collected", "checked", len(checklist), "removed", removed)
-			})
-
+			log.Info("Filestore garbage collected", "location", location, "checked", len(checklist), "removed", removed)
 		})
 
 	attachmentModel.Methods().ComputeDatas().DeclareMethod(
@@ -260,28 +448,45 @@ func init() {
 				binData = string(binBytes)
 			}
 			vals := &h.AttachmentData{
-				FileSize:     len(binData),
-				CheckSum:     rs.ComputeCheckSum(binData),
-				IndexContent: rs.Index(binData, rs.MimeType()),
-				DBDatas:      val,
+				FileSize: len(binData),
+				CheckSum: rs.ComputeCheckSum(binData),
+				DBDatas:  val,
 			}
-			if val != "" && rs.Storage() != "db" {
-				// Save the file to the filestore
-				vals.StoreFname = rs.FileWrite(val, vals.CheckSum)
-				vals.DBDatas = ""
-			}
-			// take current location in filestore to possibly garbage-collect it
-			fName := rs.StoreFname()
-			// write as superuser, as user probably does not have write access
-			rs.Sudo().WithContext("attachment_set_datas", true).Write(vals,
+			// only index again if the content changed, e.g. not when moving to another storage
+			fieldsToReset := []models.FieldNamer{
 				h.Attachment().FileSize(),
 				h.Attachment().CheckSum(),
-				h.Attachment().IndexContent(),
 				h.Attachment().DBDatas(),
-				h.Attachment().StoreFname())
-			if fName != "" {
-				rs.FileDelete(fName)
+				h.Attachment().StoreFname(),
+				h.Attachment().StoreLocation(),
+			}
+			var indexAsync bool
+			if vals.CheckSum != rs.CheckSum() {
+				rs.CheckQuota(vals.CheckSum, int64(len(binData)))
+				if rs.StoreFname() != "" || rs.DBDatas() != "" {
+					// keep the previous content as a revision
+					rs.SaveRevision()
+				}
+				indexAsync = int64(len(binData)) > indexAsyncSize(rs.Env())
+				if !indexAsync {
+					vals.IndexContent = rs.Index(binData, rs.MimeType())
+				}
+				vals.IndexPending = indexAsync
+				fieldsToReset = append(fieldsToReset, h.Attachment().IndexContent(), h.Attachment().IndexPending())
+			}
+			if location := rs.Storage(); val != "" && location != "db" {
+				// Save the file to the configured storage
+				vals.StoreFname = rs.FileWrite(val, vals.CheckSum)
+				vals.StoreLocation = location
+				vals.DBDatas = ""
+			}
+			// mark the current file to possibly garbage-collect it
+			// while we still know in which storage it is saved
+			if rs.StoreFname() != "" {
+				rs.FileDelete(rs.StoreFname())
 			}
+			// write as superuser, as user probably does not have write access
+			rs.Sudo().WithContext("attachment_set_datas", true).Write(vals, fieldsToReset...)
 		})
 
 	attachmentModel.Methods().ComputeCheckSum().DeclareMethod(
@@ -294,8 +499,14 @@ func init() {
 		`ComputeMimeType of the given values`,
 		func(rs h.AttachmentSet, values *h.AttachmentData) string {
 			mimeType := values.MimeType
+			if mimeType == "" && values.DatasFname != "" {
+				mimeType = mime.TypeByExtension(filepath.Ext(values.DatasFname))
+			}
 			if mimeType == "" && values.Datas != "" {
-				mimeType = http.DetectContentType([]byte(values.Datas))
+				binData, err := base64.StdEncoding.DecodeString(values.Datas)
+				if err == nil {
+					mimeType = http.DetectContentType(binData)
+				}
 			}
 			if mimeType == "" {
 				mimeType = "application/octet-stream"
@@ -308,7 +519,9 @@ func init() {
 		func(rs h.AttachmentSet, values *h.AttachmentData) *h.AttachmentData {
 			res := *values
 			res.MimeType = rs.ComputeMimeType(values)
-			if strings.Contains(res.MimeType, "ht") || strings.Contains(res.MimeType, "xml") &&
+			// office documents such as DOCX are zipped XML, but they are not rendered by browsers
+			xmlLike := strings.Contains(res.MimeType, "xml") && !strings.Contains(res.MimeType, "openxmlformats")
+			if strings.Contains(res.MimeType, "ht") || xmlLike &&
 				(!h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() ||
 					rs.Env().Context().GetBool("attachments_mime_plainxml")) {
 				res.MimeType = "text/plain"
@@ -317,17 +530,55 @@ func init() {
 		})
 
 	attachmentModel.Methods().Index().DeclareMethod(
-		`Index computes the index content of the given filename, or binary data.`,
+		`Index computes the index content of the given binary data with the extractor
+		registered for the given MIME type. It returns an empty string if there is no
+		such extractor.`,
 		func(rs h.AttachmentSet, binData, fileType string) string {
 			if fileType == "" {
 				return ""
 			}
-			if strings.Split(fileType, "/")[0] != "text" {
+			text, err := extractor.Extract(fileType, []byte(binData))
+			switch err {
+			case nil:
+				return text
+			case extractor.ErrUnsupported:
 				return ""
+			default:
+				log.Warn("Unable to extract text content", "type", fileType, "error", err)
+				return ""
+			}
+		})
+
+	attachmentModel.Methods().ProcessPendingIndexes().DeclareMethod(
+		`ProcessPendingIndexes computes the index content of at most limit attachments
+		waiting to be indexed, or of all of them if limit is 0. Attachments which are
+		being indexed by another transaction are skipped.
+
+		It returns the number of indexed attachments.`,
+		func(rs h.AttachmentSet, limit int) int {
+			query := "SELECT id FROM attachment WHERE index_pending ORDER BY id"
+			var args []interface{}
+			if limit > 0 {
+				query += " LIMIT ?"
+				args = append(args, limit)
+			}
+			var ids []int64
+			rs.Env().Cr().Select(&ids, query+" FOR UPDATE SKIP LOCKED", args...)
+			for _, attach := range h.Attachment().Browse(rs.Env(), ids).Sudo().Records() {
+				var binData []byte
+				if datas := attach.Datas(); datas != "" {
+					var err error
+					binData, err = base64.StdEncoding.DecodeString(datas)
+					if err != nil {
+						log.Warn("Unable to decode attachment content", "attachment", attach.ID(), "error", err)
+					}
+				}
+				attach.WithContext("attachment_set_datas", true).Write(&h.AttachmentData{
+					IndexContent: attach.Index(string(binData), attach.MimeType()),
+					IndexPending: false,
+				}, h.Attachment().IndexContent(), h.Attachment().IndexPending())
 			}
-			re := regexp.MustCompile(`[^\x00-\x1F\x7F-\xFF]{4,}`)
-			words := re.FindAllString(binData, -1)
-			return strings.Join(words, "\n")
+			return len(ids)
 		})
 
 	attachmentModel.Methods().Check().DeclareMethod(
@@ -446,7 +697,7 @@ func init() {
 	attachmentModel.Methods().Write().Extend("",
 		func(rs h.AttachmentSet, vals *h.AttachmentData, fieldsToReset ...models.FieldNamer) bool {
 			if rs.Env().Context().GetBool("attachment_set_datas") {
-				return rs.Super().Write(vals)
+				return rs.Super().Write(vals, fieldsToReset...)
 			}
 			rs.Check("write", vals)
 			_, mtExists := vals.Get(h.Attachment().MimeType(), fieldsToReset...)
@@ -454,7 +705,7 @@ func init() {
 			if mtExists || dtExists {
 				vals = rs.CheckContents(vals)
 			}
-			return rs.Super().Write(vals)
+			return rs.Super().Write(vals, fieldsToReset...)
 		})
 
 	attachmentModel.Methods().Copy().Extend("",
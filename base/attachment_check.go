@@ -0,0 +1,266 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hexya-erp/hexya/hexya/actions"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// Key prefixes of the storages which do not hold attachment files
+const (
+	checklistPrefix  = "checklist/"
+	quarantinePrefix = "quarantine/"
+)
+
+// A StorageCheckResult is the result of the integrity check of a storage location
+type StorageCheckResult struct {
+	// Orphans are the keys of the files which no attachment references
+	Orphans []string
+	// Missing are the IDs of the attachments whose file does not exist
+	Missing []int64
+	// Corrupt are the IDs of the attachments whose file content does not match their checksum
+	Corrupt []int64
+}
+
+func init() {
+	attachmentModel := h.Attachment()
+
+	attachmentModel.Methods().CheckStorage().DeclareMethod(
+		`CheckStorage walks all the files of the given storage location and checks them
+		against the attachments stored in it. It reports the files which no attachment
+		references, the attachments whose file is missing and the attachments whose file
+		content does not match their checksum.
+
+		Files waiting in the garbage collector checklist are not reported as orphans.`,
+		func(rs h.AttachmentSet, location string) StorageCheckResult {
+			if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				log.Panic(rs.T("Only administrators can execute this action."))
+			}
+			driver := rs.StorageDriver(location)
+			keys, err := driver.List("")
+			if err != nil {
+				log.Panic("Unable to list storage files", "location", location, "error", err)
+			}
+			files := make(map[string]bool)
+			pending := make(map[string]bool)
+			for _, key := range keys {
+				switch {
+				case strings.HasPrefix(key, checklistPrefix):
+					pending[strings.TrimPrefix(key, checklistPrefix)] = true
+				case strings.HasPrefix(key, quarantinePrefix):
+				default:
+					files[key] = true
+				}
+			}
+
+			var rows []struct {
+				ID         int64
+				StoreFname string `db:"store_fname"`
+				CheckSum   string `db:"check_sum"`
+			}
+			rs.Env().Cr().Select(&rows, `SELECT id, store_fname, check_sum FROM attachment
+				WHERE store_fname <> '' AND COALESCE(NULLIF(store_location, ''), 'file') = ?
+				ORDER BY id`, location)
+
+			var res StorageCheckResult
+			referenced := make(map[string]bool)
+			// files of attachment revisions are not orphans
+			var revisionFiles []string
+			rs.Env().Cr().Select(&revisionFiles, `SELECT DISTINCT store_fname FROM attachment_revision
+				WHERE store_fname <> '' AND COALESCE(NULLIF(store_location, ''), 'file') = ?`, location)
+			for _, fName := range revisionFiles {
+				referenced[fName] = true
+			}
+			checkSums := make(map[string]string)
+			for _, row := range rows {
+				referenced[row.StoreFname] = true
+				if !files[row.StoreFname] {
+					res.Missing = append(res.Missing, row.ID)
+					continue
+				}
+				checkSum, ok := checkSums[row.StoreFname]
+				if !ok {
+					data, err := driver.Get(row.StoreFname)
+					if err != nil {
+						log.Warn("Unable to read file", "location", location, "file", row.StoreFname, "error", err)
+					}
+					checkSum = fmt.Sprintf("%x", sha1.Sum(data))
+					checkSums[row.StoreFname] = checkSum
+				}
+				if checkSum != row.CheckSum {
+					res.Corrupt = append(res.Corrupt, row.ID)
+				}
+			}
+			for _, key := range keys {
+				if files[key] && !referenced[key] && !pending[key] {
+					res.Orphans = append(res.Orphans, key)
+				}
+			}
+			log.Info("Storage checked", "location", location, "files", len(files), "orphans", len(res.Orphans),
+				"missing", len(res.Missing), "corrupt", len(res.Corrupt))
+			return res
+		})
+
+	attachmentModel.Methods().QuarantineFiles().DeclareMethod(
+		`QuarantineFiles moves the given orphan files of the given storage location under
+		the 'quarantine/' prefix, from where they can be inspected and restored or deleted
+		by hand. Files which are referenced by an attachment are left in place.
+
+		It returns the number of quarantined files.`,
+		func(rs h.AttachmentSet, location string, keys []string) int {
+			if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				log.Panic(rs.T("Only administrators can execute this action."))
+			}
+			if len(keys) == 0 {
+				return 0
+			}
+			// prevent attachments from being created on these files while we move them
+			rs.Env().Cr().Execute("LOCK attachment IN SHARE MODE")
+			var referencedSlice []string
+			rs.Env().Cr().Select(&referencedSlice, `SELECT DISTINCT store_fname FROM attachment
+				WHERE store_fname IN (?) AND COALESCE(NULLIF(store_location, ''), 'file') = ?
+				UNION SELECT DISTINCT store_fname FROM attachment_revision
+				WHERE store_fname IN (?) AND COALESCE(NULLIF(store_location, ''), 'file') = ?`,
+				keys, location, keys, location)
+			referenced := make(map[string]bool)
+			for _, key := range referencedSlice {
+				referenced[key] = true
+			}
+			driver := rs.StorageDriver(location)
+			var count int
+			for _, key := range keys {
+				if referenced[key] || strings.HasPrefix(key, checklistPrefix) || strings.HasPrefix(key, quarantinePrefix) {
+					continue
+				}
+				data, err := driver.Get(key)
+				if err == nil {
+					err = driver.Put(path.Join(quarantinePrefix, key), data)
+				}
+				if err == nil {
+					err = driver.Delete(key)
+				}
+				if err != nil {
+					log.Warn("Unable to quarantine file", "location", location, "file", key, "error", err)
+					continue
+				}
+				count++
+			}
+			log.Info("Orphan files quarantined", "location", location, "count", count)
+			return count
+		})
+
+	attachmentModel.Methods().RehydrateFiles().DeclareMethod(
+		`RehydrateFiles restores the missing or corrupt files of these attachments in their
+		storage by copying them from the given source location. A file is only copied if
+		its content matches the checksum of the attachment.
+
+		It returns the number of restored files.`,
+		func(rs h.AttachmentSet, source string) int {
+			if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				log.Panic(rs.T("Only administrators can execute this action."))
+			}
+			sourceDriver := rs.StorageDriver(source)
+			var count int
+			for _, attach := range rs.Sudo().Records() {
+				fName := attach.StoreFname()
+				if fName == "" || attach.FileLocation() == source {
+					continue
+				}
+				data, err := sourceDriver.Get(fName)
+				if err != nil {
+					log.Warn("Unable to read file from source storage", "source", source, "file", fName, "error", err)
+					continue
+				}
+				if fmt.Sprintf("%x", sha1.Sum(data)) != attach.CheckSum() {
+					log.Warn("File of source storage does not match checksum", "source", source, "file", fName)
+					continue
+				}
+				if err = attach.StorageDriver(attach.FileLocation()).Put(fName, data); err != nil {
+					log.Warn("Unable to restore file", "location", attach.FileLocation(), "file", fName, "error", err)
+					continue
+				}
+				count++
+			}
+			log.Info("Files restored", "source", source, "count", count)
+			return count
+		})
+
+	checkWizard := h.AttachmentStorageCheck().DeclareTransientModel()
+	checkWizard.AddFields(map[string]models.FieldDefinition{
+		"Location": models.CharField{String: "Storage", Required: true,
+			Help: "Storage to check: 'file' or a URL such as 's3://bucket/prefix'",
+			Default: func(env models.Environment) interface{} {
+				return h.Attachment().NewSet(env).FileLocation()
+			}},
+		"Source": models.CharField{String: "Rehydrate From",
+			Help: "Storage holding a copy of the files, from which missing or corrupt files can be restored"},
+		"State": models.SelectionField{Selection: types.Selection{
+			"draft":   "Draft",
+			"checked": "Checked",
+		}, Default: models.DefaultValue("draft")},
+		"Orphans": models.TextField{String: "Orphan Files", ReadOnly: true,
+			Help: "Files which no attachment references, one per line"},
+		"Missing": models.Many2ManyField{String: "Missing Files", RelationModel: h.Attachment(),
+			JSON: "missing_ids", M2MLinkModelName: "AttachmentStorageCheckMissing", ReadOnly: true},
+		"Corrupt": models.Many2ManyField{String: "Corrupt Files", RelationModel: h.Attachment(),
+			JSON: "corrupt_ids", M2MLinkModelName: "AttachmentStorageCheckCorrupt", ReadOnly: true},
+	})
+
+	checkWizard.Methods().Reload().DeclareMethod(
+		`Reload returns the action to display this wizard again`,
+		func(rs h.AttachmentStorageCheckSet) *actions.Action {
+			return &actions.Action{
+				Name:     rs.T("Check Storage"),
+				Type:     actions.ActionActWindow,
+				Model:    "AttachmentStorageCheck",
+				ViewMode: "form",
+				ResID:    rs.ID(),
+				Target:   "new",
+			}
+		})
+
+	checkWizard.Methods().ActionCheck().DeclareMethod(
+		`ActionCheck checks the integrity of the storage and displays the result`,
+		func(rs h.AttachmentStorageCheckSet) *actions.Action {
+			rs.EnsureOne()
+			attachments := h.Attachment().NewSet(rs.Env())
+			res := attachments.CheckStorage(rs.Location())
+			rs.Write(&h.AttachmentStorageCheckData{
+				State:   "checked",
+				Orphans: strings.Join(res.Orphans, "\n"),
+				Missing: h.Attachment().Browse(rs.Env(), res.Missing),
+				Corrupt: h.Attachment().Browse(rs.Env(), res.Corrupt),
+			}, h.AttachmentStorageCheck().Orphans(), h.AttachmentStorageCheck().Missing(),
+				h.AttachmentStorageCheck().Corrupt())
+			return rs.Reload()
+		})
+
+	checkWizard.Methods().ActionQuarantine().DeclareMethod(
+		`ActionQuarantine moves the orphan files found by the check to the quarantine`,
+		func(rs h.AttachmentStorageCheckSet) *actions.Action {
+			rs.EnsureOne()
+			keys := strings.Fields(rs.Orphans())
+			h.Attachment().NewSet(rs.Env()).QuarantineFiles(rs.Location(), keys)
+			return rs.ActionCheck()
+		})
+
+	checkWizard.Methods().ActionRehydrate().DeclareMethod(
+		`ActionRehydrate restores the missing and corrupt files found by the check from the source storage`,
+		func(rs h.AttachmentStorageCheckSet) *actions.Action {
+			rs.EnsureOne()
+			if rs.Source() == "" {
+				log.Panic(rs.T("Please set the storage from which files must be restored."))
+			}
+			rs.Missing().Union(rs.Corrupt()).RehydrateFiles(rs.Source())
+			return rs.ActionCheck()
+		})
+}
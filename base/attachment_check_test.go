@@ -0,0 +1,84 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestAttachmentStorageCheck(t *testing.T) {
+	Convey("Testing attachment storage checks", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			dataDir, err := ioutil.TempDir("", "hexya-check")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dataDir)
+			backupDir, err := ioutil.TempDir("", "hexya-backup")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(backupDir)
+			viper.Set("DataDir", dataDir)
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+
+			attachments := h.Attachment().NewSet(env)
+			driver := attachments.StorageDriver("file")
+			newAttachment := func(name string) h.AttachmentSet {
+				return h.Attachment().Create(env, &h.AttachmentData{
+					Name:  name,
+					Datas: base64.StdEncoding.EncodeToString([]byte(name)),
+				})
+			}
+			healthy := newAttachment("check-healthy")
+			corrupt := newAttachment("check-corrupt")
+			So(driver.Put(corrupt.StoreFname(), []byte("garbage")), ShouldBeNil)
+			missing := newAttachment("check-missing")
+			So(driver.Delete(missing.StoreFname()), ShouldBeNil)
+			So(driver.Put("ab/orphan", []byte("orphan")), ShouldBeNil)
+
+			res := attachments.CheckStorage("file")
+			So(res.Orphans, ShouldContain, "ab/orphan")
+			So(res.Orphans, ShouldNotContain, healthy.StoreFname())
+			So(res.Missing, ShouldContain, missing.ID())
+			So(res.Missing, ShouldNotContain, healthy.ID())
+			So(res.Corrupt, ShouldContain, corrupt.ID())
+			So(res.Corrupt, ShouldNotContain, healthy.ID())
+			Convey("Quarantining orphans", func() {
+				So(attachments.QuarantineFiles("file", []string{"ab/orphan", healthy.StoreFname()}), ShouldEqual, 1)
+				exists, err := driver.Exists("quarantine/ab/orphan")
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeTrue)
+				exists, err = driver.Exists("ab/orphan")
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeFalse)
+				exists, err = driver.Exists(healthy.StoreFname())
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeTrue)
+				So(attachments.CheckStorage("file").Orphans, ShouldNotContain, "ab/orphan")
+			})
+			Convey("Rehydrating missing and corrupt files", func() {
+				backup := "file://" + backupDir
+				backupDriver := attachments.StorageDriver(backup)
+				So(backupDriver.Put(missing.StoreFname(), []byte("check-missing")), ShouldBeNil)
+				So(backupDriver.Put(corrupt.StoreFname(), []byte("check-corrupt")), ShouldBeNil)
+				So(missing.Union(corrupt).RehydrateFiles(backup), ShouldEqual, 2)
+				res := attachments.CheckStorage("file")
+				So(res.Missing, ShouldNotContain, missing.ID())
+				So(res.Corrupt, ShouldNotContain, corrupt.ID())
+				So(missing.Datas(), ShouldEqual, base64.StdEncoding.EncodeToString([]byte("check-missing")))
+			})
+			Convey("Files not matching the checksum are not rehydrated", func() {
+				backup := "file://" + backupDir
+				So(attachments.StorageDriver(backup).Put(missing.StoreFname(), []byte("other")), ShouldBeNil)
+				So(missing.RehydrateFiles(backup), ShouldEqual, 0)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hexya-erp/hexya-base/base/storage"
+	"github.com/hexya-erp/hexya/hexya/actions"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	"github.com/spf13/viper"
+)
+
+// Server configuration keys of the encryption of the local filestore
+const (
+	// AttachmentEncryptionKeysConfig is the map of the base64 encoded AES keys
+	// (16, 24 or 32 bytes) with which files may be encrypted, by key ID.
+	// Key IDs are case insensitive. Files of the filestore are not encrypted
+	// if this map is empty.
+	AttachmentEncryptionKeysConfig = "Attachment.Encryption.Keys"
+	// AttachmentEncryptionKeyConfig is the ID of the key with which new files
+	// are encrypted. Set it to the ID of a new key to rotate keys, then run
+	// the re-encryption of the filestore.
+	AttachmentEncryptionKeyConfig = "Attachment.Encryption.Key"
+	// AttachmentEncryptionNameKeyConfig is the secret with which file names are
+	// derived from checksums, so that the names of the files do not reveal the
+	// hash of their content. It is required with encryption keys and must never
+	// change once set.
+	AttachmentEncryptionNameKeyConfig = "Attachment.Encryption.NameKey"
+	// AttachmentEncryptionAllowPlaintextConfig allows to read the unencrypted
+	// files of the local filestore while it is migrated to encryption. It is
+	// ignored once ReencryptFiles has rewritten all the files.
+	AttachmentEncryptionAllowPlaintextConfig = "Attachment.Encryption.AllowPlaintext"
+)
+
+// attachmentEncryptedParam is the configuration parameter set once all the
+// files of the local filestore have been encrypted by ReencryptFiles.
+const attachmentEncryptedParam = "attachment.encryption.complete"
+
+// attachmentKeyring returns the keyring of the local filestore as defined in
+// the server configuration, or nil if encryption is not enabled.
+func attachmentKeyring() (*storage.Keyring, error) {
+	encodedKeys := viper.GetStringMapString(AttachmentEncryptionKeysConfig)
+	if len(encodedKeys) == 0 {
+		return nil, nil
+	}
+	if viper.GetString(AttachmentEncryptionNameKeyConfig) == "" {
+		return nil, fmt.Errorf("%s must be set with attachment encryption keys", AttachmentEncryptionNameKeyConfig)
+	}
+	keys := make(map[string][]byte)
+	for keyID, encoded := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attachment encryption key '%s': %s", keyID, err)
+		}
+		keys[strings.ToLower(keyID)] = key
+	}
+	return storage.NewKeyring(keys, strings.ToLower(viper.GetString(AttachmentEncryptionKeyConfig)))
+}
+
+// attachmentPlaintextAllowed returns true if the unencrypted files of the local
+// filestore may be read, that is if the server configuration allows it and the
+// filestore has not been entirely encrypted yet.
+func attachmentPlaintextAllowed(env models.Environment) bool {
+	if !viper.GetBool(AttachmentEncryptionAllowPlaintextConfig) {
+		return false
+	}
+	return h.ConfigParameter().NewSet(env).Sudo().GetParam(attachmentEncryptedParam, "") == ""
+}
+
+// storeFname returns the name of the file in which the content
+// with the given checksum is stored. The name is derived from the
+// checksum with the name key if any, which encryption requires.
+func storeFname(checkSum string) string {
+	if nameKey := viper.GetString(AttachmentEncryptionNameKeyConfig); nameKey != "" {
+		mac := hmac.New(sha1.New, []byte(nameKey))
+		mac.Write([]byte(checkSum))
+		checkSum = hex.EncodeToString(mac.Sum(nil))
+	}
+	return path.Join(checkSum[:2], checkSum)
+}
+
+// Configuration parameters of the re-encryption of the local filestore
+const (
+	// attachmentReencryptionParam is the state of the re-encryption run by
+	// the background job: 'queued', 'running' or 'done'
+	attachmentReencryptionParam = "attachment.encryption.reencryption"
+	// attachmentReencryptionProgressParam holds the number of processed files,
+	// the total number of files and the number of failures, separated by '/'
+	attachmentReencryptionProgressParam = "attachment.encryption.reencryption_progress"
+)
+
+const (
+	// reencryptionJobInterval is the time between two checks for a queued re-encryption
+	reencryptionJobInterval = 10 * time.Second
+	// reencryptionProgressStep is the number of files between two progress reports
+	reencryptionProgressStep = 100
+	// reencryptionStaleDelay is the time after which a running re-encryption which
+	// has not reported its progress is considered interrupted
+	reencryptionStaleDelay = 10 * time.Minute
+)
+
+// reencryptFiles rewrites all the files of the given driver which are not encrypted
+// with its current key, and returns the number of rewritten files and of failures.
+// If progress is not nil, it is called every reencryptionProgressStep files.
+func reencryptFiles(driver storage.EncryptedDriver, progress func(processed, total, failed int)) (int, int) {
+	keys, err := driver.List("")
+	if err != nil {
+		log.Panic("Unable to list storage files", "location", "file", "error", err)
+	}
+	var done, failed int
+	for i, key := range keys {
+		if progress != nil && i%reencryptionProgressStep == 0 {
+			progress(i, len(keys), failed)
+		}
+		if strings.HasPrefix(key, checklistPrefix) {
+			continue
+		}
+		rewritten, err := driver.Reencrypt(key)
+		if err != nil {
+			log.Warn("Unable to re-encrypt file", "file", key, "error", err)
+			failed++
+			continue
+		}
+		if rewritten {
+			done++
+		}
+	}
+	if progress != nil {
+		progress(len(keys), len(keys), failed)
+	}
+	log.Info("Filestore re-encrypted", "files", len(keys), "rewritten", done, "failed", failed)
+	return done, failed
+}
+
+// RunAttachmentReencryption rewrites all the files of the local filestore which
+// are not encrypted with the current key, and reports its progress in the
+// configuration parameters. It is run by a background job once queued by the
+// ActionReencrypt of the storage check wizard.
+func RunAttachmentReencryption() error {
+	var driver storage.EncryptedDriver
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		var ok bool
+		driver, ok = h.Attachment().NewSet(env).StorageDriver("file").(storage.EncryptedDriver)
+		if !ok {
+			log.Panic("Encryption of attachments is not configured")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	_, failed := reencryptFiles(driver, func(processed, total, failed int) {
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.ConfigParameter().NewSet(env).SetParam(attachmentReencryptionProgressParam,
+				fmt.Sprintf("%d/%d/%d", processed, total, failed))
+		})
+	})
+	return models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		if failed == 0 {
+			h.ConfigParameter().NewSet(env).SetParam(attachmentEncryptedParam, "True")
+		}
+	})
+}
+
+// runQueuedAttachmentReencryption runs the re-encryption of the local filestore if it
+// has been queued by ActionReencrypt. The re-encryption is dequeued in its own
+// transaction before being run, so that it is run only once.
+func runQueuedAttachmentReencryption() error {
+	var ids []int64
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Select(&ids, "UPDATE config_parameter SET value = 'running' WHERE key = ? AND value = 'queued' RETURNING id",
+			attachmentReencryptionParam)
+	})
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	defer models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		h.ConfigParameter().NewSet(env).SetParam(attachmentReencryptionParam, "done")
+	})
+	return RunAttachmentReencryption()
+}
+
+func init() {
+	RegisterBackgroundJob("attachment_reencryption", reencryptionJobInterval, runQueuedAttachmentReencryption)
+
+	attachmentModel := h.Attachment()
+
+	attachmentModel.Methods().ReencryptFiles().DeclareMethod(
+		`ReencryptFiles rewrites all the files of the local filestore which are not
+		encrypted with the current key, including unencrypted files if the server
+		configuration allows to read them. Files keep their name, so that attachments
+		do not need to be modified.
+
+		Once all the files have been rewritten without failure, unencrypted files are
+		refused even if the server configuration allows them.
+
+		It returns the number of rewritten files and the number of failures.`,
+		func(rs h.AttachmentSet) (int, int) {
+			if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				log.Panic(rs.T("Only administrators can execute this action."))
+			}
+			driver, ok := rs.StorageDriver("file").(storage.EncryptedDriver)
+			if !ok {
+				log.Panic(rs.T("Encryption of attachments is not configured."))
+			}
+			done, failed := reencryptFiles(driver, nil)
+			if failed == 0 {
+				h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam(attachmentEncryptedParam, "True")
+			}
+			return done, failed
+		})
+
+	checkWizard := h.AttachmentStorageCheck()
+	checkWizard.AddFields(map[string]models.FieldDefinition{
+		"ReencryptionState": models.SelectionField{String: "Re-encryption", Selection: types.Selection{
+			"queued":  "Queued",
+			"running": "Running",
+			"done":    "Done",
+		}, Compute: checkWizard.Methods().ComputeReencryption()},
+		"ReencryptionProgress": models.CharField{String: "Re-encryption Progress",
+			Compute: checkWizard.Methods().ComputeReencryption()},
+	})
+
+	checkWizard.Methods().ComputeReencryption().DeclareMethod(
+		`ComputeReencryption returns the state and the progress of the re-encryption of the local filestore`,
+		func(rs h.AttachmentStorageCheckSet) *h.AttachmentStorageCheckData {
+			params := h.ConfigParameter().NewSet(rs.Env()).Sudo()
+			res := h.AttachmentStorageCheckData{
+				ReencryptionState: params.GetParam(attachmentReencryptionParam, ""),
+			}
+			var processed, total, failed int
+			if _, err := fmt.Sscanf(params.GetParam(attachmentReencryptionProgressParam, ""), "%d/%d/%d",
+				&processed, &total, &failed); err == nil {
+				res.ReencryptionProgress = rs.T("%d of %d files processed, %d failed", processed, total, failed)
+			}
+			return &res
+		})
+
+	checkWizard.Methods().ActionReencrypt().DeclareMethod(
+		`ActionReencrypt queues the re-encryption of the local filestore, so that it is
+		started in the background once the current transaction is committed. Its progress
+		can be followed on the storage check wizard.`,
+		func(rs h.AttachmentStorageCheckSet) *actions.Action {
+			rs.EnsureOne()
+			if _, ok := h.Attachment().NewSet(rs.Env()).StorageDriver("file").(storage.EncryptedDriver); !ok {
+				log.Panic(rs.T("Encryption of attachments is not configured."))
+			}
+			params := h.ConfigParameter().NewSet(rs.Env()).Sudo()
+			state := params.Search(q.ConfigParameter().Key().Equals(attachmentReencryptionParam))
+			// a running re-encryption reports its progress regularly, unless it was interrupted
+			lastUpdate := state.WriteDate()
+			if progress := params.Search(q.ConfigParameter().Key().Equals(attachmentReencryptionProgressParam)); !progress.IsEmpty() {
+				lastUpdate = progress.WriteDate()
+			}
+			if state.Value() == "queued" ||
+				state.Value() == "running" && time.Since(lastUpdate.Time) < reencryptionStaleDelay {
+				log.Panic(rs.T("The re-encryption of the filestore is already in progress."))
+			}
+			params.SetParam(attachmentReencryptionProgressParam, "")
+			params.SetParam(attachmentReencryptionParam, "queued")
+			return rs.Reload()
+		})
+}
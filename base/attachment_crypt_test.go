@@ -0,0 +1,112 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hexya-erp/hexya-base/base/storage"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestAttachmentEncryption(t *testing.T) {
+	Convey("Testing the encryption of the filestore", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			viper.Set(AttachmentEncryptionKeysConfig, map[string]string{
+				"k1": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)),
+				"k2": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)),
+			})
+			viper.Set(AttachmentEncryptionKeyConfig, "k1")
+			viper.Set(AttachmentEncryptionNameKeyConfig, "name secret")
+			defer func() {
+				viper.Set(AttachmentEncryptionKeysConfig, map[string]string{})
+				viper.Set(AttachmentEncryptionKeyConfig, "")
+				viper.Set(AttachmentEncryptionNameKeyConfig, "")
+			}()
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+			content := "confidential blob"
+			contentB64 := base64.StdEncoding.EncodeToString([]byte(content))
+			attach := h.Attachment().Create(env, &h.AttachmentData{
+				Name:  "secret",
+				Datas: contentB64,
+			})
+			Convey("Files are encrypted but checksums are computed on the content", func() {
+				So(attach.CheckSum(), ShouldEqual, fmt.Sprintf("%x", sha1.Sum([]byte(content))))
+				So(attach.Datas(), ShouldEqual, contentB64)
+				raw, err := ioutil.ReadFile(filepath.Join(attach.FileStore(), attach.StoreFname()))
+				So(err, ShouldBeNil)
+				So(bytes.Contains(raw, []byte(content)), ShouldBeFalse)
+			})
+			Convey("Files are re-encrypted with the newest key", func() {
+				// other tests leave unencrypted files in the filestore
+				viper.Set(AttachmentEncryptionAllowPlaintextConfig, true)
+				defer viper.Set(AttachmentEncryptionAllowPlaintextConfig, false)
+				viper.Set(AttachmentEncryptionKeyConfig, "k2")
+				done, failed := attach.ReencryptFiles()
+				So(done, ShouldBeGreaterThanOrEqualTo, 1)
+				So(failed, ShouldEqual, 0)
+				driver := attach.StorageDriver("file").(storage.EncryptedDriver)
+				keyID, err := driver.KeyID(attach.StoreFname())
+				So(err, ShouldBeNil)
+				So(keyID, ShouldEqual, "k2")
+				So(attach.Datas(), ShouldEqual, contentB64)
+			})
+			Convey("Re-encryption is queued once and reports its progress", func() {
+				wizard := h.AttachmentStorageCheck().Create(env, &h.AttachmentStorageCheckData{Location: "file"})
+				wizard.ActionReencrypt()
+				So(wizard.ReencryptionState(), ShouldEqual, "queued")
+				So(func() { wizard.ActionReencrypt() }, ShouldPanic)
+				var processed, total int
+				driver := attach.StorageDriver("file").(storage.EncryptedDriver).WithPlaintext()
+				_, failed := reencryptFiles(driver, func(p, t, f int) {
+					processed, total = p, t
+				})
+				So(failed, ShouldEqual, 0)
+				So(total, ShouldBeGreaterThanOrEqualTo, 1)
+				So(processed, ShouldEqual, total)
+			})
+			Convey("Unencrypted files are only read while migrating", func() {
+				fileDriver := storage.NewFileDriver(attach.FileStore())
+				So(fileDriver.Put(attach.StoreFname(), []byte(content)), ShouldBeNil)
+				defer attach.StorageDriver("file").Put(attach.StoreFname(), []byte(content))
+				_, err := attach.StorageDriver("file").Get(attach.StoreFname())
+				So(err, ShouldEqual, storage.ErrUnencrypted)
+				viper.Set(AttachmentEncryptionAllowPlaintextConfig, true)
+				defer viper.Set(AttachmentEncryptionAllowPlaintextConfig, false)
+				data, err := attach.StorageDriver("file").Get(attach.StoreFname())
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, content)
+				_, failed := attach.ReencryptFiles()
+				So(failed, ShouldEqual, 0)
+				So(fileDriver.Put(attach.StoreFname(), []byte(content)), ShouldBeNil)
+				_, err = attach.StorageDriver("file").Get(attach.StoreFname())
+				So(err, ShouldEqual, storage.ErrUnencrypted)
+			})
+			Convey("File names hide checksums", func() {
+				other := h.Attachment().Create(env, &h.AttachmentData{
+					Name:  "other",
+					Datas: base64.StdEncoding.EncodeToString([]byte("another blob")),
+				})
+				So(other.StoreFname(), ShouldNotContainSubstring, other.CheckSum())
+				So(other.Datas(), ShouldEqual, base64.StdEncoding.EncodeToString([]byte("another blob")))
+			})
+			Convey("Encryption requires a name key", func() {
+				viper.Set(AttachmentEncryptionNameKeyConfig, "")
+				So(func() { attach.StorageDriver("file") }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// RunAttachmentMigration runs the attachment migration with the given ID as the
+// given user until it is done. Each batch is committed in its own transaction, so
+// that an interrupted migration can be resumed by calling this function again.
+func RunAttachmentMigration(uid, migrationID int64) error {
+	for {
+		var done bool
+		err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+			done = h.AttachmentMigration().Browse(env, []int64{migrationID}).RunBatch()
+		})
+		if err != nil {
+			log.Warn("Attachment migration interrupted", "migration", migrationID, "error", err)
+			models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+				h.AttachmentMigration().Browse(env, []int64{migrationID}).SetLastError(err.Error())
+			})
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// migrationJobInterval is the time between two checks for queued attachment migrations
+const migrationJobInterval = 10 * time.Second
+
+// runQueuedAttachmentMigrations runs the attachment migrations which have been queued
+// by ActionRun. Each migration is dequeued in its own transaction before being run, so
+// that a migration interrupted by an error is not retried until it is queued again.
+func runQueuedAttachmentMigrations() error {
+	var ids []int64
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		env.Cr().Select(&ids, "UPDATE attachment_migration SET queued = FALSE WHERE queued RETURNING id")
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		// errors are recorded on the migration itself
+		RunAttachmentMigration(security.SuperUserID, id)
+	}
+	return nil
+}
+
+func init() {
+	RegisterBackgroundJob("attachment_migration", migrationJobInterval, runQueuedAttachmentMigrations)
+
+	migrationModel := h.AttachmentMigration().DeclareModel()
+	migrationModel.SetDefaultOrder("id desc")
+	migrationModel.AddFields(map[string]models.FieldDefinition{
+		"Location": models.CharField{String: "Target Storage", Required: true,
+			Help: "Storage to move the attachments to: 'db', 'file' or a URL such as 's3://bucket/prefix'",
+			Default: func(env models.Environment) interface{} {
+				return h.Attachment().NewSet(env).Storage()
+			}},
+		"BatchSize": models.IntegerField{Required: true, Default: models.DefaultValue(int64(100)),
+			Help: "Number of attachments moved in each transaction"},
+		"State": models.SelectionField{Selection: types.Selection{
+			"draft":   "New",
+			"running": "Running",
+			"done":    "Done",
+		}, Default: models.DefaultValue("draft"), Required: true, ReadOnly: true},
+		"Queued": models.BooleanField{ReadOnly: true,
+			Help: "This migration will be started or resumed in the background"},
+		"LastID": models.IntegerField{String: "Last Attachment ID", ReadOnly: true,
+			Help: "Attachments up to this ID have been processed. An interrupted migration resumes after it."},
+		"Total":     models.IntegerField{String: "Files To Move", ReadOnly: true},
+		"TotalSize": models.IntegerField{String: "Bytes To Move", ReadOnly: true},
+		"Moved":     models.IntegerField{String: "Moved Files", ReadOnly: true},
+		"MovedSize": models.IntegerField{String: "Moved Bytes", ReadOnly: true},
+		"Failed":    models.IntegerField{String: "Failed Files", ReadOnly: true},
+		"Progress": models.FloatField{Compute: h.AttachmentMigration().Methods().ComputeProgress(),
+			Depends: []string{"Total", "Moved", "Failed"}},
+		"StartDate": models.DateTimeField{ReadOnly: true},
+		"EndDate":   models.DateTimeField{ReadOnly: true},
+		"LastError": models.TextField{ReadOnly: true,
+			Help: "Error which interrupted the last run of this migration"},
+		"Errors": models.One2ManyField{RelationModel: h.AttachmentMigrationError(), ReverseFK: "Migration",
+			JSON: "error_ids", ReadOnly: true},
+	})
+
+	migrationModel.Methods().ComputeProgress().DeclareMethod(
+		`ComputeProgress computes the percentage of processed files`,
+		func(rs h.AttachmentMigrationSet) *h.AttachmentMigrationData {
+			var res h.AttachmentMigrationData
+			if rs.Total() > 0 {
+				res.Progress = 100 * float64(rs.Moved()+rs.Failed()) / float64(rs.Total())
+			}
+			return &res
+		})
+
+	migrationModel.Methods().ActionDryRun().DeclareMethod(
+		`ActionDryRun computes how many files and bytes would be moved by this migration,
+		without moving anything.`,
+		func(rs h.AttachmentMigrationSet) bool {
+			for _, migration := range rs.Records() {
+				count, size := h.Attachment().NewSet(rs.Env()).Sudo().MigrationEstimate(migration.Location())
+				migration.Write(&h.AttachmentMigrationData{
+					Total:     count,
+					TotalSize: size,
+				}, h.AttachmentMigration().Total(), h.AttachmentMigration().TotalSize())
+			}
+			return true
+		})
+
+	migrationModel.Methods().ActionRun().DeclareMethod(
+		`ActionRun queues this migration, so that it is started or resumed in the background
+		once the current transaction is committed. Its progress can be followed on the
+		migration form.`,
+		func(rs h.AttachmentMigrationSet) bool {
+			rs.EnsureOne()
+			if rs.State() == "done" {
+				log.Panic(rs.T("This migration is already done."))
+			}
+			rs.SetQueued(true)
+			return true
+		})
+
+	migrationModel.Methods().RunBatch().DeclareMethod(
+		`RunBatch moves the next batch of attachments of this migration to its target storage
+		and saves the migration cursor. Files which cannot be moved are recorded as errors and
+		skipped. It returns true when there is no attachment left to move.
+
+		Only one batch of a given migration can run at a time.`,
+		func(rs h.AttachmentMigrationSet) bool {
+			rs.EnsureOne()
+			if rs.State() == "done" {
+				return true
+			}
+			// fail immediately if this migration is being run by another process
+			rs.Env().Cr().Execute("SELECT id FROM attachment_migration WHERE id = ? FOR UPDATE NOWAIT", rs.ID())
+			attachments := h.Attachment().NewSet(rs.Env()).Sudo()
+			if rs.State() == "draft" {
+				count, size := attachments.MigrationEstimate(rs.Location())
+				rs.Write(&h.AttachmentMigrationData{
+					State:     "running",
+					Total:     count,
+					TotalSize: size,
+					StartDate: dates.Now(),
+				})
+				log.Info("Attachment migration started", "migration", rs.ID(), "location", rs.Location(),
+					"files", count, "bytes", size)
+			}
+			batch := attachments.ToMigrate(rs.Location(), rs.LastID(), int(rs.BatchSize()))
+			if batch.IsEmpty() {
+				rs.Write(&h.AttachmentMigrationData{
+					State:     "done",
+					EndDate:   dates.Now(),
+					LastError: "",
+				}, h.AttachmentMigration().LastError())
+				log.Info("Attachment migration done", "migration", rs.ID(), "moved", rs.Moved(), "failed", rs.Failed())
+				return true
+			}
+			vals := h.AttachmentMigrationData{
+				Moved:     rs.Moved(),
+				MovedSize: rs.MovedSize(),
+				Failed:    rs.Failed(),
+			}
+			for _, attach := range batch.Records() {
+				size := int64(attach.FileSize())
+				if err := attach.MoveToStorage(rs.Location()); err != nil {
+					log.Warn("Unable to move attachment", "migration", rs.ID(), "attachment", attach.ID(), "error", err)
+					h.AttachmentMigrationError().Create(rs.Env(), &h.AttachmentMigrationErrorData{
+						Migration:  rs,
+						Attachment: attach,
+						StoreFname: attach.StoreFname(),
+						Error:      err.Error(),
+					})
+					vals.Failed++
+					continue
+				}
+				vals.Moved++
+				vals.MovedSize += size
+			}
+			vals.LastID = batch.Records()[batch.Len()-1].ID()
+			rs.Write(&vals, h.AttachmentMigration().LastError())
+			log.Info("Attachment migration progress", "migration", rs.ID(), "processed", vals.Moved+vals.Failed,
+				"total", rs.Total(), "moved_bytes", vals.MovedSize)
+			return false
+		})
+
+	migrationErrorModel := h.AttachmentMigrationError().DeclareModel()
+	migrationErrorModel.AddFields(map[string]models.FieldDefinition{
+		"Migration": models.Many2OneField{RelationModel: h.AttachmentMigration(), OnDelete: models.Cascade,
+			Required: true, Index: true},
+		"Attachment": models.Many2OneField{RelationModel: h.Attachment(), OnDelete: models.SetNull},
+		"StoreFname": models.CharField{String: "Stored Filename"},
+		"Error":      models.TextField{},
+	})
+}
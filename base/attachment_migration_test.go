@@ -0,0 +1,115 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestAttachmentMigration(t *testing.T) {
+	Convey("Testing attachment migrations", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+			var attachments []h.AttachmentSet
+			for _, blob := range []string{"migration1", "migration2", "migration3"} {
+				attachments = append(attachments, h.Attachment().Create(env, &h.AttachmentData{
+					Name:  blob,
+					Datas: base64.StdEncoding.EncodeToString([]byte(blob)),
+				}))
+			}
+			Convey("Dry run does not move anything", func() {
+				migration := h.AttachmentMigration().Create(env, &h.AttachmentMigrationData{
+					Location: "file",
+				})
+				migration.ActionDryRun()
+				So(migration.Total(), ShouldBeGreaterThanOrEqualTo, 3)
+				So(migration.TotalSize(), ShouldBeGreaterThanOrEqualTo, 30)
+				So(migration.State(), ShouldEqual, "draft")
+				for _, attach := range attachments {
+					So(attach.StoreFname(), ShouldBeBlank)
+				}
+			})
+			Convey("Migrating in batches", func() {
+				migration := h.AttachmentMigration().Create(env, &h.AttachmentMigrationData{
+					Location:  "file",
+					BatchSize: 2,
+				})
+				So(migration.RunBatch(), ShouldBeFalse)
+				So(migration.State(), ShouldEqual, "running")
+				So(migration.LastID(), ShouldBeGreaterThan, 0)
+				So(migration.Moved(), ShouldEqual, 2)
+				for !migration.RunBatch() {
+				}
+				So(migration.State(), ShouldEqual, "done")
+				So(migration.Moved(), ShouldEqual, migration.Total())
+				So(migration.Failed(), ShouldEqual, 0)
+				So(migration.Progress(), ShouldEqual, 100)
+				for _, attach := range attachments {
+					So(attach.StoreLocation(), ShouldEqual, "file")
+					So(attach.DBDatas(), ShouldBeBlank)
+					_, err := os.Stat(filepath.Join(attach.FileStore(), attach.StoreFname()))
+					So(err, ShouldBeNil)
+				}
+				Convey("Done migrations do nothing", func() {
+					So(migration.RunBatch(), ShouldBeTrue)
+					So(func() { migration.ActionRun() }, ShouldPanic)
+				})
+			})
+			Convey("Running a migration queues it for the background worker", func() {
+				migration := h.AttachmentMigration().Create(env, &h.AttachmentMigrationData{
+					Location: "file",
+				})
+				So(migration.ActionRun(), ShouldBeTrue)
+				So(migration.Queued(), ShouldBeTrue)
+				So(migration.State(), ShouldEqual, "draft")
+				for _, attach := range attachments {
+					So(attach.StoreFname(), ShouldBeBlank)
+				}
+			})
+			Convey("Failed moves are recorded and skipped", func() {
+				migration := h.AttachmentMigration().Create(env, &h.AttachmentMigrationData{
+					Location: "bogus://nowhere",
+				})
+				for !migration.RunBatch() {
+				}
+				So(migration.State(), ShouldEqual, "done")
+				So(migration.Failed(), ShouldEqual, migration.Total())
+				So(migration.LastID(), ShouldBeGreaterThanOrEqualTo, attachments[2].ID())
+				So(migration.Errors().Len(), ShouldEqual, migration.Total())
+				for _, attach := range attachments {
+					So(attach.DBDatas(), ShouldNotBeBlank)
+				}
+			})
+			Convey("Missing files are recorded as errors", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+				broken := h.Attachment().Create(env, &h.AttachmentData{
+					Name:  "broken",
+					Datas: base64.StdEncoding.EncodeToString([]byte("migration-broken")),
+				})
+				fName := broken.StoreFname()
+				So(os.Remove(filepath.Join(broken.FileStore(), fName)), ShouldBeNil)
+				migration := h.AttachmentMigration().Create(env, &h.AttachmentMigrationData{
+					Location: "db",
+				})
+				for !migration.RunBatch() {
+				}
+				So(migration.State(), ShouldEqual, "done")
+				So(migration.Failed(), ShouldEqual, 1)
+				So(migration.Errors().Attachment().Equals(broken), ShouldBeTrue)
+				So(migration.Errors().StoreFname(), ShouldEqual, fName)
+				So(broken.StoreFname(), ShouldEqual, fName)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// formatBytes returns the given size in a human readable form
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// Conditions on the attachments of a company and of a user for storageUsage
+const (
+	companyStorageCond = "attachment.company_id = ?"
+	userStorageCond    = "attachment.create_uid = ?"
+)
+
+// storageUsageQuery returns the query giving the size of the distinct contents
+// of the attachments matching the given condition and of their revisions, and
+// whether one of them has the given checksum.
+func storageUsageQuery(where string) string {
+	return fmt.Sprintf(`SELECT COALESCE(SUM(file_size), 0) AS usage, COALESCE(BOOL_OR(check_sum = ?), FALSE) AS found
+		FROM (SELECT check_sum, file_size FROM attachment WHERE check_sum <> '' AND %[1]s
+			UNION SELECT revision.check_sum, revision.file_size FROM attachment_revision revision
+			JOIN attachment ON attachment.id = revision.attachment_id WHERE revision.check_sum <> '' AND %[1]s) contents`, where)
+}
+
+// storageUsage returns the storage usage of the attachments matching the given
+// condition and whether the content with the given checksum is among them.
+// Contents which are only kept by revisions are counted too.
+func storageUsage(env models.Environment, checkSum, where string, args ...interface{}) (int64, bool) {
+	var res struct {
+		Usage int64
+		Found bool
+	}
+	queryArgs := append([]interface{}{checkSum}, args...)
+	env.Cr().Get(&res, storageUsageQuery(where), append(queryArgs, args...)...)
+	return res.Usage, res.Found
+}
+
+// storageUsageCacheDuration is the time during which the storage usages
+// of the storage warnings are cached.
+const storageUsageCacheDuration = 5 * time.Minute
+
+// A cachedStorageUsage is a storage usage and the time at which it expires
+type cachedStorageUsage struct {
+	usage  int64
+	expiry time.Time
+}
+
+// storageUsageCache caches the storage usages of the storage warnings, which are
+// computed each time the web client gets the session info. They are cached by
+// condition and record ID.
+var storageUsageCache = struct {
+	sync.Mutex
+	entries map[string]cachedStorageUsage
+}{entries: make(map[string]cachedStorageUsage)}
+
+// getCachedStorageUsage returns the storage usage of the attachments matching the given
+// condition with the given record ID. It is computed at most once per storageUsageCacheDuration.
+func getCachedStorageUsage(env models.Environment, where string, id int64) int64 {
+	key := fmt.Sprintf("%s/%d", where, id)
+	storageUsageCache.Lock()
+	entry, ok := storageUsageCache.entries[key]
+	storageUsageCache.Unlock()
+	if ok && time.Now().Before(entry.expiry) {
+		return entry.usage
+	}
+	usage, _ := storageUsage(env, "", where, id)
+	storageUsageCache.Lock()
+	storageUsageCache.entries[key] = cachedStorageUsage{usage: usage, expiry: time.Now().Add(storageUsageCacheDuration)}
+	storageUsageCache.Unlock()
+	return usage
+}
+
+// lockQuotaOwner locks the row with the given ID of the given table until the end of
+// the transaction, so that concurrent uploads checking the quota of the same company
+// or user wait for each other instead of all fitting in the remaining space.
+func lockQuotaOwner(env models.Environment, table string, id int64) {
+	var lockedID int64
+	env.Cr().Get(&lockedID, fmt.Sprintf(`SELECT id FROM "%s" WHERE id = ? FOR UPDATE`, table), id)
+}
+
+func init() {
+	companyModel := h.Company()
+	companyModel.AddFields(map[string]models.FieldDefinition{
+		"AttachmentQuota": models.IntegerField{String: "Storage Quota",
+			Help: "Maximum size in bytes of the attachments of this company. If 0, the size is not limited."},
+		"AttachmentQuotaWarning": models.IntegerField{String: "Storage Warning Threshold (%)", GoType: new(int),
+			Default: models.DefaultValue(80),
+			Help:    "Users are warned when the storage usage reaches this percentage of the quota"},
+		"AttachmentUsage": models.IntegerField{String: "Storage Usage",
+			Compute: h.Company().Methods().ComputeAttachmentUsage(),
+			Help:    "Size in bytes of the distinct contents of the attachments of this company"},
+		"AttachmentUsagePercent": models.FloatField{String: "Storage Usage (%)",
+			Compute: h.Company().Methods().ComputeAttachmentUsage()},
+	})
+
+	companyModel.Methods().ComputeAttachmentUsage().DeclareMethod(
+		`ComputeAttachmentUsage computes the storage used by the attachments of this company.
+		Identical contents are only counted once.`,
+		func(rs h.CompanySet) *h.CompanyData {
+			usage, _ := storageUsage(rs.Env(), "", companyStorageCond, rs.ID())
+			res := &h.CompanyData{AttachmentUsage: usage}
+			if rs.AttachmentQuota() > 0 {
+				res.AttachmentUsagePercent = float64(usage) * 100 / float64(rs.AttachmentQuota())
+			}
+			return res
+		})
+
+	userModel := h.User()
+	userModel.AddFields(map[string]models.FieldDefinition{
+		"AttachmentQuota": models.IntegerField{String: "Storage Quota",
+			Help: "Maximum size in bytes of the attachments uploaded by this user. If 0, only the quota of the company applies."},
+		"AttachmentUsage": models.IntegerField{String: "Storage Usage",
+			Compute: h.User().Methods().ComputeAttachmentUsage(),
+			Help:    "Size in bytes of the distinct contents of the attachments uploaded by this user"},
+		"AttachmentUsagePercent": models.FloatField{String: "Storage Usage (%)",
+			Compute: h.User().Methods().ComputeAttachmentUsage()},
+	})
+
+	userModel.Methods().ComputeAttachmentUsage().DeclareMethod(
+		`ComputeAttachmentUsage computes the storage used by the attachments uploaded by this user.
+		Identical contents are only counted once.`,
+		func(rs h.UserSet) *h.UserData {
+			usage, _ := storageUsage(rs.Env(), "", userStorageCond, rs.ID())
+			res := &h.UserData{AttachmentUsage: usage}
+			if rs.AttachmentQuota() > 0 {
+				res.AttachmentUsagePercent = float64(usage) * 100 / float64(rs.AttachmentQuota())
+			}
+			return res
+		})
+
+	userModel.Methods().StorageWarning().DeclareMethod(
+		`StorageWarning returns a message warning this user that their storage usage or the
+		one of their company is close to the quota. It returns an empty string if both are
+		below the warning threshold of the company.
+
+		Usages are only computed if a quota is set, and they are cached for a few minutes,
+		since this method is called each time the web client gets the session info.`,
+		func(rs h.UserSet) string {
+			rs.EnsureOne()
+			user := rs.Sudo()
+			company := user.Company()
+			threshold := float64(company.AttachmentQuotaWarning())
+			if threshold <= 0 {
+				return ""
+			}
+			var msgs []string
+			if quota := company.AttachmentQuota(); quota > 0 {
+				usage := getCachedStorageUsage(rs.Env(), companyStorageCond, company.ID())
+				if float64(usage)*100/float64(quota) >= threshold {
+					msgs = append(msgs, rs.T("Your company uses %s of its %s storage quota.",
+						formatBytes(usage), formatBytes(quota)))
+				}
+			}
+			if quota := user.AttachmentQuota(); quota > 0 {
+				usage := getCachedStorageUsage(rs.Env(), userStorageCond, user.ID())
+				if float64(usage)*100/float64(quota) >= threshold {
+					msgs = append(msgs, rs.T("You use %s of your %s storage quota.",
+						formatBytes(usage), formatBytes(quota)))
+				}
+			}
+			return strings.Join(msgs, "\n")
+		})
+
+	attachmentModel := h.Attachment()
+	// storage usages are computed by company and by user
+	attachmentModel.Fields().Company().SetIndex(true)
+	attachmentModel.Fields().CreateUID().SetIndex(true)
+
+	attachmentModel.Methods().CheckQuota().DeclareMethod(
+		`CheckQuota panics if storing a content of the given checksum and size in this
+		attachment would exceed the storage quota of its company or of the current user.
+
+		Contents which are already stored for the company (resp. the user) do not count,
+		since identical contents are only stored once. The company and the user whose quota
+		is checked are locked until the end of the transaction, so that concurrent uploads
+		cannot exceed the quota together.`,
+		func(rs h.AttachmentSet, checkSum string, size int64) {
+			rs.EnsureOne()
+			if size == 0 {
+				return
+			}
+			company := rs.Sudo().Company()
+			if !company.IsEmpty() && company.AttachmentQuota() > 0 {
+				lockQuotaOwner(rs.Env(), "company", company.ID())
+				usage, found := storageUsage(rs.Env(), checkSum, companyStorageCond, company.ID())
+				if !found && usage+size > company.AttachmentQuota() {
+					log.Panic(rs.T("This file (%s) would exceed the storage quota of your company (%s used out of %s).",
+						formatBytes(size), formatBytes(usage), formatBytes(company.AttachmentQuota())))
+				}
+			}
+			user := h.User().NewSet(rs.Env()).CurrentUser().Sudo()
+			if user.AttachmentQuota() > 0 {
+				lockQuotaOwner(rs.Env(), "user", user.ID())
+				usage, found := storageUsage(rs.Env(), checkSum, userStorageCond, user.ID())
+				if !found && usage+size > user.AttachmentQuota() {
+					log.Panic(rs.T("This file (%s) would exceed your storage quota (%s used out of %s).",
+						formatBytes(size), formatBytes(usage), formatBytes(user.AttachmentQuota())))
+				}
+			}
+		})
+}
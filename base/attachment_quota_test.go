@@ -0,0 +1,92 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAttachmentQuota(t *testing.T) {
+	Convey("Testing attachment quotas", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+			user := h.User().NewSet(env).CurrentUser()
+			company := user.Company()
+			data := func(s string) string {
+				return base64.StdEncoding.EncodeToString([]byte(s))
+			}
+			storageUsageCache.Lock()
+			storageUsageCache.entries = make(map[string]cachedStorageUsage)
+			storageUsageCache.Unlock()
+			initialUsage := company.AttachmentUsage()
+			h.Attachment().Create(env, &h.AttachmentData{Name: "first", Datas: data(strings.Repeat("a", 100))})
+			Convey("Identical contents are counted once", func() {
+				So(company.AttachmentUsage(), ShouldEqual, initialUsage+100)
+				h.Attachment().Create(env, &h.AttachmentData{Name: "copy", Datas: data(strings.Repeat("a", 100))})
+				So(company.AttachmentUsage(), ShouldEqual, initialUsage+100)
+				h.Attachment().Create(env, &h.AttachmentData{Name: "other", Datas: data(strings.Repeat("b", 50))})
+				So(company.AttachmentUsage(), ShouldEqual, initialUsage+150)
+			})
+			Convey("Contents kept by revisions are counted", func() {
+				attach := h.Attachment().Create(env, &h.AttachmentData{Name: "revised", Datas: data(strings.Repeat("r", 40))})
+				attach.SetDatas(data(strings.Repeat("s", 20)))
+				So(attach.Revisions().Len(), ShouldEqual, 1)
+				So(company.AttachmentUsage(), ShouldEqual, initialUsage+160)
+			})
+			Convey("Company quota", func() {
+				company.SetAttachmentQuota(initialUsage + 120)
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "big", Datas: data(strings.Repeat("c", 50))})
+				}, ShouldPanic)
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "copy", Datas: data(strings.Repeat("a", 100))})
+				}, ShouldNotPanic)
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "small", Datas: data(strings.Repeat("d", 10))})
+				}, ShouldNotPanic)
+				Convey("Writing new content is checked too", func() {
+					attach := h.Attachment().Create(env, &h.AttachmentData{Name: "empty"})
+					So(func() { attach.SetDatas(data(strings.Repeat("e", 50))) }, ShouldPanic)
+				})
+				Convey("Warning threshold", func() {
+					So(user.StorageWarning(), ShouldNotBeBlank)
+					company.SetAttachmentQuota(0)
+					So(user.StorageWarning(), ShouldBeBlank)
+				})
+				Convey("Usages of the warnings are cached", func() {
+					usage := company.AttachmentUsage()
+					company.SetAttachmentQuota(2 * usage)
+					So(user.StorageWarning(), ShouldBeBlank)
+					h.Attachment().Create(env, &h.AttachmentData{Name: "big", Datas: data(strings.Repeat("h", int(usage)))})
+					So(user.StorageWarning(), ShouldBeBlank)
+					storageUsageCache.Lock()
+					storageUsageCache.entries = make(map[string]cachedStorageUsage)
+					storageUsageCache.Unlock()
+					So(user.StorageWarning(), ShouldNotBeBlank)
+				})
+			})
+			Convey("User quota", func() {
+				user.SetAttachmentQuota(user.AttachmentUsage() + 120)
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "big", Datas: data(strings.Repeat("f", 150))})
+				}, ShouldPanic)
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "small", Datas: data(strings.Repeat("g", 10))})
+				}, ShouldNotPanic)
+			})
+		}), ShouldBeNil)
+	})
+	Convey("Formatting sizes", t, func() {
+		So(formatBytes(512), ShouldEqual, "512 B")
+		So(formatBytes(1536), ShouldEqual, "1.5 KiB")
+		So(formatBytes(3*1024*1024), ShouldEqual, "3.0 MiB")
+	})
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"encoding/base64"
+	"strconv"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// Configuration parameter keys of the global revision policy of attachments
+const (
+	// AttachmentRevisionKeepCountParam is the number of revisions kept for each
+	// attachment. If 0, the previous contents of attachments are not kept.
+	AttachmentRevisionKeepCountParam = "attachment.revision.keep_count"
+	// AttachmentRevisionKeepDaysParam is the number of days during which
+	// revisions are kept. If 0, revisions are kept regardless of their age.
+	AttachmentRevisionKeepDaysParam = "attachment.revision.keep_days"
+)
+
+func init() {
+	revisionModel := h.AttachmentRevision().DeclareModel()
+	revisionModel.SetDefaultOrder("id desc")
+	revisionModel.AddFields(map[string]models.FieldDefinition{
+		"Attachment": models.Many2OneField{RelationModel: h.Attachment(), OnDelete: models.Cascade,
+			Required: true, Index: true},
+		"StoreFname":    models.CharField{String: "Stored Filename", Index: true},
+		"StoreLocation": models.CharField{String: "Storage Location"},
+		"DBDatas":       models.CharField{String: "Database Data"},
+		"CheckSum":      models.CharField{String: "Checksum/SHA1", Size: 40},
+		"FileSize":      models.IntegerField{GoType: new(int)},
+		"MimeType":      models.CharField{},
+		"Author": models.Many2OneField{RelationModel: h.User(), OnDelete: models.SetNull,
+			Help: "User who saved this content"},
+		"Date": models.DateTimeField{Help: "Date at which this content was saved"},
+	})
+
+	revisionModel.Methods().ReadContent().DeclareMethod(
+		`ReadContent returns the base64 encoded content of this revision`,
+		func(rs h.AttachmentRevisionSet) (string, error) {
+			rs.EnsureOne()
+			if rs.StoreFname() == "" {
+				return rs.DBDatas(), nil
+			}
+			data, err := h.Attachment().NewSet(rs.Env()).StorageDriver(rs.StoreLocation()).Get(rs.StoreFname())
+			if err != nil {
+				return "", err
+			}
+			return base64.StdEncoding.EncodeToString(data), nil
+		})
+
+	revisionModel.Methods().ActionRestore().DeclareMethod(
+		`ActionRestore sets the content of the attachment back to this revision.
+		The current content of the attachment is saved as a new revision.`,
+		func(rs h.AttachmentRevisionSet) bool {
+			if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				log.Panic(rs.T("Only administrators can execute this action."))
+			}
+			for _, revision := range rs.Records() {
+				datas, err := revision.ReadContent()
+				if err != nil {
+					log.Panic(rs.T("Unable to read the content of this revision: %s", err))
+				}
+				revision.Attachment().Write(&h.AttachmentData{
+					Datas:    datas,
+					MimeType: revision.MimeType(),
+				})
+				log.Info("Attachment revision restored", "attachment", revision.Attachment().ID(), "revision", revision.ID())
+			}
+			return true
+		})
+
+	revisionModel.Methods().Prune().DeclareMethod(
+		`Prune deletes the revisions of all attachments which are beyond their retention policy`,
+		func(rs h.AttachmentRevisionSet) {
+			var ids []int64
+			rs.Env().Cr().Select(&ids, "SELECT DISTINCT attachment_id FROM attachment_revision")
+			h.Attachment().Browse(rs.Env(), ids).Sudo().PruneRevisions()
+		})
+
+	revisionModel.Methods().Load().Extend("",
+		func(rs h.AttachmentRevisionSet, fields ...string) h.AttachmentRevisionSet {
+			// revisions can be read by the users who can read their attachment
+			var ids []int64
+			if !rs.IsEmpty() {
+				rs.Env().Cr().Select(&ids, "SELECT DISTINCT attachment_id FROM attachment_revision WHERE id IN (?)", rs.Ids())
+			}
+			h.Attachment().Browse(rs.Env(), ids).Check("read", nil)
+			return rs.Super().Load(fields...)
+		})
+
+	revisionModel.Methods().Unlink().Extend("",
+		func(rs h.AttachmentRevisionSet) int64 {
+			attachments := h.Attachment().NewSet(rs.Env())
+			for _, revision := range rs.Records() {
+				if revision.StoreFname() != "" {
+					attachments.MarkForGC(revision.StoreLocation(), revision.StoreFname())
+				}
+			}
+			return rs.Super().Unlink()
+		})
+
+	policyModel := h.AttachmentRevisionPolicy().DeclareModel()
+	policyModel.AddFields(map[string]models.FieldDefinition{
+		"ResModel": models.CharField{String: "Resource Model", Required: true, Unique: true,
+			Help: "Model of the attachments to which this policy applies"},
+		"KeepCount": models.IntegerField{String: "Revisions To Keep", GoType: new(int),
+			Help: "Number of revisions kept for each attachment. If 0, revisions are not kept."},
+		"KeepDays": models.IntegerField{String: "Days To Keep", GoType: new(int),
+			Help: "Number of days during which revisions are kept. If 0, revisions are kept regardless of their age."},
+	})
+
+	attachmentModel := h.Attachment()
+	attachmentModel.AddFields(map[string]models.FieldDefinition{
+		"Revisions": models.One2ManyField{RelationModel: h.AttachmentRevision(), ReverseFK: "Attachment",
+			JSON: "revision_ids"},
+	})
+
+	attachmentModel.Methods().RevisionPolicy().DeclareMethod(
+		`RevisionPolicy returns the number of revisions to keep and the number of days
+		during which to keep them for this attachment. The policy of the attachment's
+		model applies if any, the global policy of the configuration parameters otherwise.`,
+		func(rs h.AttachmentSet) (int, int) {
+			policy := h.AttachmentRevisionPolicy().NewSet(rs.Env()).Sudo().Search(
+				q.AttachmentRevisionPolicy().ResModel().Equals(rs.ResModel())).Limit(1)
+			if !policy.IsEmpty() {
+				return policy.KeepCount(), policy.KeepDays()
+			}
+			params := h.ConfigParameter().NewSet(rs.Env()).Sudo()
+			keepCount, err := strconv.Atoi(params.GetParam(AttachmentRevisionKeepCountParam, "10"))
+			if err != nil {
+				log.Warn("Invalid attachment revision parameter", "key", AttachmentRevisionKeepCountParam, "error", err)
+				keepCount = 10
+			}
+			keepDays, err := strconv.Atoi(params.GetParam(AttachmentRevisionKeepDaysParam, "0"))
+			if err != nil {
+				log.Warn("Invalid attachment revision parameter", "key", AttachmentRevisionKeepDaysParam, "error", err)
+				keepDays = 0
+			}
+			return keepCount, keepDays
+		})
+
+	attachmentModel.Methods().SaveRevision().DeclareMethod(
+		`SaveRevision records the current content of this attachment as a revision if
+		its revision policy allows it. It returns the created revision, if any.`,
+		func(rs h.AttachmentSet) h.AttachmentRevisionSet {
+			rs.EnsureOne()
+			revisions := h.AttachmentRevision().NewSet(rs.Env()).Sudo()
+			if keepCount, _ := rs.RevisionPolicy(); keepCount <= 0 {
+				return revisions
+			}
+			vals := &h.AttachmentRevisionData{
+				Attachment: rs,
+				DBDatas:    rs.DBDatas(),
+				CheckSum:   rs.CheckSum(),
+				FileSize:   rs.FileSize(),
+				MimeType:   rs.MimeType(),
+				Author:     h.User().Browse(rs.Env(), []int64{rs.WriteUID()}),
+				Date:       rs.WriteDate(),
+			}
+			if rs.StoreFname() != "" {
+				vals.StoreFname = rs.StoreFname()
+				vals.StoreLocation = rs.FileLocation()
+				vals.DBDatas = ""
+			}
+			revision := revisions.Create(vals)
+			rs.PruneRevisions()
+			return revision
+		})
+
+	attachmentModel.Methods().PruneRevisions().DeclareMethod(
+		`PruneRevisions deletes the revisions of these attachments which are beyond their retention policy`,
+		func(rs h.AttachmentSet) {
+			toDelete := h.AttachmentRevision().NewSet(rs.Env()).Sudo()
+			for _, attach := range rs.Records() {
+				keepCount, keepDays := attach.RevisionPolicy()
+				limitDate := time.Now().AddDate(0, 0, -keepDays)
+				revisions := h.AttachmentRevision().NewSet(rs.Env()).Sudo().Search(
+					q.AttachmentRevision().Attachment().Equals(attach))
+				for i, revision := range revisions.Records() {
+					if i >= keepCount || keepDays > 0 && revision.CreateDate().Before(limitDate) {
+						toDelete = toDelete.Union(revision)
+					}
+				}
+			}
+			if !toDelete.IsEmpty() {
+				toDelete.Unlink()
+			}
+		})
+
+	attachmentModel.Methods().Unlink().Extend("",
+		func(rs h.AttachmentSet) int64 {
+			// delete revisions explicitly so that their files are garbage collected
+			h.AttachmentRevision().NewSet(rs.Env()).Sudo().Search(
+				q.AttachmentRevision().Attachment().In(rs)).Unlink()
+			return rs.Super().Unlink()
+		})
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestAttachmentRevision(t *testing.T) {
+	Convey("Testing attachment revisions", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+			v1 := base64.StdEncoding.EncodeToString([]byte("revision one"))
+			v2 := base64.StdEncoding.EncodeToString([]byte("revision two"))
+			v3 := base64.StdEncoding.EncodeToString([]byte("revision three"))
+			attach := h.Attachment().Create(env, &h.AttachmentData{
+				Name:  "contract",
+				Datas: v1,
+			})
+			fName1, checkSum1 := attach.StoreFname(), attach.CheckSum()
+			So(attach.Revisions().IsEmpty(), ShouldBeTrue)
+			Convey("Overwriting an attachment keeps its previous content", func() {
+				attach.SetDatas(v2)
+				So(attach.Revisions().Len(), ShouldEqual, 1)
+				revision := attach.Revisions()
+				So(revision.StoreFname(), ShouldEqual, fName1)
+				So(revision.StoreLocation(), ShouldEqual, "file")
+				So(revision.CheckSum(), ShouldEqual, checkSum1)
+				So(revision.FileSize(), ShouldEqual, len("revision one"))
+				So(revision.Author().ID(), ShouldEqual, security.SuperUserID)
+				content, err := revision.ReadContent()
+				So(err, ShouldBeNil)
+				So(content, ShouldEqual, v1)
+				So(attach.CheckStorage("file").Orphans, ShouldNotContain, fName1)
+				Convey("Restoring a revision", func() {
+					revision.ActionRestore()
+					So(attach.Datas(), ShouldEqual, v1)
+					So(attach.Revisions().Len(), ShouldEqual, 2)
+				})
+				Convey("Revisions can only be read by the users who can read the attachment", func() {
+					h.Group().NewSet(env).ReloadGroups()
+					userGroup := h.Group().Search(env, q.Group().GroupID().Equals(GroupUser.ID))
+					user := h.User().Create(env, &h.UserData{
+						Name:   "John Smith",
+						Login:  "jsmith",
+						Groups: userGroup,
+					})
+					So(func() { revision.Sudo(user.ID()).Load() }, ShouldNotPanic)
+					authLog := h.AuthLog().NewSet(env).Record("jsmith", "failure", "")
+					attach.Write(&h.AttachmentData{ResModel: "AuthLog", ResID: authLog.ID()})
+					So(func() { revision.Sudo(user.ID()).Load() }, ShouldPanic)
+					So(func() { revision.Load() }, ShouldNotPanic)
+				})
+				Convey("Moving to another storage does not create revisions", func() {
+					So(attach.MoveToStorage("db"), ShouldBeNil)
+					So(attach.Revisions().Len(), ShouldEqual, 1)
+				})
+			})
+			Convey("Revisions of database attachments", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+				dbAttach := h.Attachment().Create(env, &h.AttachmentData{
+					Name:  "db contract",
+					Datas: v1,
+				})
+				dbAttach.SetDatas(v2)
+				So(dbAttach.Revisions().StoreFname(), ShouldBeBlank)
+				So(dbAttach.Revisions().DBDatas(), ShouldEqual, v1)
+			})
+			Convey("Global retention policy", func() {
+				h.ConfigParameter().NewSet(env).SetParam(AttachmentRevisionKeepCountParam, "2")
+				attach.SetDatas(v2)
+				attach.SetDatas(v3)
+				attach.SetDatas(v1)
+				So(attach.Revisions().Len(), ShouldEqual, 2)
+				So(attach.Revisions().Records()[0].CheckSum(), ShouldEqual, attach.ComputeCheckSum("revision three"))
+				Convey("Disabling revisions", func() {
+					h.ConfigParameter().NewSet(env).SetParam(AttachmentRevisionKeepCountParam, "0")
+					attach.SetDatas(v2)
+					So(attach.Revisions().Len(), ShouldEqual, 2)
+				})
+			})
+			Convey("Retention policy of a model", func() {
+				h.AttachmentRevisionPolicy().Create(env, &h.AttachmentRevisionPolicyData{
+					ResModel:  "Partner",
+					KeepCount: 1,
+				})
+				partner := h.User().Browse(env, []int64{security.SuperUserID}).Partner()
+				partnerAttach := h.Attachment().Create(env, &h.AttachmentData{
+					Name:     "partner contract",
+					ResModel: "Partner",
+					ResID:    partner.ID(),
+					Datas:    v1,
+				})
+				partnerAttach.SetDatas(v2)
+				partnerAttach.SetDatas(v3)
+				So(partnerAttach.Revisions().Len(), ShouldEqual, 1)
+				keepCount, keepDays := partnerAttach.RevisionPolicy()
+				So(keepCount, ShouldEqual, 1)
+				So(keepDays, ShouldEqual, 0)
+			})
+			Convey("Deleting an attachment deletes its revisions", func() {
+				attach.SetDatas(v2)
+				revision := attach.Revisions()
+				attach.Unlink()
+				So(h.AttachmentRevision().Search(env, q.AttachmentRevision().ID().In(revision.Ids())).IsEmpty(), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/hexya-erp/hexya-base/base/scanner"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/spf13/viper"
+)
+
+// Server configuration keys of the scanning of uploaded contents
+const (
+	// AttachmentClamdSocketConfig is the path of the Unix socket of the clamd
+	// daemon with which uploaded contents are scanned. Contents are not sent
+	// to clamd if it is empty.
+	AttachmentClamdSocketConfig = "Attachment.Scanner.ClamdSocket"
+	// AttachmentClamdQuarantineConfig quarantines the contents in which clamd
+	// finds a malware instead of rejecting them.
+	AttachmentClamdQuarantineConfig = "Attachment.Scanner.ClamdQuarantine"
+	// AttachmentScanFailOpenConfig accepts contents which could not be scanned,
+	// for instance because the daemon is down, instead of rejecting them.
+	AttachmentScanFailOpenConfig = "Attachment.Scanner.FailOpen"
+)
+
+// attachmentScanners returns the scanners of uploaded contents, that is
+// the registered ones and clamd if it is configured.
+func attachmentScanners() []scanner.Scanner {
+	scanners := scanner.Registered()
+	if socket := viper.GetString(AttachmentClamdSocketConfig); socket != "" {
+		clamd := scanner.NewClamd(socket)
+		if viper.GetBool(AttachmentClamdQuarantineConfig) {
+			clamd.Found = scanner.Quarantine
+		}
+		scanners = append(scanners, clamd)
+	}
+	return scanners
+}
+
+// fileTypePatterns returns the file extensions and MIME types of the given comma
+// separated list. Extensions are returned with a leading dot.
+func fileTypePatterns(list string) []string {
+	var res []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+			continue
+		case !strings.Contains(pattern, "/") && !strings.HasPrefix(pattern, "."):
+			pattern = "." + pattern
+		}
+		res = append(res, pattern)
+	}
+	return res
+}
+
+// matchFileType returns true if the extension of fileName or one of the given
+// MIME types matches one of patterns. MIME type patterns may end with a wildcard,
+// such as "image/*".
+func matchFileType(patterns []string, fileName string, mimeTypes ...string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, ".") {
+			if pattern == ext {
+				return true
+			}
+			continue
+		}
+		for _, mimeType := range mimeTypes {
+			if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+				mimeType = mediaType
+			}
+			if pattern == mimeType || strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, pattern[:len(pattern)-1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func init() {
+	companyModel := h.Company()
+	companyModel.AddFields(map[string]models.FieldDefinition{
+		"AttachmentAllowedTypes": models.CharField{String: "Allowed File Types",
+			Help: "Comma separated list of the file extensions (e.g. 'pdf') and MIME types (e.g. 'image/*') which can be uploaded. If empty, all types are allowed unless they are denied."},
+		"AttachmentDeniedTypes": models.CharField{String: "Denied File Types",
+			Help: "Comma separated list of the file extensions (e.g. 'exe') and MIME types which cannot be uploaded."},
+	})
+
+	companyModel.Methods().CheckAttachmentType().DeclareMethod(
+		`CheckAttachmentType panics if a file with the given name and MIME types
+		cannot be uploaded in this company.`,
+		func(rs h.CompanySet, fileName string, mimeTypes ...string) {
+			rs.EnsureOne()
+			if matchFileType(fileTypePatterns(rs.AttachmentDeniedTypes()), fileName, mimeTypes...) {
+				log.Panic(rs.T("Files of this type (%s) are not allowed.", fileName))
+			}
+			allowed := fileTypePatterns(rs.AttachmentAllowedTypes())
+			if len(allowed) > 0 && !matchFileType(allowed, fileName, mimeTypes...) {
+				log.Panic(rs.T("Files of this type (%s) are not allowed.", fileName))
+			}
+		})
+
+	attachmentModel := h.Attachment()
+	attachmentModel.AddFields(map[string]models.FieldDefinition{
+		"Quarantined": models.BooleanField{Index: true, NoCopy: true,
+			Help: "The content of this attachment has been quarantined by the content scanner and can only be read by administrators"},
+		"ScanResult": models.CharField{NoCopy: true, Help: "Reason of the quarantine given by the content scanner"},
+	})
+
+	attachmentModel.Methods().ScanContents().DeclareMethod(
+		`ScanContents checks the content read from r before it is stored in this attachment.
+		It panics if the file type is not allowed in the given company, or in the company
+		of this attachment if company is empty, or if the content is rejected by a scanner.
+		If fileName is empty, the file name of this attachment is checked.
+
+		It returns the Quarantined and ScanResult values of the attachment.`,
+		func(rs h.AttachmentSet, r io.ReadSeeker, fileName, mimeType string, company h.CompanySet) *h.AttachmentData {
+			if fileName == "" && rs.Len() == 1 {
+				fileName = rs.Sudo().DatasFname()
+				if fileName == "" {
+					fileName = rs.Sudo().Name()
+				}
+			}
+			head := make([]byte, 512)
+			n, err := io.ReadFull(r, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				log.Panic("Unable to read attachment content", "error", err)
+			}
+			sniffedType := http.DetectContentType(head[:n])
+			if mimeType == "" {
+				mimeType = rs.ComputeMimeType(&h.AttachmentData{DatasFname: fileName})
+				if mimeType == "application/octet-stream" {
+					mimeType = sniffedType
+				}
+			}
+			if company.IsEmpty() && rs.Len() == 1 {
+				company = rs.Sudo().Company()
+			}
+			if company.IsEmpty() {
+				company = h.User().NewSet(rs.Env()).CurrentUser().Company()
+			}
+			if !company.IsEmpty() {
+				company.Sudo().CheckAttachmentType(fileName, mimeType, sniffedType)
+			}
+
+			scanners := attachmentScanners()
+			if len(scanners) == 0 {
+				return &h.AttachmentData{}
+			}
+			res, err := scanner.ScanAll(r, scanners...)
+			if err != nil {
+				if viper.GetBool(AttachmentScanFailOpenConfig) {
+					log.Warn("Unable to scan attachment content, accepting it", "file", fileName, "error", err)
+					return &h.AttachmentData{}
+				}
+				log.Warn("Unable to scan attachment content", "file", fileName, "error", err)
+				log.Panic(rs.T("This file could not be checked for viruses. Please try again later."))
+			}
+			switch res.Verdict {
+			case scanner.Reject:
+				log.Info("Attachment content rejected", "file", fileName, "reason", res.Reason)
+				log.Panic(rs.T("This file has been rejected by the content scanner: %s", res.Reason))
+			case scanner.Quarantine:
+				log.Info("Attachment content quarantined", "file", fileName, "reason", res.Reason)
+				return &h.AttachmentData{Quarantined: true, ScanResult: res.Reason}
+			}
+			return &h.AttachmentData{}
+		})
+
+	attachmentModel.Methods().CheckContents().Extend("",
+		func(rs h.AttachmentSet, values *h.AttachmentData) *h.AttachmentData {
+			res := rs.Super().CheckContents(values)
+			if values.Datas == "" {
+				return res
+			}
+			binData, err := base64.StdEncoding.DecodeString(values.Datas)
+			if err != nil {
+				log.Panic("Unable to decode attachment content", "error", err)
+			}
+			fileName := values.DatasFname
+			if fileName == "" && rs.IsEmpty() {
+				fileName = values.Name
+			}
+			scanVals := rs.ScanContents(bytes.NewReader(binData), fileName, values.MimeType, values.Company)
+			res.Quarantined = scanVals.Quarantined
+			res.ScanResult = scanVals.ScanResult
+			return res
+		})
+
+	attachmentModel.Methods().Write().Extend("",
+		func(rs h.AttachmentSet, vals *h.AttachmentData, fieldsToReset ...models.FieldNamer) bool {
+			if _, exists := vals.Get(h.Attachment().Datas(), fieldsToReset...); exists && !rs.Env().Context().GetBool("attachment_set_datas") {
+				// new contents are scanned again, so that the quarantine must be updated
+				fieldsToReset = append(fieldsToReset, h.Attachment().Quarantined(), h.Attachment().ScanResult())
+			}
+			return rs.Super().Write(vals, fieldsToReset...)
+		})
+
+	attachmentModel.Methods().CheckQuarantine().DeclareMethod(
+		`CheckQuarantine panics if the content of one of these attachments is
+		quarantined and the current user is not an administrator.`,
+		func(rs h.AttachmentSet) {
+			if h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				return
+			}
+			for _, attach := range rs.Sudo().Records() {
+				if attach.Quarantined() {
+					log.Panic(rs.T("This document has been quarantined by the content scanner."))
+				}
+			}
+		})
+
+	attachmentModel.Methods().ComputeDatas().Extend("",
+		func(rs h.AttachmentSet) *h.AttachmentData {
+			if rs.Quarantined() && !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				return &h.AttachmentData{}
+			}
+			return rs.Super().ComputeDatas()
+		})
+
+	revisionModel := h.AttachmentRevision()
+	revisionModel.AddFields(map[string]models.FieldDefinition{
+		"Quarantined": models.BooleanField{Index: true, ReadOnly: true,
+			Help: "This content was quarantined by the content scanner when it was saved and cannot be read nor restored"},
+		"ScanResult": models.CharField{ReadOnly: true, Help: "Reason of the quarantine given by the content scanner"},
+	})
+
+	attachmentModel.Methods().SaveRevision().Extend("",
+		func(rs h.AttachmentSet) h.AttachmentRevisionSet {
+			revision := rs.Super().SaveRevision()
+			if !revision.IsEmpty() && rs.Sudo().Quarantined() {
+				revision.Write(&h.AttachmentRevisionData{
+					Quarantined: true,
+					ScanResult:  rs.Sudo().ScanResult(),
+				})
+			}
+			return revision
+		})
+
+	revisionModel.Methods().ReadContent().Extend("",
+		func(rs h.AttachmentRevisionSet) (string, error) {
+			// quarantined contents are never served from revisions, even to administrators,
+			// since restoring them would lift the quarantine.
+			if rs.Sudo().Quarantined() {
+				return "", errors.New("this content has been quarantined by the content scanner")
+			}
+			return rs.Super().ReadContent()
+		})
+
+	attachmentModel.Methods().ActionReleaseQuarantine().DeclareMethod(
+		`ActionReleaseQuarantine makes the content of these quarantined attachments available again.`,
+		func(rs h.AttachmentSet) bool {
+			if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				log.Panic(rs.T("Only administrators can execute this action."))
+			}
+			for _, attach := range rs.Records() {
+				log.Info("Attachment released from quarantine", "attachment", attach.ID(), "reason", attach.ScanResult())
+			}
+			return rs.Sudo().WithContext("attachment_set_datas", true).Write(&h.AttachmentData{Quarantined: false},
+				h.Attachment().Quarantined())
+		})
+}
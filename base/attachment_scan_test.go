@@ -0,0 +1,122 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hexya-erp/hexya-base/base/scanner"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAttachmentScan(t *testing.T) {
+	Convey("Testing the scanning of attachments", t, func() {
+		scanner.Register("test", scanner.ScannerFunc(func(r io.Reader) (scanner.Result, error) {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return scanner.Result{}, err
+			}
+			switch {
+			case bytes.Contains(data, []byte("MALWARE")):
+				return scanner.Result{Verdict: scanner.Reject, Reason: "Test-Malware"}, nil
+			case bytes.Contains(data, []byte("SUSPECT")):
+				return scanner.Result{Verdict: scanner.Quarantine, Reason: "Test-Suspect"}, nil
+			}
+			return scanner.Result{Verdict: scanner.Allow}, nil
+		}))
+		defer scanner.Unregister("test")
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+			data := func(s string) string {
+				return base64.StdEncoding.EncodeToString([]byte(s))
+			}
+			Convey("Clean contents are stored", func() {
+				attach := h.Attachment().Create(env, &h.AttachmentData{Name: "clean.txt", Datas: data("clean content")})
+				So(attach.Quarantined(), ShouldBeFalse)
+				So(attach.Datas(), ShouldEqual, data("clean content"))
+			})
+			Convey("Rejected contents are not stored", func() {
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "bad.txt", Datas: data("some MALWARE")})
+				}, ShouldPanic)
+				attach := h.Attachment().Create(env, &h.AttachmentData{Name: "clean.txt", Datas: data("clean content")})
+				So(func() { attach.SetDatas(data("some MALWARE")) }, ShouldPanic)
+				So(func() { attach.WriteContent(strings.NewReader("some MALWARE")) }, ShouldPanic)
+			})
+			Convey("Quarantined contents are only served to administrators", func() {
+				attach := h.Attachment().Create(env, &h.AttachmentData{Name: "suspect.txt", Datas: data("SUSPECT content")})
+				So(attach.Quarantined(), ShouldBeTrue)
+				So(attach.ScanResult(), ShouldEqual, "Test-Suspect")
+				So(attach.Datas(), ShouldEqual, data("SUSPECT content"))
+				So(func() { attach.CheckQuarantine() }, ShouldNotPanic)
+				user := h.User().Create(env, &h.UserData{
+					Name:  "John Smith",
+					Login: "john@example.com",
+				})
+				So(func() { attach.Sudo(user.ID()).CheckQuarantine() }, ShouldPanic)
+				Convey("Releasing from quarantine", func() {
+					attach.ActionReleaseQuarantine()
+					So(attach.Quarantined(), ShouldBeFalse)
+					So(func() { attach.Sudo(user.ID()).CheckQuarantine() }, ShouldNotPanic)
+				})
+				Convey("Quarantined contents cannot be shared", func() {
+					link := attach.CreateShareLink(dates.DateTime{}, 0, "")
+					_, result := h.AttachmentShareLink().NewSet(env).Access(link.Token(), "", "10.0.0.1")
+					So(result, ShouldEqual, ShareAccessQuarantined)
+					So(link.DownloadCount(), ShouldEqual, 0)
+				})
+				Convey("Quarantined revisions cannot be read nor restored", func() {
+					attach.SetDatas(data("clean content"))
+					revision := attach.Revisions()
+					So(revision.Len(), ShouldEqual, 1)
+					So(revision.Quarantined(), ShouldBeTrue)
+					_, err := revision.ReadContent()
+					So(err, ShouldNotBeNil)
+					So(func() { revision.ActionRestore() }, ShouldPanic)
+				})
+				Convey("Clean contents lift the quarantine", func() {
+					attach.SetDatas(data("clean content"))
+					So(attach.Quarantined(), ShouldBeFalse)
+					So(attach.ScanResult(), ShouldBeBlank)
+				})
+			})
+			Convey("File types of the company", func() {
+				company := h.User().NewSet(env).CurrentUser().Company()
+				company.SetAttachmentDeniedTypes("exe, application/x-msdownload")
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "tool.exe", DatasFname: "tool.exe", Datas: data("binary")})
+				}, ShouldPanic)
+				company.SetAttachmentDeniedTypes("")
+				company.SetAttachmentAllowedTypes("pdf, image/*")
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "notes.txt", DatasFname: "notes.txt", Datas: data("text")})
+				}, ShouldPanic)
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "logo.png", DatasFname: "logo.png", Datas: data("png")})
+				}, ShouldNotPanic)
+				So(func() {
+					h.Attachment().Create(env, &h.AttachmentData{Name: "doc.pdf", DatasFname: "doc.pdf", Datas: data("%PDF-1.4")})
+				}, ShouldNotPanic)
+			})
+		}), ShouldBeNil)
+	})
+	Convey("Matching file types", t, func() {
+		patterns := fileTypePatterns(" PDF, .Exe,image/*, ,text/plain")
+		So(patterns, ShouldResemble, []string{".pdf", ".exe", "image/*", "text/plain"})
+		So(matchFileType(patterns, "Report.PDF"), ShouldBeTrue)
+		So(matchFileType(patterns, "photo.jpg", "image/jpeg"), ShouldBeTrue)
+		So(matchFileType(patterns, "notes", "text/plain; charset=utf-8"), ShouldBeTrue)
+		So(matchFileType(patterns, "archive.zip", "application/zip"), ShouldBeFalse)
+		So(matchFileType(patterns, "pdf"), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,398 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/actions"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// AttachmentShareSecretParam is the key of the configuration parameter holding the
+// secret with which share link tokens are signed. It is generated on first use.
+// Changing it invalidates all existing share links.
+const AttachmentShareSecretParam = "attachment.share.secret"
+
+// Results of an access to a share link
+const (
+	ShareAccessOK          = "ok"
+	ShareAccessInvalid     = "invalid"
+	ShareAccessRevoked     = "revoked"
+	ShareAccessExpired     = "expired"
+	ShareAccessExhausted   = "exhausted"
+	ShareAccessPassword    = "password"
+	ShareAccessQuarantined = "quarantined"
+	ShareAccessThrottled   = "throttled"
+)
+
+// shareSecret returns the secret with which share link tokens are signed
+func shareSecret(env models.Environment) []byte {
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	secret := params.GetParam(AttachmentShareSecretParam, "")
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			log.Panic("Unable to generate share link secret", "error", err)
+		}
+		secret = base64.RawURLEncoding.EncodeToString(buf)
+		systemGroup := h.Group().Search(env, q.Group().GroupID().Equals(GroupSystem.ID))
+		params.SetParam(AttachmentShareSecretParam, secret).LimitToGroups(systemGroup)
+	}
+	return []byte(secret)
+}
+
+// signShareToken returns the signature of the given token payload
+func signShareToken(env models.Environment, payload string) string {
+	mac := hmac.New(sha256.New, shareSecret(env))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseShareToken checks the signature of the given token and returns the
+// link ID and the expiration timestamp it holds.
+func parseShareToken(env models.Environment, token string) (int64, int64, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(signShareToken(env, payload)), []byte(parts[2])) {
+		return 0, 0, false
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return id, expiry, true
+}
+
+// expiryTimestamp returns the unix timestamp of the given expiration date,
+// or 0 if it is not set.
+func expiryTimestamp(date dates.DateTime) int64 {
+	if date.IsZero() {
+		return 0
+	}
+	return date.Unix()
+}
+
+// shareThrottleKey returns the authentication log login under which the wrong
+// passwords given for the share link with the given ID are recorded.
+func shareThrottleKey(id int64) string {
+	return fmt.Sprintf("share:%d", id)
+}
+
+// checkSharePassword checks the given password of the given password protected link.
+// Wrong passwords are recorded in the authentication log, so that guesses are throttled
+// for each link and each IP address like login attempts. It returns the access result.
+func checkSharePassword(link h.AttachmentShareLinkSet, password, ip string) string {
+	if password == "" {
+		return ShareAccessPassword
+	}
+	key := shareThrottleKey(link.ID())
+	authLog := h.AuthLog().NewSet(link.Env()).WithContext("client_ip", ip)
+	if wait := authLog.LoginWait(key, ip); wait > 0 {
+		authLog.Record(key, "throttled", fmt.Sprintf("Retry in %s", wait))
+		return ShareAccessThrottled
+	}
+	if ok, _ := CheckPassword(password, link.Password()); !ok {
+		authLog.Record(key, "failure", "Wrong share link password")
+		return ShareAccessPassword
+	}
+	return ShareAccessOK
+}
+
+// checkShareLinkOwner panics if the current user is not an administrator and
+// did not create all the share links with the given IDs.
+func checkShareLinkOwner(env models.Environment, linkIDs []int64) {
+	if len(linkIDs) == 0 || h.User().NewSet(env).CurrentUser().IsAdmin() {
+		return
+	}
+	var count int
+	env.Cr().Get(&count, "SELECT COUNT(*) FROM attachment_share_link WHERE id IN (?) AND create_uid <> ?",
+		linkIDs, env.Uid())
+	if count > 0 {
+		log.Panic(h.AttachmentShareLink().NewSet(env).T("You can only access the share links you created."))
+	}
+}
+
+func init() {
+	shareLinkModel := h.AttachmentShareLink().DeclareModel()
+	shareLinkModel.SetDefaultOrder("id desc")
+	shareLinkModel.AddFields(map[string]models.FieldDefinition{
+		"Attachment": models.Many2OneField{RelationModel: h.Attachment(), OnDelete: models.Cascade,
+			Required: true, Index: true},
+		"ExpirationDate": models.DateTimeField{
+			Help: "Leave empty for a link that never expires"},
+		"MaxDownloads": models.IntegerField{GoType: new(int),
+			Help: "Number of downloads after which the link stops working. If 0, downloads are not limited."},
+		"DownloadCount": models.IntegerField{String: "Downloads", GoType: new(int), ReadOnly: true, NoCopy: true},
+		"Password": models.CharField{NoCopy: true,
+			Help: "If set, visitors must give this password to download the file"},
+		"HasPassword": models.BooleanField{String: "Password Protected",
+			Compute: h.AttachmentShareLink().Methods().ComputeHasPassword()},
+		"Revoked": models.BooleanField{ReadOnly: true, NoCopy: true, Index: true},
+		"URL": models.CharField{String: "Link",
+			Compute: h.AttachmentShareLink().Methods().ComputeURL()},
+		"Accesses": models.One2ManyField{RelationModel: h.AttachmentShareAccess(), ReverseFK: "Link",
+			JSON: "access_ids", ReadOnly: true},
+	})
+
+	shareLinkModel.Methods().ComputeHasPassword().DeclareMethod(
+		`ComputeHasPassword returns true if this link is protected by a password`,
+		func(rs h.AttachmentShareLinkSet) *h.AttachmentShareLinkData {
+			return &h.AttachmentShareLinkData{
+				HasPassword: rs.Sudo().Password() != "",
+			}
+		})
+
+	shareLinkModel.Methods().Token().DeclareMethod(
+		`Token returns the signed token of this link. It holds the link ID and its
+		expiration date, so that it changes if the expiration date is modified.`,
+		func(rs h.AttachmentShareLinkSet) string {
+			rs.EnsureOne()
+			payload := fmt.Sprintf("%d.%d", rs.ID(), expiryTimestamp(rs.ExpirationDate()))
+			return payload + "." + signShareToken(rs.Env(), payload)
+		})
+
+	shareLinkModel.Methods().ComputeURL().DeclareMethod(
+		`ComputeURL returns the public URL of this link`,
+		func(rs h.AttachmentShareLinkSet) *h.AttachmentShareLinkData {
+			baseURL := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("web.base.url", "")
+			return &h.AttachmentShareLinkData{
+				URL: fmt.Sprintf("%s/web/share/%s", strings.TrimSuffix(baseURL, "/"), url.PathEscape(rs.Token())),
+			}
+		})
+
+	shareLinkModel.Methods().Access().DeclareMethod(
+		`Access checks the given token and password, and records the access from the given
+		IP address. It returns the link of the token with the result of the check, which
+		is ShareAccessOK if the file may be served. The link is empty if the token is invalid.
+
+		The download counter of the link is incremented each time the access is granted,
+		including for requests of a byte range.`,
+		func(rs h.AttachmentShareLinkSet, token, password, ip string) (h.AttachmentShareLinkSet, string) {
+			id, expiry, ok := parseShareToken(rs.Env(), token)
+			if !ok {
+				log.Warn("Invalid share link token", "ip", ip)
+				return h.AttachmentShareLink().NewSet(rs.Env()), ShareAccessInvalid
+			}
+			// lock the link so that concurrent downloads are counted correctly
+			rs.Env().Cr().Execute("SELECT id FROM attachment_share_link WHERE id = ? FOR UPDATE", id)
+			link := rs.Sudo().Search(q.AttachmentShareLink().ID().Equals(id))
+			if link.IsEmpty() || expiryTimestamp(link.ExpirationDate()) != expiry {
+				log.Warn("Invalid share link token", "ip", ip)
+				return h.AttachmentShareLink().NewSet(rs.Env()), ShareAccessInvalid
+			}
+			result := ShareAccessOK
+			switch {
+			case link.Revoked():
+				result = ShareAccessRevoked
+			case expiry != 0 && time.Now().Unix() >= expiry:
+				result = ShareAccessExpired
+			case link.MaxDownloads() > 0 && link.DownloadCount() >= link.MaxDownloads():
+				result = ShareAccessExhausted
+			case link.Attachment().Quarantined():
+				result = ShareAccessQuarantined
+			case link.Password() != "":
+				result = checkSharePassword(link, password, ip)
+			}
+			if result == ShareAccessOK {
+				link.Write(&h.AttachmentShareLinkData{DownloadCount: link.DownloadCount() + 1})
+			}
+			h.AttachmentShareAccess().NewSet(rs.Env()).Sudo().Create(&h.AttachmentShareAccessData{
+				Link:   link,
+				IP:     ip,
+				Result: result,
+			})
+			return link, result
+		})
+
+	shareLinkModel.Methods().ActionRevoke().DeclareMethod(
+		`ActionRevoke disables these links. Visitors are rejected at their next request.`,
+		func(rs h.AttachmentShareLinkSet) bool {
+			if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				for _, link := range rs.Sudo().Records() {
+					if link.CreateUID() != rs.Env().Uid() {
+						log.Panic(rs.T("You can only revoke the share links you created."))
+					}
+				}
+			}
+			rs.Sudo().Write(&h.AttachmentShareLinkData{Revoked: true})
+			log.Info("Share links revoked", "links", rs.Ids(), "uid", rs.Env().Uid())
+			return true
+		})
+
+	shareLinkModel.Methods().Create().Extend("",
+		func(rs h.AttachmentShareLinkSet, vals *h.AttachmentShareLinkData, fieldsToReset ...models.FieldNamer) h.AttachmentShareLinkSet {
+			vals.Attachment.Check("read", nil)
+			if vals.Password != "" && !IsPasswordHash(vals.Password) {
+				vals.Password = HashPassword(vals.Password)
+			}
+			return rs.Super().Create(vals, fieldsToReset...)
+		})
+
+	shareLinkModel.Methods().Write().Extend("",
+		func(rs h.AttachmentShareLinkSet, vals *h.AttachmentShareLinkData, fieldsToReset ...models.FieldNamer) bool {
+			if val, exists := vals.Get(h.AttachmentShareLink().Password(), fieldsToReset...); exists && val.(string) != "" && !IsPasswordHash(val.(string)) {
+				vals.Password = HashPassword(val.(string))
+			}
+			return rs.Super().Write(vals, fieldsToReset...)
+		})
+
+	shareLinkModel.Methods().Load().Extend("",
+		func(rs h.AttachmentShareLinkSet, fields ...string) h.AttachmentShareLinkSet {
+			checkShareLinkOwner(rs.Env(), rs.Ids())
+			return rs.Super().Load(fields...)
+		})
+
+	shareLinkModel.Methods().Read().Extend("",
+		func(rs h.AttachmentShareLinkSet, fields []string) []models.FieldMap {
+			result := rs.Super().Read(fields)
+			// Never send password hashes to the client
+			for i, res := range result {
+				if _, exists := res["password"]; exists {
+					result[i]["password"] = "********"
+				}
+			}
+			return result
+		})
+
+	shareLinkModel.Methods().Search().Extend("",
+		func(rs h.AttachmentShareLinkSet, cond q.AttachmentShareLinkCondition) h.AttachmentShareLinkSet {
+			if h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				return rs.Super().Search(cond)
+			}
+			// Users can only see the links they created
+			return rs.Super().Search(q.AttachmentShareLink().CreateUID().Equals(rs.Env().Uid()).AndCond(cond))
+		})
+
+	shareAccessModel := h.AttachmentShareAccess().DeclareModel()
+	shareAccessModel.SetDefaultOrder("id desc")
+	shareAccessModel.AddFields(map[string]models.FieldDefinition{
+		"Link": models.Many2OneField{RelationModel: h.AttachmentShareLink(), OnDelete: models.Cascade,
+			Required: true, Index: true},
+		"IP": models.CharField{String: "IP Address"},
+		"Result": models.SelectionField{Selection: types.Selection{
+			ShareAccessOK:          "Granted",
+			ShareAccessRevoked:     "Revoked",
+			ShareAccessExpired:     "Expired",
+			ShareAccessExhausted:   "Download Limit Reached",
+			ShareAccessPassword:    "Wrong Password",
+			ShareAccessQuarantined: "Quarantined",
+			ShareAccessThrottled:   "Too Many Attempts",
+		}, Required: true},
+	})
+
+	shareAccessModel.Methods().Load().Extend("",
+		func(rs h.AttachmentShareAccessSet, fields ...string) h.AttachmentShareAccessSet {
+			var linkIDs []int64
+			if !rs.IsEmpty() {
+				rs.Env().Cr().Select(&linkIDs, "SELECT DISTINCT link_id FROM attachment_share_access WHERE id IN (?)", rs.Ids())
+			}
+			checkShareLinkOwner(rs.Env(), linkIDs)
+			return rs.Super().Load(fields...)
+		})
+
+	shareAccessModel.Methods().Search().Extend("",
+		func(rs h.AttachmentShareAccessSet, cond q.AttachmentShareAccessCondition) h.AttachmentShareAccessSet {
+			if h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+				return rs.Super().Search(cond)
+			}
+			// Users can only see the accesses to the links they created
+			links := h.AttachmentShareLink().Search(rs.Env(), q.AttachmentShareLink().CreateUID().Equals(rs.Env().Uid()))
+			return rs.Super().Search(q.AttachmentShareAccess().Link().In(links).AndCond(cond))
+		})
+
+	attachmentModel := h.Attachment()
+	attachmentModel.AddFields(map[string]models.FieldDefinition{
+		"ShareLinks": models.One2ManyField{RelationModel: h.AttachmentShareLink(), ReverseFK: "Attachment",
+			JSON: "share_link_ids", NoCopy: true},
+	})
+
+	attachmentModel.Methods().CreateShareLink().DeclareMethod(
+		`CreateShareLink creates a public link to this attachment which expires at the
+		given date and after the given number of downloads. Zero values mean no limit.
+		If password is not empty, visitors must give it to download the file.`,
+		func(rs h.AttachmentSet, expirationDate dates.DateTime, maxDownloads int, password string) h.AttachmentShareLinkSet {
+			rs.EnsureOne()
+			link := h.AttachmentShareLink().Create(rs.Env(), &h.AttachmentShareLinkData{
+				Attachment:     rs,
+				ExpirationDate: expirationDate,
+				MaxDownloads:   maxDownloads,
+				Password:       password,
+			})
+			log.Info("Share link created", "attachment", rs.ID(), "link", link.ID(), "uid", rs.Env().Uid())
+			return link
+		})
+
+	attachmentModel.Methods().ActionShare().DeclareMethod(
+		`ActionShare returns the action to create a share link for this attachment`,
+		func(rs h.AttachmentSet) *actions.Action {
+			rs.EnsureOne()
+			return &actions.Action{
+				Name:     rs.T("Share"),
+				Type:     actions.ActionActWindow,
+				Model:    "AttachmentShareWizard",
+				ViewMode: "form",
+				Target:   "new",
+				Context:  types.NewContext().WithKey("default_attachment_id", rs.ID()),
+			}
+		})
+
+	shareWizard := h.AttachmentShareWizard().DeclareTransientModel()
+	shareWizard.AddFields(map[string]models.FieldDefinition{
+		"Attachment": models.Many2OneField{RelationModel: h.Attachment(), Required: true},
+		"ExpirationDate": models.DateTimeField{
+			Help: "Leave empty for a link that never expires",
+			Default: func(env models.Environment) interface{} {
+				return dates.DateTime{Time: time.Now().AddDate(0, 0, 7)}
+			}},
+		"MaxDownloads": models.IntegerField{GoType: new(int),
+			Help: "Number of downloads after which the link stops working. If 0, downloads are not limited."},
+		"Password": models.CharField{
+			Help: "If set, visitors must give this password to download the file"},
+		"State": models.SelectionField{Selection: types.Selection{
+			"draft": "Draft",
+			"done":  "Done",
+		}, Default: models.DefaultValue("draft")},
+		"URL": models.CharField{String: "Link", ReadOnly: true},
+	})
+
+	shareWizard.Methods().ActionGenerate().DeclareMethod(
+		`ActionGenerate creates the share link and displays it`,
+		func(rs h.AttachmentShareWizardSet) *actions.Action {
+			rs.EnsureOne()
+			link := rs.Attachment().CreateShareLink(rs.ExpirationDate(), rs.MaxDownloads(), rs.Password())
+			rs.Write(&h.AttachmentShareWizardData{
+				State:    "done",
+				URL:      link.URL(),
+				Password: "",
+			}, h.AttachmentShareWizard().Password())
+			return &actions.Action{
+				Name:     rs.T("Share"),
+				Type:     actions.ActionActWindow,
+				Model:    "AttachmentShareWizard",
+				ViewMode: "form",
+				ResID:    rs.ID(),
+				Target:   "new",
+			}
+		})
+}
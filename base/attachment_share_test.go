@@ -0,0 +1,118 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAttachmentShareLinks(t *testing.T) {
+	Convey("Testing attachment share links", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			attach := h.Attachment().Create(env, &h.AttachmentData{
+				Name:  "shared",
+				Datas: base64.StdEncoding.EncodeToString([]byte("shared content")),
+			})
+			links := h.AttachmentShareLink().NewSet(env)
+			Convey("Accessing a valid link", func() {
+				link := attach.CreateShareLink(dates.DateTime{Time: time.Now().Add(time.Hour)}, 0, "")
+				So(link.URL(), ShouldEndWith, "/web/share/"+link.Token())
+				res, result := links.Access(link.Token(), "", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessOK)
+				So(res.ID(), ShouldEqual, link.ID())
+				So(link.DownloadCount(), ShouldEqual, 1)
+				So(link.Accesses().Len(), ShouldEqual, 1)
+				So(link.Accesses().IP(), ShouldEqual, "10.0.0.1")
+				So(link.Accesses().Result(), ShouldEqual, ShareAccessOK)
+				Convey("Tampered tokens are rejected", func() {
+					parts := strings.Split(link.Token(), ".")
+					res, result = links.Access(parts[0]+".0."+parts[2], "", "10.0.0.1")
+					So(result, ShouldEqual, ShareAccessInvalid)
+					So(res.IsEmpty(), ShouldBeTrue)
+				})
+				Convey("Revoked links are rejected", func() {
+					link.ActionRevoke()
+					_, result = links.Access(link.Token(), "", "10.0.0.1")
+					So(result, ShouldEqual, ShareAccessRevoked)
+					So(link.DownloadCount(), ShouldEqual, 1)
+				})
+			})
+			Convey("Expired links are rejected", func() {
+				link := attach.CreateShareLink(dates.DateTime{Time: time.Now().Add(-time.Hour)}, 0, "")
+				_, result := links.Access(link.Token(), "", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessExpired)
+			})
+			Convey("Download limit", func() {
+				link := attach.CreateShareLink(dates.DateTime{}, 2, "")
+				_, result := links.Access(link.Token(), "", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessOK)
+				_, result = links.Access(link.Token(), "", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessOK)
+				_, result = links.Access(link.Token(), "", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessExhausted)
+				So(link.DownloadCount(), ShouldEqual, 2)
+				So(link.Accesses().Len(), ShouldEqual, 3)
+			})
+			Convey("Password protected links", func() {
+				link := attach.CreateShareLink(dates.DateTime{}, 0, "s3cret")
+				So(link.HasPassword(), ShouldBeTrue)
+				So(link.Password(), ShouldNotEqual, "s3cret")
+				_, result := links.Access(link.Token(), "", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessPassword)
+				_, result = links.Access(link.Token(), "wrong", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessPassword)
+				_, result = links.Access(link.Token(), "s3cret", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessOK)
+				Convey("Password hashes are never read", func() {
+					res := link.Read([]string{"password"})
+					So(res[0]["password"], ShouldEqual, "********")
+				})
+				Convey("Wrong passwords are throttled", func() {
+					for i := 0; i < 3; i++ {
+						_, result = links.Access(link.Token(), "wrong", "10.0.0.2")
+						So(result, ShouldEqual, ShareAccessPassword)
+					}
+					_, result = links.Access(link.Token(), "s3cret", "10.0.0.2")
+					So(result, ShouldEqual, ShareAccessThrottled)
+					So(link.DownloadCount(), ShouldEqual, 1)
+				})
+			})
+			Convey("Links can only be read by their creator", func() {
+				h.Group().NewSet(env).ReloadGroups()
+				userGroup := h.Group().Search(env, q.Group().GroupID().Equals(GroupUser.ID))
+				user := h.User().Create(env, &h.UserData{
+					Name:   "John Smith",
+					Login:  "jsmith",
+					Groups: userGroup,
+				})
+				link := attach.CreateShareLink(dates.DateTime{}, 0, "")
+				links.Access(link.Token(), "", "10.0.0.1")
+				So(func() { link.Sudo(user.ID()).Load() }, ShouldPanic)
+				So(func() { link.Accesses().Sudo(user.ID()).Load() }, ShouldPanic)
+				ownLink := attach.Sudo(user.ID()).CreateShareLink(dates.DateTime{}, 0, "")
+				So(func() { ownLink.Load() }, ShouldNotPanic)
+				So(func() { link.Union(ownLink).Sudo(user.ID()).Load() }, ShouldPanic)
+			})
+			Convey("Changing the expiration date invalidates previous tokens", func() {
+				link := attach.CreateShareLink(dates.DateTime{}, 0, "")
+				token := link.Token()
+				link.SetExpirationDate(dates.DateTime{Time: time.Now().Add(time.Hour)})
+				_, result := links.Access(token, "", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessInvalid)
+				_, result = links.Access(link.Token(), "", "10.0.0.1")
+				So(result, ShouldEqual, ShareAccessOK)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/hexya-erp/hexya-base/base/storage"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// bytesContent is a storage.ReadSeekCloser of in-memory data
+type bytesContent struct {
+	*bytes.Reader
+}
+
+// Close does nothing
+func (bytesContent) Close() error {
+	return nil
+}
+
+func init() {
+	attachmentModel := h.Attachment()
+
+	attachmentModel.Methods().OpenContent().DeclareMethod(
+		`OpenContent returns a reader of the content of this attachment after checking
+		that the current user may read it. Files are read directly from their storage
+		without being loaded in memory. The caller must close the returned reader.`,
+		func(rs h.AttachmentSet) (storage.ReadSeekCloser, error) {
+			rs.EnsureOne()
+			rs.Check("read", nil)
+			rs.CheckQuarantine()
+			attach := rs.Sudo()
+			if attach.StoreFname() != "" {
+				return attach.StorageDriver(attach.FileLocation()).Reader(attach.StoreFname())
+			}
+			data, err := base64.StdEncoding.DecodeString(attach.DBDatas())
+			if err != nil {
+				return nil, err
+			}
+			return bytesContent{Reader: bytes.NewReader(data)}, nil
+		})
+
+	attachmentModel.Methods().WriteContent().DeclareMethod(
+		`WriteContent sets the content of this attachment to the data read from r, after
+		checking that the current user may modify it. Unless attachments are stored in the
+		database, the data is copied to the storage without being loaded in memory, and
+		large files are indexed in the background.`,
+		func(rs h.AttachmentSet, r io.ReadSeeker) error {
+			rs.EnsureOne()
+			rs.Check("write", nil)
+			location := rs.Storage()
+			if location == "db" {
+				data, err := ioutil.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				rs.CheckQuota(rs.ComputeCheckSum(string(data)), int64(len(data)))
+				scanVals := rs.ScanContents(bytes.NewReader(data), "", "", h.CompanySet{})
+				attach := rs.Sudo().WithContext("attachment_set_datas", true)
+				attach.SetDatas(base64.StdEncoding.EncodeToString(data))
+				attach.Write(scanVals, h.Attachment().Quarantined(), h.Attachment().ScanResult())
+				return nil
+			}
+
+			// compute the checksum and sniff the content type in a first pass
+			head := make([]byte, 512)
+			n, err := io.ReadFull(r, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			head = head[:n]
+			if _, err = r.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			hash := sha1.New()
+			size, err := io.Copy(hash, r)
+			if err != nil {
+				return err
+			}
+			checkSum := hex.EncodeToString(hash.Sum(nil))
+			if _, err = r.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			var scanVals *h.AttachmentData
+			if checkSum != rs.CheckSum() {
+				rs.CheckQuota(checkSum, size)
+				scanVals = rs.ScanContents(r, "", "", h.CompanySet{})
+				if _, err = r.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+			}
+
+			// then copy the data to the storage
+			fName := storeFname(checkSum)
+			driver := rs.StorageDriver(location)
+			exists, err := driver.Exists(fName)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				if err = driver.PutReader(fName, r); err != nil {
+					return err
+				}
+				// add fname to checklist, in case the transaction aborts
+				rs.MarkForGC(location, fName)
+			}
+
+			attach := rs.Sudo().WithContext("attachment_set_datas", true)
+			vals := &h.AttachmentData{
+				FileSize:      int(size),
+				CheckSum:      checkSum,
+				StoreFname:    fName,
+				StoreLocation: location,
+				DBDatas:       "",
+				MimeType:      attach.MimeType(),
+			}
+			fieldsToReset := []models.FieldNamer{h.Attachment().DBDatas()}
+			if vals.MimeType == "" || vals.MimeType == "application/octet-stream" {
+				// guess from the file name, then from the first bytes of the content
+				mimeType := attach.ComputeMimeType(&h.AttachmentData{DatasFname: attach.DatasFname()})
+				if mimeType == "application/octet-stream" {
+					mimeType = http.DetectContentType(head)
+				}
+				vals.MimeType = attach.CheckContents(&h.AttachmentData{MimeType: mimeType}).MimeType
+			}
+			if checkSum != attach.CheckSum() {
+				if attach.StoreFname() != "" || attach.DBDatas() != "" {
+					// keep the previous content as a revision
+					attach.SaveRevision()
+				}
+				indexAsync := size > indexAsyncSize(rs.Env())
+				if !indexAsync {
+					if _, err = r.Seek(0, io.SeekStart); err != nil {
+						return err
+					}
+					data, err := ioutil.ReadAll(r)
+					if err != nil {
+						return err
+					}
+					vals.IndexContent = attach.Index(string(data), vals.MimeType)
+				}
+				vals.IndexPending = indexAsync
+				fieldsToReset = append(fieldsToReset, h.Attachment().IndexContent(), h.Attachment().IndexPending())
+				vals.Quarantined = scanVals.Quarantined
+				vals.ScanResult = scanVals.ScanResult
+				fieldsToReset = append(fieldsToReset, h.Attachment().Quarantined(), h.Attachment().ScanResult())
+			}
+			if attach.StoreFname() != "" {
+				attach.FileDelete(attach.StoreFname())
+			}
+			attach.Write(vals, fieldsToReset...)
+			return nil
+		})
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestAttachmentStream(t *testing.T) {
+	Convey("Testing attachment streaming", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+			attach := h.Attachment().Create(env, &h.AttachmentData{
+				Name:       "stream",
+				DatasFname: "stream.txt",
+			})
+			Convey("Writing content from a reader", func() {
+				So(attach.WriteContent(strings.NewReader("streamed content")), ShouldBeNil)
+				So(attach.Datas(), ShouldEqual, base64.StdEncoding.EncodeToString([]byte("streamed content")))
+				So(attach.CheckSum(), ShouldEqual, attach.ComputeCheckSum("streamed content"))
+				So(attach.FileSize(), ShouldEqual, len("streamed content"))
+				So(attach.StoreFname(), ShouldNotBeBlank)
+				So(attach.DBDatas(), ShouldBeBlank)
+				So(attach.MimeType(), ShouldStartWith, "text/plain")
+				So(attach.IndexContent(), ShouldEqual, "streamed content")
+				Convey("Reading content with a seeker", func() {
+					content, err := attach.OpenContent()
+					So(err, ShouldBeNil)
+					defer content.Close()
+					_, err = content.Seek(9, io.SeekStart)
+					So(err, ShouldBeNil)
+					data, err := ioutil.ReadAll(content)
+					So(err, ShouldBeNil)
+					So(string(data), ShouldEqual, "content")
+				})
+				Convey("Overwriting content keeps a revision", func() {
+					So(attach.WriteContent(strings.NewReader("new content")), ShouldBeNil)
+					So(attach.Revisions().Len(), ShouldEqual, 1)
+					So(attach.Revisions().CheckSum(), ShouldEqual, attach.ComputeCheckSum("streamed content"))
+				})
+			})
+			Convey("Streaming database attachments", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+				So(attach.WriteContent(strings.NewReader("db content")), ShouldBeNil)
+				So(attach.StoreFname(), ShouldBeBlank)
+				So(attach.DBDatas(), ShouldEqual, base64.StdEncoding.EncodeToString([]byte("db content")))
+				content, err := attach.OpenContent()
+				So(err, ShouldBeNil)
+				data, err := ioutil.ReadAll(content)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "db content")
+			})
+		}), ShouldBeNil)
+	})
+}
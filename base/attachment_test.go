@@ -4,22 +4,53 @@
 package base
 
 import (
+	"archive/zip"
+	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/hexya-erp/hexya-base/base/extractor"
 	"github.com/hexya-erp/hexya/hexya/models"
 	"github.com/hexya-erp/hexya/hexya/models/security"
 	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/spf13/viper"
 )
 
 const HashSplit = 1
 
+// forceStorage moves all the attachments to the configured storage
+// by running the migration created by ForceStorage to completion.
+func forceStorage(rs h.AttachmentSet) {
+	migration := rs.ForceStorage()
+	So(migration.Queued(), ShouldBeTrue)
+	for !migration.RunBatch() {
+	}
+	So(migration.Failed(), ShouldEqual, 0)
+}
+
+// setTestEnv sets the given environment variable and returns
+// a function restoring its previous value.
+func setTestEnv(key, value string) func() {
+	old, exists := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if exists {
+			os.Setenv(key, old)
+			return
+		}
+		os.Unsetenv(key)
+	}
+}
+
 func TestAttachment(t *testing.T) {
 	Convey("Testing Attachments", t, func() {
 		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
@@ -92,6 +123,92 @@ func TestAttachment(t *testing.T) {
 				_, err = os.Stat(a2FN)
 				So(err, ShouldBeNil)
 			})
+			Convey("Garbage collecting files", func() {
+				a2 := h.Attachment().Create(env, &h.AttachmentData{
+					Name:  "a2",
+					Datas: blob1B64,
+				})
+				driver := a2.StorageDriver("file")
+				So(driver.Put("ff/orphan", []byte("orphan")), ShouldBeNil)
+				a2.MarkForGC("file", "ff/orphan")
+				a2.MarkForGC("file", a2.StoreFname())
+				a2.FileGCLocation("file")
+				exists, err := driver.Exists("ff/orphan")
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeFalse)
+				exists, err = driver.Exists(a2.StoreFname())
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeTrue)
+				entries, err := driver.List("checklist/")
+				So(err, ShouldBeNil)
+				So(entries, ShouldBeEmpty)
+			})
+			Convey("Indexing documents", func() {
+				var buf bytes.Buffer
+				archive := zip.NewWriter(&buf)
+				w, _ := archive.Create("content.xml")
+				w.Write([]byte(`<office:document-content xmlns:office="urn:o" xmlns:text="urn:t">` +
+					`<text:p>Meeting notes</text:p></office:document-content>`))
+				So(archive.Close(), ShouldBeNil)
+				a5 := h.Attachment().Create(env, &h.AttachmentData{
+					Name:       "a5",
+					DatasFname: "notes.odt",
+					Datas:      base64.StdEncoding.EncodeToString(buf.Bytes()),
+				})
+				So(a5.MimeType(), ShouldEqual, extractor.ODTType)
+				So(a5.IndexContent(), ShouldEqual, "Meeting notes")
+				Convey("Large files are indexed in the background", func() {
+					h.ConfigParameter().NewSet(env).SetParam("attachment.index_async_size", "10")
+					a6 := h.Attachment().Create(env, &h.AttachmentData{
+						Name:       "a6",
+						DatasFname: "notes.txt",
+						Datas:      base64.StdEncoding.EncodeToString([]byte("Some long meeting notes")),
+					})
+					So(a6.IndexPending(), ShouldBeTrue)
+					So(a6.IndexContent(), ShouldBeBlank)
+					So(a6.ProcessPendingIndexes(0), ShouldBeGreaterThanOrEqualTo, 1)
+					So(a6.IndexPending(), ShouldBeFalse)
+					So(a6.IndexContent(), ShouldEqual, "Some long meeting notes")
+				})
+			})
+			Convey("Storing in S3", func() {
+				backend := s3mem.New()
+				So(backend.CreateBucket("attachments"), ShouldBeNil)
+				server := httptest.NewServer(gofakes3.New(backend).Server())
+				defer server.Close()
+				defer setTestEnv("AWS_ACCESS_KEY_ID", "test-key")()
+				defer setTestEnv("AWS_SECRET_ACCESS_KEY", "test-secret")()
+				endpoint, _ := url.Parse(server.URL)
+				location := "s3://attachments/filestore?secure=false&endpoint=" + endpoint.Host
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", location)
+				a4 := h.Attachment().Create(env, &h.AttachmentData{
+					Name:  "a4",
+					Datas: blob1B64,
+				})
+				So(a4.StoreFname(), ShouldEqual, blob1FName)
+				So(a4.StoreLocation(), ShouldEqual, location)
+				So(a4.Datas(), ShouldEqual, blob1B64)
+				exists, err := a4.StorageDriver(location).Exists(blob1FName)
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeTrue)
+				Convey("Migrating between storages", func() {
+					h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+					forceStorage(a4)
+					So(a4.StoreLocation(), ShouldEqual, "file")
+					So(a4.Datas(), ShouldEqual, blob1B64)
+					_, err := os.Stat(filepath.Join(a4.FileStore(), a4.StoreFname()))
+					So(err, ShouldBeNil)
+					h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+					forceStorage(a4)
+					So(a4.StoreFname(), ShouldBeBlank)
+					So(a4.DBDatas(), ShouldEqual, blob1B64)
+					h.ConfigParameter().NewSet(env).SetParam("attachment.location", location)
+					forceStorage(a4)
+					So(a4.StoreLocation(), ShouldEqual, location)
+					So(a4.DBDatas(), ShouldBeBlank)
+					So(a4.Datas(), ShouldEqual, blob1B64)
+				})
+			})
 		}), ShouldBeNil)
 	})
 }
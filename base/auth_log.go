@@ -0,0 +1,196 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// Configuration parameter keys of the brute-force protection
+const (
+	// LoginDelayAfterParam is the number of failed attempts after which
+	// the user must wait before trying again.
+	LoginDelayAfterParam = "auth.lockout.delay_after"
+	// LoginDelayParam is the number of seconds to wait after the first delayed
+	// failure. This delay doubles at each new failure.
+	LoginDelayParam = "auth.lockout.delay"
+	// LoginMaxDelayParam is the maximum number of seconds to wait between two attempts
+	LoginMaxDelayParam = "auth.lockout.max_delay"
+	// LoginLockAfterParam is the number of failed attempts after which the account is locked
+	LoginLockAfterParam = "auth.lockout.lock_after"
+	// LoginLockDurationParam is the number of minutes an account stays locked
+	LoginLockDurationParam = "auth.lockout.lock_duration"
+	// LoginIPDelayAfterParam is the number of failed attempts from a single IP address
+	// after which this address must wait before trying again.
+	LoginIPDelayAfterParam = "auth.lockout.ip_delay_after"
+	// LoginWindowParam is the number of minutes during which failed attempts are counted
+	LoginWindowParam = "auth.lockout.window"
+)
+
+// An AccountLockedError is returned when a user tries to log in while
+// his account is locked or while he must wait before trying again.
+type AccountLockedError string
+
+// Error method for the AccountLockedError type
+func (ale AccountLockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts for '%s'", string(ale))
+}
+
+// loginThrottle holds the brute-force protection settings
+type loginThrottle struct {
+	DelayAfter   int
+	Delay        time.Duration
+	MaxDelay     time.Duration
+	LockAfter    int
+	LockDuration time.Duration
+	IPDelayAfter int
+	Window       time.Duration
+}
+
+// getLoginThrottle reads the brute-force protection settings
+func getLoginThrottle(env models.Environment) loginThrottle {
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	atoi := func(key string, defaultValue int) int {
+		val, err := strconv.Atoi(params.GetParam(key, strconv.Itoa(defaultValue)))
+		if err != nil || val < 0 {
+			log.Warn("Invalid login throttling parameter", "key", key, "error", err)
+			return defaultValue
+		}
+		return val
+	}
+	return loginThrottle{
+		DelayAfter:   atoi(LoginDelayAfterParam, 3),
+		Delay:        time.Duration(atoi(LoginDelayParam, 1)) * time.Second,
+		MaxDelay:     time.Duration(atoi(LoginMaxDelayParam, 60)) * time.Second,
+		LockAfter:    atoi(LoginLockAfterParam, 10),
+		LockDuration: time.Duration(atoi(LoginLockDurationParam, 15)) * time.Minute,
+		IPDelayAfter: atoi(LoginIPDelayAfterParam, 20),
+		Window:       time.Duration(atoi(LoginWindowParam, 60)) * time.Minute,
+	}
+}
+
+// wait returns the time to wait after the last of the given number
+// of failures before a new attempt is allowed.
+func (lt loginThrottle) wait(failures, delayAfter int) time.Duration {
+	if delayAfter == 0 || failures < delayAfter {
+		return 0
+	}
+	exp := failures - delayAfter
+	if exp > 30 {
+		return lt.MaxDelay
+	}
+	wait := time.Duration(float64(lt.Delay) * math.Pow(2, float64(exp)))
+	if wait > lt.MaxDelay {
+		wait = lt.MaxDelay
+	}
+	return wait
+}
+
+// checkLoginThrottle returns an AccountLockedError if the given user (which may be
+// empty if the login is unknown) must not try to log in now, either because he
+// must wait after previous failures or because his account is locked.
+func checkLoginThrottle(user h.UserSet, login string) error {
+	authLog := h.AuthLog().NewSet(user.Env())
+	if wait := authLog.LoginWait(login, user.Env().Context().GetString("client_ip")); wait > 0 {
+		authLog.Record(login, "throttled", fmt.Sprintf("Retry in %s", wait))
+		return AccountLockedError(login)
+	}
+	if !user.IsEmpty() && user.Sudo().LockedUntil().Time.After(time.Now()) {
+		authLog.Record(login, "locked", "")
+		return AccountLockedError(login)
+	}
+	return nil
+}
+
+func init() {
+	authLogModel := h.AuthLog().DeclareModel()
+	authLogModel.SetDefaultOrder("id desc")
+	authLogModel.AddFields(map[string]models.FieldDefinition{
+		"Login": models.CharField{Required: true, Index: true},
+		"User":  models.Many2OneField{RelationModel: h.User(), OnDelete: models.SetNull, Index: true},
+		"IP":    models.CharField{String: "IP Address", Index: true},
+		"Event": models.SelectionField{Selection: types.Selection{
+			"password":  "Password Verified",
+			"success":   "Success",
+			"failure":   "Failure",
+			"throttled": "Throttled",
+			"locked":    "Locked",
+			"unlock":    "Unlocked",
+		}, Required: true, Index: true},
+		"Message": models.CharField{},
+	})
+
+	authLogModel.Methods().Record().DeclareMethod(
+		`Record adds an entry to the authentication log for the given login and event.
+		The client IP address is taken from the 'client_ip' key of the context.`,
+		func(rs h.AuthLogSet, login, event, message string) h.AuthLogSet {
+			user := h.User().NewSet(rs.Env()).Sudo().Search(q.User().Login().Equals(login)).Limit(1)
+			return rs.Sudo().Create(&h.AuthLogData{
+				Login:   login,
+				User:    user,
+				IP:      rs.Env().Context().GetString("client_ip"),
+				Event:   event,
+				Message: message,
+			})
+		})
+
+	authLogModel.Methods().CountFailures().DeclareMethod(
+		`CountFailures returns the number of failed attempts matching the given condition
+		since the given date, as well as the date of the last one.`,
+		func(rs h.AuthLogSet, cond q.AuthLogCondition, since dates.DateTime) (int, dates.DateTime) {
+			failures := rs.Sudo().Search(q.AuthLog().Event().Equals("failure").
+				And().CreateDate().GreaterOrEqual(since).
+				AndCond(cond))
+			if failures.IsEmpty() {
+				return 0, dates.DateTime{}
+			}
+			return failures.SearchCount(), failures.Records()[0].CreateDate()
+		})
+
+	authLogModel.Methods().LoginFailures().DeclareMethod(
+		`LoginFailures returns the number of failed attempts for the given login within
+		the lockout window, as well as the date of the last one. Failures are forgotten
+		after a successful login or an unlock.`,
+		func(rs h.AuthLogSet, login string) (int, dates.DateTime) {
+			throttle := getLoginThrottle(rs.Env())
+			since := dates.DateTime{Time: time.Now().Add(-throttle.Window)}
+			last := rs.Sudo().Search(q.AuthLog().Login().Equals(login).
+				And().Event().In([]string{"success", "unlock"}).
+				And().CreateDate().GreaterOrEqual(since)).Limit(1)
+			if !last.IsEmpty() {
+				since = last.CreateDate()
+			}
+			return rs.CountFailures(q.AuthLog().Login().Equals(login), since)
+		})
+
+	authLogModel.Methods().LoginWait().DeclareMethod(
+		`LoginWait returns how long a client must wait before trying to log in
+		with the given login from the given IP address.`,
+		func(rs h.AuthLogSet, login, ip string) time.Duration {
+			throttle := getLoginThrottle(rs.Env())
+			now := time.Now()
+			var wait time.Duration
+			count, lastFailure := rs.LoginFailures(login)
+			if w := lastFailure.Time.Add(throttle.wait(count, throttle.DelayAfter)).Sub(now); count > 0 && w > wait {
+				wait = w
+			}
+			if ip != "" {
+				count, lastFailure = rs.CountFailures(q.AuthLog().IP().Equals(ip),
+					dates.DateTime{Time: now.Add(-throttle.Window)})
+				if w := lastFailure.Time.Add(throttle.wait(count, throttle.IPDelayAfter)).Sub(now); count > 0 && w > wait {
+					wait = w
+				}
+			}
+			return wait
+		})
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A backgroundJob is a function run periodically by the server
+type backgroundJob struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+var (
+	backgroundJobs     []backgroundJob
+	backgroundJobsOnce sync.Once
+)
+
+// RegisterBackgroundJob registers the given function to be run every interval once
+// the server is started. The function must run its queries in its own transactions
+// with models.ExecuteInNewEnvironment, so that it only sees committed data. The
+// errors it returns are logged, and it is run again at the next interval anyway.
+//
+// This function must be called in an init function.
+func RegisterBackgroundJob(name string, interval time.Duration, run func() error) {
+	backgroundJobs = append(backgroundJobs, backgroundJob{
+		name:     name,
+		interval: interval,
+		run:      run,
+	})
+}
+
+// runBackgroundJob runs the given job once, logging its errors and panics
+func runBackgroundJob(job backgroundJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("Background job panicked", "job", job.name, "error", fmt.Sprintf("%v", r))
+		}
+	}()
+	if err := job.run(); err != nil {
+		log.Warn("Error in background job", "job", job.name, "error", err)
+	}
+}
+
+// startBackgroundJobs starts a goroutine for each registered background job.
+// Calling it several times has no effect.
+func startBackgroundJobs() {
+	backgroundJobsOnce.Do(func() {
+		for _, job := range backgroundJobs {
+			go func(job backgroundJob) {
+				ticker := time.NewTicker(job.interval)
+				defer ticker.Stop()
+				for range ticker.C {
+					runBackgroundJob(job)
+				}
+			}(job)
+		}
+	})
+}
@@ -0,0 +1,31 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackgroundJobs(t *testing.T) {
+	Convey("Testing background jobs", t, func() {
+		Convey("Pending attachments are indexed by a background job", func() {
+			var names []string
+			for _, job := range backgroundJobs {
+				names = append(names, job.name)
+			}
+			So(names, ShouldContain, "attachment_index")
+		})
+		Convey("Failing jobs do not stop the worker", func() {
+			So(func() {
+				runBackgroundJob(backgroundJob{name: "error", run: func() error { return errors.New("failed") }})
+			}, ShouldNotPanic)
+			So(func() {
+				runBackgroundJob(backgroundJob{name: "panic", run: func() error { panic("failed") }})
+			}, ShouldNotPanic)
+		})
+	})
+}
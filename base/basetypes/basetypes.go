@@ -15,3 +15,13 @@ type AddressData struct {
 	CountryCode string
 	CompanyName string
 }
+
+// OIDCClaims holds the claims of an OpenID Connect ID token
+// used to identify a user.
+type OIDCClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package checkdigit defines the check digit algorithms, such as Luhn
+// or ISO 7064 MOD 97-10, which can be added to sequence numbers.
+package checkdigit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// An Algorithm computes the check characters of a code
+type Algorithm interface {
+	// Label returns the name of the algorithm displayed to users
+	Label() string
+	// Size returns the number of check characters
+	Size() int
+	// Compute returns the check characters of the given payload.
+	// Characters which are not handled by the algorithm, such as
+	// separators, are ignored.
+	Compute(payload string) (string, error)
+}
+
+// Validate returns true if code ends with the check characters
+// computed by alg on the rest of code.
+func Validate(alg Algorithm, code string) bool {
+	split := len(code) - alg.Size()
+	if split < 0 {
+		return false
+	}
+	check, err := alg.Compute(code[:split])
+	return err == nil && check == code[split:]
+}
+
+var algorithms = struct {
+	sync.RWMutex
+	byName map[string]Algorithm
+}{byName: make(map[string]Algorithm)}
+
+// Register adds the given Algorithm under the given name, replacing any existing one.
+func Register(name string, alg Algorithm) {
+	algorithms.Lock()
+	defer algorithms.Unlock()
+	algorithms.byName[name] = alg
+}
+
+// Unregister removes the Algorithm with the given name, if any.
+func Unregister(name string) {
+	algorithms.Lock()
+	defer algorithms.Unlock()
+	delete(algorithms.byName, name)
+}
+
+// Get returns the Algorithm registered under the given name
+func Get(name string) (Algorithm, bool) {
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+	alg, ok := algorithms.byName[name]
+	return alg, ok
+}
+
+// Names returns the names of the registered algorithms, in alphabetical order.
+func Names() []string {
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+	names := make([]string, 0, len(algorithms.byName))
+	for name := range algorithms.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// errNoDigits is returned when a payload has no character handled by the algorithm
+var errNoDigits = errors.New("checkdigit: no digit to check")
+
+// digits returns the values of the decimal digits of s, ignoring other characters
+func digits(s string) []int {
+	var res []int
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			res = append(res, int(c-'0'))
+		}
+	}
+	return res
+}
+
+// Luhn is the Luhn (mod 10) algorithm, used for instance in credit card numbers.
+// Non-digit characters are ignored.
+var Luhn Algorithm = luhn{}
+
+type luhn struct{}
+
+// Label returns the name of the algorithm
+func (luhn) Label() string {
+	return "Luhn"
+}
+
+// Size returns the number of check digits
+func (luhn) Size() int {
+	return 1
+}
+
+// Compute returns the Luhn check digit of the digits of payload
+func (luhn) Compute(payload string) (string, error) {
+	ds := digits(payload)
+	if len(ds) == 0 {
+		return "", errNoDigits
+	}
+	var sum int
+	for i := range ds {
+		d := ds[len(ds)-1-i]
+		if i%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return fmt.Sprintf("%d", (10-sum%10)%10), nil
+}
+
+// Mod97 is the ISO 7064 MOD 97-10 algorithm, used for instance in IBAN and
+// structured creditor references. Letters are converted to numbers (A=10,
+// B=11, ..., Z=35) and other characters are ignored.
+var Mod97 Algorithm = mod97{}
+
+type mod97 struct{}
+
+// Label returns the name of the algorithm
+func (mod97) Label() string {
+	return "ISO 7064 MOD 97-10"
+}
+
+// Size returns the number of check digits
+func (mod97) Size() int {
+	return 2
+}
+
+// Compute returns the two MOD 97-10 check digits of payload
+func (mod97) Compute(payload string) (string, error) {
+	var rem, count int
+	for _, c := range payload {
+		switch {
+		case c >= '0' && c <= '9':
+			rem = (rem*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+			if c >= 'a' {
+				c -= 'a' - 'A'
+			}
+			rem = (rem*100 + int(c-'A') + 10) % 97
+		default:
+			continue
+		}
+		count++
+	}
+	if count == 0 {
+		return "", errNoDigits
+	}
+	return fmt.Sprintf("%02d", 98-rem*100%97), nil
+}
+
+// EAN13 is the check digit algorithm of EAN-13 barcodes. The payload must
+// have exactly 12 digits, other characters are ignored.
+var EAN13 Algorithm = ean13{}
+
+type ean13 struct{}
+
+// Label returns the name of the algorithm
+func (ean13) Label() string {
+	return "EAN-13"
+}
+
+// Size returns the number of check digits
+func (ean13) Size() int {
+	return 1
+}
+
+// Compute returns the EAN-13 check digit of the 12 digits of payload
+func (ean13) Compute(payload string) (string, error) {
+	ds := digits(payload)
+	if len(ds) != 12 {
+		return "", fmt.Errorf("checkdigit: EAN-13 codes must have 12 digits before the check digit, got %d", len(ds))
+	}
+	var sum int
+	for i, d := range ds {
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return fmt.Sprintf("%d", (10-sum%10)%10), nil
+}
+
+func init() {
+	Register("luhn", Luhn)
+	Register("mod97_10", Mod97)
+	Register("ean13", EAN13)
+}
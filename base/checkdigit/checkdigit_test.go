@@ -0,0 +1,70 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package checkdigit
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type constant struct{}
+
+func (constant) Label() string                          { return "Constant" }
+func (constant) Size() int                              { return 1 }
+func (constant) Compute(payload string) (string, error) { return "X", nil }
+
+func TestAlgorithms(t *testing.T) {
+	Convey("Testing the Luhn algorithm", t, func() {
+		check, err := Luhn.Compute("7992739871")
+		So(err, ShouldBeNil)
+		So(check, ShouldEqual, "3")
+		check, err = Luhn.Compute("INV/2016/0001")
+		So(err, ShouldBeNil)
+		So(check, ShouldEqual, "2")
+		So(Validate(Luhn, "79927398713"), ShouldBeTrue)
+		So(Validate(Luhn, "79927398710"), ShouldBeFalse)
+		So(Validate(Luhn, "4539 1488 0343 6467"), ShouldBeTrue)
+		_, err = Luhn.Compute("INV/")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Testing the ISO 7064 MOD 97-10 algorithm", t, func() {
+		check, err := Mod97.Compute("794")
+		So(err, ShouldBeNil)
+		So(check, ShouldEqual, "44")
+		check, err = Mod97.Compute("WEST12345698765432GB")
+		So(err, ShouldBeNil)
+		So(check, ShouldEqual, "82")
+		check, err = Mod97.Compute("539007547034RF")
+		So(err, ShouldBeNil)
+		So(check, ShouldEqual, "18")
+		check, err = Mod97.Compute("539007547034rf")
+		So(err, ShouldBeNil)
+		So(check, ShouldEqual, "18")
+		So(Validate(Mod97, "79444"), ShouldBeTrue)
+		So(Validate(Mod97, "79445"), ShouldBeFalse)
+		So(Validate(Mod97, "4"), ShouldBeFalse)
+	})
+	Convey("Testing the EAN-13 algorithm", t, func() {
+		check, err := EAN13.Compute("400638133393")
+		So(err, ShouldBeNil)
+		So(check, ShouldEqual, "1")
+		So(Validate(EAN13, "5901234123457"), ShouldBeTrue)
+		So(Validate(EAN13, "5901234123458"), ShouldBeFalse)
+		_, err = EAN13.Compute("12345")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Testing the algorithm registry", t, func() {
+		So(Names(), ShouldResemble, []string{"ean13", "luhn", "mod97_10"})
+		Register("constant", constant{})
+		defer Unregister("constant")
+		alg, ok := Get("constant")
+		So(ok, ShouldBeTrue)
+		So(Validate(alg, "123X"), ShouldBeTrue)
+		So(Names(), ShouldContain, "constant")
+		Unregister("constant")
+		_, ok = Get("constant")
+		So(ok, ShouldBeFalse)
+	})
+}
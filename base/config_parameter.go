@@ -57,6 +57,28 @@ func init() {
 			return param.Value()
 		})
 
+	h.ConfigParameter().Methods().GetCompanyParam().DeclareMethod(
+		`GetCompanyParam retrieves the value for a given key for the given company.
+		Company specific values are stored under the key suffixed by '.<company_id>'.
+		If there is no value for this company, the global value of the key is returned,
+		and defaultValue if the parameter is missing altogether.`,
+		func(rs h.ConfigParameterSet, company h.CompanySet, key string, defaultValue string) string {
+			if !company.IsEmpty() {
+				if value := rs.GetParam(fmt.Sprintf("%s.%d", key, company.ID()), ""); value != "" {
+					return value
+				}
+			}
+			return rs.GetParam(key, defaultValue)
+		})
+
+	h.ConfigParameter().Methods().SetCompanyParam().DeclareMethod(
+		`SetCompanyParam sets the value of a parameter for the given company only.
+		It returns the parameter.`,
+		func(rs h.ConfigParameterSet, company h.CompanySet, key, value string) h.ConfigParameterSet {
+			company.EnsureOne()
+			return rs.SetParam(fmt.Sprintf("%s.%d", key, company.ID()), value)
+		})
+
 	h.ConfigParameter().Methods().SetParam().DeclareMethod(
 		`SetParam sets the value of a parameter. It returns the parameter`,
 		func(rs h.ConfigParameterSet, key, value string) h.ConfigParameterSet {
@@ -0,0 +1,85 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package extractor extracts the text content of documents
+// so that attachments can be searched by their content.
+package extractor
+
+import (
+	"errors"
+	"mime"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupported is returned by Extract when no extractor is registered for the MIME type
+var ErrUnsupported = errors.New("extractor: unsupported MIME type")
+
+// An Extractor returns the text content of a document
+type Extractor interface {
+	Extract(data []byte) (string, error)
+}
+
+// ExtractorFunc is an adapter to use an ordinary function as an Extractor
+type ExtractorFunc func(data []byte) (string, error)
+
+// Extract calls f(data)
+func (f ExtractorFunc) Extract(data []byte) (string, error) {
+	return f(data)
+}
+
+var extractors = struct {
+	sync.RWMutex
+	byType map[string]Extractor
+}{byType: make(map[string]Extractor)}
+
+// Register sets the Extractor of the given MIME type, replacing any existing one.
+// The MIME type can be a wildcard such as "text/*", in which case the extractor is
+// used for all the types of this family which have no extractor of their own.
+func Register(mimeType string, extractor Extractor) {
+	extractors.Lock()
+	defer extractors.Unlock()
+	extractors.byType[mimeType] = extractor
+}
+
+// Get returns the Extractor of the given MIME type, if any.
+// MIME type parameters, such as the charset, are ignored.
+func Get(mimeType string) (Extractor, bool) {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = mediaType
+	}
+	extractors.RLock()
+	defer extractors.RUnlock()
+	if extractor, ok := extractors.byType[mimeType]; ok {
+		return extractor, true
+	}
+	if i := strings.Index(mimeType, "/"); i >= 0 {
+		extractor, ok := extractors.byType[mimeType[:i]+"/*"]
+		return extractor, ok
+	}
+	return nil, false
+}
+
+// Extract returns the text content of the given data of the given MIME type.
+// It returns ErrUnsupported if there is no extractor for this type.
+func Extract(mimeType string, data []byte) (string, error) {
+	extractor, ok := Get(mimeType)
+	if !ok {
+		return "", ErrUnsupported
+	}
+	return extractor.Extract(data)
+}
+
+// wordsRegexp matches the sequences of at least 4 printable characters
+var wordsRegexp = regexp.MustCompile(`[^\x00-\x1F\x7F-\xFF]{4,}`)
+
+// extractPlainText returns the sequences of printable characters of data, one per line
+func extractPlainText(data []byte) (string, error) {
+	words := wordsRegexp.FindAllString(string(data), -1)
+	return strings.Join(words, "\n"), nil
+}
+
+func init() {
+	Register("text/*", ExtractorFunc(extractPlainText))
+}
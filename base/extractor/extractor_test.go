@@ -0,0 +1,128 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package extractor
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// zipDocument returns a zip archive with the given files
+func zipDocument(files map[string]string) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		So(err, ShouldBeNil)
+		_, err = w.Write([]byte(content))
+		So(err, ShouldBeNil)
+	}
+	So(archive.Close(), ShouldBeNil)
+	return buf.Bytes()
+}
+
+// pdfDocument returns a single page PDF document showing the given text
+func pdfDocument(text string) []byte {
+	stream := fmt.Sprintf("BT /F1 12 Tf 72 712 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestExtractors(t *testing.T) {
+	Convey("Testing text extractors", t, func() {
+		Convey("Plain text", func() {
+			text, err := Extract("text/plain; charset=utf-8", []byte("Hello\x00\x01World of text"))
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, "Hello\nWorld of text")
+		})
+		Convey("Unsupported types", func() {
+			_, err := Extract("image/png", []byte("PNG"))
+			So(err, ShouldEqual, ErrUnsupported)
+		})
+		Convey("Registering an extractor", func() {
+			Register("application/x-test", ExtractorFunc(func(data []byte) (string, error) {
+				return strings.ToUpper(string(data)), nil
+			}))
+			text, err := Extract("application/x-test", []byte("test"))
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, "TEST")
+		})
+		Convey("PDF documents", func() {
+			text, err := Extract(PDFType, pdfDocument("Quarterly invoice"))
+			So(err, ShouldBeNil)
+			So(text, ShouldContainSubstring, "Quarterly invoice")
+			_, err = Extract(PDFType, []byte("%PDF-1.4 garbage"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Word documents", func() {
+			text, err := Extract(DOCXType, zipDocument(map[string]string{
+				"word/document.xml": `<w:document xmlns:w="urn:w"><w:body>
+<w:p><w:r><w:t>First</w:t></w:r><w:r><w:t xml:space="preserve"> paragraph</w:t></w:r></w:p>
+<w:p><w:r><w:t>Second paragraph</w:t></w:r></w:p></w:body></w:document>`,
+				"word/styles.xml": `<w:styles xmlns:w="urn:w"><w:t>Ignored</w:t></w:styles>`,
+			}))
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, "First paragraph\nSecond paragraph")
+		})
+		Convey("Excel documents", func() {
+			text, err := Extract(XLSXType, zipDocument(map[string]string{
+				"xl/sharedStrings.xml": `<sst xmlns="urn:x"><si><t>Customer</t></si><si><t>Amount</t></si></sst>`,
+				"xl/worksheets/sheet1.xml": `<worksheet xmlns="urn:x"><sheetData><row>
+<c t="s"><v>0</v></c><c t="inlineStr"><is><t>Inline</t></is></c></row></sheetData></worksheet>`,
+			}))
+			So(err, ShouldBeNil)
+			So(text, ShouldContainSubstring, "Customer\nAmount")
+			So(text, ShouldContainSubstring, "Inline")
+			So(text, ShouldNotContainSubstring, "0")
+		})
+		Convey("PowerPoint documents", func() {
+			text, err := Extract(PPTXType, zipDocument(map[string]string{
+				"ppt/slides/slide10.xml": `<p:sld xmlns:p="urn:p" xmlns:a="urn:a"><a:p><a:t>Tenth</a:t></a:p></p:sld>`,
+				"ppt/slides/slide2.xml":  `<p:sld xmlns:p="urn:p" xmlns:a="urn:a"><a:p><a:t>Second</a:t></a:p></p:sld>`,
+			}))
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, "Second\nTenth")
+		})
+		Convey("OpenDocument documents", func() {
+			doc := zipDocument(map[string]string{
+				"content.xml": `<office:document-content xmlns:office="urn:o" xmlns:text="urn:t"><office:body>` +
+					`<office:text><text:h>Title</text:h><text:p>Some <text:span>styled</text:span> text</text:p>` +
+					`</office:text></office:body></office:document-content>`,
+			})
+			for _, mimeType := range []string{ODTType, ODSType} {
+				text, err := Extract(mimeType, doc)
+				So(err, ShouldBeNil)
+				So(text, ShouldEqual, "Title\nSome styled text")
+			}
+		})
+		Convey("Invalid archives", func() {
+			_, err := Extract(DOCXType, []byte("not a zip"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package extractor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// MIME types of the office documents supported by this package
+const (
+	DOCXType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	XLSXType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	PPTXType = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	ODTType  = "application/vnd.oasis.opendocument.text"
+	ODSType  = "application/vnd.oasis.opendocument.spreadsheet"
+)
+
+// maxXMLPartSize is the maximum uncompressed size of an XML part that is read,
+// so that a small malicious archive cannot exhaust the memory.
+const maxXMLPartSize = 64 << 20
+
+// An xmlTextSpec tells which elements of an XML document hold text
+type xmlTextSpec struct {
+	// text holds the local names of the elements whose character data is
+	// extracted. If nil, the character data of all elements is extracted.
+	text map[string]bool
+	// breaks holds the local names of the elements after which a new line is added
+	breaks map[string]bool
+}
+
+// names returns a set with the given names
+func names(elems ...string) map[string]bool {
+	res := make(map[string]bool, len(elems))
+	for _, elem := range elems {
+		res[elem] = true
+	}
+	return res
+}
+
+// extractXMLText writes to w the text of the XML document read from r according to spec
+func extractXMLText(w *strings.Builder, r io.Reader, spec xmlTextSpec) error {
+	decoder := xml.NewDecoder(r)
+	var depth int
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok := token.(type) {
+		case xml.StartElement:
+			if spec.text[tok.Name.Local] {
+				depth++
+			}
+		case xml.EndElement:
+			if spec.text[tok.Name.Local] {
+				depth--
+			}
+			if spec.breaks[tok.Name.Local] {
+				w.WriteString("\n")
+			}
+		case xml.CharData:
+			if spec.text == nil || depth > 0 {
+				w.Write(tok)
+			}
+		}
+	}
+}
+
+// zipXMLExtractor returns an Extractor for zipped XML documents. The text of the parts
+// whose name matches one of the given patterns is extracted in the order of their names.
+func zipXMLExtractor(spec xmlTextSpec, patterns ...string) Extractor {
+	return ExtractorFunc(func(data []byte) (string, error) {
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return "", err
+		}
+		var parts []*zip.File
+		for _, file := range archive.File {
+			for _, pattern := range patterns {
+				if matched, _ := path.Match(pattern, file.Name); matched {
+					parts = append(parts, file)
+					break
+				}
+			}
+		}
+		sort.Slice(parts, func(i, j int) bool {
+			return partLess(parts[i].Name, parts[j].Name)
+		})
+		var res strings.Builder
+		for _, part := range parts {
+			if part.UncompressedSize64 > maxXMLPartSize {
+				return "", fmt.Errorf("extractor: part %s is too large", part.Name)
+			}
+			rc, err := part.Open()
+			if err != nil {
+				return "", err
+			}
+			err = extractXMLText(&res, io.LimitReader(rc, maxXMLPartSize), spec)
+			rc.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+		return strings.TrimSpace(res.String()), nil
+	})
+}
+
+// partLess sorts part names in natural order, so that "slide2.xml" comes before "slide10.xml"
+func partLess(a, b string) bool {
+	prefixA := strings.TrimRightFunc(strings.TrimSuffix(a, path.Ext(a)), unicode.IsDigit)
+	prefixB := strings.TrimRightFunc(strings.TrimSuffix(b, path.Ext(b)), unicode.IsDigit)
+	if prefixA == prefixB && len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func init() {
+	// Word: text runs are in <w:t> elements of the main document, headers and footers
+	Register(DOCXType, zipXMLExtractor(
+		xmlTextSpec{text: names("t"), breaks: names("p", "tab", "br")},
+		"word/document.xml", "word/header*.xml", "word/footer*.xml"))
+	// Excel: strings are either shared in sharedStrings.xml or inline in the worksheets
+	Register(XLSXType, zipXMLExtractor(
+		xmlTextSpec{text: names("t"), breaks: names("si", "is")},
+		"xl/sharedStrings.xml", "xl/worksheets/sheet*.xml"))
+	// PowerPoint: text runs are in <a:t> elements of the slides
+	Register(PPTXType, zipXMLExtractor(
+		xmlTextSpec{text: names("t"), breaks: names("p")},
+		"ppt/slides/slide*.xml"))
+	// OpenDocument: all the character data of the content is text
+	odfSpec := xmlTextSpec{breaks: names("p", "h", "table-cell")}
+	Register(ODTType, zipXMLExtractor(odfSpec, "content.xml"))
+	Register(ODSType, zipXMLExtractor(odfSpec, "content.xml"))
+
+	// The extensions of these types are not known to all systems
+	for ext, mimeType := range map[string]string{
+		".docx": DOCXType,
+		".xlsx": XLSXType,
+		".pptx": PPTXType,
+		".odt":  ODTType,
+		".ods":  ODSType,
+	} {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, mimeType)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package extractor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// PDFType is the MIME type of PDF documents
+const PDFType = "application/pdf"
+
+// extractPDF returns the text of the pages of the given PDF document
+func extractPDF(data []byte) (text string, err error) {
+	// the PDF reader panics on some malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("extractor: invalid PDF document: %v", r)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	content, err := reader.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	res, err := ioutil.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(res)), nil
+}
+
+func init() {
+	Register(PDFType, ExtractorFunc(extractPDF))
+}
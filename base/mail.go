@@ -0,0 +1,167 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// Configuration parameter keys of the outgoing mail server
+const (
+	// MailSMTPHostParam is the host name of the SMTP server
+	MailSMTPHostParam = "mail.smtp.host"
+	// MailSMTPPortParam is the port of the SMTP server
+	MailSMTPPortParam = "mail.smtp.port"
+	// MailSMTPUserParam is the user name to authenticate on the SMTP server.
+	// If empty, no authentication is performed.
+	MailSMTPUserParam = "mail.smtp.user"
+	// MailSMTPPasswordParam is the password to authenticate on the SMTP server
+	MailSMTPPasswordParam = "mail.smtp.password"
+	// MailFromParam is the address from which emails are sent
+	MailFromParam = "mail.from"
+)
+
+// A MailMessage is an email to send
+type MailMessage struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+}
+
+// headerSanitizer removes line breaks from header values
+var headerSanitizer = strings.NewReplacer("\r", "", "\n", "")
+
+// Bytes returns the given message in RFC 5322 format, with a plain text body.
+func (mm MailMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", headerSanitizer.Replace(mm.From))
+	fmt.Fprintf(&buf, "To: %s\r\n", headerSanitizer.Replace(strings.Join(mm.To, ", ")))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mm.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.Replace(mm.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+// A MailSender sends emails
+type MailSender interface {
+	Send(msg MailMessage) error
+}
+
+// DefaultMailSender is the MailSender used to send the emails of the application.
+// If nil, emails are sent through the SMTP server set in the mail.smtp.* parameters.
+var DefaultMailSender MailSender
+
+// An SMTPMailSender sends emails through an SMTP server
+type SMTPMailSender struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+}
+
+// Send the given message through the SMTP server
+func (s SMTPMailSender) Send(msg MailMessage) error {
+	if s.Host == "" {
+		return errors.New("no outgoing mail server configured")
+	}
+	var auth smtp.Auth
+	if s.User != "" {
+		auth = smtp.PlainAuth("", s.User, s.Password, s.Host)
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %s", err)
+	}
+	to := make([]string, len(msg.To))
+	for i, addr := range msg.To {
+		rcpt, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("invalid recipient address: %s", err)
+		}
+		to[i] = rcpt.Address
+	}
+	return smtp.SendMail(net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), auth, from.Address, to, msg.Bytes())
+}
+
+// getMailSender returns the MailSender to use in the given environment
+func getMailSender(env models.Environment) MailSender {
+	if DefaultMailSender != nil {
+		return DefaultMailSender
+	}
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	port, err := strconv.Atoi(params.GetParam(MailSMTPPortParam, "25"))
+	if err != nil {
+		log.Warn("Invalid SMTP port parameter", "error", err)
+		port = 25
+	}
+	return SMTPMailSender{
+		Host:     params.GetParam(MailSMTPHostParam, ""),
+		Port:     port,
+		User:     params.GetParam(MailSMTPUserParam, ""),
+		Password: params.GetParam(MailSMTPPasswordParam, ""),
+	}
+}
+
+// SendMail sends the given message with the MailSender of the given environment.
+// If the message has no sender, it is sent from the mail.from parameter address.
+func SendMail(env models.Environment, msg MailMessage) error {
+	if msg.From == "" {
+		msg.From = h.ConfigParameter().NewSet(env).Sudo().GetParam(MailFromParam, "noreply@localhost")
+	}
+	if err := getMailSender(env).Send(msg); err != nil {
+		log.Warn("Unable to send email", "to", msg.To, "subject", msg.Subject, "error", err)
+		return err
+	}
+	log.Debug("Email sent", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
+
+// A MailTemplate renders the subject and body of an email
+type MailTemplate struct {
+	Subject *template.Template
+	Body    *template.Template
+}
+
+// NewMailTemplate returns a MailTemplate with the given subject
+// and body, which are parsed as text/template templates.
+func NewMailTemplate(name, subject, body string) MailTemplate {
+	return MailTemplate{
+		Subject: template.Must(template.New(name + ".subject").Parse(subject)),
+		Body:    template.Must(template.New(name + ".body").Parse(body)),
+	}
+}
+
+// Render returns a message to the given recipient, whose subject and body
+// are rendered from this template with the given data.
+func (mt MailTemplate) Render(to string, data interface{}) (MailMessage, error) {
+	var subject, body bytes.Buffer
+	if err := mt.Subject.Execute(&subject, data); err != nil {
+		return MailMessage{}, err
+	}
+	if err := mt.Body.Execute(&body, data); err != nil {
+		return MailMessage{}, err
+	}
+	return MailMessage{
+		To:      []string{to},
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    body.String(),
+	}, nil
+}
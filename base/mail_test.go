@@ -0,0 +1,141 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testSMTPServer is a minimal local SMTP server that
+// records the messages it receives.
+type testSMTPServer struct {
+	listener net.Listener
+	messages chan string
+}
+
+// newTestSMTPServer starts a testSMTPServer on a random local port
+func newTestSMTPServer() *testSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	srv := &testSMTPServer{
+		listener: listener,
+		messages: make(chan string, 10),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.handle(conn)
+		}
+	}()
+	return srv
+}
+
+// handle a single SMTP client connection
+func (s *testSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- string(data)
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// configure sets the mail parameters of the given environment to use this server
+func (s *testSMTPServer) configure(env models.Environment) {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	params := h.ConfigParameter().NewSet(env)
+	params.SetParam(MailSMTPHostParam, addr.IP.String())
+	params.SetParam(MailSMTPPortParam, strconv.Itoa(addr.Port))
+	params.SetParam(MailFromParam, "Hexya <noreply@example.com>")
+}
+
+// nextMessage returns the next message received by the server,
+// or an empty string if none is received within a second.
+func (s *testSMTPServer) nextMessage() string {
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(time.Second):
+		return ""
+	}
+}
+
+// Close stops the server
+func (s *testSMTPServer) Close() {
+	s.listener.Close()
+}
+
+func TestSendMail(t *testing.T) {
+	Convey("Testing sending emails", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			srv := newTestSMTPServer()
+			defer srv.Close()
+			srv.configure(env)
+			Convey("Rendering a template", func() {
+				tmpl := NewMailTemplate("test", `Hello {{ .Name }}`, "Dear {{ .Name }},\nWelcome!\n")
+				msg, err := tmpl.Render("john@example.com", struct{ Name string }{Name: "John"})
+				So(err, ShouldBeNil)
+				So(msg.To, ShouldResemble, []string{"john@example.com"})
+				So(msg.Subject, ShouldEqual, "Hello John")
+				So(msg.Body, ShouldEqual, "Dear John,\nWelcome!\n")
+			})
+			Convey("Sending an email through SMTP", func() {
+				err := SendMail(env, MailMessage{
+					To:      []string{"John Smith <john@example.com>"},
+					Subject: "Test\r\nBcc: evil@example.com",
+					Body:    "Hello John,\nThis is a test.\n",
+				})
+				So(err, ShouldBeNil)
+				msg := srv.nextMessage()
+				So(msg, ShouldContainSubstring, "From: Hexya <noreply@example.com>\n")
+				So(msg, ShouldContainSubstring, "To: John Smith <john@example.com>\n")
+				So(msg, ShouldNotContainSubstring, "\nBcc:")
+				So(msg, ShouldContainSubstring, "Hello John,\nThis is a test.\n")
+			})
+			Convey("Sending fails without mail server", func() {
+				h.ConfigParameter().NewSet(env).Search(q.ConfigParameter().Key().Equals(MailSMTPHostParam)).Unlink()
+				err := SendMail(env, MailMessage{To: []string{"john@example.com"}, Subject: "Test"})
+				So(err, ShouldNotBeNil)
+			})
+		}), ShouldBeNil)
+	})
+}
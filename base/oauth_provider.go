@@ -0,0 +1,242 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc"
+	"github.com/hexya-erp/hexya-base/base/basetypes"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	"golang.org/x/oauth2"
+)
+
+// oidcProviders caches the discovered OpenID Connect providers by issuer URL
+var oidcProviders = struct {
+	sync.RWMutex
+	byIssuer map[string]*oidc.Provider
+}{
+	byIssuer: make(map[string]*oidc.Provider),
+}
+
+// getOIDCProvider returns the OpenID Connect provider of the given issuer,
+// fetching its discovery document the first time.
+func getOIDCProvider(issuer string) (*oidc.Provider, error) {
+	oidcProviders.RLock()
+	provider, ok := oidcProviders.byIssuer[issuer]
+	oidcProviders.RUnlock()
+	if ok {
+		return provider, nil
+	}
+	provider, err := oidc.NewProvider(context.Background(), issuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProviders.Lock()
+	oidcProviders.byIssuer[issuer] = provider
+	oidcProviders.Unlock()
+	return provider, nil
+}
+
+// NewOAuthRandomString returns a random string suitable for OAuth2 state,
+// nonce and PKCE code verifier values.
+func NewOAuthRandomString() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Panic("Unable to generate random string", "error", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// pkceChallenge returns the S256 PKCE code challenge of the given verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// oauth2Config returns the OAuth2 configuration of the given provider record
+func oauth2Config(rs h.OAuthProviderSet, provider *oidc.Provider, redirectURI string) *oauth2.Config {
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range strings.Fields(rs.Scopes()) {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+	return &oauth2.Config{
+		ClientID:     rs.ClientID(),
+		ClientSecret: rs.ClientSecret(),
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURI,
+		Scopes:       scopes,
+	}
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func init() {
+	oauthProviderModel := h.OAuthProvider().DeclareModel()
+	oauthProviderModel.SetDefaultOrder("Sequence", "Name")
+	oauthProviderModel.AddFields(map[string]models.FieldDefinition{
+		"Name": models.CharField{Required: true, Translate: true,
+			Help: "Name of the provider, displayed on the 'Log in with' button of the login page"},
+		"Active":   models.BooleanField{Default: models.DefaultValue(true), Required: true},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(10)},
+		"Issuer": models.CharField{Required: true,
+			Help: "Issuer URL of the OpenID Connect provider, e.g. https://accounts.example.com"},
+		"ClientID":     models.CharField{String: "Client ID", Required: true},
+		"ClientSecret": models.CharField{NoCopy: true},
+		"Scopes": models.CharField{Default: models.DefaultValue("openid email profile"),
+			Help: "Space separated list of the requested scopes. 'openid' is always requested."},
+		"MatchEmail": models.BooleanField{String: "Match Users by Email", Default: models.DefaultValue(true),
+			Help: "Link unknown accounts to the existing user whose login is their verified email address"},
+		"CreateUser": models.BooleanField{String: "Create Users",
+			Help: "Create users for unknown accounts at their first login"},
+		"UserTemplate": models.Many2OneField{RelationModel: h.User(), OnDelete: models.SetNull,
+			Help: "User whose groups are given to the users created at their first login"},
+	})
+
+	oauthProviderModel.Methods().AuthorizationURL().DeclareMethod(
+		`AuthorizationURL returns the URL of the provider to which the client must be redirected
+		to log in. state, nonce and codeVerifier must be random values kept in the client's session
+		to be checked or used when the client comes back to redirectURI.`,
+		func(rs h.OAuthProviderSet, redirectURI, state, nonce, codeVerifier string) (string, error) {
+			rs.EnsureOne()
+			provider, err := getOIDCProvider(rs.Issuer())
+			if err != nil {
+				return "", err
+			}
+			return oauth2Config(rs, provider, redirectURI).AuthCodeURL(state,
+				oidc.Nonce(nonce),
+				oauth2.SetAuthURLParam("code_challenge", pkceChallenge(codeVerifier)),
+				oauth2.SetAuthURLParam("code_challenge_method", "S256")), nil
+		})
+
+	oauthProviderModel.Methods().ExchangeCode().DeclareMethod(
+		`ExchangeCode exchanges the given authorization code for tokens at the provider,
+		then verifies the signature, audience, expiry and nonce of the ID token and returns its claims.`,
+		func(rs h.OAuthProviderSet, code, redirectURI, codeVerifier, nonce string) (basetypes.OIDCClaims, error) {
+			rs.EnsureOne()
+			var claims basetypes.OIDCClaims
+			provider, err := getOIDCProvider(rs.Issuer())
+			if err != nil {
+				return claims, err
+			}
+			ctx := context.Background()
+			token, err := oauth2Config(rs, provider, redirectURI).Exchange(ctx, code,
+				oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+			if err != nil {
+				return claims, err
+			}
+			rawIDToken, ok := token.Extra("id_token").(string)
+			if !ok {
+				return claims, fmt.Errorf("no id_token in token response")
+			}
+			idToken, err := provider.Verifier(&oidc.Config{ClientID: rs.ClientID()}).Verify(ctx, rawIDToken)
+			if err != nil {
+				return claims, err
+			}
+			if err = idToken.Claims(&claims); err != nil {
+				return claims, err
+			}
+			if claims.Nonce != nonce {
+				return claims, fmt.Errorf("invalid nonce in ID token")
+			}
+			return claims, nil
+		})
+
+	oauthProviderModel.Methods().GetOrCreateUser().DeclareMethod(
+		`GetOrCreateUser returns the user identified by the given claims of this provider.
+		Users are found by subject first, then by verified email if MatchEmail is set.
+		Unknown users are created from the template user if CreateUser is set.
+		The returned set is empty if no user matches.`,
+		func(rs h.OAuthProviderSet, claims basetypes.OIDCClaims) h.UserSet {
+			rs.EnsureOne()
+			users := h.User().NewSet(rs.Env()).Sudo().WithContext("active_test", false)
+			user := users.Search(q.User().OAuthProvider().Equals(rs).And().OAuthUID().Equals(claims.Subject))
+			if !user.IsEmpty() {
+				return user
+			}
+			if claims.Email == "" || !claims.EmailVerified {
+				return h.User().NewSet(rs.Env())
+			}
+			if rs.MatchEmail() {
+				email := likeEscaper.Replace(claims.Email)
+				user = users.Search(q.User().Login().ILike(email).Or().Email().ILike(email)).Limit(1)
+				if !user.IsEmpty() {
+					if !user.OAuthProvider().IsEmpty() {
+						// Already linked to another account
+						return h.User().NewSet(rs.Env())
+					}
+					user.Write(&h.UserData{OAuthProvider: rs, OAuthUID: claims.Subject})
+					return user
+				}
+			}
+			if !rs.CreateUser() {
+				return user
+			}
+			name := claims.Name
+			if name == "" {
+				name = claims.Email
+			}
+			data := &h.UserData{
+				Name:          name,
+				Login:         claims.Email,
+				Email:         claims.Email,
+				OAuthProvider: rs,
+				OAuthUID:      claims.Subject,
+			}
+			if !rs.UserTemplate().IsEmpty() {
+				data.Company = rs.UserTemplate().Company()
+				data.Companies = rs.UserTemplate().Companies()
+				data.Groups = rs.UserTemplate().Groups()
+				data.Lang = rs.UserTemplate().Lang()
+				data.TZ = rs.UserTemplate().TZ()
+				data.ActionID = rs.UserTemplate().ActionID()
+			}
+			user = users.Create(data)
+			log.Info("User created from OpenID Connect provider", "login", claims.Email, "provider", rs.Name())
+			return user
+		})
+
+	oauthProviderModel.Methods().Authenticate().DeclareMethod(
+		`Authenticate logs in the user coming back from this provider with the given authorization code.
+		It returns the uid of the user, who may still need to complete two-factor authentication,
+		and an error if the code is invalid or if no active user matches the account.`,
+		func(rs h.OAuthProviderSet, code, redirectURI, codeVerifier, nonce string) (int64, error) {
+			rs.EnsureOne()
+			claims, err := rs.Sudo().ExchangeCode(code, redirectURI, codeVerifier, nonce)
+			if err != nil {
+				log.Warn("OpenID Connect authentication failed", "provider", rs.Name(), "error", err)
+				return 0, security.InvalidCredentialsError(rs.Name())
+			}
+			user := rs.Sudo().GetOrCreateUser(claims)
+			if user.IsEmpty() || !user.Active() {
+				h.AuthLog().NewSet(rs.Env()).Record(claims.Email, "failure",
+					fmt.Sprintf("No user for subject '%s' of %s", claims.Subject, rs.Name()))
+				return 0, security.UserNotFoundError(claims.Email)
+			}
+			if err = checkLoginThrottle(user, user.Login()); err != nil {
+				return 0, err
+			}
+			user.RecordLogin(fmt.Sprintf("Signed in with %s", rs.Name()))
+			return user.ID(), nil
+		})
+
+	h.User().AddFields(map[string]models.FieldDefinition{
+		"OAuthProvider": models.Many2OneField{RelationModel: h.OAuthProvider(), OnDelete: models.SetNull,
+			String: "OAuth Provider", NoCopy: true},
+		"OAuthUID": models.CharField{String: "OAuth User ID", NoCopy: true, Index: true,
+			Help: "Subject identifying the user at the OAuth provider"},
+	})
+}
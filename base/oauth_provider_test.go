@@ -0,0 +1,254 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya-base/base/basetypes"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider for tests.
+// Authorization requests are registered with authorize and the returned
+// code can then be exchanged at the token endpoint.
+type mockOIDCProvider struct {
+	sync.Mutex
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	codes  map[string]mockOIDCAuthorization
+}
+
+// mockOIDCAuthorization is an authorization request to the mock provider
+type mockOIDCAuthorization struct {
+	challenge string
+	claims    map[string]interface{}
+	// key signs the ID token instead of the provider's key if set
+	key *rsa.PrivateKey
+}
+
+func newMockOIDCProvider() *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p := &mockOIDCProvider{key: key, codes: make(map[string]mockOIDCAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.Lock()
+		auth, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.Unlock()
+		if !ok || pkceChallenge(r.PostForm.Get("code_verifier")) != auth.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.sign(auth.claims, auth.key),
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+// sign returns a RS256 JWT of the given claims, signed with the given
+// key or with the key of the provider if key is nil.
+func (p *mockOIDCProvider) sign(claims map[string]interface{}, key *rsa.PrivateKey) string {
+	if key == nil {
+		key = p.key
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize simulates the login of a user at the provider for the given
+// authorization URL and returns the authorization code.
+func (p *mockOIDCProvider) authorize(authURL string, claims map[string]interface{}) string {
+	u, _ := url.Parse(authURL)
+	params := u.Query()
+	fullClaims := map[string]interface{}{
+		"iss":   p.server.URL,
+		"aud":   params.Get("client_id"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": params.Get("nonce"),
+	}
+	for k, v := range claims {
+		fullClaims[k] = v
+	}
+	code := NewOAuthRandomString()
+	p.Lock()
+	p.codes[code] = mockOIDCAuthorization{challenge: params.Get("code_challenge"), claims: fullClaims}
+	p.Unlock()
+	return code
+}
+
+func TestOAuthAuthentication(t *testing.T) {
+	mock := newMockOIDCProvider()
+	defer mock.server.Close()
+	redirectURI := "http://localhost/web/login/oauth/callback"
+	Convey("Testing OpenID Connect authentication", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			provider := h.OAuthProvider().Create(env, &h.OAuthProviderData{
+				Name:         "Mock",
+				Issuer:       mock.server.URL,
+				ClientID:     "hexya",
+				ClientSecret: "client-secret",
+				Scopes:       "email profile",
+				MatchEmail:   true,
+			})
+			userJohn := h.User().Create(env, &h.UserData{
+				Name:  "John Smith",
+				Login: "john@example.com",
+			})
+			authURL, err := provider.AuthorizationURL(redirectURI, "state", "nonce", "verifier")
+			So(err, ShouldBeNil)
+			Convey("The authorization URL uses PKCE", func() {
+				So(authURL, ShouldStartWith, mock.server.URL+"/authorize?")
+				u, _ := url.Parse(authURL)
+				So(u.Query().Get("code_challenge"), ShouldEqual, pkceChallenge("verifier"))
+				So(u.Query().Get("code_challenge_method"), ShouldEqual, "S256")
+				So(u.Query().Get("nonce"), ShouldEqual, "nonce")
+				So(u.Query().Get("state"), ShouldEqual, "state")
+				So(strings.Fields(u.Query().Get("scope")), ShouldContain, "openid")
+			})
+			Convey("Users are matched by verified email, then by subject", func() {
+				code := mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "John@example.com", "email_verified": true,
+				})
+				uid, err := provider.Authenticate(code, redirectURI, "verifier", "nonce")
+				So(err, ShouldBeNil)
+				So(uid, ShouldEqual, userJohn.ID())
+				So(userJohn.OAuthUID(), ShouldEqual, "12345")
+				code = mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "other@example.com", "email_verified": true,
+				})
+				uid, err = provider.Authenticate(code, redirectURI, "verifier", "nonce")
+				So(err, ShouldBeNil)
+				So(uid, ShouldEqual, userJohn.ID())
+			})
+			Convey("Unverified emails are not matched", func() {
+				code := mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "john@example.com", "email_verified": false,
+				})
+				_, err := provider.Authenticate(code, redirectURI, "verifier", "nonce")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Users are created if enabled", func() {
+				provider.SetCreateUser(true)
+				code := mock.authorize(authURL, map[string]interface{}{
+					"sub": "67890", "email": "jane@example.com", "email_verified": true, "name": "Jane Doe",
+				})
+				uid, err := provider.Authenticate(code, redirectURI, "verifier", "nonce")
+				So(err, ShouldBeNil)
+				jane := h.User().Browse(env, []int64{uid})
+				So(jane.Login(), ShouldEqual, "jane@example.com")
+				So(jane.Name(), ShouldEqual, "Jane Doe")
+				So(jane.OAuthProvider().Equals(provider), ShouldBeTrue)
+				So(jane.PasswordExpired(), ShouldBeFalse)
+			})
+			Convey("Wrong PKCE verifier, nonce or audience are rejected", func() {
+				code := mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "john@example.com", "email_verified": true,
+				})
+				_, err := provider.Authenticate(code, redirectURI, "wrong-verifier", "nonce")
+				So(err, ShouldNotBeNil)
+				code = mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "john@example.com", "email_verified": true,
+				})
+				_, err = provider.Authenticate(code, redirectURI, "verifier", "wrong-nonce")
+				So(err, ShouldNotBeNil)
+				code = mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "john@example.com", "email_verified": true, "aud": "other-client",
+				})
+				_, err = provider.Authenticate(code, redirectURI, "verifier", "nonce")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Tokens signed with another key are rejected", func() {
+				code := mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "john@example.com", "email_verified": true,
+				})
+				otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+				auth := mock.codes[code]
+				auth.key = otherKey
+				mock.codes[code] = auth
+				_, err := provider.ExchangeCode(code, redirectURI, "verifier", "nonce")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Provider claims are parsed", func() {
+				code := mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "john@example.com", "email_verified": true, "name": "John",
+				})
+				claims, err := provider.ExchangeCode(code, redirectURI, "verifier", "nonce")
+				So(err, ShouldBeNil)
+				So(claims, ShouldResemble, basetypes.OIDCClaims{
+					Subject: "12345", Email: "john@example.com", EmailVerified: true, Name: "John", Nonce: "nonce",
+				})
+			})
+			Convey("Matching users by email can be disabled", func() {
+				provider.SetMatchEmail(false)
+				code := mock.authorize(authURL, map[string]interface{}{
+					"sub": "12345", "email": "john@example.com", "email_verified": true,
+				})
+				_, err := provider.Authenticate(code, redirectURI, "verifier", "nonce")
+				So(err, ShouldNotBeNil)
+				So(h.User().Search(env, q.User().OAuthUID().Equals("12345")).IsEmpty(), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
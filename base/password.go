@@ -0,0 +1,237 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/pool/h"
+	"golang.org/x/crypto/argon2"
+)
+
+// PasswordHashParams are the argon2id parameters used to hash new passwords.
+//
+// They are encoded in each stored hash, so that changing them does not
+// invalidate existing passwords: hashes computed with other parameters are
+// transparently upgraded at the next successful login.
+var PasswordHashParams = struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 2,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// HashPassword returns the argon2id hash of the given password,
+// in the PHC string format ($argon2id$v=19$m=...,t=...,p=...$salt$hash).
+func HashPassword(password string) string {
+	salt := make([]byte, PasswordHashParams.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		log.Panic("Unable to generate password salt", "error", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, PasswordHashParams.Time, PasswordHashParams.Memory,
+		PasswordHashParams.Threads, PasswordHashParams.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		PasswordHashParams.Memory, PasswordHashParams.Time, PasswordHashParams.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// IsPasswordHash returns true if the given value is a password hash
+// as returned by HashPassword, and not a cleartext password.
+func IsPasswordHash(value string) bool {
+	_, _, _, err := decodePasswordHash(value)
+	return err == nil
+}
+
+// CheckPassword returns true if password matches the given stored value.
+//
+// The second returned value is true if the stored value should be replaced
+// by a new hash of the password, either because it is still stored in
+// cleartext or because it was hashed with outdated parameters.
+func CheckPassword(password, stored string) (ok bool, needsRehash bool) {
+	if stored == "" {
+		return false, false
+	}
+	if !strings.HasPrefix(stored, argon2idPrefix) {
+		// Legacy cleartext password
+		ok = subtle.ConstantTimeCompare([]byte(password), []byte(stored)) == 1
+		return ok, ok
+	}
+	params, salt, key, err := decodePasswordHash(stored)
+	if err != nil {
+		log.Warn("Unable to decode password hash", "error", err)
+		return false, false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false
+	}
+	needsRehash = params.Memory != PasswordHashParams.Memory ||
+		params.Time != PasswordHashParams.Time ||
+		params.Threads != PasswordHashParams.Threads ||
+		uint32(len(key)) != PasswordHashParams.KeyLen
+	return true, needsRehash
+}
+
+// argon2Params are the cost parameters decoded from a stored hash
+type argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// decodePasswordHash parses a hash in the PHC string format
+func decodePasswordHash(value string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(value, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+// Configuration parameter keys of the password policy. Each of them can be
+// set globally or for a single company (see ConfigParameter.SetCompanyParam).
+const (
+	// PasswordMinLengthParam is the minimum number of characters of a password.
+	// Zero, the default, only rejects empty passwords.
+	PasswordMinLengthParam = "auth.password_policy.min_length"
+	// PasswordRequiredClassesParam is a comma separated list of the character
+	// classes that must appear in a password among 'lower', 'upper', 'digit'
+	// and 'special'.
+	PasswordRequiredClassesParam = "auth.password_policy.required_classes"
+	// PasswordCommonListParam is a newline separated list of forbidden passwords
+	// that are rejected in addition to CommonPasswords.
+	PasswordCommonListParam = "auth.password_policy.common_passwords"
+	// PasswordHistorySizeParam is the number of previous passwords that cannot be reused
+	PasswordHistorySizeParam = "auth.password_policy.history_size"
+	// PasswordMaxAgeParam is the number of days after which a password must be changed.
+	// Zero means that passwords never expire.
+	PasswordMaxAgeParam = "auth.password_policy.max_age"
+)
+
+// CommonPasswords is the built-in list of passwords which are rejected
+// by the password policy because they are too easy to guess.
+// Modules may append their own entries to this list.
+var CommonPasswords = []string{
+	"123456", "12345678", "123456789", "1234567890", "1234567", "12345", "111111", "000000",
+	"123123", "654321", "666666", "121212", "112233", "password", "password1", "passw0rd",
+	"qwerty", "qwertyuiop", "azerty", "azertyuiop", "abc123", "admin", "administrator", "letmein",
+	"welcome", "monkey", "dragon", "iloveyou", "sunshine", "princess", "football", "baseball",
+	"master", "shadow", "superman", "trustno1", "changeme", "secret", "login", "hexya",
+}
+
+// passwordClasses are the character classes which can be required in passwords
+var passwordClasses = map[string]bool{
+	"lower":   true,
+	"upper":   true,
+	"digit":   true,
+	"special": true,
+}
+
+// passwordPolicy holds the rules that new passwords must comply with
+type passwordPolicy struct {
+	MinLength       int
+	RequiredClasses []string
+	Common          map[string]bool
+	HistorySize     int
+	MaxAge          int
+}
+
+// getPasswordPolicy returns the password policy that applies to the given company
+func getPasswordPolicy(env models.Environment, company h.CompanySet) passwordPolicy {
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	atoi := func(key, defaultValue string) int {
+		val, err := strconv.Atoi(strings.TrimSpace(params.GetCompanyParam(company, key, defaultValue)))
+		if err != nil || val < 0 {
+			log.Warn("Invalid password policy parameter", "key", key, "error", err)
+			val, _ = strconv.Atoi(defaultValue)
+		}
+		return val
+	}
+	policy := passwordPolicy{
+		MinLength:   atoi(PasswordMinLengthParam, "0"),
+		HistorySize: atoi(PasswordHistorySizeParam, "0"),
+		MaxAge:      atoi(PasswordMaxAgeParam, "0"),
+		Common:      make(map[string]bool),
+	}
+	for _, class := range strings.Split(params.GetCompanyParam(company, PasswordRequiredClassesParam, ""), ",") {
+		class = strings.ToLower(strings.TrimSpace(class))
+		switch {
+		case class == "":
+		case !passwordClasses[class]:
+			log.Warn("Unknown password character class ignored", "key", PasswordRequiredClassesParam, "class", class)
+		default:
+			policy.RequiredClasses = append(policy.RequiredClasses, class)
+		}
+	}
+	common := append([]string{}, CommonPasswords...)
+	common = append(common, strings.Split(params.GetCompanyParam(company, PasswordCommonListParam, ""), "\n")...)
+	for _, pwd := range common {
+		pwd = strings.ToLower(strings.TrimSpace(pwd))
+		if pwd != "" {
+			policy.Common[pwd] = true
+		}
+	}
+	return policy
+}
+
+// passwordHasClass returns true if the given password contains
+// at least one character of the given class.
+func passwordHasClass(password, class string) bool {
+	for _, r := range password {
+		switch class {
+		case "lower":
+			if unicode.IsLower(r) {
+				return true
+			}
+		case "upper":
+			if unicode.IsUpper(r) {
+				return true
+			}
+		case "digit":
+			if unicode.IsDigit(r) {
+				return true
+			}
+		case "special":
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the maximum size of the chunks sent to clamd
+const clamdChunkSize = 64 << 10
+
+// Clamd is a Scanner which sends contents to a ClamAV daemon
+// with the INSTREAM command.
+type Clamd struct {
+	// Network is the network of the daemon, either "unix" or "tcp"
+	Network string
+	// Address is the path of the socket, or the host and port of the daemon
+	Address string
+	// Timeout is the maximum duration of a scan
+	Timeout time.Duration
+	// Found is the verdict of the contents in which clamd finds a malware
+	Found Verdict
+}
+
+// NewClamd returns a Clamd scanner connecting to the daemon listening on
+// the given Unix socket, such as "/var/run/clamav/clamd.ctl". Infected
+// contents are rejected.
+func NewClamd(socket string) *Clamd {
+	return &Clamd{
+		Network: "unix",
+		Address: socket,
+		Timeout: time.Minute,
+		Found:   Reject,
+	}
+}
+
+// Scan sends the content of r to clamd and returns its verdict
+func (c *Clamd) Scan(r io.Reader) (Result, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: unable to connect: %s", err)
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	writeErr := c.send(conn, r)
+	// clamd replies before closing the connection if the stream is too long,
+	// so that we try to read its reply even if sending failed.
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if writeErr != nil {
+			return Result{}, fmt.Errorf("clamd: unable to send content: %s", writeErr)
+		}
+		return Result{}, fmt.Errorf("clamd: unable to read reply: %s", err)
+	}
+	return c.parseReply(reply)
+}
+
+// send writes the INSTREAM command and the content of r to w
+func (c *Clamd) send(w io.Writer, r io.Reader) error {
+	if _, err := w.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, wErr := w.Write(buf[:4+n]); wErr != nil {
+				return wErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseReply returns the Result of the given clamd reply, such as
+// "stream: OK" or "stream: Eicar-Signature FOUND".
+func (c *Clamd) parseReply(reply string) (Result, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		return Result{Verdict: Allow}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Verdict: c.Found, Reason: strings.TrimSuffix(status, " FOUND")}, nil
+	case strings.HasSuffix(status, " ERROR"):
+		return Result{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(status, " ERROR"))
+	}
+	return Result{}, fmt.Errorf("clamd: unexpected reply '%s'", reply)
+}
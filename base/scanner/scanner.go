@@ -0,0 +1,118 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package scanner defines the content scanners, such as antivirus
+// engines, which check the files uploaded as attachments.
+package scanner
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// A Verdict is the decision of a Scanner about a content
+type Verdict int
+
+// The verdicts of scanners, by increasing severity
+const (
+	// Allow means that the content can be stored
+	Allow Verdict = iota
+	// Quarantine means that the content can be stored, but must not be served
+	Quarantine
+	// Reject means that the content must not be stored
+	Reject
+)
+
+// String returns the name of the verdict
+func (v Verdict) String() string {
+	switch v {
+	case Allow:
+		return "allow"
+	case Quarantine:
+		return "quarantine"
+	case Reject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// A Result is the outcome of the scan of a content
+type Result struct {
+	Verdict Verdict
+	// Reason explains the verdict, such as the name of the detected malware
+	Reason string
+}
+
+// A Scanner checks contents
+type Scanner interface {
+	// Scan reads the content from r and returns its verdict.
+	// It returns an error if the content could not be scanned.
+	Scan(r io.Reader) (Result, error)
+}
+
+// ScannerFunc is an adapter to use an ordinary function as a Scanner
+type ScannerFunc func(r io.Reader) (Result, error)
+
+// Scan calls f(r)
+func (f ScannerFunc) Scan(r io.Reader) (Result, error) {
+	return f(r)
+}
+
+var scanners = struct {
+	sync.RWMutex
+	byName map[string]Scanner
+}{byName: make(map[string]Scanner)}
+
+// Register adds the given Scanner under the given name, replacing any existing one.
+func Register(name string, scanner Scanner) {
+	scanners.Lock()
+	defer scanners.Unlock()
+	scanners.byName[name] = scanner
+}
+
+// Unregister removes the Scanner with the given name, if any.
+func Unregister(name string) {
+	scanners.Lock()
+	defer scanners.Unlock()
+	delete(scanners.byName, name)
+}
+
+// Registered returns the registered scanners, ordered by name.
+func Registered() []Scanner {
+	scanners.RLock()
+	defer scanners.RUnlock()
+	names := make([]string, 0, len(scanners.byName))
+	for name := range scanners.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]Scanner, len(names))
+	for i, name := range names {
+		res[i] = scanners.byName[name]
+	}
+	return res
+}
+
+// ScanAll scans the content of r with each of the given scanners, rewinding r
+// in between, and returns the most severe of their results. It stops at the
+// first scanner which rejects the content or which returns an error.
+func ScanAll(r io.ReadSeeker, scanners ...Scanner) (Result, error) {
+	var res Result
+	for _, scanner := range scanners {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return Result{}, err
+		}
+		scanRes, err := scanner.Scan(r)
+		if err != nil {
+			return Result{}, err
+		}
+		if scanRes.Verdict > res.Verdict {
+			res = scanRes
+		}
+		if res.Verdict == Reject {
+			break
+		}
+	}
+	return res, nil
+}
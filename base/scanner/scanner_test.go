@@ -0,0 +1,157 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeClamd is a minimal clamd daemon which reports
+// the contents containing "EICAR" as infected
+type fakeClamd struct {
+	listener net.Listener
+	maxSize  int
+}
+
+// newFakeClamd starts a fakeClamd listening on a Unix socket in dir
+func newFakeClamd(dir string, maxSize int) *fakeClamd {
+	listener, err := net.Listen("unix", filepath.Join(dir, "clamd.ctl"))
+	So(err, ShouldBeNil)
+	fc := &fakeClamd{listener: listener, maxSize: maxSize}
+	go fc.serve()
+	return fc
+}
+
+func (fc *fakeClamd) serve() {
+	for {
+		conn, err := fc.listener.Accept()
+		if err != nil {
+			return
+		}
+		go fc.handle(conn)
+	}
+}
+
+func (fc *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil || command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var content bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if content.Len()+int(size) > fc.maxSize {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+		if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+			return
+		}
+	}
+	if bytes.Contains(content.Bytes(), []byte("EICAR")) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamd(t *testing.T) {
+	Convey("Testing the clamd scanner", t, func() {
+		dir, err := ioutil.TempDir("", "hexya-clamd")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		daemon := newFakeClamd(dir, 200000)
+		defer daemon.listener.Close()
+		clamd := NewClamd(filepath.Join(dir, "clamd.ctl"))
+		Convey("Clean contents are allowed", func() {
+			res, err := clamd.Scan(strings.NewReader("harmless content"))
+			So(err, ShouldBeNil)
+			So(res.Verdict, ShouldEqual, Allow)
+			res, err = clamd.Scan(bytes.NewReader(bytes.Repeat([]byte("x"), 3*clamdChunkSize/2)))
+			So(err, ShouldBeNil)
+			So(res.Verdict, ShouldEqual, Allow)
+			res, err = clamd.Scan(strings.NewReader(""))
+			So(err, ShouldBeNil)
+			So(res.Verdict, ShouldEqual, Allow)
+		})
+		Convey("Infected contents get the configured verdict", func() {
+			res, err := clamd.Scan(strings.NewReader("some EICAR test"))
+			So(err, ShouldBeNil)
+			So(res.Verdict, ShouldEqual, Reject)
+			So(res.Reason, ShouldEqual, "Eicar-Test-Signature")
+			clamd.Found = Quarantine
+			res, err = clamd.Scan(strings.NewReader("some EICAR test"))
+			So(err, ShouldBeNil)
+			So(res.Verdict, ShouldEqual, Quarantine)
+		})
+		Convey("Daemon errors are returned", func() {
+			_, err := clamd.Scan(bytes.NewReader(make([]byte, 300000)))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "size limit exceeded")
+			_, err = NewClamd(filepath.Join(dir, "missing.ctl")).Scan(strings.NewReader("content"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestScanAll(t *testing.T) {
+	Convey("Testing scanners combination", t, func() {
+		verdict := func(v Verdict, reason string) Scanner {
+			return ScannerFunc(func(r io.Reader) (Result, error) {
+				data, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "content")
+				return Result{Verdict: v, Reason: reason}, nil
+			})
+		}
+		failing := ScannerFunc(func(r io.Reader) (Result, error) {
+			return Result{}, errors.New("scanner down")
+		})
+		r := strings.NewReader("content")
+		res, err := ScanAll(r)
+		So(err, ShouldBeNil)
+		So(res.Verdict, ShouldEqual, Allow)
+		res, err = ScanAll(r, verdict(Allow, ""), verdict(Quarantine, "suspect"), verdict(Allow, ""))
+		So(err, ShouldBeNil)
+		So(res, ShouldResemble, Result{Verdict: Quarantine, Reason: "suspect"})
+		res, err = ScanAll(r, verdict(Quarantine, "suspect"), verdict(Reject, "malware"), failing)
+		So(err, ShouldBeNil)
+		So(res, ShouldResemble, Result{Verdict: Reject, Reason: "malware"})
+		_, err = ScanAll(r, verdict(Allow, ""), failing)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Testing the scanner registry", t, func() {
+		Register("b", ScannerFunc(func(r io.Reader) (Result, error) { return Result{Reason: "b"}, nil }))
+		Register("a", ScannerFunc(func(r io.Reader) (Result, error) { return Result{Reason: "a"}, nil }))
+		registered := Registered()
+		So(registered, ShouldHaveLength, 2)
+		res, _ := registered[0].Scan(nil)
+		So(res.Reason, ShouldEqual, "a")
+		Unregister("a")
+		Unregister("b")
+		So(Registered(), ShouldBeEmpty)
+		So(Quarantine.String(), ShouldEqual, "quarantine")
+	})
+}
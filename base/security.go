@@ -42,11 +42,46 @@ func init() {
 
 	h.Attachment().Methods().Load().AllowGroup(security.GroupEveryone)
 	h.Attachment().Methods().AllowAllToGroup(GroupUser)
+	h.AttachmentMigration().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentMigrationError().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentStorageCheck().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentRevision().Methods().Load().AllowGroup(GroupUser)
+	h.AttachmentRevision().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentRevisionPolicy().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentShareLink().Methods().Load().AllowGroup(GroupUser)
+	h.AttachmentShareLink().Methods().Create().AllowGroup(GroupUser)
+	h.AttachmentShareLink().Methods().ActionRevoke().AllowGroup(GroupUser)
+	h.AttachmentShareLink().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentShareAccess().Methods().Load().AllowGroup(GroupUser)
+	h.AttachmentShareAccess().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentShareWizard().Methods().AllowAllToGroup(GroupUser)
 
 	h.User().Methods().Load().AllowGroup(security.GroupEveryone)
 	h.User().Methods().HasGroup().AllowGroup(security.GroupEveryone)
+	h.User().Methods().ChangePassword().AllowGroup(security.GroupEveryone)
+	h.User().Methods().PreferenceEnableTOTP().AllowGroup(security.GroupEveryone)
 	h.User().Methods().AllowAllToGroup(GroupERPManager)
 
+	h.AuthLog().Methods().Load().AllowGroup(GroupERPManager)
+
+	h.UserSession().Methods().Load().AllowGroup(security.GroupEveryone)
+	h.UserSession().Methods().ActionRevoke().AllowGroup(security.GroupEveryone)
+	h.UserSession().Methods().AllowAllToGroup(GroupERPManager)
+	h.User().Methods().ActionMySessions().AllowGroup(security.GroupEveryone)
+
+	h.UserAPIKey().Methods().Load().AllowGroup(security.GroupEveryone)
+	h.UserAPIKey().Methods().Generate().AllowGroup(security.GroupEveryone)
+	h.UserAPIKey().Methods().ActionRevoke().AllowGroup(security.GroupEveryone)
+	h.UserAPIKey().Methods().AllowAllToGroup(GroupERPManager)
+	h.User().Methods().ActionMyAPIKeys().AllowGroup(security.GroupEveryone)
+	h.User().Methods().PreferenceNewAPIKey().AllowGroup(security.GroupEveryone)
+
+	h.UserImpersonation().Methods().Load().AllowGroup(GroupERPManager)
+
+	h.LDAPServer().Methods().AllowAllToGroup(GroupSystem)
+	h.LDAPGroupMapping().Methods().AllowAllToGroup(GroupSystem)
+	h.OAuthProvider().Methods().AllowAllToGroup(GroupSystem)
+
 	h.CurrencyRate().Methods().Load().AllowGroup(security.GroupEveryone)
 	h.CurrencyRate().Methods().AllowAllToGroup(GroupSystem)
 
@@ -68,4 +103,8 @@ func init() {
 	h.Bank().Methods().AllowAllToGroup(GroupPartnerManager)
 
 	h.Company().Methods().Load().AllowGroup(security.GroupEveryone, h.User().Methods().ContextGet())
+
+	h.SequenceAudit().Methods().AllowAllToGroup(GroupSystem)
+	h.SequenceAuditReport().Methods().AllowAllToGroup(GroupSystem)
+	h.SequenceAuditReportLine().Methods().AllowAllToGroup(GroupSystem)
 }
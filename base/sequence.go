@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/hexya-erp/hexya-base/base/checkdigit"
 	"github.com/hexya-erp/hexya/hexya/models"
 	"github.com/hexya-erp/hexya/hexya/models/types"
 	"github.com/hexya-erp/hexya/hexya/models/types/dates"
@@ -33,6 +34,176 @@ var SequenceFuncs = map[string]func(time.Time) string{
 	"weekday": func(t time.Time) string {
 		return fmt.Sprintf("%d", int(t.Weekday()))
 	},
+	"quarter": func(t time.Time) string {
+		return fmt.Sprintf("%d", (int(t.Month())-1)/3+1)
+	},
+}
+
+// checkDigitPlaceholder is the placeholder of the check digits in the prefix or suffix of a sequence
+const checkDigitPlaceholder = "%(check)"
+
+// sequenceInterpolate replaces the %(key) placeholders of format with their value in data
+func sequenceInterpolate(format string, data map[string]string) string {
+	if format == "" {
+		return ""
+	}
+	res := format
+	for k, v := range data {
+		res = strings.Replace(res, fmt.Sprintf("%%(%s)", k), v, -1)
+	}
+	return res
+}
+
+// addCheckDigit returns value with the check digits computed by the algorithm
+// registered under algName. They replace the first %(check) placeholder of value
+// if any, or are appended otherwise. Other placeholders are removed, as well as
+// all of them if there is no such algorithm.
+func addCheckDigit(algName, value string) (string, error) {
+	payload := strings.Replace(value, checkDigitPlaceholder, "", -1)
+	alg, ok := checkdigit.Get(algName)
+	if !ok {
+		return payload, nil
+	}
+	check, err := alg.Compute(payload)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(value, checkDigitPlaceholder) {
+		return payload + check, nil
+	}
+	return strings.Replace(strings.Replace(value, checkDigitPlaceholder, check, 1), checkDigitPlaceholder, "", -1), nil
+}
+
+// sequencePreview returns the next count formatted values of the given sequence,
+// as documented in its Preview method, or an error if they cannot be formatted.
+func sequencePreview(rs h.SequenceSet, count int) ([]string, error) {
+	rs.EnsureOne()
+	seq := rs
+	number := rs.PeekNextNumber()
+	if rs.UseDateRange() {
+		dt := rs.SequenceDate()
+		dateFrom, dateTo := rs.NewDateRangeBounds(dt)
+		number = 1
+		if seqDate := rs.DateRangeFor(dt); !seqDate.IsEmpty() {
+			dateFrom, dateTo = seqDate.DateFrom(), seqDate.DateTo()
+			number = seqDate.PeekNextNumber()
+		}
+		seq = rs.WithContext("sequence_date_range", dateFrom).WithContext("sequence_date_range_end", dateTo)
+	}
+	increment := rs.NumberIncrement()
+	if increment == 0 {
+		increment = 1
+	}
+	res := make([]string, count)
+	for i := range res {
+		value, err := seq.FormatNumber(number + int64(i)*increment)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = value
+	}
+	return res, nil
+}
+
+// sequenceInterpolationMap returns the values of the date placeholders of
+// sequences, given the timezone and sequence dates of the context of env.
+func sequenceInterpolationMap(env models.Environment) map[string]string {
+	location, err := time.LoadLocation(env.Context().GetString("tz"))
+	if err != nil {
+		location = time.UTC
+	}
+	now := time.Now().In(location)
+	rangeDate, rangeEndDate, effectiveDate := now, now, now
+	if env.Context().HasKey("sequence_date") {
+		effectiveDate = env.Context().GetDate("sequence_date").Time
+	}
+	if env.Context().HasKey("sequence_date_range") {
+		rangeDate = env.Context().GetDate("sequence_date_range").Time
+	}
+	if env.Context().HasKey("sequence_date_range_end") {
+		rangeEndDate = env.Context().GetDate("sequence_date_range_end").Time
+	}
+
+	res := make(map[string]string)
+	for key, format := range Sequences {
+		res[key] = effectiveDate.Format(format)
+		res["range_"+key] = rangeDate.Format(format)
+		res["range_end_"+key] = rangeEndDate.Format(format)
+		res["current_"+key] = now.Format(format)
+	}
+	for key, fFunc := range SequenceFuncs {
+		res[key] = fFunc(effectiveDate)
+		res["range_"+key] = fFunc(rangeDate)
+		res["range_end_"+key] = fFunc(rangeEndDate)
+		res["current_"+key] = fFunc(now)
+	}
+	return res
+}
+
+// fiscalYearStart returns the first day of the fiscal year starting in the given
+// year on the given month and day. The day is reduced to the last day of the
+// month if the month is shorter.
+func fiscalYearStart(year, month, day int, loc *time.Location) time.Time {
+	if lastDay := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, loc).Day(); day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc)
+}
+
+// sequenceRangeBounds returns the first and last days of the period which contains
+// the given date. period is one of 'year', 'fiscal_year', 'quarter', 'month' or 'week',
+// and defaults to 'year'. Fiscal years start on fyMonth/fyDay and weeks on Monday.
+func sequenceRangeBounds(period string, date time.Time, fyMonth, fyDay int) (time.Time, time.Time) {
+	y, m, d := date.Date()
+	loc := date.Location()
+	switch period {
+	case "fiscal_year":
+		from := fiscalYearStart(y, fyMonth, fyDay, loc)
+		if from.After(date) {
+			from = fiscalYearStart(y-1, fyMonth, fyDay, loc)
+		}
+		return from, fiscalYearStart(from.Year()+1, fyMonth, fyDay, loc).AddDate(0, 0, -1)
+	case "quarter":
+		from := time.Date(y, m-(m-1)%3, 1, 0, 0, 0, 0, loc)
+		return from, from.AddDate(0, 3, -1)
+	case "month":
+		from := time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		return from, from.AddDate(0, 1, -1)
+	case "week":
+		from := time.Date(y, m, d-(int(date.Weekday())+6)%7, 0, 0, 0, 0, loc)
+		return from, from.AddDate(0, 0, 6)
+	default:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, loc), time.Date(y, 12, 31, 0, 0, 0, 0, loc)
+	}
+}
+
+// peekSequence returns the next value of the given database sequence without consuming it
+func peekSequence(env models.Environment, name string, increment int64) int64 {
+	var res struct {
+		LastValue int64
+		IsCalled  bool
+	}
+	env.Cr().Get(&res, fmt.Sprintf("SELECT last_value AS lastvalue, is_called AS iscalled FROM %s", name))
+	if !res.IsCalled {
+		return res.LastValue
+	}
+	return res.LastValue + increment
+}
+
+// nextSequenceValues draws count values of the given database sequence in a single query
+func nextSequenceValues(env models.Environment, name string, count int) []int64 {
+	var res []int64
+	env.Cr().Select(&res, fmt.Sprintf("SELECT nextval('%s') FROM generate_series(1, ?)", name), count)
+	return res
+}
+
+// consecutiveNumbers returns count numbers starting at first with the given increment
+func consecutiveNumbers(first, increment int64, count int) []int64 {
+	res := make([]int64, count)
+	for i := range res {
+		res[i] = first + int64(i)*increment
+	}
+	return res
 }
 
 func init() {
@@ -47,8 +218,10 @@ func init() {
 The latter is slower than the former but forbids any
 gap in the sequence (while they are possible in the former).`},
 		"Active": models.BooleanField{Default: models.DefaultValue(true), Required: true},
-		"Prefix": models.CharField{Help: "Prefix value of the record for the sequence"},
-		"Suffix": models.CharField{Help: "Suffix value of the record for the sequence"},
+		"Prefix": models.CharField{Help: "Prefix value of the record for the sequence",
+			OnChange: h.Sequence().Methods().OnChangePreview(), Constraint: h.Sequence().Methods().CheckCheckDigit()},
+		"Suffix": models.CharField{Help: "Suffix value of the record for the sequence",
+			OnChange: h.Sequence().Methods().OnChangePreview(), Constraint: h.Sequence().Methods().CheckCheckDigit()},
 		"NumberNext": models.IntegerField{String: "Next Number", Required: true,
 			Default: models.DefaultValue(1), Help: "Next number of this sequence"},
 		"NumberNextActual": models.IntegerField{
@@ -57,18 +230,72 @@ gap in the sequence (while they are possible in the former).`},
 			Help:    "Next number that will be used. This number can be incremented frequently so the displayed value might already be obsolete",
 			Depends: []string{"NumberNext"}},
 		"NumberIncrement": models.IntegerField{String: "Step", Required: true,
-			Default: models.DefaultValue(1), Help: "The next number of the sequence will be incremented by this number"},
+			Default: models.DefaultValue(1), OnChange: h.Sequence().Methods().OnChangePreview(),
+			Help: "The next number of the sequence will be incremented by this number"},
 		"Padding": models.IntegerField{String: "Sequence Size", Required: true,
-			Default: models.DefaultValue(0),
-			Help:    "Hexya will automatically adds some '0' on the left of the 'Next Number' to get the required padding size."},
+			Default: models.DefaultValue(0), OnChange: h.Sequence().Methods().OnChangePreview(),
+			Constraint: h.Sequence().Methods().CheckCheckDigit(), Help: "Hexya will automatically adds some '0' on the left of the 'Next Number' to get the required padding size."},
 		"Company": models.Many2OneField{RelationModel: h.Company(), Default: func(env models.Environment) interface{} {
 			return h.Company().NewSet(env).CompanyDefaultGet()
 		}},
-		"UseDateRange": models.BooleanField{String: "Use subsequences per Date Range"},
+		"UseDateRange": models.BooleanField{String: "Use subsequences per Date Range",
+			OnChange: h.Sequence().Methods().OnChangePreview()},
+		"RangePeriod": models.SelectionField{String: "Range Period", Selection: types.Selection{
+			"year": "Yearly", "fiscal_year": "Fiscal Year", "quarter": "Quarterly", "month": "Monthly", "week": "Weekly"},
+			Default: models.DefaultValue("year"), OnChange: h.Sequence().Methods().OnChangePreview(),
+			Help: "Period of the subsequences which are created automatically. Weeks start on Monday."},
+		"FiscalYearStartMonth": models.IntegerField{String: "Fiscal Year Start Month", GoType: new(int),
+			Default: models.DefaultValue(1), Constraint: h.Sequence().Methods().CheckFiscalYearStart()},
+		"FiscalYearStartDay": models.IntegerField{String: "Fiscal Year Start Day", GoType: new(int),
+			Default: models.DefaultValue(1), Constraint: h.Sequence().Methods().CheckFiscalYearStart()},
+		"CheckDigit": models.SelectionField{String: "Check Digit", Constraint: h.Sequence().Methods().CheckCheckDigit(),
+			SelectionFunc: func() types.Selection {
+				out := make(types.Selection)
+				for _, name := range checkdigit.Names() {
+					alg, _ := checkdigit.Get(name)
+					out[name] = alg.Label()
+				}
+				return out
+			}, OnChange: h.Sequence().Methods().OnChangePreview(),
+			Help: "Algorithm of the check digits added at the end of the numbers, or in place of %(check) in the prefix or suffix"},
 		"DateRanges": models.One2ManyField{RelationModel: h.SequenceDateRange(), ReverseFK: "Sequence",
 			String: "Subsequences"},
+		"NextValues": models.TextField{Compute: h.Sequence().Methods().ComputeNextValues(),
+			Depends: []string{"Prefix", "Suffix", "Padding", "NumberNext", "NumberIncrement", "UseDateRange", "RangePeriod", "CheckDigit"}},
 	})
 
+	h.Sequence().Methods().CheckFiscalYearStart().DeclareMethod(
+		`CheckFiscalYearStart checks that the start of the fiscal year is a valid month and day`,
+		func(rs h.SequenceSet) {
+			for _, seq := range rs.Records() {
+				if seq.FiscalYearStartMonth() < 1 || seq.FiscalYearStartMonth() > 12 ||
+					seq.FiscalYearStartDay() < 1 || seq.FiscalYearStartDay() > 31 {
+					log.Panic(rs.T("The start of the fiscal year must be a valid month (1-12) and day (1-31)."))
+				}
+			}
+		})
+
+	h.Sequence().Methods().CheckCheckDigit().DeclareMethod(
+		`CheckCheckDigit checks that the check digit placeholder appears at most once in
+		the prefix and suffix of this sequence, and that the check digits of its algorithm
+		can be computed on its next number.`,
+		func(rs h.SequenceSet) {
+			for _, seq := range rs.Records() {
+				if strings.Count(seq.Prefix()+seq.Suffix(), checkDigitPlaceholder) > 1 {
+					log.Panic(rs.T("The %s placeholder may only appear once in the prefix and suffix of a sequence.", checkDigitPlaceholder))
+				}
+				if seq.CheckDigit() == "" {
+					continue
+				}
+				if _, ok := checkdigit.Get(seq.CheckDigit()); !ok {
+					log.Panic(rs.T("Unknown check digit algorithm: %s", seq.CheckDigit()))
+				}
+				if _, err := seq.FormatNumber(seq.PeekNextNumber()); err != nil {
+					log.Panic(rs.T("The check digits of sequence %s cannot be computed on its numbers: %s", seq.Name(), err))
+				}
+			}
+		})
+
 	h.Sequence().Methods().ComputeNumberNextActual().DeclareMethod(
 		`ComputeNumberNextActual returns the real next number for the sequence depending on the implementation`,
 		func(rs h.SequenceSet) *h.SequenceData {
@@ -160,20 +387,28 @@ gap in the sequence (while they are possible in the former).`},
 		`NextDo returns the next sequence number formatted`,
 		func(rs h.SequenceSet) string {
 			rs.EnsureOne()
+			var number int64
 			if rs.Implementation() == "standard" {
 				hexyaSeq := models.Registry.MustGetSequence(fmt.Sprintf("sequence_%03d", rs.ID()))
-				return rs.GetNextChar(hexyaSeq.NextValue())
+				number = hexyaSeq.NextValue()
+			} else {
+				number = rs.UpdateNoGap()
 			}
-			return rs.GetNextChar(rs.UpdateNoGap())
+			res := rs.GetNextChar(number)
+			rs.AuditNumbers(h.SequenceDateRange().NewSet(rs.Env()), []int64{number}, []string{res})
+			return res
 		})
 
 	h.Sequence().Methods().UpdateNoGap().DeclareMethod(
 		`UpdateNoGap gets the next number of a "No Gap" sequence`,
 		func(rs h.SequenceSet) int64 {
 			rs.EnsureOne()
-			numberNext := rs.NumberNext()
-			rs.Env().Cr().Execute(`SELECT number_next FROM sequence WHERE id=? FOR UPDATE NOWAIT`, rs.ID())
-			rs.Env().Cr().Execute(`UPDATE sequence SET number_next=number_next + ? WHERE id=?`, rs.NumberIncrement(), rs.ID())
+			// FOR NO KEY UPDATE does not block the foreign key checks of the
+			// transactions referencing this sequence, such as AuditNumbers.
+			rs.Env().Cr().Execute(`SELECT number_next FROM sequence WHERE id=? FOR NO KEY UPDATE NOWAIT`, rs.ID())
+			var numberNext int64
+			rs.Env().Cr().Get(&numberNext, `UPDATE sequence SET number_next=number_next + ? WHERE id=? RETURNING number_next - ?`,
+				rs.NumberIncrement(), rs.ID(), rs.NumberIncrement())
 			rs.InvalidateCache()
 			return numberNext
 		})
@@ -181,58 +416,82 @@ gap in the sequence (while they are possible in the former).`},
 	h.Sequence().Methods().GetNextChar().DeclareMethod(
 		`GetNextChar returns the given number formatted as per the sequence data`,
 		func(rs h.SequenceSet, numberNext int64) string {
-			interpolate := func(format string, data map[string]string) string {
-				if format == "" {
-					return ""
-				}
-				res := format
-				for k, v := range data {
-					res = strings.Replace(res, fmt.Sprintf("%%(%s)", k), v, -1)
-				}
-				return res
+			res, err := rs.FormatNumber(numberNext)
+			if err != nil {
+				log.Panic(rs.T("Unable to compute the check digit of number %d of sequence %s: %s", numberNext, rs.Name(), err))
 			}
-			interpolateMap := func() map[string]string {
-				location, err := time.LoadLocation(rs.Env().Context().GetString("tz"))
-				if err != nil {
-					location = time.UTC
-				}
-				now := time.Now().In(location)
-				rangeDate, effectiveDate := now, now
-				if rs.Env().Context().HasKey("sequence_date") {
-					effectiveDate = rs.Env().Context().GetDate("sequence_date").Time
-				}
-				if rs.Env().Context().HasKey("sequence_date_range") {
-					rangeDate = rs.Env().Context().GetDate("sequence_date_range").Time
-				}
+			return res
+		})
 
-				res := make(map[string]string)
-				for key, format := range Sequences {
-					res[key] = effectiveDate.Format(format)
-					res["range_"+key] = rangeDate.Format(format)
-					res["current_"+key] = now.Format(format)
-				}
-				for key, fFunc := range SequenceFuncs {
-					res[key] = fFunc(effectiveDate)
-					res["range_"+key] = fFunc(rangeDate)
-					res["current_"+key] = fFunc(now)
-				}
-				return res
+	h.Sequence().Methods().FormatNumber().DeclareMethod(
+		`FormatNumber returns the given number formatted as per the sequence data, or an
+		error if the check digits of this sequence cannot be computed on it.`,
+		func(rs h.SequenceSet, numberNext int64) (string, error) {
+			d := sequenceInterpolationMap(rs.Env())
+			interpolatedPrefix := sequenceInterpolate(rs.Prefix(), d)
+			interpolatedSuffix := sequenceInterpolate(rs.Suffix(), d)
+			return addCheckDigit(rs.CheckDigit(), interpolatedPrefix+
+				fmt.Sprintf(fmt.Sprintf("%%0%dd", rs.Padding()), numberNext)+
+				interpolatedSuffix)
+		})
+
+	h.Sequence().Methods().AddCheckDigit().DeclareMethod(
+		`AddCheckDigit returns the given formatted number with the check digits of this
+		sequence's algorithm, computed on the rest of the number. Check digits replace
+		the %(check) placeholder if any, or are appended otherwise.`,
+		func(rs h.SequenceSet, value string) string {
+			res, err := addCheckDigit(rs.CheckDigit(), value)
+			if err != nil {
+				log.Panic(rs.T("Unable to compute the check digit of %s: %s", strings.Replace(value, checkDigitPlaceholder, "", -1), err))
 			}
-			d := interpolateMap()
-			interpolatedPrefix := interpolate(rs.Prefix(), d)
-			interpolatedSuffix := interpolate(rs.Suffix(), d)
-			return interpolatedPrefix +
-				fmt.Sprintf(fmt.Sprintf("%%0%dd", rs.Padding()), numberNext) +
-				interpolatedSuffix
+			return res
 		})
 
-	h.Sequence().Methods().CreateDateRangeSeq().DeclareMethod(
-		`CreateDateRangeSeq creates the date range for the given date`,
-		func(rs h.SequenceSet, date dates.Date) h.SequenceDateRangeSet {
+	h.Sequence().Methods().ValidateNumber().DeclareMethod(
+		`ValidateNumber returns true if the check digits of the given number drawn from
+		this sequence are valid, or if this sequence has no check digit.
+
+		If the check digits are not at the end of the number, date placeholders
+		between them and the end of the suffix (or between the start of the prefix
+		and them) are evaluated with the current context, so that the 'sequence_date'
+		context key may have to be set to the date of the number.`,
+		func(rs h.SequenceSet, value string) bool {
+			rs.EnsureOne()
+			alg, ok := checkdigit.Get(rs.CheckDigit())
+			if !ok {
+				return true
+			}
+			d := sequenceInterpolationMap(rs.Env())
+			pos := len(value) - alg.Size()
+			if idx := strings.Index(rs.Prefix(), checkDigitPlaceholder); idx >= 0 {
+				pos = len(sequenceInterpolate(rs.Prefix()[:idx], d))
+			} else if idx := strings.Index(rs.Suffix(), checkDigitPlaceholder); idx >= 0 {
+				tail := strings.Replace(rs.Suffix()[idx+len(checkDigitPlaceholder):], checkDigitPlaceholder, "", -1)
+				pos -= len(sequenceInterpolate(tail, d))
+			}
+			if pos < 0 || pos+alg.Size() > len(value) {
+				return false
+			}
+			check, err := alg.Compute(value[:pos] + value[pos+alg.Size():])
+			return err == nil && check == value[pos:pos+alg.Size()]
+		})
+
+	h.Sequence().Methods().RangeBounds().DeclareMethod(
+		`RangeBounds returns the first and last days of the period of this sequence's
+		subsequences which contains the given date.`,
+		func(rs h.SequenceSet, date dates.Date) (dates.Date, dates.Date) {
 			rs.EnsureOne()
-			year := date.Year()
-			dateFrom := dates.ParseDate(fmt.Sprintf("%d-01-01", year))
-			dateTo := dates.ParseDate(fmt.Sprintf("%d-12-31", year))
+			from, to := sequenceRangeBounds(rs.RangePeriod(), date.Time, rs.FiscalYearStartMonth(), rs.FiscalYearStartDay())
+			return dates.Date{Time: from}, dates.Date{Time: to}
+		})
+
+	h.Sequence().Methods().NewDateRangeBounds().DeclareMethod(
+		`NewDateRangeBounds returns the first and last days of the date range which would
+		be created for the given date, according to the range period of this sequence.
+		The range is shortened so as not to overlap the existing ones.`,
+		func(rs h.SequenceSet, date dates.Date) (dates.Date, dates.Date) {
+			rs.EnsureOne()
+			dateFrom, dateTo := rs.RangeBounds(date)
 			dateRange := h.SequenceDateRange().Search(rs.Env(),
 				q.SequenceDateRange().Sequence().Equals(rs).
 					And().DateFrom().GreaterOrEqual(date).
@@ -249,8 +508,18 @@ gap in the sequence (while they are possible in the former).`},
 				OrderBy("DateTo DESC").
 				Limit(1)
 			if !dateRange.IsEmpty() {
-				dateTo = dateRange.DateTo().AddDate(0, 0, 1)
+				dateFrom = dateRange.DateTo().AddDate(0, 0, 1)
 			}
+			return dateFrom, dateTo
+		})
+
+	h.Sequence().Methods().CreateDateRangeSeq().DeclareMethod(
+		`CreateDateRangeSeq creates the date range for the given date, according to the
+		range period of this sequence. The range is shortened so as not to overlap the
+		existing ones.`,
+		func(rs h.SequenceSet, date dates.Date) h.SequenceDateRangeSet {
+			rs.EnsureOne()
+			dateFrom, dateTo := rs.NewDateRangeBounds(date)
 			seqDateRange := h.SequenceDateRange().Create(rs.Env(), &h.SequenceDateRangeData{
 				DateFrom: dateFrom,
 				DateTo:   dateTo,
@@ -259,6 +528,27 @@ gap in the sequence (while they are possible in the former).`},
 			return seqDateRange
 		})
 
+	h.Sequence().Methods().SequenceDate().DeclareMethod(
+		`SequenceDate returns the date for which numbers are drawn, that is the
+		'sequence_date' context key if set, or today.`,
+		func(rs h.SequenceSet) dates.Date {
+			if rs.Env().Context().HasKey("sequence_date") {
+				return rs.Env().Context().GetDate("sequence_date")
+			}
+			return dates.Today()
+		})
+
+	h.Sequence().Methods().DateRangeFor().DeclareMethod(
+		`DateRangeFor returns the existing subsequence of this sequence which contains
+		the given date, if any.`,
+		func(rs h.SequenceSet, date dates.Date) h.SequenceDateRangeSet {
+			return h.SequenceDateRange().Search(rs.Env(),
+				q.SequenceDateRange().Sequence().Equals(rs).
+					And().DateFrom().LowerOrEqual(date).
+					And().DateTo().GreaterOrEqual(date)).
+				Limit(1)
+		})
+
 	h.Sequence().Methods().Next().DeclareMethod(
 		`Next returns the next number (formatted) in the preferred sequence in all the ones given in self`,
 		func(rs h.SequenceSet) string {
@@ -267,19 +557,64 @@ gap in the sequence (while they are possible in the former).`},
 				return rs.NextDo()
 			}
 			// Date mode
-			dt := dates.Today()
-			if rs.Env().Context().HasKey("sequence_date") {
-				dt = rs.Env().Context().GetDate("sequence_date")
-			}
-			seqDate := h.SequenceDateRange().Search(rs.Env(),
-				q.SequenceDateRange().Sequence().Equals(rs).
-					And().DateFrom().LowerOrEqual(dt).
-					And().DateTo().GreaterOrEqual(dt)).
-				Limit(1)
+			dt := rs.SequenceDate()
+			seqDate := rs.DateRangeFor(dt)
 			if seqDate.IsEmpty() {
 				seqDate = rs.CreateDateRangeSeq(dt)
 			}
-			return seqDate.WithContext("sequence_date_range", seqDate.DateFrom()).Next()
+			return seqDate.
+				WithContext("sequence_date_range", seqDate.DateFrom()).
+				WithContext("sequence_date_range_end", seqDate.DateTo()).
+				Next()
+		})
+
+	h.Sequence().Methods().PeekNextNumber().DeclareMethod(
+		`PeekNextNumber returns the number that NextDo would return next, without consuming it.`,
+		func(rs h.SequenceSet) int64 {
+			rs.EnsureOne()
+			if rs.Implementation() == "standard" && rs.ID() != 0 {
+				if hexyaSeq, exists := models.Registry.GetSequence(fmt.Sprintf("sequence_%03d", rs.ID())); exists {
+					return peekSequence(rs.Env(), hexyaSeq.JSON, rs.NumberIncrement())
+				}
+			}
+			return rs.NumberNext()
+		})
+
+	h.Sequence().Methods().Preview().DeclareMethod(
+		`Preview returns the next count formatted values of this sequence for the
+		'sequence_date' context key, or today, without consuming them.
+
+		If the subsequence of this date does not exist yet, the values it would
+		give once created are returned.
+
+		It panics if the check digits of this sequence cannot be computed on these values.`,
+		func(rs h.SequenceSet, count int) []string {
+			res, err := sequencePreview(rs, count)
+			if err != nil {
+				log.Panic(rs.T("Unable to compute the check digits of sequence %s: %s", rs.Name(), err))
+			}
+			return res
+		})
+
+	h.Sequence().Methods().ComputeNextValues().DeclareMethod(
+		`ComputeNextValues computes a preview of the next values of this sequence, or
+		the reason why they cannot be formatted.`,
+		func(rs h.SequenceSet) *h.SequenceData {
+			values, err := sequencePreview(rs, 3)
+			if err != nil {
+				return &h.SequenceData{
+					NextValues: rs.T("Invalid format: %s", err),
+				}
+			}
+			return &h.SequenceData{
+				NextValues: strings.Join(values, "\n"),
+			}
+		})
+
+	h.Sequence().Methods().OnChangePreview().DeclareMethod(
+		`OnChangePreview updates the preview of the next values when the format of this sequence changes`,
+		func(rs h.SequenceSet) (*h.SequenceData, []models.FieldNamer) {
+			return rs.ComputeNextValues(), []models.FieldNamer{h.Sequence().NextValues()}
 		})
 
 	h.Sequence().Methods().NextByID().DeclareMethod(
@@ -289,22 +624,22 @@ gap in the sequence (while they are possible in the former).`},
 			return rs.Next()
 		})
 
-	h.Sequence().Methods().NextByCode().DeclareMethod(
-		`NextByCode draws an interpolated string using a sequence with the requested code.
-		If several sequences with the correct code are available to the user
-		(multi-company cases), the one from the user's current company will be used.
+	h.Sequence().Methods().ByCode().DeclareMethod(
+		`ByCode returns the sequence with the requested code. If several sequences
+		with the correct code are available to the user (multi-company cases), the one
+		from the user's current company is returned.
 
 		The context may contain a 'force_company' key with the ID of the company to
-		use instead of the user's current company for the sequence selection. 
+		use instead of the user's current company for the sequence selection.
 		A matching sequence for that specific company will get higher priority`,
-		func(rs h.SequenceSet, sequenceCode string) string {
-			rs.CheckExecutionPermission(h.Sequence().Methods().Read().Underlying())
+		func(rs h.SequenceSet, sequenceCode string) h.SequenceSet {
 			companies := h.Company().NewSet(rs.Env()).SearchAll()
 			seqs := h.Sequence().Search(rs.Env(),
 				q.Sequence().Code().Equals(sequenceCode).AndCond(
 					q.Sequence().Company().In(companies).Or().Company().IsNull()))
 			if seqs.IsEmpty() {
 				log.Debug("No Sequence has been found for this code", "code", sequenceCode, "companies", companies)
+				return seqs
 			}
 			forceCompanyID := rs.Env().Context().GetInteger("force_company")
 			if forceCompanyID == 0 {
@@ -312,10 +647,79 @@ gap in the sequence (while they are possible in the former).`},
 			}
 			for _, seq := range seqs.Records() {
 				if seq.Company().ID() == forceCompanyID {
-					return seq.Next()
+					return seq
 				}
 			}
-			return seqs.Records()[0].Next()
+			return seqs.Records()[0]
+		})
+
+	h.Sequence().Methods().NextByCode().DeclareMethod(
+		`NextByCode draws an interpolated string using a sequence with the requested code.
+		If several sequences with the correct code are available to the user
+		(multi-company cases), the one from the user's current company will be used.
+
+		The context may contain a 'force_company' key with the ID of the company to
+		use instead of the user's current company for the sequence selection. 
+		A matching sequence for that specific company will get higher priority`,
+		func(rs h.SequenceSet, sequenceCode string) string {
+			rs.CheckExecutionPermission(h.Sequence().Methods().Read().Underlying())
+			return rs.ByCode(sequenceCode).Next()
+		})
+
+	h.Sequence().Methods().NextNumbers().DeclareMethod(
+		`NextNumbers reserves the count next numbers of this sequence, ignoring date
+		ranges, in a single query.
+
+		Numbers of 'no_gap' sequences are consecutive. Those of 'standard' sequences
+		are consecutive unless other transactions draw numbers at the same time.`,
+		func(rs h.SequenceSet, count int) []int64 {
+			rs.EnsureOne()
+			if rs.Implementation() == "standard" {
+				hexyaSeq := models.Registry.MustGetSequence(fmt.Sprintf("sequence_%03d", rs.ID()))
+				return nextSequenceValues(rs.Env(), hexyaSeq.JSON, count)
+			}
+			var numberNext int64
+			rs.Env().Cr().Get(&numberNext, `UPDATE sequence SET number_next=number_next + ? WHERE id=? RETURNING number_next`,
+				int64(count)*rs.NumberIncrement(), rs.ID())
+			rs.InvalidateCache()
+			return consecutiveNumbers(numberNext-int64(count)*rs.NumberIncrement(), rs.NumberIncrement(), count)
+		})
+
+	h.Sequence().Methods().NextBatch().DeclareMethod(
+		`NextBatch returns the count next numbers (formatted) of this sequence. Numbers are
+		reserved in a single query, so that it is much faster than calling Next count times.`,
+		func(rs h.SequenceSet, count int) []string {
+			rs.EnsureOne()
+			if count <= 0 {
+				return nil
+			}
+			if !rs.UseDateRange() {
+				numbers := rs.NextNumbers(count)
+				res := make([]string, len(numbers))
+				for i, number := range numbers {
+					res[i] = rs.GetNextChar(number)
+				}
+				rs.AuditNumbers(h.SequenceDateRange().NewSet(rs.Env()), numbers, res)
+				return res
+			}
+			// Date mode
+			dt := rs.SequenceDate()
+			seqDate := rs.DateRangeFor(dt)
+			if seqDate.IsEmpty() {
+				seqDate = rs.CreateDateRangeSeq(dt)
+			}
+			return seqDate.
+				WithContext("sequence_date_range", seqDate.DateFrom()).
+				WithContext("sequence_date_range_end", seqDate.DateTo()).
+				NextBatch(count)
+		})
+
+	h.Sequence().Methods().NextBatchByCode().DeclareMethod(
+		`NextBatchByCode returns the count next numbers (formatted) of the sequence with the
+		requested code, which is selected as in NextByCode.`,
+		func(rs h.SequenceSet, sequenceCode string, count int) []string {
+			rs.CheckExecutionPermission(h.Sequence().Methods().Read().Underlying())
+			return rs.ByCode(sequenceCode).NextBatch(count)
 		})
 
 	h.SequenceDateRange().DeclareModel()
@@ -353,11 +757,57 @@ gap in the sequence (while they are possible in the former).`},
 	h.SequenceDateRange().Methods().Next().DeclareMethod(
 		`Next returns the next number (formatted) of this sequence date range.`,
 		func(rs h.SequenceDateRangeSet) string {
+			var number int64
+			if rs.Sequence().Implementation() == "standard" {
+				hexyaSeq := models.Registry.MustGetSequence(fmt.Sprintf("sequence_%03d_%03d", rs.Sequence().ID(), rs.ID()))
+				number = hexyaSeq.NextValue()
+			} else {
+				number = rs.UpdateNoGap()
+			}
+			res := rs.Sequence().GetNextChar(number)
+			rs.Sequence().AuditNumbers(rs, []int64{number}, []string{res})
+			return res
+		})
+
+	h.SequenceDateRange().Methods().NextBatch().DeclareMethod(
+		`NextBatch returns the count next numbers (formatted) of this sequence date range,
+		reserved in a single query.`,
+		func(rs h.SequenceDateRangeSet, count int) []string {
+			rs.EnsureOne()
+			if count <= 0 {
+				return nil
+			}
+			var numbers []int64
+			increment := rs.Sequence().NumberIncrement()
 			if rs.Sequence().Implementation() == "standard" {
 				hexyaSeq := models.Registry.MustGetSequence(fmt.Sprintf("sequence_%03d_%03d", rs.Sequence().ID(), rs.ID()))
-				return rs.Sequence().GetNextChar(hexyaSeq.NextValue())
+				numbers = nextSequenceValues(rs.Env(), hexyaSeq.JSON, count)
+			} else {
+				var numberNext int64
+				rs.Env().Cr().Get(&numberNext, `UPDATE sequence_date_range SET number_next=number_next + ? WHERE id=? RETURNING number_next`,
+					int64(count)*increment, rs.ID())
+				rs.InvalidateCache()
+				numbers = consecutiveNumbers(numberNext-int64(count)*increment, increment, count)
+			}
+			res := make([]string, len(numbers))
+			for i, number := range numbers {
+				res[i] = rs.Sequence().GetNextChar(number)
+			}
+			rs.Sequence().AuditNumbers(rs, numbers, res)
+			return res
+		})
+
+	h.SequenceDateRange().Methods().PeekNextNumber().DeclareMethod(
+		`PeekNextNumber returns the number that Next would use next, without consuming it.`,
+		func(rs h.SequenceDateRangeSet) int64 {
+			rs.EnsureOne()
+			if rs.Sequence().Implementation() == "standard" {
+				hexyaSeq, exists := models.Registry.GetSequence(fmt.Sprintf("sequence_%03d_%03d", rs.Sequence().ID(), rs.ID()))
+				if exists {
+					return peekSequence(rs.Env(), hexyaSeq.JSON, rs.Sequence().NumberIncrement())
+				}
 			}
-			return rs.Sequence().GetNextChar(rs.UpdateNoGap())
+			return rs.NumberNext()
 		})
 
 	h.SequenceDateRange().Methods().Create().Extend("",
@@ -406,9 +856,13 @@ gap in the sequence (while they are possible in the former).`},
 		`UpdateNoGap gets the next number of a "No Gap" sequence`,
 		func(rs h.SequenceDateRangeSet) int64 {
 			rs.EnsureOne()
-			numberNext := rs.NumberNext()
-			rs.Env().Cr().Execute(`SELECT number_next FROM sequence_date_range WHERE id=? FOR UPDATE NOWAIT`, rs.ID())
-			rs.Env().Cr().Execute(`UPDATE sequence_date_range SET number_next=number_next + ? WHERE id=?`, rs.Sequence().NumberIncrement(), rs.ID())
+			// FOR NO KEY UPDATE does not block the foreign key checks of the
+			// transactions referencing this date range, such as AuditNumbers.
+			rs.Env().Cr().Execute(`SELECT number_next FROM sequence_date_range WHERE id=? FOR NO KEY UPDATE NOWAIT`, rs.ID())
+			increment := rs.Sequence().NumberIncrement()
+			var numberNext int64
+			rs.Env().Cr().Get(&numberNext, `UPDATE sequence_date_range SET number_next=number_next + ? WHERE id=? RETURNING number_next - ?`,
+				increment, rs.ID(), increment)
 			rs.InvalidateCache()
 			return numberNext
 		})
@@ -0,0 +1,296 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"sort"
+
+	"github.com/hexya-erp/hexya/hexya/actions"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// Kinds of the issues found by the audit of sequences
+const (
+	// SequenceAuditGap is a range of numbers which have never been drawn
+	SequenceAuditGap = "gap"
+	// SequenceAuditRolledBack is a range of numbers which have been drawn
+	// by transactions which have been rolled back
+	SequenceAuditRolledBack = "rolled_back"
+	// SequenceAuditDuplicate is a number which has been drawn several times
+	SequenceAuditDuplicate = "duplicate"
+)
+
+// A SequenceAuditIssue is a gap or a duplicate in the numbers drawn from a sequence
+type SequenceAuditIssue struct {
+	// Sequence is the ID of the audited sequence
+	Sequence int64
+	// DateRange is the ID of the subsequence, or 0 if the sequence does not use date ranges
+	DateRange int64
+	// Kind is one of SequenceAuditGap, SequenceAuditRolledBack or SequenceAuditDuplicate
+	Kind string
+	// From and To are the first and last numbers of the issue
+	From, To int64
+	// Count is the number of missing numbers, or the number of times a duplicate was drawn
+	Count int
+}
+
+// An auditedNumber is a number drawn from a sequence, as logged in the audit
+type auditedNumber struct {
+	Number    int64
+	Committed bool
+}
+
+// auditIssues returns the gaps and duplicates of the given numbers drawn from a
+// sequence incremented by the given step. Missing numbers which have only been
+// drawn by rolled back transactions are reported as SequenceAuditRolledBack.
+// Sequence and DateRange are not set in the returned issues.
+func auditIssues(numbers []auditedNumber, increment int64) []SequenceAuditIssue {
+	step := increment
+	if step < 0 {
+		step = -step
+	}
+	if step == 0 {
+		step = 1
+	}
+	counts := make(map[int64]int)
+	var committed, rolledBack []int64
+	for _, n := range numbers {
+		if n.Committed {
+			if counts[n.Number] == 0 {
+				committed = append(committed, n.Number)
+			}
+			counts[n.Number]++
+		}
+	}
+	for _, n := range numbers {
+		if !n.Committed && counts[n.Number] == 0 {
+			rolledBack = append(rolledBack, n.Number)
+			counts[n.Number] = -1
+		}
+	}
+	sort.Slice(committed, func(i, j int) bool { return committed[i] < committed[j] })
+	sort.Slice(rolledBack, func(i, j int) bool { return rolledBack[i] < rolledBack[j] })
+
+	var res []SequenceAuditIssue
+	addMissing := func(kind string, from, to int64) {
+		count := int((to-from)/step) + 1
+		if last := len(res) - 1; last >= 0 && res[last].Kind == kind && res[last].To+step == from {
+			res[last].To = to
+			res[last].Count += count
+			return
+		}
+		res = append(res, SequenceAuditIssue{Kind: kind, From: from, To: to, Count: count})
+	}
+	for i, number := range committed {
+		if counts[number] > 1 {
+			res = append(res, SequenceAuditIssue{Kind: SequenceAuditDuplicate, From: number, To: number, Count: counts[number]})
+		}
+		if i == len(committed)-1 {
+			break
+		}
+		from, to := number+step, committed[i+1]-step
+		next := from
+		for j := sort.Search(len(rolledBack), func(k int) bool { return rolledBack[k] >= from }); j < len(rolledBack) && rolledBack[j] <= to; j++ {
+			rb := rolledBack[j]
+			if (rb-from)%step != 0 {
+				continue
+			}
+			if rb > next {
+				addMissing(SequenceAuditGap, next, rb-step)
+			}
+			addMissing(SequenceAuditRolledBack, rb, rb)
+			next = rb + step
+		}
+		if next <= to {
+			addMissing(SequenceAuditGap, next, to)
+		}
+	}
+	return res
+}
+
+func init() {
+	h.Sequence().AddFields(map[string]models.FieldDefinition{
+		"Audit": models.BooleanField{String: "Audit Numbers",
+			Help: "Log every number drawn from this sequence, so that gaps and duplicates can be reported"},
+	})
+
+	h.Sequence().Methods().AuditNumbers().DeclareMethod(
+		`AuditNumbers logs the given numbers and values drawn from this sequence, or from
+		the given date range of this sequence, if it is audited.
+
+		Entries are created in a separate transaction and only marked as committed in the
+		current one, so that numbers drawn by transactions which are rolled back remain
+		in the log. If the sequence or date range has been created in the current
+		transaction, entries are created in the current one and are not marked as
+		committed, since they would not outlive a rollback.
+
+		The model and ID of the consuming record can be given with the 'sequence_res_model'
+		and 'sequence_res_id' context keys, or set afterwards with LinkAudit.`,
+		func(rs h.SequenceSet, dateRange h.SequenceDateRangeSet, numbers []int64, values []string) {
+			rs.EnsureOne()
+			if !rs.Audit() || len(numbers) == 0 {
+				return
+			}
+			entries := make([]*h.SequenceAuditData, len(numbers))
+			for i, number := range numbers {
+				entries[i] = &h.SequenceAuditData{
+					Sequence:  rs,
+					DateRange: dateRange,
+					Number:    number,
+					Value:     values[i],
+					ResModel:  rs.Env().Context().GetString("sequence_res_model"),
+					ResID:     rs.Env().Context().GetInteger("sequence_res_id"),
+				}
+			}
+			var ids []int64
+			err := models.ExecuteInNewEnvironment(rs.Env().Uid(), func(env models.Environment) {
+				for _, entry := range entries {
+					data := *entry
+					data.Sequence = h.Sequence().Browse(env, []int64{rs.ID()})
+					data.DateRange = h.SequenceDateRange().Browse(env, dateRange.Ids())
+					ids = append(ids, h.SequenceAudit().NewSet(env).Sudo().Create(&data).ID())
+				}
+			})
+			if err != nil {
+				log.Warn("Unable to log sequence numbers in a separate transaction", "sequence", rs.ID(), "error", err)
+				for _, entry := range entries {
+					h.SequenceAudit().NewSet(rs.Env()).Sudo().Create(entry)
+				}
+				return
+			}
+			rs.Env().Cr().Execute(`UPDATE sequence_audit SET committed = TRUE WHERE id IN (?)`, ids)
+		})
+
+	h.Sequence().Methods().LinkAudit().DeclareMethod(
+		`LinkAudit sets the given record as the consumer of the given value drawn from this sequence`,
+		func(rs h.SequenceSet, value, resModel string, resID int64) {
+			rs.EnsureOne()
+			rs.Env().Cr().Execute(`UPDATE sequence_audit SET res_model = ?, res_id = ?
+				WHERE sequence_id = ? AND value = ? AND committed`, resModel, resID, rs.ID(), value)
+		})
+
+	h.Sequence().Methods().AuditIssues().DeclareMethod(
+		`AuditIssues returns the gaps and duplicates in the numbers drawn from these
+		sequences, or from all the audited sequences if this set is empty, per sequence
+		and date range. Only the numbers drawn while the sequence was audited are checked.`,
+		func(rs h.SequenceSet) []SequenceAuditIssue {
+			seqs := rs
+			if seqs.IsEmpty() {
+				seqs = h.Sequence().NewSet(rs.Env()).Sudo().Search(q.Sequence().Audit().Equals(true))
+			}
+			if seqs.IsEmpty() {
+				return nil
+			}
+			var rows []struct {
+				Sequence  int64 `db:"sequence_id"`
+				DateRange int64 `db:"date_range_id"`
+				Number    int64
+				Committed bool
+			}
+			rs.Env().Cr().Select(&rows, `SELECT sequence_id, COALESCE(date_range_id, 0) AS date_range_id, number, committed
+				FROM sequence_audit WHERE sequence_id IN (?) ORDER BY sequence_id, date_range_id, number`, seqs.Ids())
+			increments := make(map[int64]int64)
+			for _, seq := range seqs.Sudo().Records() {
+				increments[seq.ID()] = seq.NumberIncrement()
+			}
+			var res []SequenceAuditIssue
+			for start := 0; start < len(rows); {
+				end := start
+				var numbers []auditedNumber
+				for ; end < len(rows) && rows[end].Sequence == rows[start].Sequence && rows[end].DateRange == rows[start].DateRange; end++ {
+					numbers = append(numbers, auditedNumber{Number: rows[end].Number, Committed: rows[end].Committed})
+				}
+				for _, issue := range auditIssues(numbers, increments[rows[start].Sequence]) {
+					issue.Sequence = rows[start].Sequence
+					issue.DateRange = rows[start].DateRange
+					res = append(res, issue)
+				}
+				start = end
+			}
+			return res
+		})
+
+	auditModel := h.SequenceAudit().DeclareModel()
+	auditModel.SetDefaultOrder("id desc")
+	auditModel.AddFields(map[string]models.FieldDefinition{
+		"Sequence": models.Many2OneField{RelationModel: h.Sequence(), Required: true, Index: true,
+			OnDelete: models.Cascade},
+		"DateRange": models.Many2OneField{String: "Subsequence", RelationModel: h.SequenceDateRange(),
+			Index: true, OnDelete: models.SetNull},
+		"Number":   models.IntegerField{Required: true, Index: true, Help: "Number drawn from the sequence"},
+		"Value":    models.CharField{Index: true, Help: "Formatted value drawn from the sequence"},
+		"ResModel": models.CharField{String: "Consuming Model", Index: true},
+		"ResID":    models.IntegerField{String: "Consuming Record"},
+		"Committed": models.BooleanField{Index: true,
+			Help: "False if the transaction which drew this number has been rolled back"},
+	})
+
+	reportModel := h.SequenceAuditReport().DeclareTransientModel()
+	reportModel.AddFields(map[string]models.FieldDefinition{
+		"Sequences": models.Many2ManyField{RelationModel: h.Sequence(), JSON: "sequence_ids",
+			M2MLinkModelName: "SequenceAuditReportSequence",
+			Help:             "Sequences to audit. If empty, all audited sequences are checked."},
+		"State": models.SelectionField{Selection: types.Selection{
+			"draft":   "Draft",
+			"checked": "Checked",
+		}, Default: models.DefaultValue("draft")},
+		"Lines": models.One2ManyField{RelationModel: h.SequenceAuditReportLine(), ReverseFK: "Report",
+			JSON: "line_ids", ReadOnly: true},
+	})
+
+	reportModel.Methods().Reload().DeclareMethod(
+		`Reload returns the action to display this report again`,
+		func(rs h.SequenceAuditReportSet) *actions.Action {
+			return &actions.Action{
+				Name:     rs.T("Sequence Audit"),
+				Type:     actions.ActionActWindow,
+				Model:    "SequenceAuditReport",
+				ViewMode: "form",
+				ResID:    rs.ID(),
+				Target:   "new",
+			}
+		})
+
+	reportModel.Methods().ActionCheck().DeclareMethod(
+		`ActionCheck audits the sequences and displays the gaps and duplicates found`,
+		func(rs h.SequenceAuditReportSet) *actions.Action {
+			rs.EnsureOne()
+			rs.Lines().Unlink()
+			for _, issue := range rs.Sequences().AuditIssues() {
+				dateRange := h.SequenceDateRange().NewSet(rs.Env())
+				if issue.DateRange != 0 {
+					dateRange = h.SequenceDateRange().Browse(rs.Env(), []int64{issue.DateRange})
+				}
+				h.SequenceAuditReportLine().Create(rs.Env(), &h.SequenceAuditReportLineData{
+					Report:     rs,
+					Sequence:   h.Sequence().Browse(rs.Env(), []int64{issue.Sequence}),
+					DateRange:  dateRange,
+					Kind:       issue.Kind,
+					NumberFrom: issue.From,
+					NumberTo:   issue.To,
+					Count:      issue.Count,
+				})
+			}
+			rs.SetState("checked")
+			return rs.Reload()
+		})
+
+	reportLineModel := h.SequenceAuditReportLine().DeclareTransientModel()
+	reportLineModel.AddFields(map[string]models.FieldDefinition{
+		"Report":    models.Many2OneField{RelationModel: h.SequenceAuditReport(), OnDelete: models.Cascade},
+		"Sequence":  models.Many2OneField{RelationModel: h.Sequence()},
+		"DateRange": models.Many2OneField{String: "Subsequence", RelationModel: h.SequenceDateRange()},
+		"Kind": models.SelectionField{Selection: types.Selection{
+			SequenceAuditGap:        "Gap",
+			SequenceAuditRolledBack: "Rolled Back",
+			SequenceAuditDuplicate:  "Duplicate",
+		}, Help: "Gaps are numbers which have never been drawn. Rolled back numbers have been drawn by transactions which were cancelled."},
+		"NumberFrom": models.IntegerField{String: "From"},
+		"NumberTo":   models.IntegerField{String: "To"},
+		"Count":      models.IntegerField{GoType: new(int)},
+	})
+}
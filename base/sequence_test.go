@@ -6,6 +6,7 @@ package base
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/hexya-erp/hexya/hexya/models"
 	"github.com/hexya-erp/hexya/hexya/models/security"
@@ -320,3 +321,411 @@ func TestSequenceDateRangeChangeImplementation(t *testing.T) {
 		}), ShouldBeNil)
 	})
 }
+
+func TestSequenceDateRangePeriods(t *testing.T) {
+	Convey("Testing the periods of date range subsequences", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			date := func(s string) dates.Date {
+				return dates.ParseDate(s)
+			}
+			Convey("Monthly subsequences", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:         "Test monthly sequence",
+					Prefix:       "%(range_year)-%(range_month)/",
+					UseDateRange: true,
+					RangePeriod:  "month",
+				})
+				So(seq.WithContext("sequence_date", date("2017-02-10")).Next(), ShouldEqual, "2017-02/1")
+				So(seq.WithContext("sequence_date", date("2017-02-28")).Next(), ShouldEqual, "2017-02/2")
+				So(seq.WithContext("sequence_date", date("2017-03-01")).Next(), ShouldEqual, "2017-03/1")
+				So(seq.DateRanges().Len(), ShouldEqual, 2)
+				february := seq.DateRanges().Records()[0]
+				if !february.DateFrom().Equal(date("2017-02-01")) {
+					february = seq.DateRanges().Records()[1]
+				}
+				So(february.DateFrom().Equal(date("2017-02-01")), ShouldBeTrue)
+				So(february.DateTo().Equal(date("2017-02-28")), ShouldBeTrue)
+			})
+			Convey("Quarterly subsequences", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:         "Test quarterly sequence",
+					Prefix:       "%(range_year)Q%(range_quarter)/",
+					UseDateRange: true,
+					RangePeriod:  "quarter",
+				})
+				So(seq.WithContext("sequence_date", date("2017-05-10")).Next(), ShouldEqual, "2017Q2/1")
+				So(seq.WithContext("sequence_date", date("2017-06-30")).Next(), ShouldEqual, "2017Q2/2")
+				So(seq.WithContext("sequence_date", date("2017-07-01")).Next(), ShouldEqual, "2017Q3/1")
+			})
+			Convey("Fiscal year subsequences", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:                 "Test fiscal year sequence",
+					Prefix:               "FY%(range_year)-%(range_end_y)/",
+					UseDateRange:         true,
+					RangePeriod:          "fiscal_year",
+					FiscalYearStartMonth: 4,
+					FiscalYearStartDay:   1,
+				})
+				So(seq.WithContext("sequence_date", date("2017-03-31")).Next(), ShouldEqual, "FY2016-17/1")
+				So(seq.WithContext("sequence_date", date("2017-04-01")).Next(), ShouldEqual, "FY2017-18/1")
+				So(seq.WithContext("sequence_date", date("2018-01-15")).Next(), ShouldEqual, "FY2017-18/2")
+				So(func() { seq.SetFiscalYearStartMonth(13) }, ShouldPanic)
+			})
+			Convey("Subsequences do not overlap existing ranges", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:         "Test weekly sequence",
+					UseDateRange: true,
+					RangePeriod:  "week",
+				})
+				h.SequenceDateRange().Create(env, &h.SequenceDateRangeData{
+					Sequence: seq,
+					DateFrom: date("2017-05-08"),
+					DateTo:   date("2017-05-10"),
+				})
+				dateRange := seq.CreateDateRangeSeq(date("2017-05-12"))
+				So(dateRange.DateFrom().Equal(date("2017-05-11")), ShouldBeTrue)
+				So(dateRange.DateTo().Equal(date("2017-05-14")), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+	Convey("Computing range bounds", t, func() {
+		day := func(s string) time.Time {
+			t, _ := time.Parse("2006-01-02", s)
+			return t
+		}
+		bounds := func(period, date string, fyMonth, fyDay int) []string {
+			from, to := sequenceRangeBounds(period, day(date), fyMonth, fyDay)
+			return []string{from.Format("2006-01-02"), to.Format("2006-01-02")}
+		}
+		So(bounds("year", "2016-05-17", 1, 1), ShouldResemble, []string{"2016-01-01", "2016-12-31"})
+		So(bounds("", "2016-05-17", 1, 1), ShouldResemble, []string{"2016-01-01", "2016-12-31"})
+		So(bounds("fiscal_year", "2016-05-17", 4, 1), ShouldResemble, []string{"2016-04-01", "2017-03-31"})
+		So(bounds("fiscal_year", "2016-02-17", 4, 6), ShouldResemble, []string{"2015-04-06", "2016-04-05"})
+		So(bounds("quarter", "2016-12-31", 1, 1), ShouldResemble, []string{"2016-10-01", "2016-12-31"})
+		So(bounds("month", "2016-02-10", 1, 1), ShouldResemble, []string{"2016-02-01", "2016-02-29"})
+		So(bounds("week", "2016-05-22", 1, 1), ShouldResemble, []string{"2016-05-16", "2016-05-22"})
+		So(bounds("week", "2016-12-31", 1, 1), ShouldResemble, []string{"2016-12-26", "2017-01-01"})
+	})
+}
+
+func TestSequencePreview(t *testing.T) {
+	Convey("Testing the preview of sequences", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			for _, implementation := range []string{"standard", "no_gap"} {
+				Convey(fmt.Sprintf("Previewing a %s sequence does not consume numbers", implementation), func() {
+					seq := h.Sequence().Create(env, &h.SequenceData{
+						Name:            "Test preview sequence",
+						Implementation:  implementation,
+						Prefix:          "INV/%(year)/",
+						Padding:         3,
+						NumberIncrement: 2,
+					}).WithContext("sequence_date", dates.ParseDate("2017-05-10"))
+					So(seq.Preview(3), ShouldResemble, []string{"INV/2017/001", "INV/2017/003", "INV/2017/005"})
+					So(seq.Preview(1), ShouldResemble, []string{"INV/2017/001"})
+					So(seq.NextValues(), ShouldEqual, "INV/2017/001\nINV/2017/003\nINV/2017/005")
+					So(seq.Next(), ShouldEqual, "INV/2017/001")
+					So(seq.Next(), ShouldEqual, "INV/2017/003")
+					So(seq.Preview(2), ShouldResemble, []string{"INV/2017/005", "INV/2017/007"})
+					So(seq.Next(), ShouldEqual, "INV/2017/005")
+				})
+			}
+			Convey("Previewing a sequence with date ranges", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:         "Test preview date range sequence",
+					Prefix:       "%(range_year)-%(range_month)/",
+					UseDateRange: true,
+					RangePeriod:  "month",
+				}).WithContext("sequence_date", dates.ParseDate("2017-05-10"))
+				So(seq.Preview(2), ShouldResemble, []string{"2017-05/1", "2017-05/2"})
+				So(seq.DateRanges().IsEmpty(), ShouldBeTrue)
+				So(seq.Next(), ShouldEqual, "2017-05/1")
+				So(seq.Preview(2), ShouldResemble, []string{"2017-05/2", "2017-05/3"})
+				So(seq.Next(), ShouldEqual, "2017-05/2")
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceBatch(t *testing.T) {
+	Convey("Testing batch reservation of sequence numbers", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			for _, implementation := range []string{"standard", "no_gap"} {
+				Convey(fmt.Sprintf("Reserving numbers of a %s sequence", implementation), func() {
+					seq := h.Sequence().Create(env, &h.SequenceData{
+						Name:            "Test batch sequence",
+						Code:            "test_sequence_batch",
+						Implementation:  implementation,
+						Prefix:          "B/",
+						NumberIncrement: 5,
+					})
+					So(seq.Next(), ShouldEqual, "B/1")
+					So(seq.NextBatch(3), ShouldResemble, []string{"B/6", "B/11", "B/16"})
+					So(seq.Next(), ShouldEqual, "B/21")
+					So(h.Sequence().NewSet(env).NextBatchByCode("test_sequence_batch", 2), ShouldResemble, []string{"B/26", "B/31"})
+				})
+				Convey(fmt.Sprintf("Reserving numbers of a %s sequence with date ranges", implementation), func() {
+					seq := h.Sequence().Create(env, &h.SequenceData{
+						Name:           "Test batch date range sequence",
+						Implementation: implementation,
+						Prefix:         "%(range_year)/",
+						UseDateRange:   true,
+					})
+					seq2016 := seq.WithContext("sequence_date", dates.ParseDate("2016-03-01"))
+					seq2017 := seq.WithContext("sequence_date", dates.ParseDate("2017-03-01"))
+					So(seq2016.NextBatch(2), ShouldResemble, []string{"2016/1", "2016/2"})
+					So(seq2017.NextBatch(3), ShouldResemble, []string{"2017/1", "2017/2", "2017/3"})
+					So(seq2016.Next(), ShouldEqual, "2016/3")
+					So(seq2017.NextBatch(1), ShouldResemble, []string{"2017/4"})
+					So(seq.DateRangeFor(dates.ParseDate("2017-03-01")).NextBatch(0), ShouldBeEmpty)
+					So(seq2017.Next(), ShouldEqual, "2017/5")
+				})
+			}
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceAudit(t *testing.T) {
+	Convey("Finding gaps and duplicates in drawn numbers", t, func() {
+		numbers := func(committed []int64, rolledBack ...int64) []auditedNumber {
+			var res []auditedNumber
+			for _, n := range committed {
+				res = append(res, auditedNumber{Number: n, Committed: true})
+			}
+			for _, n := range rolledBack {
+				res = append(res, auditedNumber{Number: n})
+			}
+			return res
+		}
+		So(auditIssues(nil, 1), ShouldBeEmpty)
+		So(auditIssues(numbers([]int64{3, 1, 2}), 1), ShouldBeEmpty)
+		So(auditIssues(numbers([]int64{1, 2, 6, 7}), 1), ShouldResemble, []SequenceAuditIssue{
+			{Kind: SequenceAuditGap, From: 3, To: 5, Count: 3},
+		})
+		So(auditIssues(numbers([]int64{1, 2, 2, 3, 2}), 1), ShouldResemble, []SequenceAuditIssue{
+			{Kind: SequenceAuditDuplicate, From: 2, To: 2, Count: 3},
+		})
+		So(auditIssues(numbers([]int64{1, 9}, 2, 3, 6, 12), 1), ShouldResemble, []SequenceAuditIssue{
+			{Kind: SequenceAuditRolledBack, From: 2, To: 3, Count: 2},
+			{Kind: SequenceAuditGap, From: 4, To: 5, Count: 2},
+			{Kind: SequenceAuditRolledBack, From: 6, To: 6, Count: 1},
+			{Kind: SequenceAuditGap, From: 7, To: 8, Count: 2},
+		})
+		So(auditIssues(numbers([]int64{1, 2, 4}, 2, 3), 1), ShouldResemble, []SequenceAuditIssue{
+			{Kind: SequenceAuditRolledBack, From: 3, To: 3, Count: 1},
+		})
+		So(auditIssues(numbers([]int64{10, 40}, 20), 10), ShouldResemble, []SequenceAuditIssue{
+			{Kind: SequenceAuditRolledBack, From: 20, To: 20, Count: 1},
+			{Kind: SequenceAuditGap, From: 30, To: 30, Count: 1},
+		})
+		So(auditIssues(numbers([]int64{-1, -4}), -1), ShouldResemble, []SequenceAuditIssue{
+			{Kind: SequenceAuditGap, From: -3, To: -2, Count: 2},
+		})
+	})
+	Convey("Auditing the numbers drawn in a transaction", t, func() {
+		var seqID int64
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seqID = h.Sequence().Create(env, &h.SequenceData{
+				Name:           "Test audited sequence",
+				Code:           "test_sequence_audit",
+				Implementation: "no_gap",
+				Prefix:         "A/",
+				Audit:          true,
+			}).ID()
+		}), ShouldBeNil)
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Browse(env, []int64{seqID})
+			So(seq.Next(), ShouldEqual, "A/1")
+			So(seq.WithContext("sequence_res_model", "Partner").WithContext("sequence_res_id", int64(7)).Next(), ShouldEqual, "A/2")
+			seq.NextBatch(2)
+			audit := h.SequenceAudit().Search(env, q.SequenceAudit().Sequence().Equals(seq))
+			So(audit.Len(), ShouldEqual, 4)
+			entry := h.SequenceAudit().Search(env, q.SequenceAudit().Value().Equals("A/2"))
+			So(entry.Number(), ShouldEqual, 2)
+			So(entry.Committed(), ShouldBeTrue)
+			So(entry.ResModel(), ShouldEqual, "Partner")
+			So(entry.ResID(), ShouldEqual, 7)
+			seq.LinkAudit("A/1", "User", 3)
+			entry = h.SequenceAudit().Search(env, q.SequenceAudit().Value().Equals("A/1"))
+			entry.InvalidateCache()
+			So(entry.ResModel(), ShouldEqual, "User")
+			So(seq.AuditIssues(), ShouldBeEmpty)
+			seq.SetNumberNextActual(7)
+			seq.Next()
+			seq.SetNumberNextActual(2)
+			seq.Next()
+			So(seq.AuditIssues(), ShouldResemble, []SequenceAuditIssue{
+				{Sequence: seq.ID(), Kind: SequenceAuditDuplicate, From: 2, To: 2, Count: 2},
+				{Sequence: seq.ID(), Kind: SequenceAuditGap, From: 5, To: 6, Count: 2},
+			})
+			Convey("Sequences which are not audited are not logged", func() {
+				seq.SetAudit(false)
+				seq.Next()
+				So(h.SequenceAudit().Search(env, q.SequenceAudit().Sequence().Equals(seq)).Len(), ShouldEqual, 6)
+			})
+			Convey("The audit report lists the issues", func() {
+				report := h.SequenceAuditReport().Create(env, &h.SequenceAuditReportData{Sequences: seq})
+				report.ActionCheck()
+				So(report.State(), ShouldEqual, "checked")
+				So(report.Lines().Len(), ShouldEqual, 2)
+			})
+		}), ShouldBeNil)
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.Sequence().Browse(env, []int64{seqID}).Unlink()
+		}), ShouldBeNil)
+	})
+	Convey("Numbers of sequences created in the same transaction are audited in it", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, &h.SequenceData{
+				Name:   "Test audited new sequence",
+				Code:   "test_sequence_audit_new",
+				Prefix: "N/",
+				Audit:  true,
+			})
+			So(seq.Next(), ShouldEqual, "N/1")
+			entry := h.SequenceAudit().Search(env, q.SequenceAudit().Sequence().Equals(seq))
+			So(entry.Len(), ShouldEqual, 1)
+			So(entry.Value(), ShouldEqual, "N/1")
+			So(entry.Committed(), ShouldBeFalse)
+		}), ShouldBeNil)
+	})
+	Convey("Auditing numbers drawn by rolled back transactions", t, func() {
+		var seqID int64
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seqID = h.Sequence().Create(env, &h.SequenceData{
+				Name:   "Test audited standard sequence",
+				Code:   "test_sequence_audit_standard",
+				Prefix: "S/",
+				Audit:  true,
+			}).ID()
+		}), ShouldBeNil)
+		draw := func(rollback bool) error {
+			return models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				h.Sequence().Browse(env, []int64{seqID}).Next()
+				if rollback {
+					panic("rollback")
+				}
+			})
+		}
+		So(draw(false), ShouldBeNil)
+		So(draw(true), ShouldNotBeNil)
+		So(draw(false), ShouldBeNil)
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Browse(env, []int64{seqID})
+			So(h.SequenceAudit().Search(env, q.SequenceAudit().Sequence().Equals(seq)).Len(), ShouldEqual, 3)
+			So(seq.AuditIssues(), ShouldResemble, []SequenceAuditIssue{
+				{Sequence: seqID, Kind: SequenceAuditRolledBack, From: 2, To: 2, Count: 1},
+			})
+			seq.Unlink()
+		}), ShouldBeNil)
+	})
+	Convey("Auditing numbers drawn from committed no gap sequences", t, func() {
+		var seqID int64
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seqID = h.Sequence().Create(env, &h.SequenceData{
+				Name:           "Test audited no gap sequence",
+				Code:           "test_sequence_audit_no_gap",
+				Implementation: "no_gap",
+				Prefix:         "G/%(year)s/",
+				UseDateRange:   true,
+				Audit:          true,
+			}).ID()
+		}), ShouldBeNil)
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Browse(env, []int64{seqID})
+			seq.Next()
+			seq.Next()
+		}), ShouldBeNil)
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Browse(env, []int64{seqID})
+			// draw from the committed date range too
+			seq.Next()
+			audit := h.SequenceAudit().Search(env, q.SequenceAudit().Sequence().Equals(seq))
+			So(audit.Len(), ShouldEqual, 3)
+			for _, entry := range audit.Records() {
+				So(entry.Committed(), ShouldBeTrue)
+				So(entry.DateRange().IsEmpty(), ShouldBeFalse)
+			}
+			So(seq.AuditIssues(), ShouldBeEmpty)
+			seq.Unlink()
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceCheckDigit(t *testing.T) {
+	Convey("Testing check digits of sequences", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			Convey("Check digits are appended to the number", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:       "Test Luhn sequence",
+					Prefix:     "C",
+					Padding:    6,
+					NumberNext: 12345,
+					CheckDigit: "luhn",
+				})
+				So(seq.Next(), ShouldEqual, "C0123455")
+				So(seq.ValidateNumber("C0123455"), ShouldBeTrue)
+				So(seq.ValidateNumber("C0123456"), ShouldBeFalse)
+				So(seq.ValidateNumber(""), ShouldBeFalse)
+				So(seq.NextBatch(2), ShouldResemble, []string{"C0123463", "C0123471"})
+			})
+			Convey("Check digits replace the placeholder", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:       "Test MOD 97-10 sequence",
+					Prefix:     "RF%(check)",
+					Suffix:     "/%(year)",
+					Padding:    4,
+					CheckDigit: "mod97_10",
+				})
+				seq2017 := seq.WithContext("sequence_date", dates.ParseDate("2017-03-01"))
+				value := seq2017.Next()
+				So(value, ShouldEqual, "RF830001/2017")
+				So(seq2017.ValidateNumber(value), ShouldBeTrue)
+				So(seq2017.ValidateNumber("RF840001/2017"), ShouldBeFalse)
+				seq.SetPrefix("")
+				seq.SetSuffix("-%(check)/%(year)")
+				value = seq2017.Next()
+				So(value, ShouldEqual, "0002-07/2017")
+				So(seq2017.ValidateNumber(value), ShouldBeTrue)
+				So(seq2017.ValidateNumber("0002-00/2017"), ShouldBeFalse)
+			})
+			Convey("Invalid numbers cannot be drawn", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:       "Test EAN-13 sequence",
+					Prefix:     "4006381",
+					Padding:    5,
+					NumberNext: 99999,
+					CheckDigit: "ean13",
+				})
+				So(seq.Next(), ShouldEqual, "4006381999991")
+				So(func() { seq.Next() }, ShouldPanic)
+				So(func() { seq.NextBatch(2) }, ShouldPanic)
+				So(seq.ComputeNextValues().NextValues, ShouldStartWith, "Invalid format: ")
+			})
+			Convey("Misconfigured check digits are refused", func() {
+				So(func() {
+					h.Sequence().Create(env, &h.SequenceData{
+						Name:       "Test misconfigured EAN-13 sequence",
+						Prefix:     "4006381",
+						Padding:    6,
+						CheckDigit: "ean13",
+					})
+				}, ShouldPanic)
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:       "Test misconfigured Luhn sequence",
+					Prefix:     "C%(check)",
+					CheckDigit: "luhn",
+				})
+				So(func() { seq.SetSuffix("/%(check)") }, ShouldPanic)
+				So(func() { seq.SetCheckDigit("unknown") }, ShouldPanic)
+			})
+			Convey("Sequences without check digit remove the placeholder", func() {
+				seq := h.Sequence().Create(env, &h.SequenceData{
+					Name:   "Test sequence without check digit",
+					Suffix: "%(check)",
+				})
+				So(seq.Next(), ShouldEqual, "1")
+				So(seq.ValidateNumber("anything"), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,415 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Encrypted data is made of a header followed by chunks of at most chunkSize
+// bytes of plaintext, each sealed with AES-GCM. The header holds the ID of the
+// key and a random nonce prefix. The nonce of each chunk is this prefix followed
+// by the index of the chunk, and the header and a flag telling whether the
+// chunk is the last one are authenticated with it, so that chunks can be neither
+// reordered nor truncated.
+//
+// Chunks allow to stream data and to seek in it without decrypting it entirely.
+const (
+	cryptMagic       = "HXE1"
+	cryptPrefixSize  = 8
+	cryptChunkSize   = 64 * 1024
+	cryptMaxKeyIDLen = 255
+)
+
+// ErrCorrupt is returned when encrypted data cannot be decrypted
+var ErrCorrupt = errors.New("storage: corrupt encrypted data")
+
+// ErrUnencrypted is returned when reading unencrypted data with an
+// EncryptedDriver which does not allow plaintext.
+var ErrUnencrypted = errors.New("storage: data is not encrypted")
+
+// A Keyring holds the AES keys with which an EncryptedDriver encrypts
+// and decrypts data, identified by their ID.
+type Keyring struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// NewKeyring returns a Keyring with the given AES keys, which must be 16, 24 or
+// 32 bytes long. New data is encrypted with the key whose ID is current, while
+// all the keys can be used to decrypt data.
+func NewKeyring(keys map[string][]byte, current string) (*Keyring, error) {
+	kr := Keyring{
+		keys:    make(map[string]cipher.AEAD),
+		current: current,
+	}
+	for keyID, key := range keys {
+		if keyID == "" || len(keyID) > cryptMaxKeyIDLen {
+			return nil, fmt.Errorf("storage: invalid key ID '%s'", keyID)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("storage: invalid key '%s': %s", keyID, err)
+		}
+		kr.keys[keyID], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := kr.keys[current]; !ok {
+		return nil, fmt.Errorf("storage: unknown current key '%s'", current)
+	}
+	return &kr, nil
+}
+
+// Current returns the ID of the key with which new data is encrypted
+func (kr *Keyring) Current() string {
+	return kr.current
+}
+
+// An EncryptedDriver encrypts the data stored in another driver.
+//
+// Data which was stored unencrypted in the underlying driver is refused, since
+// it is not authenticated, unless plaintext is allowed with WithPlaintext. This
+// allows to enable encryption on an existing storage and to encrypt its files
+// afterwards with Reencrypt.
+type EncryptedDriver struct {
+	Driver
+	keyring   *Keyring
+	plaintext bool
+}
+
+var _ Driver = EncryptedDriver{}
+
+// NewEncryptedDriver returns an EncryptedDriver storing the data
+// in the given driver, encrypted with the keys of the given keyring.
+func NewEncryptedDriver(driver Driver, keyring *Keyring) EncryptedDriver {
+	return EncryptedDriver{
+		Driver:  driver,
+		keyring: keyring,
+	}
+}
+
+// WithPlaintext returns a copy of this driver which reads the data stored
+// unencrypted in the underlying driver as is.
+func (ed EncryptedDriver) WithPlaintext() EncryptedDriver {
+	ed.plaintext = true
+	return ed
+}
+
+// cryptHeader returns the header of encrypted data
+func cryptHeader(keyID string, prefix []byte) []byte {
+	header := make([]byte, 0, len(cryptMagic)+1+len(keyID)+cryptPrefixSize)
+	header = append(header, cryptMagic...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	return append(header, prefix...)
+}
+
+// cryptNonce returns the nonce of the chunk of the given index
+func cryptNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, cryptPrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptPrefixSize:], index)
+	return nonce
+}
+
+// cryptAdditionalData returns the data authenticated with a chunk
+func cryptAdditionalData(header []byte, last bool) []byte {
+	ad := make([]byte, len(header)+1)
+	copy(ad, header)
+	if last {
+		ad[len(header)] = 1
+	}
+	return ad
+}
+
+// encrypt writes to w the data read from r encrypted with the current key
+func (ed EncryptedDriver) encrypt(w io.Writer, r io.Reader) error {
+	aead := ed.keyring.keys[ed.keyring.current]
+	prefix := make([]byte, cryptPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header := cryptHeader(ed.keyring.current, prefix)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(r, cryptChunkSize)
+	buf := make([]byte, cryptChunkSize)
+	sealed := make([]byte, 0, cryptChunkSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			if _, err = br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if !last && index == 1<<32-1 {
+			return errors.New("storage: data too large to be encrypted")
+		}
+		sealed = aead.Seal(sealed[:0], cryptNonce(prefix, index), buf[:n], cryptAdditionalData(header, last))
+		if _, err = w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Put encrypts data and stores it under the given key
+func (ed EncryptedDriver) Put(key string, data []byte) error {
+	return ed.PutReader(key, bytes.NewReader(data))
+}
+
+// PutReader encrypts the data read from r and stores it under the given key
+func (ed EncryptedDriver) PutReader(key string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ed.encrypt(pw, r))
+	}()
+	err := ed.Driver.PutReader(key, pr)
+	// stop the encryption if the driver returned before reading everything
+	pr.Close()
+	return err
+}
+
+// Get returns the decrypted data stored under the given key
+func (ed EncryptedDriver) Get(key string) ([]byte, error) {
+	r, err := ed.Reader(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Size returns the size of the decrypted data stored under the given key
+func (ed EncryptedDriver) Size(key string) (int64, error) {
+	r, err := ed.Reader(key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.Seek(0, io.SeekEnd)
+}
+
+// Reader returns a reader of the decrypted data stored under the given key
+func (ed EncryptedDriver) Reader(key string) (ReadSeekCloser, error) {
+	src, err := ed.Driver.Reader(key)
+	if err != nil {
+		return nil, err
+	}
+	keyID, header, err := readCryptHeader(src)
+	if err == nil && keyID == "" {
+		// unencrypted data
+		if !ed.plaintext {
+			src.Close()
+			return nil, ErrUnencrypted
+		}
+		_, err = src.Seek(0, io.SeekStart)
+		if err == nil {
+			return src, nil
+		}
+	}
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	aead, ok := ed.keyring.keys[keyID]
+	if !ok {
+		src.Close()
+		return nil, fmt.Errorf("storage: unknown key '%s' for '%s'", keyID, key)
+	}
+	cr, err := newCryptReader(src, aead, header)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return cr, nil
+}
+
+// KeyID returns the ID of the key with which the data stored under
+// the given key is encrypted, or an empty string if it is not encrypted.
+func (ed EncryptedDriver) KeyID(key string) (string, error) {
+	src, err := ed.Driver.Reader(key)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	keyID, _, err := readCryptHeader(src)
+	return keyID, err
+}
+
+// Reencrypt rewrites the data stored under the given key with the current key,
+// if it is not encrypted with it yet. It returns true if the data was rewritten.
+//
+// Unencrypted data can only be rewritten if this driver allows plaintext.
+func (ed EncryptedDriver) Reencrypt(key string) (bool, error) {
+	keyID, err := ed.KeyID(key)
+	if err != nil || keyID == ed.keyring.current {
+		return false, err
+	}
+	r, err := ed.Reader(key)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	if err = ed.PutReader(key, r); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readCryptHeader reads the header of encrypted data from r. It returns an
+// empty key ID if the data is not encrypted.
+func readCryptHeader(r io.Reader) (string, []byte, error) {
+	start := make([]byte, len(cryptMagic)+1)
+	if _, err := io.ReadFull(r, start); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", nil, nil
+		}
+		return "", nil, err
+	}
+	if string(start[:len(cryptMagic)]) != cryptMagic {
+		return "", nil, nil
+	}
+	rest := make([]byte, int(start[len(cryptMagic)])+cryptPrefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", nil, ErrCorrupt
+		}
+		return "", nil, err
+	}
+	keyID := string(rest[:len(rest)-cryptPrefixSize])
+	if keyID == "" {
+		return "", nil, ErrCorrupt
+	}
+	return keyID, append(start, rest...), nil
+}
+
+// A cryptReader decrypts encrypted data chunk by chunk
+type cryptReader struct {
+	src       ReadSeekCloser
+	aead      cipher.AEAD
+	header    []byte
+	prefix    []byte
+	bodySize  int64
+	chunks    int64
+	size      int64
+	pos       int64
+	chunk     []byte
+	chunkIdx  int64
+	sealedBuf []byte
+}
+
+// newCryptReader returns a reader of the data of src, whose given header has
+// already been read, decrypted with the given AEAD.
+func newCryptReader(src ReadSeekCloser, aead cipher.AEAD, header []byte) (*cryptReader, error) {
+	total, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	cr := cryptReader{
+		src:      src,
+		aead:     aead,
+		header:   header,
+		prefix:   header[len(header)-cryptPrefixSize:],
+		bodySize: total - int64(len(header)),
+		chunkIdx: -1,
+	}
+	sealedChunkSize := int64(cryptChunkSize + aead.Overhead())
+	cr.chunks = (cr.bodySize + sealedChunkSize - 1) / sealedChunkSize
+	if cr.chunks == 0 || cr.bodySize-(cr.chunks-1)*sealedChunkSize < int64(aead.Overhead()) {
+		return nil, ErrCorrupt
+	}
+	cr.size = cr.bodySize - cr.chunks*int64(aead.Overhead())
+	return &cr, nil
+}
+
+// loadChunk decrypts the chunk of the given index
+func (cr *cryptReader) loadChunk(index int64) error {
+	sealedChunkSize := int64(cryptChunkSize + cr.aead.Overhead())
+	if _, err := cr.src.Seek(int64(len(cr.header))+index*sealedChunkSize, io.SeekStart); err != nil {
+		return err
+	}
+	size := sealedChunkSize
+	if rest := cr.bodySize - index*sealedChunkSize; rest < size {
+		size = rest
+	}
+	if int64(cap(cr.sealedBuf)) < size {
+		cr.sealedBuf = make([]byte, sealedChunkSize)
+	}
+	sealed := cr.sealedBuf[:size]
+	if _, err := io.ReadFull(cr.src, sealed); err != nil {
+		return err
+	}
+	last := index == cr.chunks-1
+	chunk, err := cr.aead.Open(cr.chunk[:0], cryptNonce(cr.prefix, uint32(index)), sealed,
+		cryptAdditionalData(cr.header, last))
+	if err != nil {
+		cr.chunkIdx = -1
+		return ErrCorrupt
+	}
+	cr.chunk = chunk
+	cr.chunkIdx = index
+	return nil
+}
+
+// Read decrypted data
+func (cr *cryptReader) Read(p []byte) (int, error) {
+	if cr.pos >= cr.size {
+		return 0, io.EOF
+	}
+	index := cr.pos / cryptChunkSize
+	if index != cr.chunkIdx {
+		if err := cr.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.chunk[cr.pos-index*cryptChunkSize:])
+	cr.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the offset for the next Read in the decrypted data
+func (cr *cryptReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = cr.pos + offset
+	case io.SeekEnd:
+		pos = cr.size + offset
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	cr.pos = pos
+	return pos, nil
+}
+
+// Close the underlying reader
+func (cr *cryptReader) Close() error {
+	return cr.src.Close()
+}
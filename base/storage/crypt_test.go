@@ -0,0 +1,129 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEncryptedDriver(t *testing.T) {
+	Convey("Testing the encrypted storage driver", t, func() {
+		root, err := ioutil.TempDir("", "hexya-filestore")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+		keys := map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 32),
+		}
+		keyring, err := NewKeyring(keys, "k1")
+		So(err, ShouldBeNil)
+		fileDriver := NewFileDriver(root)
+		driver := NewEncryptedDriver(fileDriver, keyring)
+		testDriver(driver)
+		Convey("Data is encrypted at rest", func() {
+			So(driver.Put("ab/abcdef", []byte("secret content")), ShouldBeNil)
+			raw, err := fileDriver.Get("ab/abcdef")
+			So(err, ShouldBeNil)
+			So(bytes.Contains(raw, []byte("secret content")), ShouldBeFalse)
+			keyID, err := driver.KeyID("ab/abcdef")
+			So(err, ShouldBeNil)
+			So(keyID, ShouldEqual, "k1")
+			Convey("Tampered data is rejected", func() {
+				raw[len(raw)-1] ^= 1
+				So(fileDriver.Put("ab/abcdef", raw), ShouldBeNil)
+				_, err := driver.Get("ab/abcdef")
+				So(err, ShouldEqual, ErrCorrupt)
+			})
+			Convey("Truncated data is rejected", func() {
+				So(driver.Put("ab/abcdef", bytes.Repeat([]byte("x"), 3*cryptChunkSize)), ShouldBeNil)
+				raw, err := fileDriver.Get("ab/abcdef")
+				So(err, ShouldBeNil)
+				So(fileDriver.Put("ab/abcdef", raw[:len(raw)-cryptChunkSize-keyring.keys["k1"].Overhead()]), ShouldBeNil)
+				_, err = driver.Get("ab/abcdef")
+				So(err, ShouldEqual, ErrCorrupt)
+			})
+		})
+		Convey("Large data is streamed in chunks", func() {
+			data := make([]byte, 3*cryptChunkSize+100)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			So(driver.PutReader("ab/large", bytes.NewReader(data)), ShouldBeNil)
+			size, err := driver.Size("ab/large")
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, len(data))
+			reader, err := driver.Reader("ab/large")
+			So(err, ShouldBeNil)
+			defer reader.Close()
+			_, err = reader.Seek(2*cryptChunkSize-10, io.SeekStart)
+			So(err, ShouldBeNil)
+			buf := make([]byte, 20)
+			_, err = io.ReadFull(reader, buf)
+			So(err, ShouldBeNil)
+			So(buf, ShouldResemble, data[2*cryptChunkSize-10:2*cryptChunkSize+10])
+			_, err = reader.Seek(0, io.SeekStart)
+			So(err, ShouldBeNil)
+			all, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(all, data), ShouldBeTrue)
+		})
+		Convey("Unencrypted data is only read if plaintext is allowed", func() {
+			So(fileDriver.Put("ab/plain", []byte("plain content")), ShouldBeNil)
+			_, err := driver.Get("ab/plain")
+			So(err, ShouldEqual, ErrUnencrypted)
+			_, err = driver.Reencrypt("ab/plain")
+			So(err, ShouldEqual, ErrUnencrypted)
+			data, err := driver.WithPlaintext().Get("ab/plain")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "plain content")
+			keyID, err := driver.KeyID("ab/plain")
+			So(err, ShouldBeNil)
+			So(keyID, ShouldBeBlank)
+		})
+		Convey("Rotating keys", func() {
+			So(driver.Put("ab/abcdef", []byte("old content")), ShouldBeNil)
+			So(fileDriver.Put("ab/plain", []byte("plain content")), ShouldBeNil)
+			newKeyring, err := NewKeyring(keys, "k2")
+			So(err, ShouldBeNil)
+			newDriver := NewEncryptedDriver(fileDriver, newKeyring).WithPlaintext()
+			data, err := newDriver.Get("ab/abcdef")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "old content")
+			for _, key := range []string{"ab/abcdef", "ab/plain"} {
+				done, err := newDriver.Reencrypt(key)
+				So(err, ShouldBeNil)
+				So(done, ShouldBeTrue)
+				keyID, err := newDriver.KeyID(key)
+				So(err, ShouldBeNil)
+				So(keyID, ShouldEqual, "k2")
+			}
+			done, err := newDriver.Reencrypt("ab/abcdef")
+			So(err, ShouldBeNil)
+			So(done, ShouldBeFalse)
+			data, err = newDriver.Get("ab/plain")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "plain content")
+			_, err = driver.Get("ab/abcdef")
+			So(err, ShouldBeNil)
+			delete(keys, "k1")
+			oldlessKeyring, err := NewKeyring(keys, "k2")
+			So(err, ShouldBeNil)
+			data, err = NewEncryptedDriver(fileDriver, oldlessKeyring).Get("ab/abcdef")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "old content")
+		})
+		Convey("Invalid keyrings", func() {
+			_, err := NewKeyring(map[string][]byte{"k1": []byte("short")}, "k1")
+			So(err, ShouldNotBeNil)
+			_, err = NewKeyring(keys, "unknown")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A FileDriver stores data in files of a local directory
+type FileDriver struct {
+	root string
+}
+
+var _ Driver = FileDriver{}
+
+// NewFileDriver returns a FileDriver storing files in the given directory
+func NewFileDriver(root string) FileDriver {
+	return FileDriver{root: root}
+}
+
+// path returns the full path of the file of the given key
+func (fd FileDriver) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", errors.New("storage: empty key")
+	}
+	return filepath.Join(fd.root, filepath.FromSlash(clean[1:])), nil
+}
+
+// Put stores data in the file of the given key
+func (fd FileDriver) Put(key string, data []byte) error {
+	return fd.PutReader(key, bytes.NewReader(data))
+}
+
+// PutReader stores the data read from r in the file of the given key. The data is
+// written to a temporary file first, so that readers never see partial content.
+func (fd FileDriver) PutReader(key string, r io.Reader) error {
+	fullPath, err := fd.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fullPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fullPath)
+}
+
+// Get returns the content of the file of the given key
+func (fd FileDriver) Get(key string) ([]byte, error) {
+	fullPath, err := fd.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Reader returns the opened file of the given key
+func (fd FileDriver) Reader(key string) (ReadSeekCloser, error) {
+	fullPath, err := fd.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(fullPath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Size returns the size of the file of the given key
+func (fd FileDriver) Size(key string) (int64, error) {
+	fullPath, err := fd.path(key)
+	if err != nil {
+		return 0, err
+	}
+	fInfo, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fInfo.Size(), nil
+}
+
+// Delete removes the file of the given key
+func (fd FileDriver) Delete(key string) error {
+	fullPath, err := fd.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Exists returns true if the file of the given key exists
+func (fd FileDriver) Exists(key string) (bool, error) {
+	_, err := fd.Size(key)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// List returns the keys of all the files whose key starts with the given prefix
+func (fd FileDriver) List(prefix string) ([]string, error) {
+	// Only walk the deepest directory containing all the matching keys
+	dir := fd.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = filepath.Join(fd.root, filepath.FromSlash(path.Clean("/" + prefix[:i])[1:]))
+	}
+	var keys []string
+	err := filepath.Walk(dir, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(fd.root, fullPath)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func init() {
+	Register("file", func(location *url.URL) (Driver, error) {
+		if location.Path == "" {
+			return nil, errors.New("storage: file location must have a path")
+		}
+		return NewFileDriver(location.Path), nil
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+)
+
+// An S3Driver stores data in a bucket of an S3-compatible object storage
+type S3Driver struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+var _ Driver = S3Driver{}
+
+// NewS3Driver returns an S3Driver storing objects in the given bucket, under the
+// given prefix, using the given client.
+func NewS3Driver(client *minio.Client, bucket, prefix string) S3Driver {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return S3Driver{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+// isNotFound returns true if the given error means that the object does not exist
+func isNotFound(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return true
+	}
+	return false
+}
+
+// Put stores data in the object of the given key
+func (sd S3Driver) Put(key string, data []byte) error {
+	_, err := sd.client.PutObject(sd.bucket, sd.prefix+key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// PutReader stores the data read from r in the object of the given key
+func (sd S3Driver) PutReader(key string, r io.Reader) error {
+	_, err := sd.client.PutObject(sd.bucket, sd.prefix+key, r, -1,
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// Get returns the content of the object of the given key
+func (sd S3Driver) Get(key string) ([]byte, error) {
+	obj, err := sd.client.GetObject(sd.bucket, sd.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	defer obj.Close()
+	data, err := ioutil.ReadAll(obj)
+	if isNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Reader returns a reader of the object of the given key
+func (sd S3Driver) Reader(key string) (ReadSeekCloser, error) {
+	obj, err := sd.client.GetObject(sd.bucket, sd.prefix+key, minio.GetObjectOptions{})
+	if err == nil {
+		// GetObject does not send any request, so check that the object exists
+		_, err = obj.Stat()
+	}
+	if err != nil {
+		if obj != nil {
+			obj.Close()
+		}
+		if isNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Size returns the size of the object of the given key
+func (sd S3Driver) Size(key string) (int64, error) {
+	info, err := sd.client.StatObject(sd.bucket, sd.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Delete removes the object of the given key
+func (sd S3Driver) Delete(key string) error {
+	err := sd.client.RemoveObject(sd.bucket, sd.prefix+key)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Exists returns true if the object of the given key exists
+func (sd S3Driver) Exists(key string) (bool, error) {
+	_, err := sd.Size(key)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// List returns the keys of all the objects whose key starts with the given prefix
+func (sd S3Driver) List(prefix string) ([]string, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	var keys []string
+	for info := range sd.client.ListObjectsV2(sd.bucket, sd.prefix+prefix, true, doneCh) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		keys = append(keys, strings.TrimPrefix(info.Key, sd.prefix))
+	}
+	return keys, nil
+}
+
+// openS3 returns the S3Driver of the given location, which must be of the form
+// s3://bucket/prefix?endpoint=host:port&region=region&secure=true.
+//
+// The endpoint defaults to Amazon S3. Credentials are read from the standard
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (or MINIO_ACCESS_KEY and
+// MINIO_SECRET_KEY) environment variables, or from the AWS credentials file.
+func openS3(location *url.URL) (Driver, error) {
+	if location.Host == "" {
+		return nil, errors.New("storage: s3 location must have a bucket")
+	}
+	query := location.Query()
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	secure := true
+	if val := query.Get("secure"); val != "" {
+		var err error
+		if secure, err = strconv.ParseBool(val); err != nil {
+			return nil, errors.New("storage: invalid 'secure' value in s3 location")
+		}
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+	})
+	client, err := minio.NewWithCredentials(endpoint, creds, secure, query.Get("region"))
+	if err != nil {
+		return nil, err
+	}
+	return NewS3Driver(client, location.Host, location.Path), nil
+}
+
+func init() {
+	Register("s3", openS3)
+}
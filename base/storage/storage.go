@@ -0,0 +1,91 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package storage defines the drivers in which the contents
+// of attachments are stored, identified by their content hash.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+)
+
+// ErrNotFound is returned by drivers when the requested key does not exist
+var ErrNotFound = errors.New("storage: key not found")
+
+// A Driver stores blobs of data identified by keys. Keys are slash
+// separated relative paths such as "ab/abcdef0123...", where the last
+// element is usually the content hash of the data.
+type Driver interface {
+	// Put stores data under the given key, replacing any existing value
+	Put(key string, data []byte) error
+	// Get returns the data stored under the given key, or ErrNotFound
+	Get(key string) ([]byte, error)
+	// Size returns the size in bytes of the data stored under the given key, or ErrNotFound
+	Size(key string) (int64, error)
+	// Delete removes the given key. Deleting a key that does not exist is not an error.
+	Delete(key string) error
+	// Exists returns true if the given key exists
+	Exists(key string) (bool, error)
+	// List returns all the keys that start with the given prefix
+	List(prefix string) ([]string, error)
+	// PutReader stores the data read from r under the given key, replacing any existing value
+	PutReader(key string, r io.Reader) error
+	// Reader returns a reader of the data stored under the given key, or ErrNotFound.
+	// The caller must close the returned reader.
+	Reader(key string) (ReadSeekCloser, error)
+}
+
+// ReadSeekCloser is the interface that groups the Read, Seek and Close methods
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// An Opener returns the Driver for the given location URL
+type Opener func(location *url.URL) (Driver, error)
+
+var (
+	openers = make(map[string]Opener)
+	drivers = struct {
+		sync.Mutex
+		cache map[string]Driver
+	}{cache: make(map[string]Driver)}
+)
+
+// Register makes the given Opener available for locations with the given URL scheme.
+// It is meant to be called in the init function of the package defining the driver.
+func Register(scheme string, opener Opener) {
+	if _, exists := openers[scheme]; exists {
+		panic(fmt.Sprintf("storage: driver already registered for scheme '%s'", scheme))
+	}
+	openers[scheme] = opener
+}
+
+// Open returns the Driver for the given location, such as "file:///var/lib/hexya/filestore"
+// or "s3://bucket/prefix". Drivers are cached, so that each location is opened only once.
+func Open(location string) (Driver, error) {
+	drivers.Lock()
+	defer drivers.Unlock()
+	if driver, ok := drivers.cache[location]; ok {
+		return driver, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("storage: invalid location '%s': %s", location, err)
+	}
+	opener, ok := openers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("storage: no driver registered for scheme '%s'", u.Scheme)
+	}
+	driver, err := opener(u)
+	if err != nil {
+		return nil, err
+	}
+	drivers.cache[location] = driver
+	return driver, nil
+}
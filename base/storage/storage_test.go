@@ -0,0 +1,154 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testDriver checks that the given driver behaves as expected
+func testDriver(driver Driver) {
+	Convey("Putting and getting data", func() {
+		So(driver.Put("ab/abcdef", []byte("blob1")), ShouldBeNil)
+		data, err := driver.Get("ab/abcdef")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "blob1")
+		size, err := driver.Size("ab/abcdef")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 5)
+		exists, err := driver.Exists("ab/abcdef")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+	Convey("Streaming data", func() {
+		So(driver.PutReader("ab/abcdef", strings.NewReader("streamed blob")), ShouldBeNil)
+		reader, err := driver.Reader("ab/abcdef")
+		So(err, ShouldBeNil)
+		defer reader.Close()
+		_, err = reader.Seek(9, io.SeekStart)
+		So(err, ShouldBeNil)
+		data, err := ioutil.ReadAll(reader)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "blob")
+		_, err = driver.Reader("cd/cdef01")
+		So(err, ShouldEqual, ErrNotFound)
+	})
+	Convey("Replacing data", func() {
+		So(driver.Put("ab/abcdef", []byte("blob1")), ShouldBeNil)
+		So(driver.Put("ab/abcdef", []byte("blob2")), ShouldBeNil)
+		data, err := driver.Get("ab/abcdef")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "blob2")
+	})
+	Convey("Missing keys", func() {
+		_, err := driver.Get("cd/cdef01")
+		So(err, ShouldEqual, ErrNotFound)
+		_, err = driver.Size("cd/cdef01")
+		So(err, ShouldEqual, ErrNotFound)
+		exists, err := driver.Exists("cd/cdef01")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+		So(driver.Delete("cd/cdef01"), ShouldBeNil)
+	})
+	Convey("Deleting data", func() {
+		So(driver.Put("ab/abcdef", []byte("blob1")), ShouldBeNil)
+		So(driver.Delete("ab/abcdef"), ShouldBeNil)
+		exists, err := driver.Exists("ab/abcdef")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+	})
+	Convey("Listing keys", func() {
+		So(driver.Put("ab/ab0001", []byte("1")), ShouldBeNil)
+		So(driver.Put("ab/ab0002", []byte("2")), ShouldBeNil)
+		So(driver.Put("cd/cd0001", []byte("3")), ShouldBeNil)
+		So(driver.Put("checklist/ab/ab0001", []byte{}), ShouldBeNil)
+		keys, err := driver.List("ab/")
+		So(err, ShouldBeNil)
+		sort.Strings(keys)
+		So(keys, ShouldResemble, []string{"ab/ab0001", "ab/ab0002"})
+		keys, err = driver.List("ab/ab0001")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"ab/ab0001"})
+		keys, err = driver.List("checklist/")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"checklist/ab/ab0001"})
+		keys, err = driver.List("ef/")
+		So(err, ShouldBeNil)
+		So(keys, ShouldBeEmpty)
+	})
+}
+
+func TestFileDriver(t *testing.T) {
+	Convey("Testing the file storage driver", t, func() {
+		root, err := ioutil.TempDir("", "hexya-filestore")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+		testDriver(NewFileDriver(root))
+		Convey("Keys cannot escape the root directory", func() {
+			driver := NewFileDriver(root)
+			So(driver.Put("../../escaped", []byte("x")), ShouldBeNil)
+			_, err := os.Stat(root + "/escaped")
+			So(err, ShouldBeNil)
+		})
+		Convey("Opening a file location", func() {
+			driver, err := Open("file://" + root)
+			So(err, ShouldBeNil)
+			So(driver, ShouldResemble, NewFileDriver(root))
+		})
+	})
+}
+
+// setTestEnv sets the given environment variable and returns
+// a function restoring its previous value.
+func setTestEnv(key, value string) func() {
+	old, exists := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if exists {
+			os.Setenv(key, old)
+			return
+		}
+		os.Unsetenv(key)
+	}
+}
+
+func TestS3Driver(t *testing.T) {
+	Convey("Testing the S3 storage driver", t, func() {
+		backend := s3mem.New()
+		So(backend.CreateBucket("attachments"), ShouldBeNil)
+		server := httptest.NewServer(gofakes3.New(backend).Server())
+		defer server.Close()
+		defer setTestEnv("AWS_ACCESS_KEY_ID", "test-key")()
+		defer setTestEnv("AWS_SECRET_ACCESS_KEY", "test-secret")()
+		endpoint, _ := url.Parse(server.URL)
+		driver, err := Open("s3://attachments/hexya/filestore?secure=false&endpoint=" + endpoint.Host)
+		So(err, ShouldBeNil)
+		testDriver(driver)
+		Convey("Objects are stored under the prefix", func() {
+			So(driver.Put("ab/abcdef", []byte("blob1")), ShouldBeNil)
+			other, err := Open("s3://attachments?secure=false&endpoint=" + endpoint.Host)
+			So(err, ShouldBeNil)
+			keys, err := other.List("hexya/filestore/ab/")
+			So(err, ShouldBeNil)
+			So(keys, ShouldContain, "hexya/filestore/ab/abcdef")
+		})
+		Convey("Invalid locations", func() {
+			_, err := Open("s3:///prefix")
+			So(err, ShouldNotBeNil)
+			_, err = Open("unknown://bucket")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+// Package totp implements the time-based one-time passwords
+// of RFC 6238 used for two-factor authentication.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits is the number of digits of the generated codes
+	Digits = 6
+	// Period is the number of seconds during which a code is valid
+	Period = 30
+	// Skew is the number of periods before and after the current
+	// one during which a code is still accepted, to allow for clock drift.
+	Skew = 1
+	// SecretSize is the size in bytes of generated secrets
+	SecretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// decodeSecret decodes a base32 secret, ignoring spaces, case and padding
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return encoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// Counter returns the time step of the given time
+func Counter(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// HOTP returns the HMAC-SHA1 one-time password of RFC 4226
+// for the given key and counter, with the given number of digits.
+func HOTP(key []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := int64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+	mod := int64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Code returns the code of the given base32 secret at the given time.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return HOTP(key, Counter(t), Digits), nil
+}
+
+// Validate checks the given code against the given base32 secret at the given time.
+//
+// It returns the time step that matched, so that callers can refuse to
+// accept a code twice, and false if the code is invalid. Codes of time steps
+// lower or equal to lastCounter are always rejected.
+func Validate(code, secret string, t time.Time, lastCounter int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Counter(t)
+	for counter := current - Skew; counter <= current+Skew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(HOTP(key, counter, Digits)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI returns the otpauth:// URI that authenticator
+// applications scan to enroll the given account.
+func ProvisioningURI(secret, issuer, account string) string {
+	label := url.PathEscape(account)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	if issuer != "" {
+		params.Set("issuer", issuer)
+	}
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", Digits))
+	params.Set("period", fmt.Sprintf("%d", Period))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
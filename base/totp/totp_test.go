@@ -0,0 +1,72 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTOTP(t *testing.T) {
+	Convey("Testing TOTP codes", t, func() {
+		Convey("RFC 6238 test vectors (SHA1)", func() {
+			key := []byte("12345678901234567890")
+			vectors := map[int64]string{
+				59:          "94287082",
+				1111111109:  "07081804",
+				1111111111:  "14050471",
+				1234567890:  "89005924",
+				2000000000:  "69279037",
+				20000000000: "65353130",
+			}
+			for ts, code := range vectors {
+				So(HOTP(key, Counter(time.Unix(ts, 0)), 8), ShouldEqual, code)
+			}
+		})
+		Convey("Generated secrets are valid base32", func() {
+			secret, err := GenerateSecret()
+			So(err, ShouldBeNil)
+			key, err := decodeSecret(secret)
+			So(err, ShouldBeNil)
+			So(key, ShouldHaveLength, SecretSize)
+		})
+		Convey("Validating codes", func() {
+			secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+			now := time.Unix(1111111111, 0)
+			code, err := Code(secret, now)
+			So(err, ShouldBeNil)
+			So(code, ShouldEqual, "050471")
+			counter, ok := Validate(code, secret, now, 0)
+			So(ok, ShouldBeTrue)
+			So(counter, ShouldEqual, Counter(now))
+			Convey("Codes of the adjacent periods are accepted", func() {
+				_, ok = Validate(code, secret, now.Add(Period*time.Second), 0)
+				So(ok, ShouldBeTrue)
+				_, ok = Validate(code, secret, now.Add(-Period*time.Second), 0)
+				So(ok, ShouldBeTrue)
+				_, ok = Validate(code, secret, now.Add(3*Period*time.Second), 0)
+				So(ok, ShouldBeFalse)
+			})
+			Convey("Codes cannot be used twice", func() {
+				_, ok = Validate(code, secret, now, counter)
+				So(ok, ShouldBeFalse)
+			})
+			Convey("Wrong codes are rejected", func() {
+				_, ok = Validate("123456", secret, now, 0)
+				So(ok, ShouldBeFalse)
+				_, ok = Validate("12345", secret, now, 0)
+				So(ok, ShouldBeFalse)
+			})
+		})
+		Convey("Provisioning URI", func() {
+			uri := ProvisioningURI("JBSWY3DPEHPK3PXP", "My Company", "john@example.com")
+			So(uri, ShouldStartWith, "otpauth://totp/My%20Company:john@example.com?")
+			So(uri, ShouldContainSubstring, "secret=JBSWY3DPEHPK3PXP")
+			So(uri, ShouldContainSubstring, "issuer=My+Company")
+		})
+	})
+}
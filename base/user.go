@@ -4,11 +4,17 @@
 package base
 
 import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
 	"github.com/hexya-erp/hexya/hexya/actions"
 	"github.com/hexya-erp/hexya/hexya/models"
 	"github.com/hexya-erp/hexya/hexya/models/operator"
 	"github.com/hexya-erp/hexya/hexya/models/security"
 	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
 	"github.com/hexya-erp/hexya/hexya/tools/emailutils"
 	"github.com/hexya-erp/hexya/pool/h"
 	"github.com/hexya-erp/hexya/pool/q"
@@ -35,9 +41,8 @@ func init() {
 				userLines := h.UserChangePasswordWizardLine().NewSet(env)
 				for _, user := range h.User().Search(env, q.User().ID().In(activeIds)).Records() {
 					ul := h.UserChangePasswordWizardLine().Create(env, &h.UserChangePasswordWizardLineData{
-						User:        user,
-						UserLogin:   user.Login(),
-						NewPassword: user.Password(),
+						User:      user,
+						UserLogin: user.Login(),
 					})
 					userLines = userLines.Union(ul)
 				}
@@ -50,7 +55,10 @@ func init() {
 		It updates the user's password.`,
 		func(rs h.UserChangePasswordWizardSet) {
 			for _, userLine := range rs.Users().Records() {
-				userLine.User().SetPassword(userLine.NewPassword())
+				if msgs := userLine.User().CheckPasswordPolicy(userLine.NewPassword()); len(msgs) > 0 {
+					log.Panic(rs.T("Invalid password for user %s:\n%s", userLine.UserLogin(), strings.Join(msgs, "\n")))
+				}
+				userLine.User().UpdatePassword(userLine.NewPassword())
 			}
 		})
 
@@ -65,6 +73,13 @@ func init() {
 	userLogModel := h.UserLog().DeclareModel()
 	userLogModel.SetDefaultOrder("id desc")
 
+	passwordHistoryModel := h.UserPasswordHistory().DeclareModel()
+	passwordHistoryModel.SetDefaultOrder("id desc")
+	passwordHistoryModel.AddFields(map[string]models.FieldDefinition{
+		"User":     models.Many2OneField{RelationModel: h.User(), OnDelete: models.Cascade, Required: true, Index: true},
+		"Password": models.CharField{Required: true, Help: "Hash of a previous password of the user"},
+	})
+
 	userModel := h.User().DeclareModel()
 	userModel.SetDefaultOrder("Login")
 	userModel.AddFields(map[string]models.FieldDefinition{
@@ -73,7 +88,10 @@ func init() {
 		"Login": models.CharField{Required: true, Unique: true, Help: "Used to log into the system",
 			OnChange: h.User().Methods().OnchangeLogin()},
 		"Password": models.CharField{Default: models.DefaultValue(""), NoCopy: true,
-			Help: "Keep empty if you don't want the user to be able to connect on the system."},
+			Help: "Hash of the user's password. Keep empty if you don't want the user to be able to connect on the system."},
+		"PasswordDate": models.DateTimeField{String: "Last Password Change", NoCopy: true},
+		"LockedUntil": models.DateTimeField{NoCopy: true,
+			Help: "The user cannot log in until this date because of too many failed login attempts."},
 		"NewPassword": models.CharField{String: "Set Password", Compute: h.User().Methods().ComputePassword(),
 			Inverse: h.User().Methods().InversePassword(), Depends: []string{""},
 			Help: `Specify a value only when creating a user or if you're
@@ -133,7 +151,10 @@ a change of password, the user has to login again.`},
 			if rs.ID() == rs.Env().Uid() {
 				log.Panic(rs.T("Please use the change password wizard (in User Preferences or User menu) to change your own password."))
 			}
-			rs.SetPassword(rs.NewPassword())
+			if msgs := rs.CheckPasswordPolicy(rs.NewPassword()); len(msgs) > 0 {
+				log.Panic(strings.Join(msgs, "\n"))
+			}
+			rs.UpdatePassword(rs.NewPassword())
 		})
 
 	userModel.Methods().ComputeShare().DeclareMethod(
@@ -185,12 +206,12 @@ a change of password, the user has to login again.`},
 				}
 			}
 			result := rSet.Super().Read(fields)
-			if !rs.CheckExecutionPermission(h.User().Methods().Write().Underlying(), true) {
-				for i, res := range result {
-					if res["id"] != rs.Env().Uid() {
-						if _, exists := res["password"]; exists {
-							result[i]["password"] = "********"
-						}
+			// Never send password hashes, TOTP secrets and signup tokens to
+			// the client, not even to administrators or to the user himself.
+			for i, res := range result {
+				for _, secret := range []string{"password", "totp_secret", "signup_token"} {
+					if _, exists := res[secret]; exists {
+						result[i][secret] = "********"
 					}
 				}
 			}
@@ -203,11 +224,17 @@ a change of password, the user has to login again.`},
 			if cond.HasField(h.User().Fields().Password()) {
 				log.Panic(rs.T("Invalid search criterion: password"))
 			}
+			if cond.HasField(h.User().Fields().TOTPSecret()) {
+				log.Panic(rs.T("Invalid search criterion: totp_secret"))
+			}
 			return rs.Super().Search(cond)
 		})
 
 	userModel.Methods().Create().Extend("",
 		func(rs h.UserSet, vals *h.UserData, fieldsToReset ...models.FieldNamer) h.UserSet {
+			if vals.Password != "" && !IsPasswordHash(vals.Password) {
+				vals.Password = HashPassword(vals.Password)
+			}
 			user := rs.Super().Create(vals)
 			user.Partner().SetActive(user.Active())
 			if !user.Partner().Company().IsEmpty() {
@@ -228,6 +255,10 @@ a change of password, the user has to login again.`},
 					}
 				}
 			}
+			if val, exists := data.Get(h.User().Password(), fieldsToUnset...); exists && val.(string) != "" && !IsPasswordHash(val.(string)) {
+				// Writing a cleartext password would skip the password policy and history
+				log.Panic(rs.T("Passwords cannot be written directly, use UpdatePassword instead."))
+			}
 			rSet := rs
 			if rs.ID() == rs.Env().Uid() {
 				var hasUnsafeFields bool
@@ -248,6 +279,9 @@ a change of password, the user has to login again.`},
 				}
 			}
 			res := rSet.Super().Write(data, fieldsToUnset...)
+			if val, exists := data.Get(h.User().Active(), fieldsToUnset...); exists && !val.(bool) {
+				rs.RevokeSessions()
+			}
 			if _, ok := data.Get(h.User().Groups(), fieldsToUnset...); ok {
 				// We get groups before removing all memberships otherwise we might get stuck with permissions if we
 				// are modifying our own user memberships.
@@ -342,38 +376,236 @@ a change of password, the user has to login again.`},
 				err = security.UserNotFoundError(login)
 				return
 			}
-			if user.Password() == "" || user.Password() != secret {
+			ok, needsRehash := CheckPassword(secret, user.Password())
+			if !ok {
 				err = security.InvalidCredentialsError(login)
 				return
 			}
+			if needsRehash {
+				// Upgrade cleartext passwords and outdated hashes
+				user.Sudo().SetPassword(HashPassword(secret))
+			}
 			uid = user.ID()
 			return
 		})
 
 	userModel.Methods().Authenticate().DeclareMethod(
-		"Authenticate the user defined by login and secret",
+		`Authenticate the user defined by login and secret.
+
+		Each attempt is recorded in the authentication log. Clients that failed too many
+		times for the same login or from the same IP address ('client_ip' key of the context)
+		must wait before trying again, and the account is temporarily locked if failures go on.
+
+		If the user has enabled two-factor authentication or is required to, the returned
+		uid must not be logged in before AuthenticateTOTP succeeds.`,
 		func(rs h.UserSet, login, secret string) (uid int64, err error) {
+			user := rs.Sudo().Search(q.User().Login().Equals(login))
+			if err = checkLoginThrottle(user, login); err != nil {
+				return 0, err
+			}
+			authLog := h.AuthLog().NewSet(rs.Env())
 			uid, err = rs.CheckCredentials(login, secret)
 			if err != nil {
-				rs.UpdateLastLogin()
+				authLog.Record(login, "failure", err.Error())
+				if !user.IsEmpty() {
+					user.CheckLockout()
+				}
+				return
 			}
+			// The user may have been created by CheckCredentials
+			h.User().NewSet(rs.Env()).Sudo().Browse([]int64{uid}).RecordLogin("")
 			return
 		})
 
+	userModel.Methods().RecordLogin().DeclareMethod(
+		`RecordLogin records in the authentication log that this user has been authenticated,
+		with the given message. If he must also use two-factor authentication, it only records
+		that his first factor has been verified, and AuthenticateTOTP must follow.`,
+		func(rs h.UserSet, message string) {
+			rs.EnsureOne()
+			authLog := h.AuthLog().NewSet(rs.Env())
+			user := rs.Sudo()
+			if user.TOTPEnabled() || user.TOTPRequired() {
+				// Failures are not forgotten until the second factor is checked
+				authLog.Record(user.Login(), "password", message)
+				return
+			}
+			authLog.Record(user.Login(), "success", message)
+			rs.UpdateLastLogin()
+		})
+
+	userModel.Methods().CheckLockout().DeclareMethod(
+		`CheckLockout locks this user account if there have been too many
+		failed login attempts since the last successful one.`,
+		func(rs h.UserSet) {
+			rs.EnsureOne()
+			throttle := getLoginThrottle(rs.Env())
+			if throttle.LockAfter == 0 {
+				return
+			}
+			if count, _ := h.AuthLog().NewSet(rs.Env()).LoginFailures(rs.Login()); count < throttle.LockAfter {
+				return
+			}
+			lockedUntil := dates.DateTime{Time: time.Now().Add(throttle.LockDuration)}
+			rs.Sudo().SetLockedUntil(lockedUntil)
+			h.AuthLog().NewSet(rs.Env()).Record(rs.Login(), "locked", fmt.Sprintf("Locked until %s", lockedUntil))
+			log.Warn("User account locked after too many failed login attempts", "login", rs.Login(), "until", lockedUntil)
+		})
+
+	userModel.Methods().ActionUnlock().DeclareMethod(
+		`ActionUnlock unlocks the accounts of these users and forgets their failed login attempts.`,
+		func(rs h.UserSet) bool {
+			for _, user := range rs.Records() {
+				user.Sudo().SetLockedUntil(dates.DateTime{})
+				h.AuthLog().NewSet(rs.Env()).Record(user.Login(), "unlock",
+					fmt.Sprintf("Unlocked by %s", h.User().NewSet(rs.Env()).CurrentUser().Sudo().Login()))
+			}
+			return true
+		})
+
+	userModel.Methods().VerifyPassword().DeclareMethod(
+		`VerifyPassword checks the given password of this user. Attempts are throttled and
+		failures are recorded in the authentication log as in Authenticate, so that the
+		password cannot be guessed from a hijacked session.
+
+		It returns an AccountLockedError while the client must wait before trying again,
+		and the error of CheckCredentials if the password is wrong.`,
+		func(rs h.UserSet, password string) error {
+			rs.EnsureOne()
+			user := rs.Sudo()
+			if err := checkLoginThrottle(user, user.Login()); err != nil {
+				return err
+			}
+			uid, err := rs.CheckCredentials(user.Login(), password)
+			if err == nil && uid != rs.ID() {
+				err = security.InvalidCredentialsError(user.Login())
+			}
+			if err != nil {
+				h.AuthLog().NewSet(rs.Env()).Record(user.Login(), "failure", err.Error())
+				user.CheckLockout()
+				return err
+			}
+			return nil
+		})
+
 	userModel.Methods().ChangePassword().DeclareMethod(
 		`ChangePassword changes current user password. Old password must be provided explicitly
         to prevent hijacking an existing user session, or for cases where the cleartext
-        password is not used to authenticate requests. It returns true or panics.`,
+        password is not used to authenticate requests. The old password is verified with
+        VerifyPassword.
+
+        It returns false if the old password is refused, so that the failure is recorded
+        when the transaction is committed, true if the password is changed, and panics if
+        the new password does not match the password policy.`,
 		func(rs h.UserSet, oldPassword, newPassword string) bool {
 			currentUser := h.User().NewSet(rs.Env()).CurrentUser()
-			uid, err := rs.CheckCredentials(currentUser.Login(), oldPassword)
-			if err != nil || rs.Env().Uid() != uid {
-				log.Panic("Invalid password", "user", currentUser.Login(), "uid", uid)
+			if err := currentUser.VerifyPassword(oldPassword); err != nil {
+				log.Info("Invalid password", "user", currentUser.Login(), "error", err)
+				return false
+			}
+			if msgs := currentUser.CheckPasswordPolicy(newPassword); len(msgs) > 0 {
+				log.Panic(strings.Join(msgs, "\n"))
 			}
-			currentUser.SetPassword(newPassword)
+			currentUser.UpdatePassword(newPassword)
 			return true
 		})
 
+	userModel.Methods().CheckPasswordPolicy().DeclareMethod(
+		`CheckPasswordPolicy checks the given password against the password policy of
+		this user's company. It returns a translated message for each violated rule, so
+		that an empty slice means that the password can be used.
+
+		This method must be called on a singleton.`,
+		func(rs h.UserSet, password string) []string {
+			rs.EnsureOne()
+			policy := getPasswordPolicy(rs.Env(), rs.Sudo().Company())
+			var msgs []string
+			if strings.TrimSpace(password) == "" {
+				return []string{rs.T("The password cannot be empty.")}
+			}
+			if utf8.RuneCountInString(password) < policy.MinLength {
+				msgs = append(msgs, rs.T("The password must contain at least %d characters.", policy.MinLength))
+			}
+			classNames := map[string]string{
+				"lower":   rs.T("a lowercase letter"),
+				"upper":   rs.T("an uppercase letter"),
+				"digit":   rs.T("a digit"),
+				"special": rs.T("a special character"),
+			}
+			for _, class := range policy.RequiredClasses {
+				if !passwordHasClass(password, class) {
+					msgs = append(msgs, rs.T("The password must contain %s.", classNames[class]))
+				}
+			}
+			switch {
+			case strings.EqualFold(password, rs.Sudo().Login()):
+				msgs = append(msgs, rs.T("The password cannot be the same as the login."))
+			case policy.Common[strings.ToLower(password)]:
+				msgs = append(msgs, rs.T("This password is too common and easy to guess."))
+			}
+			if policy.HistorySize > 0 {
+				previous := []string{rs.Sudo().Password()}
+				if policy.HistorySize > 1 {
+					history := h.UserPasswordHistory().NewSet(rs.Env()).Sudo().
+						Search(q.UserPasswordHistory().User().Equals(rs)).
+						Limit(policy.HistorySize - 1)
+					for _, hist := range history.Records() {
+						previous = append(previous, hist.Password())
+					}
+				}
+				for _, hash := range previous {
+					if ok, _ := CheckPassword(password, hash); ok {
+						msgs = append(msgs, rs.T("You cannot reuse any of your last %d passwords.", policy.HistorySize))
+						break
+					}
+				}
+			}
+			return msgs
+		})
+
+	userModel.Methods().UpdatePassword().DeclareMethod(
+		`UpdatePassword sets the password of the users of this RecordSet to the given cleartext value.
+		The password is hashed and the previous one is kept in the password history if the
+		password policy requires it. All the sessions of the users are revoked. The password
+		policy itself is not checked by this method, use CheckPasswordPolicy beforehand.`,
+		func(rs h.UserSet, password string) {
+			for _, user := range rs.Sudo().Records() {
+				// The current password is always checked, so we only need
+				// to keep the historySize-1 previous ones.
+				if historySize := getPasswordPolicy(rs.Env(), user.Company()).HistorySize; historySize > 1 && user.Password() != "" {
+					h.UserPasswordHistory().Create(user.Env(), &h.UserPasswordHistoryData{
+						User:     user,
+						Password: user.Password(),
+					})
+					h.UserPasswordHistory().Search(user.Env(), q.UserPasswordHistory().User().Equals(user)).
+						Offset(historySize - 1).Unlink()
+				}
+				user.Write(&h.UserData{
+					Password:     HashPassword(password),
+					PasswordDate: dates.Now(),
+				})
+			}
+			rs.RevokeSessions()
+		})
+
+	userModel.Methods().PasswordExpired().DeclareMethod(
+		`PasswordExpired returns true if the password of this user is older than the
+		maximum password age of the password policy. In this case, the user is asked
+		to change his password at the next login. Users without local password, such as
+		those authenticated by an external directory or provider, never expire.`,
+		func(rs h.UserSet) bool {
+			rs.EnsureOne()
+			maxAge := getPasswordPolicy(rs.Env(), rs.Sudo().Company()).MaxAge
+			if maxAge == 0 || rs.Sudo().Password() == "" {
+				return false
+			}
+			lastChange := rs.Sudo().PasswordDate()
+			if lastChange.IsZero() {
+				lastChange = rs.Sudo().CreateDate()
+			}
+			return lastChange.Time.AddDate(0, 0, maxAge).Before(time.Now())
+		})
+
 	userModel.Methods().PreferenceSave().DeclareMethod(
 		`PreferenceSave is called when validating the preferences popup`,
 		func(rs h.UserSet) *actions.Action {
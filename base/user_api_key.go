@@ -0,0 +1,244 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/actions"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// apiKeyPrefix is prepended to all generated API keys, so that
+// they can easily be told apart from other secrets.
+const apiKeyPrefix = "hxk_"
+
+// APIKeyReadMethods is the set of methods that API keys with the 'read' scope
+// are allowed to call. Modules may add their own read-only methods to this set.
+var APIKeyReadMethods = map[string]bool{
+	"Load":          true,
+	"Read":          true,
+	"Search":        true,
+	"SearchRead":    true,
+	"SearchCount":   true,
+	"ReadGroup":     true,
+	"NameGet":       true,
+	"NameSearch":    true,
+	"FieldsGet":     true,
+	"FieldsViewGet": true,
+	"LoadViews":     true,
+	"DefaultGet":    true,
+	"GetFormviewId": true,
+}
+
+// hashAPIKey returns the value stored in the database for the given API key.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkAPIKeyOwner panics if the current user is not a user manager and
+// does not own all the API keys with the given IDs.
+func checkAPIKeyOwner(env models.Environment, keyIDs []int64) {
+	if len(keyIDs) == 0 || isUserManager(env) {
+		return
+	}
+	var count int
+	env.Cr().Get(&count, "SELECT COUNT(*) FROM user_api_key WHERE id IN (?) AND user_id <> ?",
+		keyIDs, env.Uid())
+	if count > 0 {
+		log.Panic(h.UserAPIKey().NewSet(env).T("You can only access your own API keys."))
+	}
+}
+
+func init() {
+	apiKeyModel := h.UserAPIKey().DeclareModel()
+	apiKeyModel.SetDefaultOrder("CreateDate desc")
+	apiKeyModel.AddFields(map[string]models.FieldDefinition{
+		"Name": models.CharField{Required: true,
+			Help: "Name of the integration or script using this key"},
+		"User": models.Many2OneField{RelationModel: h.User(), OnDelete: models.Cascade, Required: true,
+			Index: true},
+		"KeyHash": models.CharField{Required: true, Unique: true, Index: true, NoCopy: true,
+			Help: "Hash of the API key"},
+		"Prefix": models.CharField{NoCopy: true,
+			Help: "First characters of the API key, to help recognizing it"},
+		"Scope": models.SelectionField{Selection: types.Selection{
+			"read":  "Read Only",
+			"write": "Read & Write",
+		}, Required: true, Default: models.DefaultValue("write"),
+			Help: "Read only keys can only call methods that do not modify data"},
+		"ExpirationDate": models.DateTimeField{
+			Help: "Leave empty for a key that never expires"},
+		"LastUsed": models.DateTimeField{ReadOnly: true, NoCopy: true},
+	})
+
+	apiKeyModel.Methods().Generate().DeclareMethod(
+		`Generate creates a new API key for the given user and returns it.
+		Only a hash of the key is stored, so that it cannot be displayed again.`,
+		func(rs h.UserAPIKeySet, user h.UserSet, name, scope string, expirationDate dates.DateTime) string {
+			user.EnsureOne()
+			if !isUserManager(rs.Env()) && user.ID() != rs.Env().Uid() {
+				log.Panic(rs.T("You can only create API keys for yourself."))
+			}
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				log.Panic("Unable to generate API key", "error", err)
+			}
+			key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+			if scope == "" {
+				scope = "write"
+			}
+			rs.Sudo().Create(&h.UserAPIKeyData{
+				Name:           name,
+				User:           user,
+				KeyHash:        hashAPIKey(key),
+				Prefix:         key[:len(apiKeyPrefix)+6],
+				Scope:          scope,
+				ExpirationDate: expirationDate,
+			})
+			log.Info("API key created", "user", user.Login(), "name", name, "uid", rs.Env().Uid())
+			return key
+		})
+
+	apiKeyModel.Methods().Check().DeclareMethod(
+		`Check returns the API key record matching the given key if it is valid, and records
+		its use. It returns an empty recordset if the key does not exist, has been revoked
+		or has expired, or if its user has been deactivated.`,
+		func(rs h.UserAPIKeySet, key string) h.UserAPIKeySet {
+			if !strings.HasPrefix(key, apiKeyPrefix) {
+				return h.UserAPIKey().NewSet(rs.Env())
+			}
+			apiKey := rs.Sudo().Search(q.UserAPIKey().KeyHash().Equals(hashAPIKey(key)))
+			if apiKey.IsEmpty() {
+				return apiKey
+			}
+			now := time.Now()
+			if !apiKey.User().Active() ||
+				!apiKey.ExpirationDate().IsZero() && apiKey.ExpirationDate().Time.Before(now) {
+				return h.UserAPIKey().NewSet(rs.Env())
+			}
+			if apiKey.LastUsed().Time.Add(sessionActivityPrecision).Before(now) {
+				apiKey.SetLastUsed(dates.Now())
+			}
+			return apiKey
+		})
+
+	apiKeyModel.Methods().AllowsMethod().DeclareMethod(
+		`AllowsMethod returns true if this API key may be used to call the given method`,
+		func(rs h.UserAPIKeySet, method string) bool {
+			rs.EnsureOne()
+			return rs.Scope() == "write" || APIKeyReadMethods[method]
+		})
+
+	apiKeyModel.Methods().ActionRevoke().DeclareMethod(
+		`ActionRevoke deletes these API keys. Scripts using them are rejected at their next request.`,
+		func(rs h.UserAPIKeySet) bool {
+			if !isUserManager(rs.Env()) {
+				for _, apiKey := range rs.Sudo().Records() {
+					if apiKey.User().ID() != rs.Env().Uid() {
+						log.Panic(rs.T("You can only revoke your own API keys."))
+					}
+				}
+			}
+			log.Info("API keys revoked", "keys", rs.Ids(), "uid", rs.Env().Uid())
+			rs.Sudo().Unlink()
+			return true
+		})
+
+	apiKeyModel.Methods().Load().Extend("",
+		func(rs h.UserAPIKeySet, fields ...string) h.UserAPIKeySet {
+			checkAPIKeyOwner(rs.Env(), rs.Ids())
+			return rs.Super().Load(fields...)
+		})
+
+	apiKeyModel.Methods().Search().Extend("",
+		func(rs h.UserAPIKeySet, cond q.UserAPIKeyCondition) h.UserAPIKeySet {
+			if isUserManager(rs.Env()) {
+				return rs.Super().Search(cond)
+			}
+			// Users can only see their own API keys
+			return rs.Super().Search(q.UserAPIKey().User().Equals(h.User().NewSet(rs.Env()).CurrentUser()).AndCond(cond))
+		})
+
+	userModel := h.User()
+	userModel.AddFields(map[string]models.FieldDefinition{
+		"APIKeys": models.One2ManyField{String: "API Keys", RelationModel: h.UserAPIKey(), ReverseFK: "User",
+			JSON: "api_key_ids", NoCopy: true},
+	})
+
+	userModel.Methods().ActionMyAPIKeys().DeclareMethod(
+		`ActionMyAPIKeys returns the action listing the API keys of the current user`,
+		func(rs h.UserSet) *actions.Action {
+			return &actions.Action{
+				Name:     rs.T("My API Keys"),
+				Type:     actions.ActionActWindow,
+				Model:    "UserAPIKey",
+				ViewMode: "tree",
+				Domain:   fmt.Sprintf("[('user_id', '=', %d)]", rs.Env().Uid()),
+				Target:   "current",
+			}
+		})
+
+	userModel.Methods().PreferenceNewAPIKey().DeclareMethod(
+		`PreferenceNewAPIKey returns the action to create a new API key for the current user.`,
+		func(rs h.UserSet) *actions.Action {
+			return &actions.Action{
+				Name:     rs.T("New API Key"),
+				Type:     actions.ActionActWindow,
+				Model:    "UserAPIKeyWizard",
+				ViewMode: "form",
+				Target:   "new",
+			}
+		})
+
+	apiKeyWizard := h.UserAPIKeyWizard().DeclareTransientModel()
+	apiKeyWizard.AddFields(map[string]models.FieldDefinition{
+		"Name": models.CharField{Help: "Name of the integration or script using this key"},
+		"Scope": models.SelectionField{Selection: types.Selection{
+			"read":  "Read Only",
+			"write": "Read & Write",
+		}, Default: models.DefaultValue("write")},
+		"ExpirationDate": models.DateTimeField{Help: "Leave empty for a key that never expires"},
+		"State": models.SelectionField{Selection: types.Selection{
+			"draft": "Draft",
+			"done":  "Done",
+		}, Default: models.DefaultValue("draft")},
+		"Key": models.CharField{String: "API Key", ReadOnly: true},
+	})
+
+	apiKeyWizard.Methods().ActionGenerate().DeclareMethod(
+		`ActionGenerate is called when the user clicks on 'Generate' in the wizard.
+		It creates the API key of the current user and displays it.`,
+		func(rs h.UserAPIKeyWizardSet) *actions.Action {
+			rs.EnsureOne()
+			if strings.TrimSpace(rs.Name()) == "" {
+				log.Panic(rs.T("Please give a name to your API key."))
+			}
+			key := h.UserAPIKey().NewSet(rs.Env()).Generate(
+				h.User().NewSet(rs.Env()).CurrentUser(), rs.Name(), rs.Scope(), rs.ExpirationDate())
+			rs.Write(&h.UserAPIKeyWizardData{
+				State: "done",
+				Key:   key,
+			})
+			return &actions.Action{
+				Name:     rs.T("New API Key"),
+				Type:     actions.ActionActWindow,
+				Model:    "UserAPIKeyWizard",
+				ViewMode: "form",
+				ResID:    rs.ID(),
+				Target:   "new",
+			}
+		})
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUserAPIKeys(t *testing.T) {
+	Convey("Testing user API keys", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			userJohn := h.User().Create(env, &h.UserData{
+				Name:     "John Smith",
+				Login:    "jsmith",
+				Password: "Secret-123",
+			})
+			apiKeys := h.UserAPIKey().NewSet(env)
+			key := apiKeys.Generate(userJohn, "Integration", "write", dates.DateTime{})
+			readKey := apiKeys.Generate(userJohn, "Reporting", "read", dates.DateTime{})
+			Convey("Keys are unique and not stored in clear", func() {
+				So(key, ShouldStartWith, apiKeyPrefix)
+				So(key, ShouldNotEqual, readKey)
+				So(userJohn.APIKeys().Len(), ShouldEqual, 2)
+				for _, apiKey := range userJohn.APIKeys().Records() {
+					So(apiKey.KeyHash(), ShouldNotBeIn, []string{key, readKey})
+					So(strings.HasPrefix(key, apiKey.Prefix()) || strings.HasPrefix(readKey, apiKey.Prefix()), ShouldBeTrue)
+				}
+			})
+			Convey("Checking keys", func() {
+				apiKey := apiKeys.Check(key)
+				So(apiKey.IsEmpty(), ShouldBeFalse)
+				So(apiKey.User().Equals(userJohn), ShouldBeTrue)
+				So(apiKey.Name(), ShouldEqual, "Integration")
+				So(apiKey.LastUsed().IsZero(), ShouldBeFalse)
+				So(apiKeys.Check("unknown").IsEmpty(), ShouldBeTrue)
+				So(apiKeys.Check(apiKeyPrefix+"unknown").IsEmpty(), ShouldBeTrue)
+				So(apiKeys.Check("").IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Key scopes", func() {
+				So(apiKeys.Check(key).AllowsMethod("Write"), ShouldBeTrue)
+				So(apiKeys.Check(key).AllowsMethod("SearchRead"), ShouldBeTrue)
+				So(apiKeys.Check(readKey).AllowsMethod("Write"), ShouldBeFalse)
+				So(apiKeys.Check(readKey).AllowsMethod("Unlink"), ShouldBeFalse)
+				So(apiKeys.Check(readKey).AllowsMethod("SearchRead"), ShouldBeTrue)
+			})
+			Convey("Revoking a key", func() {
+				apiKeys.Check(key).ActionRevoke()
+				So(apiKeys.Check(key).IsEmpty(), ShouldBeTrue)
+				So(apiKeys.Check(readKey).IsEmpty(), ShouldBeFalse)
+			})
+			Convey("Expired keys are rejected", func() {
+				expiredKey := apiKeys.Generate(userJohn, "Old", "write", dates.DateTime{Time: time.Now().Add(-time.Hour)})
+				futureKey := apiKeys.Generate(userJohn, "New", "write", dates.DateTime{Time: time.Now().Add(time.Hour)})
+				So(apiKeys.Check(expiredKey).IsEmpty(), ShouldBeTrue)
+				So(apiKeys.Check(futureKey).IsEmpty(), ShouldBeFalse)
+			})
+			Convey("Keys of inactive users are rejected", func() {
+				userJohn.SetActive(false)
+				So(apiKeys.Check(key).IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Users can only create keys for themselves", func() {
+				userJane := h.User().Create(env, &h.UserData{
+					Name:  "Jane Smith",
+					Login: "jane",
+				})
+				So(func() {
+					apiKeys.Sudo(userJohn.ID()).Generate(userJane, "Stolen", "write", dates.DateTime{})
+				}, ShouldPanic)
+				So(func() {
+					apiKeys.Sudo(userJohn.ID()).Generate(userJohn, "Mine", "write", dates.DateTime{})
+				}, ShouldNotPanic)
+			})
+			Convey("Users can only read their own keys", func() {
+				userJane := h.User().Create(env, &h.UserData{
+					Name:  "Jane Smith",
+					Login: "jane",
+				})
+				apiKey := apiKeys.Check(key)
+				So(func() { apiKey.Sudo(userJane.ID()).Load() }, ShouldPanic)
+				So(func() { apiKey.Sudo(userJohn.ID()).Load() }, ShouldNotPanic)
+				So(func() { apiKey.Load() }, ShouldNotPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
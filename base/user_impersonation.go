@@ -0,0 +1,116 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"github.com/hexya-erp/hexya/hexya/actions"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// isAdmin returns true if the user with the given id is the super user
+// or a member of the GroupERPManager group.
+func isAdmin(uid int64) bool {
+	return uid == security.SuperUserID || security.Registry.HasMembership(uid, GroupERPManager)
+}
+
+func init() {
+	impersonationModel := h.UserImpersonation().DeclareModel()
+	impersonationModel.SetDefaultOrder("id desc")
+	impersonationModel.AddFields(map[string]models.FieldDefinition{
+		"Admin": models.Many2OneField{RelationModel: h.User(), OnDelete: models.Restrict, Required: true,
+			Index: true, Help: "User who logged in as another user"},
+		"User": models.Many2OneField{String: "Impersonated User", RelationModel: h.User(),
+			OnDelete: models.Restrict, Required: true, Index: true},
+		"IP":      models.CharField{String: "IP Address"},
+		"EndDate": models.DateTimeField{Help: "Date at which the admin returned to their own account"},
+	})
+
+	impersonationModel.Methods().Start().DeclareMethod(
+		`Start checks that the given admin may log in as the given user and records
+		the beginning of the impersonation. The client IP address is taken from the
+		'client_ip' key of the context.`,
+		func(rs h.UserImpersonationSet, admin, user h.UserSet) h.UserImpersonationSet {
+			admin.EnsureOne()
+			user.EnsureOne()
+			switch {
+			case !isAdmin(admin.ID()):
+				log.Panic(rs.T("You are not allowed to log in as another user."))
+			case admin.Equals(user):
+				log.Panic(rs.T("You cannot log in as yourself."))
+			case isAdmin(user.ID()):
+				log.Panic(rs.T("You cannot log in as an administrator."))
+			case !user.Sudo().Active():
+				log.Panic(rs.T("You cannot log in as an inactive user."))
+			}
+			log.Info("Impersonation started", "admin", admin.Login(), "user", user.Login())
+			return rs.Sudo().Create(&h.UserImpersonationData{
+				Admin: admin,
+				User:  user,
+				IP:    rs.Env().Context().GetString("client_ip"),
+			})
+		})
+
+	impersonationModel.Methods().Stop().DeclareMethod(
+		`Stop records the end of all the running impersonations of the given user by the given admin`,
+		func(rs h.UserImpersonationSet, admin, user h.UserSet) {
+			running := rs.Sudo().Search(q.UserImpersonation().Admin().Equals(admin).
+				And().User().Equals(user).
+				And().EndDate().IsNull())
+			if running.IsEmpty() {
+				return
+			}
+			log.Info("Impersonation stopped", "admin", admin.Login(), "user", user.Login())
+			running.SetEndDate(dates.Now())
+		})
+
+	impersonationModel.Methods().StopAll().DeclareMethod(
+		`StopAll records the end of all the running impersonations by the given admins`,
+		func(rs h.UserImpersonationSet, admins h.UserSet) {
+			running := rs.Sudo().Search(q.UserImpersonation().Admin().In(admins).
+				And().EndDate().IsNull())
+			if running.IsEmpty() {
+				return
+			}
+			log.Info("Impersonations stopped", "admins", admins.Ids())
+			running.SetEndDate(dates.Now())
+		})
+
+	h.UserSession().Methods().Unlink().Extend("",
+		func(rs h.UserSessionSet) int64 {
+			// The impersonations of admins whose sessions have all expired or
+			// have been revoked are over, even if they did not return to their account.
+			admins := h.User().NewSet(rs.Env())
+			for _, session := range rs.Sudo().Records() {
+				admins = admins.Union(session.User())
+			}
+			res := rs.Super().Unlink()
+			loggedOut := h.User().NewSet(rs.Env())
+			for _, admin := range admins.Records() {
+				if h.UserSession().NewSet(rs.Env()).Sudo().Search(q.UserSession().User().Equals(admin)).IsEmpty() {
+					loggedOut = loggedOut.Union(admin)
+				}
+			}
+			if !loggedOut.IsEmpty() {
+				h.UserImpersonation().NewSet(rs.Env()).StopAll(loggedOut)
+			}
+			return res
+		})
+
+	h.User().Methods().ActionImpersonate().DeclareMethod(
+		`ActionImpersonate is called when clicking 'Log In As This User' on the user form.
+		It returns the client action that swaps the user of the current session.`,
+		func(rs h.UserSet) *actions.Action {
+			rs.EnsureOne()
+			return &actions.Action{
+				Type:    actions.ActionClient,
+				Tag:     "impersonate",
+				Context: types.NewContext().WithKey("impersonate_uid", rs.ID()),
+			}
+		})
+}
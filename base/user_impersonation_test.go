@@ -0,0 +1,71 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUserImpersonation(t *testing.T) {
+	Convey("Testing user impersonation", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.Group().NewSet(env).ReloadGroups()
+			managerGroup := h.Group().Search(env, q.Group().GroupID().Equals(GroupERPManager.ID))
+			userAdmin := h.User().Create(env, &h.UserData{
+				Name:   "Support Admin",
+				Login:  "support",
+				Groups: managerGroup,
+			})
+			userJohn := h.User().Create(env, &h.UserData{
+				Name:  "John Smith",
+				Login: "jsmith",
+			})
+			h.Group().NewSet(env).ReloadGroups()
+			impersonations := h.UserImpersonation().NewSet(env).WithContext("client_ip", "10.0.0.1")
+			Convey("Admins can log in as other users", func() {
+				impersonation := impersonations.Start(userAdmin, userJohn)
+				So(impersonation.Admin().Equals(userAdmin), ShouldBeTrue)
+				So(impersonation.User().Equals(userJohn), ShouldBeTrue)
+				So(impersonation.IP(), ShouldEqual, "10.0.0.1")
+				So(impersonation.EndDate().IsZero(), ShouldBeTrue)
+				Convey("Stopping the impersonation records its end date", func() {
+					impersonations.Stop(userAdmin, userJohn)
+					So(impersonation.EndDate().IsZero(), ShouldBeFalse)
+				})
+				Convey("The impersonation ends with the sessions of the admin", func() {
+					sessions := h.UserSession().NewSet(env)
+					sessionID := sessions.Open(userAdmin, "10.0.0.1", "test")
+					otherID := sessions.Open(userAdmin, "10.0.0.2", "test")
+					sessions.Revoke(otherID)
+					So(impersonation.EndDate().IsZero(), ShouldBeTrue)
+					sessions.Revoke(sessionID)
+					So(impersonation.EndDate().IsZero(), ShouldBeFalse)
+				})
+			})
+			Convey("Users cannot log in as other users", func() {
+				userJane := h.User().Create(env, &h.UserData{
+					Name:  "Jane Smith",
+					Login: "jane",
+				})
+				So(func() { impersonations.Start(userJohn, userJane) }, ShouldPanic)
+			})
+			Convey("Admins cannot log in as other admins or themselves", func() {
+				So(func() { impersonations.Start(userAdmin, userAdmin) }, ShouldPanic)
+				So(func() {
+					impersonations.Start(userAdmin, h.User().Browse(env, []int64{security.SuperUserID}))
+				}, ShouldPanic)
+			})
+			Convey("Admins cannot log in as inactive users", func() {
+				userJohn.SetActive(false)
+				So(func() { impersonations.Start(userAdmin, userJohn) }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
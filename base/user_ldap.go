@@ -0,0 +1,308 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	"gopkg.in/ldap.v2"
+)
+
+// dialLDAP opens a connection to the directory of the given LDAP server
+// configuration, using TLS if the URL scheme is ldaps or if StartTLS is set.
+func dialLDAP(server h.LDAPServerSet) (*ldap.Conn, error) {
+	u, err := url.Parse(server.URL())
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	port := u.Port()
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: server.TLSSkipVerify(),
+	}
+	var conn *ldap.Conn
+	switch u.Scheme {
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+		conn, err = ldap.DialTLS("tcp", net.JoinHostPort(host, port), tlsConfig)
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+		conn, err = ldap.Dial("tcp", net.JoinHostPort(host, port))
+		if err == nil && server.StartTLS() {
+			if err = conn.StartTLS(tlsConfig); err != nil {
+				conn.Close()
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported LDAP URL scheme '%s'", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func init() {
+	ldapServerModel := h.LDAPServer().DeclareModel()
+	ldapServerModel.SetDefaultOrder("Sequence", "ID")
+	ldapServerModel.AddFields(map[string]models.FieldDefinition{
+		"Company":  models.Many2OneField{RelationModel: h.Company(), Required: true, OnDelete: models.Cascade, Index: true},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(10)},
+		"URL": models.CharField{String: "Server URL", Required: true,
+			Default: models.DefaultValue("ldap://localhost:389"),
+			Help:    "URL of the LDAP server, such as ldap://ldap.example.com or ldaps://ldap.example.com:636"},
+		"StartTLS": models.BooleanField{String: "Use StartTLS",
+			Help: "Upgrade the connection to TLS with StartTLS. Not needed with ldaps:// URLs."},
+		"TLSSkipVerify": models.BooleanField{String: "Skip TLS Certificate Verification",
+			Help: "Do not verify the certificate of the server. Only use this for testing."},
+		"BindDN": models.CharField{String: "Bind DN",
+			Help: "DN of the account used to search the directory. Leave empty for anonymous search."},
+		"BindPassword": models.CharField{String: "Bind Password", NoCopy: true},
+		"BaseDN": models.CharField{String: "Base DN", Required: true,
+			Help: "DN of the subtree in which users are searched"},
+		"Filter": models.CharField{Required: true, Default: models.DefaultValue("(uid=%s)"),
+			Help:       "LDAP filter to find a user entry. %s is replaced by the escaped login.",
+			Constraint: h.LDAPServer().Methods().CheckFilter()},
+		"CreateUser": models.BooleanField{String: "Create Users", Default: models.DefaultValue(true),
+			Help: "Automatically create local users for directory users at their first login"},
+		"UserTemplate": models.Many2OneField{RelationModel: h.User(), OnDelete: models.SetNull,
+			Help: "User whose groups are given to the users created at their first login"},
+		"AttributeMapping": models.TextField{Default: models.DefaultValue("Name=cn\nEmail=mail"),
+			Help: "Partner fields updated from directory attributes at each login, one 'Field=attribute' per line"},
+		"SyncGroups": models.BooleanField{String: "Synchronize Groups",
+			Help: "Update the membership of the mapped groups from the directory at each login"},
+		"GroupAttribute": models.CharField{Default: models.DefaultValue("memberOf"),
+			Help: "Attribute of user entries listing the DN of their directory groups"},
+		"GroupMappings": models.One2ManyField{RelationModel: h.LDAPGroupMapping(), ReverseFK: "Server",
+			JSON: "group_mapping_ids"},
+	})
+
+	ldapServerModel.Methods().CheckFilter().DeclareMethod(
+		`CheckFilter checks that the user filter contains exactly one placeholder for the login`,
+		func(rs h.LDAPServerSet) {
+			if strings.Count(rs.Filter(), "%s") != 1 {
+				log.Panic(rs.T("The LDAP filter must contain '%%s' exactly once"))
+			}
+		})
+
+	ldapServerModel.Methods().FindUser().DeclareMethod(
+		`FindUser searches the directory for the given login and returns the DN of the
+		user entry and its attributes. It returns an error if there is not exactly one entry.`,
+		func(rs h.LDAPServerSet, login string) (string, map[string][]string, error) {
+			rs.EnsureOne()
+			conn, err := dialLDAP(rs)
+			if err != nil {
+				return "", nil, err
+			}
+			defer conn.Close()
+			return findLDAPUser(rs, conn, login)
+		})
+
+	ldapServerModel.Methods().AuthenticateUser().DeclareMethod(
+		`AuthenticateUser checks the given credentials against this directory by binding
+		as the user entry matching the login. It returns the attributes of the entry.`,
+		func(rs h.LDAPServerSet, login, password string) (map[string][]string, error) {
+			rs.EnsureOne()
+			if password == "" {
+				// An empty password would be an unauthenticated bind, which always succeeds
+				return nil, security.InvalidCredentialsError(login)
+			}
+			conn, err := dialLDAP(rs)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			dn, attrs, err := findLDAPUser(rs, conn, login)
+			if err != nil {
+				return nil, err
+			}
+			if err = conn.Bind(dn, password); err != nil {
+				if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+					return nil, security.InvalidCredentialsError(login)
+				}
+				return nil, err
+			}
+			return attrs, nil
+		})
+
+	ldapServerModel.Methods().GetOrCreateUser().DeclareMethod(
+		`GetOrCreateUser returns the local user with the given login, creating it from the
+		template user if it does not exist yet and user creation is enabled. The user is
+		then updated from the given directory attributes. It returns an empty recordset if
+		the existing user with this login is not flagged as an LDAP user.`,
+		func(rs h.LDAPServerSet, login string, attrs map[string][]string) h.UserSet {
+			rs.EnsureOne()
+			user := h.User().NewSet(rs.Env()).Sudo().WithContext("active_test", false).
+				Search(q.User().Login().Equals(login))
+			if !user.IsEmpty() && !user.LDAPUser() {
+				log.Warn("Local user not updated from LDAP directory", "login", login, "server", rs.URL())
+				return h.User().NewSet(rs.Env())
+			}
+			if user.IsEmpty() {
+				if !rs.CreateUser() {
+					return user
+				}
+				data := &h.UserData{
+					Name:      login,
+					Login:     login,
+					Company:   rs.Company(),
+					Companies: rs.Company(),
+					LDAPUser:  true,
+				}
+				if !rs.UserTemplate().IsEmpty() {
+					data.Groups = rs.UserTemplate().Groups()
+					data.Lang = rs.UserTemplate().Lang()
+					data.TZ = rs.UserTemplate().TZ()
+					data.ActionID = rs.UserTemplate().ActionID()
+				}
+				user = h.User().NewSet(rs.Env()).Sudo().Create(data)
+				log.Info("User created from LDAP directory", "login", login, "server", rs.URL())
+			}
+			rs.MapAttributes(user, attrs)
+			if rs.SyncGroups() {
+				rs.SyncUserGroups(user, attrs[rs.GroupAttribute()])
+			}
+			return user
+		})
+
+	ldapServerModel.Methods().MapAttributes().DeclareMethod(
+		`MapAttributes updates the partner of the given user from the given directory attributes,
+		according to the attribute mapping of this server.`,
+		func(rs h.LDAPServerSet, user h.UserSet, attrs map[string][]string) {
+			for _, line := range strings.Split(rs.AttributeMapping(), "\n") {
+				parts := strings.SplitN(line, "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				fieldName, attribute := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+				values := attrs[attribute]
+				if fieldName == "" || len(values) == 0 {
+					continue
+				}
+				if _, exists := h.Partner().Fields().Get(fieldName); !exists {
+					log.Warn("Unknown partner field in LDAP attribute mapping", "field", fieldName, "server", rs.URL())
+					continue
+				}
+				if user.Partner().Get(fieldName) != values[0] {
+					user.Partner().Sudo().Set(fieldName, values[0])
+				}
+			}
+		})
+
+	ldapServerModel.Methods().SyncUserGroups().DeclareMethod(
+		`SyncUserGroups adds the given user to the mapped groups of the given directory
+		groups, and removes him from the other mapped groups. Groups that are not mapped
+		are left untouched.`,
+		func(rs h.LDAPServerSet, user h.UserSet, ldapGroups []string) {
+			memberOf := make(map[string]bool)
+			for _, dn := range ldapGroups {
+				memberOf[strings.ToLower(strings.TrimSpace(dn))] = true
+			}
+			groups := user.Groups()
+			for _, mapping := range rs.GroupMappings().Records() {
+				if memberOf[strings.ToLower(strings.TrimSpace(mapping.LDAPGroup()))] {
+					groups = groups.Union(mapping.Group())
+				} else {
+					groups = groups.Subtract(mapping.Group())
+				}
+			}
+			if !groups.Equals(user.Groups()) {
+				user.Sudo().SetGroups(groups)
+			}
+		})
+
+	groupMappingModel := h.LDAPGroupMapping().DeclareModel()
+	groupMappingModel.AddFields(map[string]models.FieldDefinition{
+		"Server": models.Many2OneField{RelationModel: h.LDAPServer(), OnDelete: models.Cascade, Required: true},
+		"LDAPGroup": models.CharField{String: "LDAP Group", Required: true,
+			Help: "DN of the directory group, as listed in the group attribute of user entries"},
+		"Group": models.Many2OneField{RelationModel: h.Group(), OnDelete: models.Cascade, Required: true},
+	})
+
+	h.Company().AddFields(map[string]models.FieldDefinition{
+		"LDAPServers": models.One2ManyField{RelationModel: h.LDAPServer(), ReverseFK: "Company",
+			String: "LDAP Servers", JSON: "ldap_ids"},
+	})
+
+	h.User().AddFields(map[string]models.FieldDefinition{
+		"LDAPUser": models.BooleanField{String: "LDAP Authentication", NoCopy: true,
+			Help: "If set, this user can log in with the password of the directory entry with the same login. Users created from an LDAP directory are flagged automatically."},
+	})
+
+	h.User().Methods().CheckCredentials().Extend(
+		`If the login and secret do not match a local password, they are checked against
+		the LDAP servers of the user's companies, or of all companies for unknown logins.
+		Users are created at their first successful LDAP login. Existing users are only
+		checked against LDAP servers if they are flagged as LDAP users, so that a directory
+		entry cannot be used to log in as a local account with the same login.`,
+		func(rs h.UserSet, login, secret string) (int64, error) {
+			uid, err := rs.Super().CheckCredentials(login, secret)
+			if err == nil {
+				return uid, nil
+			}
+			servers := h.LDAPServer().NewSet(rs.Env()).Sudo().SearchAll()
+			// Inactive users must be found too, so that an inactive local account
+			// cannot be taken over by a directory entry with the same login.
+			user := rs.Sudo().WithContext("active_test", false).Search(q.User().Login().Equals(login))
+			if !user.IsEmpty() {
+				if !user.LDAPUser() {
+					return uid, err
+				}
+				servers = h.LDAPServer().NewSet(rs.Env()).Sudo().Search(q.LDAPServer().Company().In(user.Companies()))
+			}
+			for _, server := range servers.Records() {
+				attrs, lErr := server.AuthenticateUser(login, secret)
+				if lErr != nil {
+					switch lErr.(type) {
+					case security.InvalidCredentialsError, security.UserNotFoundError:
+					default:
+						log.Warn("LDAP authentication failed", "login", login, "server", server.URL(), "error", lErr)
+					}
+					continue
+				}
+				if ldapUser := server.GetOrCreateUser(login, attrs); !ldapUser.IsEmpty() && ldapUser.Active() {
+					return ldapUser.ID(), nil
+				}
+			}
+			return uid, err
+		})
+}
+
+// findLDAPUser searches the user entry matching login in the directory of
+// the given server and returns its DN and attributes.
+func findLDAPUser(server h.LDAPServerSet, conn *ldap.Conn, login string) (string, map[string][]string, error) {
+	if server.BindDN() != "" {
+		if err := conn.Bind(server.BindDN(), server.BindPassword()); err != nil {
+			return "", nil, fmt.Errorf("unable to bind to LDAP server: %s", err)
+		}
+	}
+	req := ldap.NewSearchRequest(server.BaseDN(), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(server.Filter(), ldap.EscapeFilter(login)), nil, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(res.Entries) != 1 {
+		return "", nil, security.UserNotFoundError(login)
+	}
+	entry := res.Entries[0]
+	attrs := make(map[string][]string)
+	for _, attr := range entry.Attributes {
+		attrs[attr.Name] = attr.Values
+	}
+	return entry.DN, attrs, nil
+}
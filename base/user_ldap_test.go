@@ -0,0 +1,212 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	ldapserver "github.com/nmcclain/ldap"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testLDAPDirectory is an in-memory directory served by the test LDAP server
+type testLDAPDirectory struct {
+	entries   []*ldapserver.Entry
+	passwords map[string]string
+}
+
+// Bind checks the credentials of the entries of the directory
+func (d *testLDAPDirectory) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldapserver.LDAPResultCode, error) {
+	if pwd, ok := d.passwords[bindDN]; ok && pwd == bindSimplePw {
+		return ldapserver.LDAPResultSuccess, nil
+	}
+	return ldapserver.LDAPResultInvalidCredentials, nil
+}
+
+// Search returns all the entries of the directory. They are filtered by the server.
+func (d *testLDAPDirectory) Search(boundDN string, req ldapserver.SearchRequest, conn net.Conn) (ldapserver.ServerSearchResult, error) {
+	return ldapserver.ServerSearchResult{Entries: d.entries, ResultCode: ldapserver.LDAPResultSuccess}, nil
+}
+
+// startTestLDAPServer starts an LDAP server serving the given
+// directory and returns its URL.
+func startTestLDAPServer(dir *testLDAPDirectory) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	server := ldapserver.NewServer()
+	server.BindFunc("", dir)
+	server.SearchFunc("", dir)
+	go server.Serve(ln)
+	return "ldap://" + ln.Addr().String()
+}
+
+func newTestLDAPEntry(dn string, attrs map[string][]string) *ldapserver.Entry {
+	entry := &ldapserver.Entry{DN: dn}
+	for name, values := range attrs {
+		entry.Attributes = append(entry.Attributes, &ldapserver.EntryAttribute{Name: name, Values: values})
+	}
+	return entry
+}
+
+// setTestLDAPAttribute sets the values of the given attribute of the
+// given entry and returns the previous values.
+func setTestLDAPAttribute(entry *ldapserver.Entry, name string, values []string) []string {
+	for _, attr := range entry.Attributes {
+		if attr.Name == name {
+			old := attr.Values
+			attr.Values = values
+			return old
+		}
+	}
+	entry.Attributes = append(entry.Attributes, &ldapserver.EntryAttribute{Name: name, Values: values})
+	return nil
+}
+
+func TestLDAPAuthentication(t *testing.T) {
+	dir := &testLDAPDirectory{
+		entries: []*ldapserver.Entry{
+			newTestLDAPEntry("uid=jdoe,ou=people,dc=example,dc=com", map[string][]string{
+				"objectClass": {"inetOrgPerson"},
+				"uid":         {"jdoe"},
+				"cn":          {"John Doe"},
+				"mail":        {"john.doe@example.com"},
+				"memberOf":    {"cn=managers,ou=groups,dc=example,dc=com"},
+			}),
+			newTestLDAPEntry("uid=asmith,ou=people,dc=example,dc=com", map[string][]string{
+				"objectClass": {"inetOrgPerson"},
+				"uid":         {"asmith"},
+				"cn":          {"Alice Smith"},
+				"mail":        {"alice.smith@example.com"},
+			}),
+		},
+		passwords: map[string]string{
+			"cn=hexya,dc=example,dc=com":             "bind-secret",
+			"uid=jdoe,ou=people,dc=example,dc=com":   "jdoe-secret",
+			"uid=asmith,ou=people,dc=example,dc=com": "asmith-secret",
+		},
+	}
+	url := startTestLDAPServer(dir)
+	Convey("Testing LDAP authentication", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.Group().NewSet(env).ReloadGroups()
+			userGroup := h.Group().Search(env, q.Group().GroupID().Equals(GroupUser.ID))
+			managerGroup := h.Group().Search(env, q.Group().GroupID().Equals(GroupERPManager.ID))
+			template := h.User().Create(env, &h.UserData{
+				Name:   "LDAP Template",
+				Login:  "ldap_template",
+				Groups: userGroup,
+			})
+			server := h.LDAPServer().Create(env, &h.LDAPServerData{
+				Company:      h.User().NewSet(env).CurrentUser().Company(),
+				URL:          url,
+				BindDN:       "cn=hexya,dc=example,dc=com",
+				BindPassword: "bind-secret",
+				BaseDN:       "ou=people,dc=example,dc=com",
+				Filter:       "(uid=%s)",
+				CreateUser:   true,
+				UserTemplate: template,
+			})
+			Convey("Searching the directory", func() {
+				dn, attrs, err := server.FindUser("jdoe")
+				So(err, ShouldBeNil)
+				So(dn, ShouldEqual, "uid=jdoe,ou=people,dc=example,dc=com")
+				So(attrs["mail"], ShouldResemble, []string{"john.doe@example.com"})
+				_, _, err = server.FindUser("unknown")
+				So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
+			})
+			Convey("Logins are escaped in the search filter", func() {
+				_, _, err := server.FindUser("*")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Wrong and empty passwords are rejected", func() {
+				_, err := h.User().NewSet(env).CheckCredentials("jdoe", "wrong")
+				So(err, ShouldNotBeNil)
+				_, err = h.User().NewSet(env).CheckCredentials("jdoe", "")
+				So(err, ShouldNotBeNil)
+				So(h.User().Search(env, q.User().Login().Equals("jdoe")).IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Users are created from the template at their first login", func() {
+				uid, err := h.User().NewSet(env).Authenticate("jdoe", "jdoe-secret")
+				So(err, ShouldBeNil)
+				jdoe := h.User().Search(env, q.User().Login().Equals("jdoe"))
+				So(jdoe.ID(), ShouldEqual, uid)
+				So(jdoe.Name(), ShouldEqual, "John Doe")
+				So(jdoe.Email(), ShouldEqual, "john.doe@example.com")
+				So(jdoe.Groups().Ids(), ShouldContain, userGroup.ID())
+				So(jdoe.Password(), ShouldBeEmpty)
+				So(jdoe.LDAPUser(), ShouldBeTrue)
+				Convey("Attributes are updated at each login", func() {
+					old := setTestLDAPAttribute(dir.entries[0], "cn", []string{"Johnny Doe"})
+					defer setTestLDAPAttribute(dir.entries[0], "cn", old)
+					_, err := h.User().NewSet(env).Authenticate("jdoe", "jdoe-secret")
+					So(err, ShouldBeNil)
+					So(jdoe.Name(), ShouldEqual, "Johnny Doe")
+				})
+			})
+			Convey("Users are not created if creation is disabled", func() {
+				server.SetCreateUser(false)
+				_, err := h.User().NewSet(env).CheckCredentials("asmith", "asmith-secret")
+				So(err, ShouldNotBeNil)
+				Convey("but existing LDAP users can log in", func() {
+					asmith := h.User().Create(env, &h.UserData{Name: "Alice", Login: "asmith", LDAPUser: true})
+					uid, err := h.User().NewSet(env).CheckCredentials("asmith", "asmith-secret")
+					So(err, ShouldBeNil)
+					So(uid, ShouldEqual, asmith.ID())
+				})
+			})
+			Convey("Local accounts cannot be taken over from the directory", func() {
+				local := h.User().Create(env, &h.UserData{Name: "Local Alice", Login: "asmith", Password: "Local-secret-42"})
+				_, err := h.User().NewSet(env).CheckCredentials("asmith", "asmith-secret")
+				So(err, ShouldNotBeNil)
+				uid, err := h.User().NewSet(env).CheckCredentials("asmith", "Local-secret-42")
+				So(err, ShouldBeNil)
+				So(uid, ShouldEqual, local.ID())
+				local.SetPassword("")
+				_, err = h.User().NewSet(env).CheckCredentials("asmith", "asmith-secret")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Inactive local accounts cannot be taken over from the directory", func() {
+				local := h.User().Create(env, &h.UserData{Name: "Local Alice", Login: "asmith"})
+				local.SetActive(false)
+				_, err := h.User().NewSet(env).CheckCredentials("asmith", "asmith-secret")
+				So(err, ShouldNotBeNil)
+				So(server.GetOrCreateUser("asmith", map[string][]string{"cn": {"Alice Smith"}}).IsEmpty(), ShouldBeTrue)
+				So(local.Name(), ShouldEqual, "Local Alice")
+				So(local.LDAPUser(), ShouldBeFalse)
+			})
+			Convey("Group membership is synchronized", func() {
+				server.SetSyncGroups(true)
+				h.LDAPGroupMapping().Create(env, &h.LDAPGroupMappingData{
+					Server:    server,
+					LDAPGroup: "CN=Managers,OU=Groups,DC=example,DC=com",
+					Group:     managerGroup,
+				})
+				uid, err := h.User().NewSet(env).CheckCredentials("jdoe", "jdoe-secret")
+				So(err, ShouldBeNil)
+				jdoe := h.User().Browse(env, []int64{uid})
+				So(jdoe.Groups().Ids(), ShouldContain, managerGroup.ID())
+				So(jdoe.Groups().Ids(), ShouldContain, userGroup.ID())
+				uid, err = h.User().NewSet(env).CheckCredentials("asmith", "asmith-secret")
+				So(err, ShouldBeNil)
+				asmith := h.User().Browse(env, []int64{uid})
+				So(asmith.Groups().Ids(), ShouldNotContain, managerGroup.ID())
+				Convey("Users are removed from mapped groups they left", func() {
+					old := setTestLDAPAttribute(dir.entries[0], "memberOf", nil)
+					defer setTestLDAPAttribute(dir.entries[0], "memberOf", old)
+					_, err := h.User().NewSet(env).CheckCredentials("jdoe", "jdoe-secret")
+					So(err, ShouldBeNil)
+					So(jdoe.Groups().Ids(), ShouldNotContain, managerGroup.ID())
+					So(jdoe.Groups().Ids(), ShouldContain, userGroup.ID())
+				})
+			})
+		}), ShouldBeNil)
+	})
+}
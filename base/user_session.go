@@ -0,0 +1,216 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/actions"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// Configuration parameter keys of the session timeouts
+const (
+	// SessionIdleTimeoutParam is the number of minutes of inactivity after
+	// which a session expires. Zero means that sessions never expire by inactivity.
+	SessionIdleTimeoutParam = "auth.session.idle_timeout"
+	// SessionAbsoluteTimeoutParam is the number of minutes after its creation
+	// at which a session expires. Zero means that sessions never expire.
+	SessionAbsoluteTimeoutParam = "auth.session.absolute_timeout"
+)
+
+// sessionActivityPrecision is the minimum duration between two
+// updates of the last activity date of a session.
+const sessionActivityPrecision = time.Minute
+
+// hashSessionID returns the value stored in the database for the given session ID,
+// so that sessions cannot be hijacked from a database dump.
+func hashSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionTimeouts returns the idle and absolute session timeouts
+func sessionTimeouts(env models.Environment) (time.Duration, time.Duration) {
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	atoi := func(key string, defaultValue int) time.Duration {
+		val, err := strconv.Atoi(params.GetParam(key, strconv.Itoa(defaultValue)))
+		if err != nil || val < 0 {
+			log.Warn("Invalid session timeout parameter", "key", key, "error", err)
+			val = defaultValue
+		}
+		return time.Duration(val) * time.Minute
+	}
+	return atoi(SessionIdleTimeoutParam, 24*60), atoi(SessionAbsoluteTimeoutParam, 30*24*60)
+}
+
+// isUserManager returns true if the user of the given environment
+// can see and revoke the sessions and API keys of other users.
+func isUserManager(env models.Environment) bool {
+	return isAdmin(env.Uid())
+}
+
+// checkSessionOwner panics if the current user is not a user manager and
+// does not own all the sessions with the given IDs.
+func checkSessionOwner(env models.Environment, sessionIDs []int64) {
+	if len(sessionIDs) == 0 || isUserManager(env) {
+		return
+	}
+	var count int
+	env.Cr().Get(&count, "SELECT COUNT(*) FROM user_session WHERE id IN (?) AND user_id <> ?",
+		sessionIDs, env.Uid())
+	if count > 0 {
+		log.Panic(h.UserSession().NewSet(env).T("You can only access your own sessions."))
+	}
+}
+
+func init() {
+	sessionModel := h.UserSession().DeclareModel()
+	sessionModel.SetDefaultOrder("LastActivity desc")
+	sessionModel.AddFields(map[string]models.FieldDefinition{
+		"SessionHash": models.CharField{Required: true, Unique: true, Index: true,
+			Help: "Hash of the session ID stored in the client's cookie"},
+		"User": models.Many2OneField{RelationModel: h.User(), OnDelete: models.Cascade, Required: true,
+			Index: true},
+		"IP":           models.CharField{String: "IP Address"},
+		"UserAgent":    models.CharField{},
+		"LastActivity": models.DateTimeField{Index: true},
+	})
+
+	sessionModel.Methods().Open().DeclareMethod(
+		`Open creates a new session for the given user and returns its ID,
+		which must be stored in the client's cookie.`,
+		func(rs h.UserSessionSet, user h.UserSet, ip, userAgent string) string {
+			rs.GCSessions()
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				log.Panic("Unable to generate session ID", "error", err)
+			}
+			sessionID := base64.RawURLEncoding.EncodeToString(buf)
+			rs.Sudo().Create(&h.UserSessionData{
+				SessionHash:  hashSessionID(sessionID),
+				User:         user,
+				IP:           ip,
+				UserAgent:    userAgent,
+				LastActivity: dates.Now(),
+			})
+			return sessionID
+		})
+
+	sessionModel.Methods().Check().DeclareMethod(
+		`Check returns the session with the given ID if it is still valid, and records
+		the activity on it. It returns an empty recordset if the session does not exist,
+		has been revoked or has expired.`,
+		func(rs h.UserSessionSet, sessionID string) h.UserSessionSet {
+			if sessionID == "" {
+				return h.UserSession().NewSet(rs.Env())
+			}
+			session := rs.Sudo().Search(q.UserSession().SessionHash().Equals(hashSessionID(sessionID)))
+			if session.IsEmpty() {
+				return session
+			}
+			now := time.Now()
+			idle, absolute := sessionTimeouts(rs.Env())
+			switch {
+			case !session.User().Active(),
+				idle > 0 && session.LastActivity().Time.Add(idle).Before(now),
+				absolute > 0 && session.CreateDate().Time.Add(absolute).Before(now):
+				session.Unlink()
+				return h.UserSession().NewSet(rs.Env())
+			}
+			if session.LastActivity().Time.Add(sessionActivityPrecision).Before(now) {
+				session.SetLastActivity(dates.Now())
+			}
+			return session
+		})
+
+	sessionModel.Methods().Revoke().DeclareMethod(
+		`Revoke ends the session with the given ID`,
+		func(rs h.UserSessionSet, sessionID string) {
+			rs.Sudo().Search(q.UserSession().SessionHash().Equals(hashSessionID(sessionID))).Unlink()
+		})
+
+	sessionModel.Methods().ActionRevoke().DeclareMethod(
+		`ActionRevoke ends these sessions. The corresponding clients are logged out at their next request.`,
+		func(rs h.UserSessionSet) bool {
+			if !isUserManager(rs.Env()) {
+				for _, session := range rs.Sudo().Records() {
+					if session.User().ID() != rs.Env().Uid() {
+						log.Panic(rs.T("You can only revoke your own sessions."))
+					}
+				}
+			}
+			rs.Sudo().Unlink()
+			return true
+		})
+
+	sessionModel.Methods().Load().Extend("",
+		func(rs h.UserSessionSet, fields ...string) h.UserSessionSet {
+			checkSessionOwner(rs.Env(), rs.Ids())
+			return rs.Super().Load(fields...)
+		})
+
+	sessionModel.Methods().Search().Extend("",
+		func(rs h.UserSessionSet, cond q.UserSessionCondition) h.UserSessionSet {
+			if isUserManager(rs.Env()) {
+				return rs.Super().Search(cond)
+			}
+			// Users can only see their own sessions
+			return rs.Super().Search(q.UserSession().User().Equals(h.User().NewSet(rs.Env()).CurrentUser()).AndCond(cond))
+		})
+
+	sessionModel.Methods().GCSessions().DeclareMethod(
+		`GCSessions deletes expired sessions. It is meant to be called periodically.`,
+		func(rs h.UserSessionSet) {
+			idle, absolute := sessionTimeouts(rs.Env())
+			if idle > 0 {
+				rs.Sudo().Search(q.UserSession().LastActivity().Lower(dates.DateTime{Time: time.Now().Add(-idle)})).Unlink()
+			}
+			if absolute > 0 {
+				rs.Sudo().Search(q.UserSession().CreateDate().Lower(dates.DateTime{Time: time.Now().Add(-absolute)})).Unlink()
+			}
+		})
+
+	userModel := h.User()
+	userModel.AddFields(map[string]models.FieldDefinition{
+		"Sessions": models.One2ManyField{RelationModel: h.UserSession(), ReverseFK: "User",
+			JSON: "session_ids", NoCopy: true},
+	})
+
+	userModel.Methods().RevokeSessions().DeclareMethod(
+		`RevokeSessions ends all the sessions of these users. They are logged out at their next request.`,
+		func(rs h.UserSet) {
+			h.UserSession().NewSet(rs.Env()).Sudo().Search(q.UserSession().User().In(rs)).Unlink()
+		})
+
+	userModel.Methods().ActionLogoutEverywhere().DeclareMethod(
+		`ActionLogoutEverywhere is called when clicking 'Log Out Everywhere' on the user form.`,
+		func(rs h.UserSet) bool {
+			rs.RevokeSessions()
+			log.Info("Sessions revoked", "users", rs.Ids(), "uid", rs.Env().Uid())
+			return true
+		})
+
+	userModel.Methods().ActionMySessions().DeclareMethod(
+		`ActionMySessions returns the action listing the active sessions of the current user`,
+		func(rs h.UserSet) *actions.Action {
+			return &actions.Action{
+				Name:     rs.T("My Active Sessions"),
+				Type:     actions.ActionActWindow,
+				Model:    "UserSession",
+				ViewMode: "tree",
+				Domain:   fmt.Sprintf("[('user_id', '=', %d)]", rs.Env().Uid()),
+				Target:   "current",
+			}
+		})
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUserSessions(t *testing.T) {
+	Convey("Testing user sessions", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			userJohn := h.User().Create(env, &h.UserData{
+				Name:     "John Smith",
+				Login:    "jsmith",
+				Password: "Secret-123",
+			})
+			sessions := h.UserSession().NewSet(env)
+			sessionID := sessions.Open(userJohn, "10.0.0.1", "Test Agent")
+			otherID := sessions.Open(userJohn, "10.0.0.2", "Test Agent")
+			Convey("Session IDs are unique and not stored in clear", func() {
+				So(sessionID, ShouldNotEqual, otherID)
+				So(userJohn.Sessions().Len(), ShouldEqual, 2)
+				for _, session := range userJohn.Sessions().Records() {
+					So(session.SessionHash(), ShouldNotBeIn, []string{sessionID, otherID})
+				}
+			})
+			Convey("Checking sessions", func() {
+				session := sessions.Check(sessionID)
+				So(session.IsEmpty(), ShouldBeFalse)
+				So(session.User().Equals(userJohn), ShouldBeTrue)
+				So(session.IP(), ShouldEqual, "10.0.0.1")
+				So(sessions.Check("unknown").IsEmpty(), ShouldBeTrue)
+				So(sessions.Check("").IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Revoking a session", func() {
+				sessions.Revoke(sessionID)
+				So(sessions.Check(sessionID).IsEmpty(), ShouldBeTrue)
+				So(sessions.Check(otherID).IsEmpty(), ShouldBeFalse)
+			})
+			Convey("Idle sessions expire", func() {
+				h.ConfigParameter().NewSet(env).SetParam(SessionIdleTimeoutParam, "30")
+				sessions.Check(sessionID).SetLastActivity(dates.DateTime{Time: time.Now().Add(-time.Hour)})
+				So(sessions.Check(sessionID).IsEmpty(), ShouldBeTrue)
+				So(sessions.Check(otherID).IsEmpty(), ShouldBeFalse)
+				So(userJohn.Sessions().Len(), ShouldEqual, 1)
+			})
+			Convey("Sessions expire after the absolute timeout", func() {
+				h.ConfigParameter().NewSet(env).SetParam(SessionAbsoluteTimeoutParam, "60")
+				env.Cr().Execute(`UPDATE user_session SET create_date = ? WHERE id = ?`,
+					time.Now().Add(-2*time.Hour), sessions.Check(sessionID).ID())
+				h.UserSession().NewSet(env).InvalidateCache()
+				So(sessions.Check(sessionID).IsEmpty(), ShouldBeTrue)
+				So(sessions.Check(otherID).IsEmpty(), ShouldBeFalse)
+			})
+			Convey("Logging out everywhere", func() {
+				userJohn.ActionLogoutEverywhere()
+				So(sessions.Check(sessionID).IsEmpty(), ShouldBeTrue)
+				So(sessions.Check(otherID).IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Changing the password revokes all sessions", func() {
+				userJohn.UpdatePassword("Other-Secret-456")
+				So(userJohn.Sessions().IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Users can only read their own sessions", func() {
+				userJane := h.User().Create(env, &h.UserData{
+					Name:  "Jane Smith",
+					Login: "jane",
+				})
+				session := sessions.Check(sessionID)
+				So(func() { session.Sudo(userJane.ID()).Load() }, ShouldPanic)
+				So(func() { session.Sudo(userJohn.ID()).Load() }, ShouldNotPanic)
+				So(func() { session.Load() }, ShouldNotPanic)
+			})
+			Convey("Deactivating the user revokes all sessions", func() {
+				userJohn.SetActive(false)
+				So(userJohn.Sessions().IsEmpty(), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
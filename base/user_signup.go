@@ -0,0 +1,323 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// Configuration parameter keys of the signup tokens
+const (
+	// SignupInvitationValidityParam is the number of hours during which an invitation link is valid
+	SignupInvitationValidityParam = "auth.signup.invitation_validity"
+	// SignupResetValidityParam is the number of minutes during which a password reset link is valid
+	SignupResetValidityParam = "auth.signup.reset_validity"
+)
+
+// passwordResetTokenThrottleKey is the authentication log login under which
+// invalid signup tokens are recorded, so that they are throttled by IP address.
+const passwordResetTokenThrottleKey = "reset_password:token"
+
+// passwordResetThrottleKey returns the authentication log login under which the
+// password reset requests for the given login are recorded. It differs from the
+// login itself so that these requests do not delay or lock the user's logins.
+func passwordResetThrottleKey(login string) string {
+	return "reset_password:" + login
+}
+
+// passwordResetJobInterval is the time between two runs of the background
+// sending of the requested password reset emails.
+const passwordResetJobInterval = 10 * time.Second
+
+// sendRequestedPasswordResets sends the password reset emails requested with
+// RequestPasswordReset. Each email is sent in its own transaction, so that the
+// token of an email is committed even if another email fails.
+func sendRequestedPasswordResets() error {
+	var ids []int64
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		ids = h.User().NewSet(env).DequeuePasswordResets().Ids()
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Browse(env, []int64{id})
+			if err := user.SendSignupMail("reset"); err != nil {
+				log.Warn("Unable to send password reset email", "login", user.Login(), "error", err)
+			}
+		})
+	}
+	return nil
+}
+
+// SignupMailData is the data with which the signup mail templates are rendered
+type SignupMailData struct {
+	Name       string
+	Login      string
+	Company    string
+	Inviter    string
+	URL        string
+	Expiration time.Time
+}
+
+// Mail templates of the signup emails. Modules may replace them with their own templates,
+// which are rendered with a SignupMailData.
+var (
+	InvitationMailTemplate = NewMailTemplate("invitation",
+		`Invitation to connect to {{ .Company }}`,
+		`Hello {{ .Name }},
+
+{{ .Inviter }} has invited you to connect to {{ .Company }}.
+Your login is: {{ .Login }}
+
+To choose your password and log in, please follow this link:
+{{ .URL }}
+
+This link is valid until {{ .Expiration.Format "2006-01-02 15:04 MST" }}.
+`)
+	ResetPasswordMailTemplate = NewMailTemplate("reset_password",
+		`Password reset on {{ .Company }}`,
+		`Hello {{ .Name }},
+
+A password reset has been requested for your account on {{ .Company }}.
+Your login is: {{ .Login }}
+
+To choose a new password, please follow this link:
+{{ .URL }}
+
+This link is valid until {{ .Expiration.Format "2006-01-02 15:04 MST" }}.
+If you did not request a password reset, you can safely ignore this email.
+`)
+)
+
+// hashSignupToken returns the value stored in the database for the given signup token.
+func hashSignupToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// signupValidity returns the validity duration of a token of the given type
+func signupValidity(env models.Environment, tokenType string) time.Duration {
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	key, defaultValue, unit := SignupResetValidityParam, 60, time.Minute
+	if tokenType == "invite" {
+		key, defaultValue, unit = SignupInvitationValidityParam, 72, time.Hour
+	}
+	val, err := strconv.Atoi(params.GetParam(key, strconv.Itoa(defaultValue)))
+	if err != nil || val <= 0 {
+		log.Warn("Invalid signup token validity parameter", "key", key, "error", err)
+		val = defaultValue
+	}
+	return time.Duration(val) * unit
+}
+
+func init() {
+	RegisterBackgroundJob("password_reset", passwordResetJobInterval, sendRequestedPasswordResets)
+
+	userModel := h.User()
+	userModel.AddFields(map[string]models.FieldDefinition{
+		"SignupToken": models.CharField{NoCopy: true, Index: true,
+			Help: "Hash of the current invitation or password reset token"},
+		"SignupType": models.SelectionField{Selection: types.Selection{
+			"invite": "Invitation",
+			"reset":  "Password Reset",
+		}, NoCopy: true},
+		"SignupExpiration": models.DateTimeField{NoCopy: true},
+		"PasswordResetRequested": models.BooleanField{NoCopy: true, Index: true,
+			Help: "A password reset email will be sent to this user in the background"},
+	})
+
+	userModel.Methods().GenerateSignupToken().DeclareMethod(
+		`GenerateSignupToken creates a new token of the given type ('invite' or 'reset')
+		for this user and returns it. Only a hash of the token is stored and any previous
+		token of this user is invalidated.`,
+		func(rs h.UserSet, tokenType string) string {
+			rs.EnsureOne()
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				log.Panic("Unable to generate signup token", "error", err)
+			}
+			token := base64.RawURLEncoding.EncodeToString(buf)
+			rs.Sudo().Write(&h.UserData{
+				SignupToken:      hashSignupToken(token),
+				SignupType:       tokenType,
+				SignupExpiration: dates.DateTime{Time: time.Now().Add(signupValidity(rs.Env(), tokenType))},
+			})
+			return token
+		})
+
+	userModel.Methods().CheckSignupToken().DeclareMethod(
+		`CheckSignupToken returns the active user with the given valid token,
+		or an empty recordset if the token does not exist or has expired.`,
+		func(rs h.UserSet, token string) h.UserSet {
+			if token == "" {
+				return h.User().NewSet(rs.Env())
+			}
+			return rs.Sudo().Search(q.User().SignupToken().Equals(hashSignupToken(token)).
+				And().SignupExpiration().Greater(dates.Now())).Limit(1)
+		})
+
+	userModel.Methods().SignupURL().DeclareMethod(
+		`SignupURL returns the URL at which the user with the given token can choose their password`,
+		func(rs h.UserSet, token string) string {
+			baseURL := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("web.base.url", "")
+			if baseURL == "" {
+				log.Panic(rs.T("The 'web.base.url' parameter must be set to send links by email."))
+			}
+			return fmt.Sprintf("%s/web/reset_password?token=%s", strings.TrimSuffix(baseURL, "/"), url.QueryEscape(token))
+		})
+
+	userModel.Methods().SendSignupMail().DeclareMethod(
+		`SendSignupMail generates a token of the given type ('invite' or 'reset') for this user
+		and sends them the corresponding email with the link to choose their password.`,
+		func(rs h.UserSet, tokenType string) error {
+			rs.EnsureOne()
+			user := rs.Sudo()
+			to := user.Email()
+			if to == "" && strings.Contains(user.Login(), "@") {
+				to = user.Login()
+			}
+			if to == "" {
+				return fmt.Errorf("user %s has no email address", user.Login())
+			}
+			if h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("web.base.url", "") == "" {
+				return errors.New("the 'web.base.url' parameter is not set")
+			}
+			token := user.GenerateSignupToken(tokenType)
+			tmpl := ResetPasswordMailTemplate
+			if tokenType == "invite" {
+				tmpl = InvitationMailTemplate
+			}
+			msg, err := tmpl.Render(to, SignupMailData{
+				Name:       user.Name(),
+				Login:      user.Login(),
+				Company:    user.Company().Name(),
+				Inviter:    h.User().NewSet(rs.Env()).CurrentUser().Sudo().Name(),
+				URL:        user.SignupURL(token),
+				Expiration: user.SignupExpiration().Time,
+			})
+			if err != nil {
+				return err
+			}
+			return SendMail(rs.Env(), msg)
+		})
+
+	userModel.Methods().ActionSendInvitation().DeclareMethod(
+		`ActionSendInvitation is called when clicking 'Send Invitation' on the user form.
+		It sends to each user an email with a link to choose their password.`,
+		func(rs h.UserSet) bool {
+			for _, user := range rs.Records() {
+				if err := user.SendSignupMail("invite"); err != nil {
+					log.Panic(rs.T("Unable to send the invitation email to %s: %s", user.Sudo().Login(), err))
+				}
+			}
+			return true
+		})
+
+	userModel.Methods().ActionSendPasswordReset().DeclareMethod(
+		`ActionSendPasswordReset is called when clicking 'Send Password Reset' on the user form.
+		It sends to each user an email with a link to choose a new password.`,
+		func(rs h.UserSet) bool {
+			for _, user := range rs.Records() {
+				if err := user.SendSignupMail("reset"); err != nil {
+					log.Panic(rs.T("Unable to send the password reset email to %s: %s", user.Sudo().Login(), err))
+				}
+			}
+			return true
+		})
+
+	userModel.Methods().RequestPasswordReset().DeclareMethod(
+		`RequestPasswordReset queues a password reset email to the active user with the given
+		login or email address, if any. It does not tell whether such a user exists, so that it
+		cannot be used to find out valid logins. The email is sent by a background job once
+		the transaction is committed, so that the response time does not depend on the login
+		either.
+
+		Requests are throttled like login attempts, for the given login and for the client IP
+		address ('client_ip' key of the context). An AccountLockedError is returned if the
+		client must wait before requesting a new email.`,
+		func(rs h.UserSet, login string) error {
+			login = strings.TrimSpace(login)
+			if login == "" {
+				return nil
+			}
+			key := passwordResetThrottleKey(login)
+			authLog := h.AuthLog().NewSet(rs.Env())
+			if wait := authLog.LoginWait(key, rs.Env().Context().GetString("client_ip")); wait > 0 {
+				authLog.Record(key, "throttled", fmt.Sprintf("Retry in %s", wait))
+				return AccountLockedError(login)
+			}
+			// Each request counts as a failure so that the following ones are delayed
+			authLog.Record(key, "failure", "Password reset requested")
+			user := rs.Sudo().Search(q.User().Login().Equals(login)).Limit(1)
+			if user.IsEmpty() {
+				user = rs.Sudo().Search(q.User().Email().Equals(login)).Limit(1)
+			}
+			if user.IsEmpty() {
+				log.Info("Password reset requested for unknown login", "login", login)
+				return nil
+			}
+			user.SetPasswordResetRequested(true)
+			return nil
+		})
+
+	userModel.Methods().DequeuePasswordResets().DeclareMethod(
+		`DequeuePasswordResets returns the users whose password reset email has been
+		requested, and clears their request so that the email is only sent once.`,
+		func(rs h.UserSet) h.UserSet {
+			var ids []int64
+			rs.Env().Cr().Select(&ids, `UPDATE "user" SET password_reset_requested = FALSE
+				WHERE password_reset_requested RETURNING id`)
+			users := h.User().Browse(rs.Env(), ids)
+			users.InvalidateCache()
+			return users
+		})
+
+	userModel.Methods().ResetPasswordWithToken().DeclareMethod(
+		`ResetPasswordWithToken sets the password of the user with the given token.
+		It returns a translated message for each error, so that an empty slice means
+		that the password has been changed. The token cannot be used again afterwards.`,
+		func(rs h.UserSet, token, password string) []string {
+			authLog := h.AuthLog().NewSet(rs.Env())
+			if authLog.LoginWait(passwordResetTokenThrottleKey, rs.Env().Context().GetString("client_ip")) > 0 {
+				return []string{rs.T("Too many attempts. Please try again later.")}
+			}
+			user := rs.CheckSignupToken(token)
+			if user.IsEmpty() {
+				authLog.Record(passwordResetTokenThrottleKey, "failure", "Invalid signup token")
+				return []string{rs.T("This link is invalid or has expired.")}
+			}
+			if msgs := user.CheckPasswordPolicy(password); len(msgs) > 0 {
+				return msgs
+			}
+			user.UpdatePassword(password)
+			user.Write(&h.UserData{
+				SignupToken:      "",
+				SignupType:       "",
+				SignupExpiration: dates.DateTime{},
+			}, h.User().SignupToken(), h.User().SignupType(), h.User().SignupExpiration())
+			if !user.LockedUntil().IsZero() {
+				user.ActionUnlock()
+			}
+			log.Info("Password set with signup token", "login", user.Login())
+			return nil
+		})
+}
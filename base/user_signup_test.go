@@ -0,0 +1,135 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// signupTokenRegexp extracts the token of the signup link of an email
+var signupTokenRegexp = regexp.MustCompile(`/web/reset_password\?token=(\S+)`)
+
+// signupTokenFromMail returns the signup token of the given email
+func signupTokenFromMail(msg string) string {
+	match := signupTokenRegexp.FindStringSubmatch(msg)
+	if match == nil {
+		return ""
+	}
+	token, _ := url.QueryUnescape(match[1])
+	return token
+}
+
+func TestUserSignup(t *testing.T) {
+	Convey("Testing user invitations and password resets", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			srv := newTestSMTPServer()
+			defer srv.Close()
+			srv.configure(env)
+			userJohn := h.User().Create(env, &h.UserData{
+				Name:  "John Smith",
+				Login: "jsmith",
+				Email: "john@example.com",
+			})
+			users := h.User().NewSet(env)
+			// sendPasswordResets sends the requested password reset emails like the background job
+			sendPasswordResets := func() {
+				for _, user := range users.DequeuePasswordResets().Records() {
+					So(user.SendSignupMail("reset"), ShouldBeNil)
+				}
+			}
+			Convey("Inviting a user", func() {
+				So(userJohn.ActionSendInvitation(), ShouldBeTrue)
+				msg := srv.nextMessage()
+				So(msg, ShouldContainSubstring, "To: john@example.com")
+				So(msg, ShouldContainSubstring, "Your login is: jsmith")
+				token := signupTokenFromMail(msg)
+				So(token, ShouldNotBeBlank)
+				So(userJohn.SignupToken(), ShouldNotEqual, token)
+				So(userJohn.SignupType(), ShouldEqual, "invite")
+				So(users.CheckSignupToken(token).Equals(userJohn), ShouldBeTrue)
+				Convey("Choosing a password with the token", func() {
+					So(users.ResetPasswordWithToken(token, "short"), ShouldNotBeEmpty)
+					So(users.ResetPasswordWithToken(token, "New-Secret-123"), ShouldBeEmpty)
+					uid, err := users.CheckCredentials("jsmith", "New-Secret-123")
+					So(err, ShouldBeNil)
+					So(uid, ShouldEqual, userJohn.ID())
+					Convey("Tokens cannot be used twice", func() {
+						So(users.CheckSignupToken(token).IsEmpty(), ShouldBeTrue)
+						So(users.ResetPasswordWithToken(token, "Other-Secret-456"), ShouldNotBeEmpty)
+					})
+				})
+			})
+			Convey("Requesting a password reset", func() {
+				users.RequestPasswordReset("john@example.com")
+				So(userJohn.PasswordResetRequested(), ShouldBeTrue)
+				So(userJohn.SignupToken(), ShouldBeEmpty)
+				sendPasswordResets()
+				So(userJohn.PasswordResetRequested(), ShouldBeFalse)
+				token := signupTokenFromMail(srv.nextMessage())
+				So(token, ShouldNotBeBlank)
+				So(userJohn.SignupType(), ShouldEqual, "reset")
+				So(users.CheckSignupToken(token).Equals(userJohn), ShouldBeTrue)
+				Convey("A new token invalidates the previous one", func() {
+					users.RequestPasswordReset("jsmith")
+					sendPasswordResets()
+					newToken := signupTokenFromMail(srv.nextMessage())
+					So(newToken, ShouldNotBeBlank)
+					So(users.CheckSignupToken(token).IsEmpty(), ShouldBeTrue)
+					So(users.CheckSignupToken(newToken).Equals(userJohn), ShouldBeTrue)
+				})
+				Convey("Expired tokens are rejected", func() {
+					userJohn.SetSignupExpiration(dates.DateTime{Time: time.Now().Add(-time.Minute)})
+					So(users.CheckSignupToken(token).IsEmpty(), ShouldBeTrue)
+				})
+			})
+			Convey("Unknown logins do not send emails", func() {
+				users.RequestPasswordReset("unknown@example.com")
+				So(users.DequeuePasswordResets().IsEmpty(), ShouldBeTrue)
+				So(srv.nextMessage(), ShouldBeEmpty)
+			})
+			Convey("Password reset emails are sent once", func() {
+				users.RequestPasswordReset("jsmith")
+				users.RequestPasswordReset("john@example.com")
+				So(users.DequeuePasswordResets().Equals(userJohn), ShouldBeTrue)
+				So(users.DequeuePasswordResets().IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Password reset requests are throttled", func() {
+				throttled := users.WithContext("client_ip", "10.0.0.5")
+				for i := 0; i < 3; i++ {
+					So(throttled.RequestPasswordReset("unknown@example.com"), ShouldBeNil)
+				}
+				So(throttled.RequestPasswordReset("unknown@example.com"), ShouldHaveSameTypeAs, AccountLockedError(""))
+				Convey("without delaying the logins of the user", func() {
+					So(h.AuthLog().NewSet(env).LoginWait("unknown@example.com", ""), ShouldEqual, 0)
+				})
+			})
+			Convey("Invalid signup tokens are throttled by IP address", func() {
+				throttled := users.WithContext("client_ip", "10.0.0.6")
+				for i := 0; i < 20; i++ {
+					So(throttled.ResetPasswordWithToken("invalid", "New-Secret-123"), ShouldNotBeEmpty)
+				}
+				So(h.AuthLog().NewSet(env).LoginWait(passwordResetTokenThrottleKey, "10.0.0.6"), ShouldBeGreaterThan, 0)
+			})
+			Convey("Signup links cannot be built without a base URL", func() {
+				h.ConfigParameter().NewSet(env).SetParam("web.base.url", "")
+				So(func() { userJohn.SignupURL("token") }, ShouldPanic)
+				So(userJohn.SendSignupMail("reset"), ShouldNotBeNil)
+			})
+			Convey("Signup tokens are never sent to the client", func() {
+				userJohn.GenerateSignupToken("reset")
+				res := userJohn.Read([]string{"signup_token"})
+				So(res[0]["signup_token"], ShouldEqual, "********")
+			})
+		}), ShouldBeNil)
+	})
+}
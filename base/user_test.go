@@ -5,10 +5,13 @@ package base
 
 import (
 	"testing"
+	"time"
 
 	"github.com/hexya-erp/hexya/hexya/models"
 	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
 	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -35,6 +38,161 @@ func TestUserAuthentication(t *testing.T) {
 				So(uid, ShouldEqual, 0)
 				So(err, ShouldHaveSameTypeAs, security.UserNotFoundError(""))
 			})
+			Convey("Passwords are stored hashed", func() {
+				So(userJohn.Password(), ShouldNotEqual, "secret")
+				So(IsPasswordHash(userJohn.Password()), ShouldBeTrue)
+				So(func() { userJohn.SetPassword("new-secret") }, ShouldPanic)
+				userJohn.UpdatePassword("new-secret")
+				So(IsPasswordHash(userJohn.Password()), ShouldBeTrue)
+				So(userJohn.PasswordDate().IsZero(), ShouldBeFalse)
+				uid, err := h.User().NewSet(env).Authenticate("jsmith", "new-secret")
+				So(uid, ShouldEqual, userJohn.ID())
+				So(err, ShouldBeNil)
+			})
+			Convey("Cleartext passwords are rehashed at login", func() {
+				env.Cr().Execute("UPDATE \"user\" SET password = ? WHERE id = ?", "plain-secret", userJohn.ID())
+				userJohn.InvalidateCache()
+				So(userJohn.Password(), ShouldEqual, "plain-secret")
+				uid, err := h.User().NewSet(env).Authenticate("jsmith", "plain-secret")
+				So(uid, ShouldEqual, userJohn.ID())
+				So(err, ShouldBeNil)
+				userJohn.InvalidateCache()
+				So(IsPasswordHash(userJohn.Password()), ShouldBeTrue)
+			})
+			Convey("Password hashes are never read", func() {
+				res := userJohn.Read([]string{"password"})
+				So(res[0]["password"], ShouldEqual, "********")
+			})
 		})
 	})
 }
+
+func TestPasswordPolicy(t *testing.T) {
+	Convey("Testing Password Policy", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			userJohn := h.User().Create(env, &h.UserData{
+				Name:     "John Smith",
+				Login:    "jsmith",
+				Password: "Secret-1234",
+			})
+			params := h.ConfigParameter().NewSet(env)
+			Convey("Minimum length", func() {
+				So(userJohn.CheckPasswordPolicy("Ab-1"), ShouldBeEmpty)
+				params.SetParam(PasswordMinLengthParam, "12")
+				So(userJohn.CheckPasswordPolicy("Short-123"), ShouldHaveLength, 1)
+				So(userJohn.CheckPasswordPolicy("Long-enough-123"), ShouldBeEmpty)
+			})
+			Convey("Company specific parameters override global ones", func() {
+				params.SetParam(PasswordMinLengthParam, "12")
+				params.SetCompanyParam(userJohn.Company(), PasswordMinLengthParam, "4")
+				So(userJohn.CheckPasswordPolicy("Short-123"), ShouldBeEmpty)
+			})
+			Convey("Required character classes", func() {
+				params.SetParam(PasswordRequiredClassesParam, "lower,upper,digit,special")
+				So(userJohn.CheckPasswordPolicy("alllowercase"), ShouldHaveLength, 3)
+				So(userJohn.CheckPasswordPolicy("Mixed-Case-42"), ShouldBeEmpty)
+				params.SetParam(PasswordRequiredClassesParam, "lower,unknown")
+				So(userJohn.CheckPasswordPolicy("alllowercase"), ShouldBeEmpty)
+			})
+			Convey("Common passwords", func() {
+				So(userJohn.CheckPasswordPolicy("Password"), ShouldNotBeEmpty)
+				So(userJohn.CheckPasswordPolicy("JSMITH-login"), ShouldBeEmpty)
+				params.SetParam(PasswordCommonListParam, "JSMITH-login\nanother one")
+				So(userJohn.CheckPasswordPolicy("jsmith-login"), ShouldNotBeEmpty)
+			})
+			Convey("Login as password", func() {
+				So(userJohn.CheckPasswordPolicy("JSmith"), ShouldContain, "The password cannot be the same as the login.")
+				So(userJohn.CheckPasswordPolicy("JSmith"), ShouldNotContain, "This password is too common and easy to guess.")
+			})
+			Convey("Password history", func() {
+				params.SetParam(PasswordHistorySizeParam, "3")
+				So(userJohn.CheckPasswordPolicy("Secret-1234"), ShouldNotBeEmpty)
+				userJohn.UpdatePassword("Secret-5678")
+				userJohn.UpdatePassword("Secret-9012")
+				So(userJohn.CheckPasswordPolicy("Secret-1234"), ShouldNotBeEmpty)
+				userJohn.UpdatePassword("Secret-3456")
+				So(userJohn.CheckPasswordPolicy("Secret-1234"), ShouldBeEmpty)
+				So(userJohn.CheckPasswordPolicy("Secret-5678"), ShouldNotBeEmpty)
+			})
+			Convey("Password expiry", func() {
+				So(userJohn.PasswordExpired(), ShouldBeFalse)
+				params.SetParam(PasswordMaxAgeParam, "30")
+				userJohn.UpdatePassword("Secret-5678")
+				So(userJohn.PasswordExpired(), ShouldBeFalse)
+				userJohn.SetPasswordDate(dates.Now().AddDate(0, 0, -31))
+				So(userJohn.PasswordExpired(), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestLoginThrottling(t *testing.T) {
+	Convey("Testing brute-force protection", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			userJohn := h.User().Create(env, &h.UserData{
+				Name:     "John Smith",
+				Login:    "jsmith",
+				Password: "Secret-123",
+			})
+			params := h.ConfigParameter().NewSet(env)
+			Convey("Failed attempts are logged", func() {
+				h.User().NewSet(env).Authenticate("jsmith", "wrong")
+				h.User().NewSet(env).Authenticate("jsmith", "Secret-123")
+				logs := h.AuthLog().Search(env, q.AuthLog().Login().Equals("jsmith"))
+				So(logs.Len(), ShouldEqual, 2)
+				So(logs.Records()[0].Event(), ShouldEqual, "success")
+				So(logs.Records()[1].Event(), ShouldEqual, "failure")
+				So(logs.Records()[1].User().Equals(userJohn), ShouldBeTrue)
+			})
+			Convey("Clients must wait after repeated failures", func() {
+				params.SetParam(LoginDelayAfterParam, "2")
+				params.SetParam(LoginDelayParam, "60")
+				users := h.User().NewSet(env).WithContext("client_ip", "10.0.0.1")
+				users.Authenticate("jsmith", "wrong")
+				So(h.AuthLog().NewSet(env).LoginWait("jsmith", "10.0.0.1"), ShouldEqual, time.Duration(0))
+				users.Authenticate("jsmith", "wrong")
+				So(h.AuthLog().NewSet(env).LoginWait("jsmith", "10.0.0.1"), ShouldBeGreaterThan, time.Duration(0))
+				_, err := users.Authenticate("jsmith", "Secret-123")
+				So(err, ShouldHaveSameTypeAs, AccountLockedError(""))
+			})
+			Convey("Failures from a single IP address are throttled", func() {
+				params.SetParam(LoginDelayAfterParam, "0")
+				params.SetParam(LoginIPDelayAfterParam, "2")
+				params.SetParam(LoginDelayParam, "60")
+				users := h.User().NewSet(env).WithContext("client_ip", "10.0.0.2")
+				users.Authenticate("user1", "wrong")
+				users.Authenticate("user2", "wrong")
+				So(h.AuthLog().NewSet(env).LoginWait("jsmith", "10.0.0.2"), ShouldBeGreaterThan, time.Duration(0))
+				So(h.AuthLog().NewSet(env).LoginWait("jsmith", "10.0.0.3"), ShouldEqual, time.Duration(0))
+			})
+			Convey("Verifying the password of a session is throttled", func() {
+				params.SetParam(LoginDelayAfterParam, "2")
+				params.SetParam(LoginDelayParam, "60")
+				user := userJohn.WithContext("client_ip", "10.0.0.4")
+				So(user.VerifyPassword("Secret-123"), ShouldBeNil)
+				So(user.VerifyPassword("wrong"), ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+				So(user.VerifyPassword("wrong"), ShouldHaveSameTypeAs, security.InvalidCredentialsError(""))
+				So(user.VerifyPassword("Secret-123"), ShouldHaveSameTypeAs, AccountLockedError(""))
+				failures := h.AuthLog().Search(env, q.AuthLog().Login().Equals("jsmith").And().Event().Equals("failure"))
+				So(failures.Len(), ShouldEqual, 2)
+			})
+			Convey("Accounts are locked after too many failures", func() {
+				params.SetParam(LoginDelayAfterParam, "0")
+				params.SetParam(LoginLockAfterParam, "3")
+				for i := 0; i < 3; i++ {
+					h.User().NewSet(env).Authenticate("jsmith", "wrong")
+				}
+				So(userJohn.LockedUntil().IsZero(), ShouldBeFalse)
+				_, err := h.User().NewSet(env).Authenticate("jsmith", "Secret-123")
+				So(err, ShouldHaveSameTypeAs, AccountLockedError(""))
+				Convey("Unlocking the account allows to log in again", func() {
+					userJohn.ActionUnlock()
+					So(userJohn.LockedUntil().IsZero(), ShouldBeTrue)
+					uid, err := h.User().NewSet(env).Authenticate("jsmith", "Secret-123")
+					So(err, ShouldBeNil)
+					So(uid, ShouldEqual, userJohn.ID())
+				})
+			})
+		}), ShouldBeNil)
+	})
+}
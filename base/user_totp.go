@@ -0,0 +1,279 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hexya-erp/hexya-base/base/totp"
+	"github.com/hexya-erp/hexya/hexya/actions"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTPRequiredGroupsParam is the configuration parameter key holding a comma
+// separated list of group IDs (e.g. 'base_group_erp_manager') whose members
+// must use two-factor authentication. It can be set for a single company.
+const TOTPRequiredGroupsParam = "auth.totp.required_groups"
+
+// RecoveryCodesCount is the number of recovery codes generated for a user
+// when he enables two-factor authentication.
+const RecoveryCodesCount = 10
+
+// An InvalidTOTPCodeError is returned when a user gives a wrong
+// two-factor authentication code.
+type InvalidTOTPCodeError string
+
+// Error method for the InvalidTOTPCodeError type
+func (ite InvalidTOTPCodeError) Error() string {
+	return fmt.Sprintf("invalid two-factor authentication code for '%s'", string(ite))
+}
+
+// hashRecoveryCode returns the value stored in the database for the given recovery code.
+//
+// Recovery codes are random enough not to need a slow hash function.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCode returns a new random recovery code in the form 'abcd-efgh'.
+func newRecoveryCode() string {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		log.Panic("Unable to generate recovery code", "error", err)
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(buf))
+	return code[:4] + "-" + code[4:]
+}
+
+func init() {
+	recoveryCodeModel := h.UserRecoveryCode().DeclareModel()
+	recoveryCodeModel.AddFields(map[string]models.FieldDefinition{
+		"User":     models.Many2OneField{RelationModel: h.User(), OnDelete: models.Cascade, Required: true, Index: true},
+		"Code":     models.CharField{Required: true, Help: "Hash of the recovery code"},
+		"UsedDate": models.DateTimeField{String: "Used On"},
+	})
+
+	userModel := h.User()
+	userModel.AddFields(map[string]models.FieldDefinition{
+		"TOTPEnabled": models.BooleanField{String: "Two-Factor Authentication", NoCopy: true, ReadOnly: true},
+		"TOTPSecret": models.CharField{String: "TOTP Secret", NoCopy: true,
+			Help: "Shared secret of the user's authenticator application"},
+		"TOTPLastCounter": models.IntegerField{String: "Last TOTP Time Step", NoCopy: true,
+			Help: "Time step of the last accepted code, so that a code cannot be used twice"},
+		"RecoveryCodes": models.One2ManyField{RelationModel: h.UserRecoveryCode(), ReverseFK: "User",
+			JSON: "recovery_code_ids", NoCopy: true},
+		"TOTPRequired": models.BooleanField{String: "Two-Factor Authentication Required",
+			Compute: h.User().Methods().ComputeTOTPRequired(), Depends: []string{"Groups", "Company"}},
+	})
+
+	userModel.Methods().ComputeTOTPRequired().DeclareMethod(
+		`ComputeTOTPRequired returns whether this user belongs to a group
+		which requires two-factor authentication.`,
+		func(rs h.UserSet) *h.UserData {
+			groups := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetCompanyParam(rs.Company(), TOTPRequiredGroupsParam, "")
+			for _, groupID := range strings.Split(groups, ",") {
+				groupID = strings.TrimSpace(groupID)
+				if groupID != "" && rs.HasGroup(groupID) {
+					return &h.UserData{TOTPRequired: true}
+				}
+			}
+			return &h.UserData{TOTPRequired: false}
+		})
+
+	userModel.Methods().TOTPProvisioningURI().DeclareMethod(
+		`TOTPProvisioningURI returns the otpauth URI to scan with an authenticator
+		application to enroll this user with the given secret.`,
+		func(rs h.UserSet, secret string) string {
+			rs.EnsureOne()
+			return totp.ProvisioningURI(secret, rs.Sudo().Company().Name(), rs.Sudo().Login())
+		})
+
+	userModel.Methods().TOTPQRCode().DeclareMethod(
+		`TOTPQRCode returns the provisioning URI of the given secret for this user
+		as a base64 encoded PNG QR code.`,
+		func(rs h.UserSet, secret string) string {
+			png, err := qrcode.Encode(rs.TOTPProvisioningURI(secret), qrcode.Medium, 256)
+			if err != nil {
+				log.Panic("Unable to generate QR code", "error", err)
+			}
+			return base64.StdEncoding.EncodeToString(png)
+		})
+
+	userModel.Methods().EnableTOTP().DeclareMethod(
+		`EnableTOTP enables two-factor authentication for this user with the given secret,
+		after checking that the given code has been generated from it. It returns the new
+		recovery codes of the user, which are not stored in clear and must be shown to him.`,
+		func(rs h.UserSet, secret, code string) []string {
+			rs.EnsureOne()
+			counter, ok := totp.Validate(code, secret, time.Now(), 0)
+			if !ok {
+				log.Panic(rs.T("Invalid verification code. Please check the time of your device and try again."))
+			}
+			rs.Sudo().Write(&h.UserData{
+				TOTPEnabled:     true,
+				TOTPSecret:      secret,
+				TOTPLastCounter: counter,
+			})
+			return rs.GenerateRecoveryCodes()
+		})
+
+	userModel.Methods().GenerateRecoveryCodes().DeclareMethod(
+		`GenerateRecoveryCodes replaces the recovery codes of this user by new ones and returns them.`,
+		func(rs h.UserSet) []string {
+			rs.EnsureOne()
+			rs.Sudo().RecoveryCodes().Unlink()
+			codes := make([]string, RecoveryCodesCount)
+			for i := range codes {
+				codes[i] = newRecoveryCode()
+				h.UserRecoveryCode().NewSet(rs.Env()).Sudo().Create(&h.UserRecoveryCodeData{
+					User: rs,
+					Code: hashRecoveryCode(codes[i]),
+				})
+			}
+			return codes
+		})
+
+	userModel.Methods().CheckTOTPCode().DeclareMethod(
+		`CheckTOTPCode returns true if the given code is either the current code of this user's
+		authenticator application or one of his unused recovery codes. Accepted codes cannot
+		be used again.`,
+		func(rs h.UserSet, code string) bool {
+			rs.EnsureOne()
+			user := rs.Sudo()
+			if !user.TOTPEnabled() {
+				return false
+			}
+			if counter, ok := totp.Validate(code, user.TOTPSecret(), time.Now(), user.TOTPLastCounter()); ok {
+				user.SetTOTPLastCounter(counter)
+				return true
+			}
+			recoveryCode := h.UserRecoveryCode().NewSet(rs.Env()).Sudo().Search(
+				q.UserRecoveryCode().User().Equals(rs).
+					And().Code().Equals(hashRecoveryCode(code)).
+					And().UsedDate().IsNull()).Limit(1)
+			if recoveryCode.IsEmpty() {
+				return false
+			}
+			recoveryCode.SetUsedDate(dates.Now())
+			return true
+		})
+
+	userModel.Methods().AuthenticateTOTP().DeclareMethod(
+		`AuthenticateTOTP completes the authentication of this user, whose password has
+		already been checked, with the given two-factor authentication code. It is subject
+		to the same brute-force protection as Authenticate.`,
+		func(rs h.UserSet, code string) error {
+			rs.EnsureOne()
+			login := rs.Sudo().Login()
+			if err := checkLoginThrottle(rs, login); err != nil {
+				return err
+			}
+			authLog := h.AuthLog().NewSet(rs.Env())
+			if !rs.CheckTOTPCode(code) {
+				authLog.Record(login, "failure", "Invalid two-factor authentication code")
+				rs.CheckLockout()
+				return InvalidTOTPCodeError(login)
+			}
+			authLog.Record(login, "success", "Two-factor authentication")
+			rs.UpdateLastLogin()
+			return nil
+		})
+
+	userModel.Methods().ActionResetTOTP().DeclareMethod(
+		`ActionResetTOTP disables two-factor authentication for these users and deletes their
+		recovery codes, e.g. when they have lost their device. Users who are required to use
+		two-factor authentication will have to enroll again at their next login.`,
+		func(rs h.UserSet) bool {
+			for _, user := range rs.Records() {
+				user.Sudo().RecoveryCodes().Unlink()
+				user.Sudo().Write(&h.UserData{
+					TOTPEnabled:     false,
+					TOTPSecret:      "",
+					TOTPLastCounter: 0,
+				}, h.User().TOTPEnabled(), h.User().TOTPSecret(), h.User().TOTPLastCounter())
+				log.Info("Two-factor authentication reset", "login", user.Login(), "uid", rs.Env().Uid())
+			}
+			return true
+		})
+
+	userModel.Methods().PreferenceEnableTOTP().DeclareMethod(
+		`PreferenceEnableTOTP is called when clicking 'Enable two-factor authentication'
+		in the preferences popup`,
+		func(rs h.UserSet) *actions.Action {
+			return &actions.Action{
+				Name:     rs.T("Two-Factor Authentication"),
+				Type:     actions.ActionActWindow,
+				Model:    "UserTOTPWizard",
+				ViewMode: "form",
+				Target:   "new",
+			}
+		})
+
+	totpWizard := h.UserTOTPWizard().DeclareTransientModel()
+	totpWizard.AddFields(map[string]models.FieldDefinition{
+		"Secret": models.CharField{Default: func(env models.Environment) interface{} {
+			secret, err := totp.GenerateSecret()
+			if err != nil {
+				log.Panic("Unable to generate TOTP secret", "error", err)
+			}
+			return secret
+		}},
+		"QRCode": models.BinaryField{String: "QR Code", Compute: h.UserTOTPWizard().Methods().ComputeQRCode(),
+			Depends: []string{"Secret"}},
+		"Code": models.CharField{String: "Verification Code",
+			Help: "The 6-digit code displayed by your authenticator application"},
+		"State": models.SelectionField{Selection: types.Selection{
+			"draft": "Draft",
+			"done":  "Done",
+		}, Default: models.DefaultValue("draft")},
+		"RecoveryCodes": models.TextField{ReadOnly: true},
+	})
+
+	totpWizard.Methods().ComputeQRCode().DeclareMethod(
+		`ComputeQRCode returns the QR code to scan to enroll the current user`,
+		func(rs h.UserTOTPWizardSet) *h.UserTOTPWizardData {
+			if rs.Secret() == "" {
+				return &h.UserTOTPWizardData{}
+			}
+			return &h.UserTOTPWizardData{
+				QRCode: h.User().NewSet(rs.Env()).CurrentUser().Sudo().TOTPQRCode(rs.Secret()),
+			}
+		})
+
+	totpWizard.Methods().ActionEnable().DeclareMethod(
+		`ActionEnable is called when the user clicks on 'Enable' in the wizard.
+		It enables two-factor authentication for the current user and displays his recovery codes.`,
+		func(rs h.UserTOTPWizardSet) *actions.Action {
+			rs.EnsureOne()
+			codes := h.User().NewSet(rs.Env()).CurrentUser().Sudo().EnableTOTP(rs.Secret(), rs.Code())
+			rs.Write(&h.UserTOTPWizardData{
+				State:         "done",
+				Secret:        "",
+				Code:          "",
+				RecoveryCodes: strings.Join(codes, "\n"),
+			}, h.UserTOTPWizard().Secret(), h.UserTOTPWizard().Code())
+			return &actions.Action{
+				Name:     rs.T("Two-Factor Authentication"),
+				Type:     actions.ActionActWindow,
+				Model:    "UserTOTPWizard",
+				ViewMode: "form",
+				ResID:    rs.ID(),
+				Target:   "new",
+			}
+		})
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya-base/base/totp"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTwoFactorAuthentication(t *testing.T) {
+	Convey("Testing two-factor authentication", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			userJohn := h.User().Create(env, &h.UserData{
+				Name:     "John Smith",
+				Login:    "jsmith",
+				Password: "Secret-123",
+			})
+			secret, err := totp.GenerateSecret()
+			So(err, ShouldBeNil)
+			Convey("Enabling with a wrong code fails", func() {
+				So(func() { userJohn.EnableTOTP(secret, "000000") }, ShouldPanic)
+				So(userJohn.TOTPEnabled(), ShouldBeFalse)
+			})
+			Convey("Enabling two-factor authentication", func() {
+				code, _ := totp.Code(secret, time.Now())
+				recoveryCodes := userJohn.EnableTOTP(secret, code)
+				So(recoveryCodes, ShouldHaveLength, RecoveryCodesCount)
+				So(userJohn.TOTPEnabled(), ShouldBeTrue)
+				So(userJohn.RecoveryCodes().Len(), ShouldEqual, RecoveryCodesCount)
+				So(userJohn.RecoveryCodes().Records()[0].Code(), ShouldNotBeIn, recoveryCodes)
+				Convey("The secret is never sent to the client", func() {
+					So(userJohn.Read([]string{"totp_secret"})[0]["totp_secret"], ShouldEqual, "********")
+				})
+				Convey("Password authentication is not enough", func() {
+					uid, err := h.User().NewSet(env).Authenticate("jsmith", "Secret-123")
+					So(err, ShouldBeNil)
+					So(uid, ShouldEqual, userJohn.ID())
+					lastLog := h.AuthLog().Search(env, q.AuthLog().Login().Equals("jsmith")).Limit(1)
+					So(lastLog.Event(), ShouldEqual, "password")
+				})
+				Convey("Codes cannot be used twice", func() {
+					So(userJohn.AuthenticateTOTP(code), ShouldHaveSameTypeAs, InvalidTOTPCodeError(""))
+					nextCode, _ := totp.Code(secret, time.Now().Add(totp.Period*time.Second))
+					So(userJohn.AuthenticateTOTP(nextCode), ShouldBeNil)
+				})
+				Convey("Recovery codes can be used once", func() {
+					So(userJohn.AuthenticateTOTP(recoveryCodes[3]), ShouldBeNil)
+					So(userJohn.AuthenticateTOTP(recoveryCodes[3]), ShouldHaveSameTypeAs, InvalidTOTPCodeError(""))
+					So(userJohn.AuthenticateTOTP(recoveryCodes[4]), ShouldBeNil)
+				})
+				Convey("Wrong codes count as failed login attempts", func() {
+					h.ConfigParameter().NewSet(env).SetParam(LoginDelayAfterParam, "0")
+					h.ConfigParameter().NewSet(env).SetParam(LoginLockAfterParam, "2")
+					userJohn.AuthenticateTOTP("000000")
+					h.User().NewSet(env).Authenticate("jsmith", "Secret-123")
+					userJohn.AuthenticateTOTP("000000")
+					So(userJohn.LockedUntil().IsZero(), ShouldBeFalse)
+					So(userJohn.AuthenticateTOTP(recoveryCodes[0]), ShouldHaveSameTypeAs, AccountLockedError(""))
+				})
+				Convey("Resetting two-factor authentication", func() {
+					userJohn.ActionResetTOTP()
+					So(userJohn.TOTPEnabled(), ShouldBeFalse)
+					So(userJohn.RecoveryCodes().IsEmpty(), ShouldBeTrue)
+					So(userJohn.CheckTOTPCode(recoveryCodes[0]), ShouldBeFalse)
+				})
+			})
+			Convey("Groups can require two-factor authentication", func() {
+				h.Group().NewSet(env).ReloadGroups()
+				managerGroup := h.Group().Search(env, q.Group().GroupID().Equals(GroupERPManager.ID))
+				userJohn.SetGroups(managerGroup)
+				h.Group().NewSet(env).ReloadGroups()
+				So(userJohn.TOTPRequired(), ShouldBeFalse)
+				h.ConfigParameter().NewSet(env).SetParam(TOTPRequiredGroupsParam, GroupERPManager.ID)
+				userJohn.InvalidateCache()
+				So(userJohn.TOTPRequired(), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/hexya/server"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// performAPIKeyRequest posts an empty JSON-RPC call to the given path,
+// authenticated with the given API key, and returns the response status.
+func performAPIKeyRequest(path, key string) int {
+	req := httptest.NewRequest(http.MethodPost, path,
+		strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "call", "params": {}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	server.GetServer().ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	bootStrapControllers()
+	Convey("Testing the scope of API keys on routes", t, func() {
+		var readKey, writeKey string
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			admin := h.User().Browse(env, []int64{security.SuperUserID})
+			readKey = h.UserAPIKey().NewSet(env).Generate(admin, "Test read route", "read", dates.DateTime{})
+			writeKey = h.UserAPIKey().NewSet(env).Generate(admin, "Test write route", "write", dates.DateTime{})
+		}), ShouldBeNil)
+		defer models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.UserAPIKey().Search(env, q.UserAPIKey().Name().In([]string{"Test read route", "Test write route"})).Unlink()
+		})
+		Convey("Read-only keys can call read routes", func() {
+			So(performAPIKeyRequest("/web/session/get_session_info", readKey), ShouldEqual, http.StatusOK)
+			So(performAPIKeyRequest("/web/session/modules", readKey), ShouldEqual, http.StatusOK)
+		})
+		Convey("Read-only keys cannot call other routes", func() {
+			So(performAPIKeyRequest("/web/binary/upload_attachment", readKey), ShouldEqual, http.StatusForbidden)
+			So(performAPIKeyRequest("/web/session/change_password", readKey), ShouldEqual, http.StatusForbidden)
+			So(performAPIKeyRequest("/web/session/stop_impersonation", readKey), ShouldEqual, http.StatusForbidden)
+		})
+		Convey("API keys cannot change the password", func() {
+			So(performAPIKeyRequest("/web/session/change_password", writeKey), ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Invalid keys are rejected", func() {
+			So(performAPIKeyRequest("/web/session/get_session_info", "hxk_invalid"), ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
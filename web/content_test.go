@@ -0,0 +1,165 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hexya-erp/hexya-base/base"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/server"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// loginAs logs in with the given credentials and returns the session cookie
+func loginAs(login, password string) *http.Cookie {
+	req := httptest.NewRequest(http.MethodPost, "/web/login", strings.NewReader(url.Values{
+		"login":    []string{login},
+		"password": []string{password},
+	}.Encode()))
+	w := httptest.NewRecorder()
+	server.GetServer().ServeHTTP(w, req)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "hexya-session" {
+			return c
+		}
+	}
+	panic("No session cookie returned")
+}
+
+// performContentRequest gets the content of the attachment with the given id with the
+// given session cookie and additional headers, and returns the response.
+func performContentRequest(cookie *http.Cookie, id string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/web/content/"+id, nil)
+	req.AddCookie(cookie)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	server.GetServer().ServeHTTP(w, req)
+	return w
+}
+
+// performUpload uploads the given files (by file name) in the 'ufile' field of a
+// multipart form with the given session cookie, and returns the response.
+func performUpload(cookie *http.Cookie, files map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for fileName, content := range files {
+		part, _ := writer.CreateFormFile("ufile", fileName)
+		part.Write([]byte(content))
+	}
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/web/binary/upload_attachment", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	server.GetServer().ServeHTTP(w, req)
+	return w
+}
+
+func TestContent(t *testing.T) {
+	bootStrapControllers()
+	Convey("Testing the upload and download of attachments", t, func() {
+		viper.Set("DataDir", os.TempDir())
+		adminCookie := login()
+		var (
+			attachIDs []int64
+			privateID int64
+		)
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			userGroup := h.Group().Search(env, q.Group().GroupID().Equals(base.GroupUser.ID))
+			h.User().Create(env, &h.UserData{
+				Name:     "Content Tester",
+				Login:    "content_tester",
+				Password: "Content-Test-123",
+				Groups:   userGroup,
+			})
+			h.Group().NewSet(env).ReloadGroups()
+			// AuthLog records can only be read by administrators
+			authLog := h.AuthLog().NewSet(env).Record("content_tester", "success", "")
+			privateID = h.Attachment().Create(env, &h.AttachmentData{
+				Name:     "private.txt",
+				ResModel: "AuthLog",
+				ResID:    authLog.ID(),
+				Datas:    base64.StdEncoding.EncodeToString([]byte("Private content")),
+			}).ID()
+		}), ShouldBeNil)
+		defer models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.Attachment().Browse(env, append(attachIDs, privateID)).Unlink()
+			user := h.User().Search(env, q.User().Login().Equals("content_tester"))
+			h.AuthLog().Search(env, q.AuthLog().Login().Equals("content_tester")).Unlink()
+			user.Unlink()
+		})
+		w := performUpload(adminCookie, map[string]string{"hello.txt": "Hello content"})
+		So(w.Code, ShouldEqual, http.StatusOK)
+		var uploaded []struct {
+			ID       int64  `json:"id"`
+			Filename string `json:"filename"`
+			MimeType string `json:"mimetype"`
+			Size     int    `json:"size"`
+			CheckSum string `json:"checksum"`
+		}
+		So(json.Unmarshal(w.Body.Bytes(), &uploaded), ShouldBeNil)
+		So(uploaded, ShouldHaveLength, 1)
+		attachIDs = append(attachIDs, uploaded[0].ID)
+		So(uploaded[0].Filename, ShouldEqual, "hello.txt")
+		So(uploaded[0].Size, ShouldEqual, len("Hello content"))
+		So(uploaded[0].MimeType, ShouldStartWith, "text/plain")
+		id := fmt.Sprintf("%d", uploaded[0].ID)
+		Convey("Uploads without files are rejected", func() {
+			So(performUpload(adminCookie, nil).Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Uploaded files are served inline with their file name", func() {
+			w := performContentRequest(adminCookie, id, nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "Hello content")
+			So(w.Header().Get("Content-Disposition"), ShouldEqual, "inline; filename=hello.txt")
+			So(w.Header().Get("ETag"), ShouldEqual, fmt.Sprintf(`"%s"`, uploaded[0].CheckSum))
+		})
+		Convey("Files can be downloaded as attachments", func() {
+			w := performContentRequest(adminCookie, id+"?download=true", nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Disposition"), ShouldEqual, "attachment; filename=hello.txt")
+		})
+		Convey("Byte ranges are served", func() {
+			w := performContentRequest(adminCookie, id, map[string]string{"Range": "bytes=6-12"})
+			So(w.Code, ShouldEqual, http.StatusPartialContent)
+			So(w.Body.String(), ShouldEqual, "content")
+			So(w.Header().Get("Content-Range"), ShouldEqual, "bytes 6-12/13")
+		})
+		Convey("Unchanged files are not sent again", func() {
+			w := performContentRequest(adminCookie, id, map[string]string{
+				"If-None-Match": fmt.Sprintf(`"%s"`, uploaded[0].CheckSum),
+			})
+			So(w.Code, ShouldEqual, http.StatusNotModified)
+			So(w.Body.Len(), ShouldEqual, 0)
+		})
+		Convey("Unknown attachments are not found", func() {
+			So(performContentRequest(adminCookie, "not-an-id", nil).Code, ShouldEqual, http.StatusNotFound)
+			So(performContentRequest(adminCookie, "999999999", nil).Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Attachments of unreadable records are forbidden", func() {
+			userCookie := loginAs("content_tester", "Content-Test-123")
+			w := performContentRequest(userCookie, fmt.Sprintf("%d", privateID), nil)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldNotContainSubstring, "Private content")
+			So(performContentRequest(adminCookie, fmt.Sprintf("%d", privateID), nil).Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
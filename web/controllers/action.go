@@ -44,6 +44,9 @@ func ActionRun(c *server.Context) {
 	}{}
 	c.BindRPCParams(&params)
 	action := actions.Registry.MustGetById(params.ActionID)
+	if !checkAPIKeyScope(c, action.Method) {
+		return
+	}
 
 	// Process context ids into args
 	var ids []int64
@@ -0,0 +1,200 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hexya-erp/hexya-base/base/storage"
+	"github.com/hexya-erp/hexya-base/web/odooproxy"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/server"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+)
+
+// maxUploadMemory is the size of the uploaded files above which they are
+// written to temporary files instead of being kept in memory.
+const maxUploadMemory = 32 << 20
+
+// attachmentCond returns the condition to get the attachment with the given id,
+// including attachments of binary fields.
+func attachmentCond(id int64) q.AttachmentCondition {
+	return q.Attachment().ID().Equals(id).AndCond(
+		q.Attachment().ResField().IsNull().Or().ResField().IsNotNull())
+}
+
+// contentDisposition returns the value of the Content-Disposition header for
+// the given file name.
+func contentDisposition(fileName string, download bool) string {
+	disposition := "inline"
+	if download {
+		disposition = "attachment"
+	}
+	if fileName == "" {
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": fileName})
+}
+
+// Content serves the content of the attachment with the given id.
+//
+// The content is streamed from the attachment storage and byte ranges are supported.
+// Set the 'download' query parameter to true to have the browser save the file.
+func Content(c *server.Context) {
+	if !checkAPIKeyScope(c, "Load") {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	serveAttachment(c, c.Session().Get("uid").(int64), id)
+}
+
+// serveAttachment streams the content of the attachment with the given id,
+// after checking that the user with the given uid may read it.
+func serveAttachment(c *server.Context, uid, id int64) {
+	var (
+		found                         bool
+		url, fileName, mimeType, etag string
+		modTime                       time.Time
+		content                       storage.ReadSeekCloser
+		cErr                          error
+	)
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		attach := h.Attachment().NewSet(env).Sudo().Search(attachmentCond(id)).Sudo(uid)
+		if attach.IsEmpty() {
+			return
+		}
+		found = true
+		if attach.Type() == "url" {
+			attach.Check("read", nil)
+			url = attach.URL()
+			return
+		}
+		content, cErr = attach.OpenContent()
+		fileName = attach.DatasFname()
+		if fileName == "" {
+			fileName = attach.Name()
+		}
+		mimeType = attach.MimeType()
+		if attach.CheckSum() != "" {
+			etag = fmt.Sprintf(`"%s"`, attach.CheckSum())
+		}
+		modTime = attach.WriteDate().Time
+	})
+	switch {
+	case err != nil:
+		if content != nil {
+			content.Close()
+		}
+		log.Warn("Unable to access attachment", "id", id, "uid", uid, "error", err)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	case !found:
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	case url != "":
+		c.Redirect(http.StatusFound, url)
+		return
+	case cErr == storage.ErrNotFound:
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	case cErr != nil:
+		c.Error(fmt.Errorf("unable to read attachment %d: %s", id, cErr))
+		return
+	}
+	defer content.Close()
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	c.Header("Content-Type", mimeType)
+	c.Header("Content-Disposition", contentDisposition(fileName, c.Query("download") == "true"))
+	c.Header("X-Content-Type-Options", "nosniff")
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+	// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since headers
+	http.ServeContent(c.Writer, c.Request, fileName, modTime, content)
+}
+
+// An uploadedFile is the description of an attachment created by Upload
+type uploadedFile struct {
+	ID       int64  `json:"id"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mimetype"`
+	CheckSum string `json:"checksum"`
+	Size     int    `json:"size"`
+}
+
+// Upload creates an attachment for each file of the 'ufile' field of a
+// multipart form, and attaches it to the record given by the 'model' and
+// 'id' fields if any.
+//
+// Files are streamed to the attachment storage without being base64 encoded.
+// It returns the list of the created attachments as JSON.
+func Upload(c *server.Context) {
+	if !checkAPIKeyScope(c, "Create") {
+		return
+	}
+	if err := c.Request.ParseMultipartForm(maxUploadMemory); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	defer c.Request.MultipartForm.RemoveAll()
+	files := c.Request.MultipartForm.File["ufile"]
+	if len(files) == 0 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	var resID int64
+	if val := c.Request.FormValue("id"); val != "" {
+		var err error
+		if resID, err = strconv.ParseInt(val, 10, 64); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+	}
+	resModel := odooproxy.ConvertModelName(c.Request.FormValue("model"))
+	uid := c.Session().Get("uid").(int64)
+	var res []uploadedFile
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		for _, fh := range files {
+			file, err := fh.Open()
+			if err != nil {
+				log.Panic("Unable to open uploaded file", "file", fh.Filename, "error", err)
+			}
+			attach := h.Attachment().Create(env, &h.AttachmentData{
+				Name:       fh.Filename,
+				DatasFname: fh.Filename,
+				ResModel:   resModel,
+				ResID:      resID,
+				MimeType:   fh.Header.Get("Content-Type"),
+			})
+			err = attach.WriteContent(file)
+			file.Close()
+			if err != nil {
+				log.Panic("Unable to store uploaded file", "file", fh.Filename, "error", err)
+			}
+			res = append(res, uploadedFile{
+				ID:       attach.ID(),
+				Filename: fh.Filename,
+				MimeType: attach.MimeType(),
+				CheckSum: attach.CheckSum(),
+				Size:     attach.FileSize(),
+			})
+		}
+	})
+	if err != nil {
+		c.Error(fmt.Errorf("unable to upload files: %s", err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -6,6 +6,7 @@ package controllers
 import (
 	"net/http"
 
+	"github.com/hexya-erp/hexya-base/web/odooproxy"
 	"github.com/hexya-erp/hexya/hexya/actions"
 	"github.com/hexya-erp/hexya/hexya/server"
 )
@@ -15,6 +16,9 @@ func CallKW(c *server.Context) {
 	uid := c.Session().Get("uid").(int64)
 	var params CallParams
 	c.BindRPCParams(&params)
+	if !checkAPIKeyScope(c, odooproxy.ConvertMethodName(params.Method)) {
+		return
+	}
 	res, err := Execute(uid, params)
 	c.RPC(http.StatusOK, res, err)
 }
@@ -25,6 +29,9 @@ func CallButton(c *server.Context) {
 	uid := c.Session().Get("uid").(int64)
 	var params CallParams
 	c.BindRPCParams(&params)
+	if !checkAPIKeyScope(c, odooproxy.ConvertMethodName(params.Method)) {
+		return
+	}
 	res, err := Execute(uid, params)
 	switch act := res.(type) {
 	case actions.Action:
@@ -0,0 +1,88 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/server"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// Impersonate logs the current admin in as another user. The admin's
+// session is kept, so that they can return to their account at any time.
+func Impersonate(c *server.Context) {
+	params := struct {
+		UserID int64 `json:"user_id"`
+	}{}
+	c.BindRPCParams(&params)
+	sess := c.Session()
+	if _, ok := c.Get(apiKeyIDKey); ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if _, ok := sess.Get("impersonator_uid").(int64); ok {
+		c.RPC(http.StatusOK, nil, errors.New("you must return to your account before logging in as another user"))
+		return
+	}
+	adminUID := sess.Get("uid").(int64)
+	adminLogin, _ := sess.Get("login").(string)
+	var login string
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		user := h.User().Browse(env, []int64{params.UserID})
+		impersonations := h.UserImpersonation().NewSet(env).WithContext("client_ip", c.ClientIP())
+		impersonations.Start(h.User().Browse(env, []int64{adminUID}), user)
+		login = user.Login()
+	})
+	if err != nil {
+		c.RPC(http.StatusOK, nil, err)
+		return
+	}
+	sess.Set("impersonator_uid", adminUID)
+	sess.Set("impersonator_login", adminLogin)
+	sess.Set("uid", params.UserID)
+	sess.Set("login", login)
+	sess.Save()
+	c.RPC(http.StatusOK, true)
+}
+
+// StopImpersonation returns to the admin's own account
+// after they have logged in as another user.
+func StopImpersonation(c *server.Context) {
+	stopImpersonation(c)
+	c.Redirect(http.StatusSeeOther, "/web")
+}
+
+// stopImpersonation records the end of the current impersonation, if any,
+// and restores the admin's user in the session.
+func stopImpersonation(c *server.Context) {
+	sess := c.Session()
+	adminUID, ok := sess.Get("impersonator_uid").(int64)
+	if !ok {
+		return
+	}
+	recordImpersonationStop(c)
+	sess.Set("uid", adminUID)
+	sess.Set("login", sess.Get("impersonator_login"))
+	sess.Delete("impersonator_uid")
+	sess.Delete("impersonator_login")
+	sess.Save()
+}
+
+// recordImpersonationStop records the end of the current impersonation, if any,
+// without changing the session.
+func recordImpersonationStop(c *server.Context) {
+	sess := c.Session()
+	adminUID, ok := sess.Get("impersonator_uid").(int64)
+	if !ok {
+		return
+	}
+	uid, _ := sess.Get("uid").(int64)
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		h.UserImpersonation().NewSet(env).Stop(h.User().Browse(env, []int64{adminUID}), h.User().Browse(env, []int64{uid}))
+	})
+}
@@ -5,11 +5,16 @@ package controllers
 
 import (
 	"net/http"
+	"strings"
 
+	"github.com/hexya-erp/hexya-base/base"
+	"github.com/hexya-erp/hexya-base/base/totp"
+	"github.com/hexya-erp/hexya/hexya/models"
 	"github.com/hexya-erp/hexya/hexya/models/security"
 	"github.com/hexya-erp/hexya/hexya/models/types"
 	"github.com/hexya-erp/hexya/hexya/server"
 	"github.com/hexya-erp/hexya/hexya/tools/hweb"
+	"github.com/hexya-erp/hexya/pool/h"
 )
 
 // LoginGet is called when the client calls the login page
@@ -19,7 +24,9 @@ func LoginGet(c *server.Context) {
 		c.Redirect(http.StatusSeeOther, redirect)
 		return
 	}
-	c.HTML(http.StatusOK, "web.login", FrontendContext)
+	c.HTML(http.StatusOK, "web.login", loginPageContext(hweb.Context{
+		"redirect": redirect,
+	}))
 }
 
 // LoginPost is called when the client sends credentials
@@ -27,28 +34,399 @@ func LoginGet(c *server.Context) {
 func LoginPost(c *server.Context) {
 	login := c.DefaultPostForm("login", "")
 	secret := c.DefaultPostForm("password", "")
-	uid, err := security.AuthenticationRegistry.Authenticate(login, secret, new(types.Context))
+	redirect := c.DefaultPostForm("redirect", "/web")
+	uid, err := security.AuthenticationRegistry.Authenticate(login, secret,
+		types.NewContext().WithKey("client_ip", c.ClientIP()))
 	if err != nil {
-		c.HTML(http.StatusOK, "web.login", FrontendContext.Update(hweb.Context{
-			"error": "Wrong login or password",
+		msg := "Wrong login or password"
+		if _, ok := err.(base.AccountLockedError); ok {
+			msg = "Too many failed login attempts. Please try again later."
+		}
+		c.HTML(http.StatusOK, "web.login", loginPageContext(hweb.Context{
+			"error":    msg,
+			"redirect": redirect,
 		}))
 		return
 	}
+	setPendingLogin(c, uid, login)
+	continueLogin(c, redirect, nil)
+}
+
+// LoginContinuePost is called when a user who is logging in
+// has read an information page and goes on to the next step.
+func LoginContinuePost(c *server.Context) {
+	if uid, _ := getPendingLogin(c); uid == 0 {
+		c.Redirect(http.StatusSeeOther, "/web/login")
+		return
+	}
+	continueLogin(c, c.DefaultPostForm("redirect", "/web"), nil)
+}
+
+// LoginTOTPPost is called when a user who has enabled two-factor
+// authentication sends the code of his authenticator application.
+func LoginTOTPPost(c *server.Context) {
+	uid, _ := getPendingLogin(c)
+	if uid == 0 || nextLoginStep(c, uid) != loginStepTOTP {
+		c.Redirect(http.StatusSeeOther, "/web/login")
+		return
+	}
+	code := c.DefaultPostForm("code", "")
+	redirect := c.DefaultPostForm("redirect", "/web")
+	var err error
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		err = h.User().Browse(env, []int64{uid}).WithContext("client_ip", c.ClientIP()).AuthenticateTOTP(code)
+	})
+	if err != nil {
+		msg := "Invalid authentication code"
+		if _, ok := err.(base.AccountLockedError); ok {
+			msg = "Too many failed login attempts. Please try again later."
+		}
+		continueLogin(c, redirect, hweb.Context{"error": msg})
+		return
+	}
+	sess := c.Session()
+	sess.Set("pending_totp", true)
+	sess.Save()
+	continueLogin(c, redirect, nil)
+}
+
+// LoginTOTPEnrollPost is called when a user who must use two-factor
+// authentication has scanned the QR code and sends the first code
+// of his authenticator application.
+func LoginTOTPEnrollPost(c *server.Context) {
+	uid, login := getPendingLogin(c)
+	if uid == 0 || nextLoginStep(c, uid) != loginStepTOTPEnroll {
+		c.Redirect(http.StatusSeeOther, "/web/login")
+		return
+	}
+	code := c.DefaultPostForm("code", "")
+	redirect := c.DefaultPostForm("redirect", "/web")
+	secret, _ := c.Session().Get("pending_totp_secret").(string)
+	var recoveryCodes []string
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		user := h.User().Browse(env, []int64{uid})
+		user = user.WithNewContext(user.ContextGet()).WithContext("client_ip", c.ClientIP())
+		recoveryCodes = user.EnableTOTP(secret, code)
+		h.AuthLog().NewSet(env).Record(login, "success", "Two-factor authentication enrolled")
+		user.UpdateLastLogin()
+	})
+	if err != nil {
+		continueLogin(c, redirect, hweb.Context{"error": "Invalid verification code"})
+		return
+	}
+	sess := c.Session()
+	sess.Set("pending_totp", true)
+	sess.Delete("pending_totp_secret")
+	sess.Save()
+	c.HTML(http.StatusOK, "web.login_totp_recovery_codes", FrontendContext.Update(hweb.Context{
+		"recovery_codes": recoveryCodes,
+		"redirect":       redirect,
+	}))
+}
+
+// LoginPasswordExpiredPost is called when a user whose password
+// has expired sends his new password from the login page.
+func LoginPasswordExpiredPost(c *server.Context) {
+	uid, _ := getPendingLogin(c)
+	if uid == 0 || nextLoginStep(c, uid) != loginStepPasswordExpired {
+		c.Redirect(http.StatusSeeOther, "/web/login")
+		return
+	}
+	newPassword := c.DefaultPostForm("new_password", "")
+	confirmPassword := c.DefaultPostForm("confirm_pwd", "")
+	redirect := c.DefaultPostForm("redirect", "/web")
+	var errors []string
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		user := h.User().Browse(env, []int64{uid})
+		user = user.WithNewContext(user.ContextGet())
+		errors = user.CheckPasswordPolicy(newPassword)
+		if newPassword != confirmPassword {
+			errors = append(errors, user.T("The new password and its confirmation must be identical."))
+		}
+		if len(errors) == 0 {
+			user.UpdatePassword(newPassword)
+		}
+	})
+	if len(errors) > 0 {
+		continueLogin(c, redirect, hweb.Context{"errors": errors})
+		return
+	}
+	continueLogin(c, redirect, nil)
+}
+
+// Steps that a user may have to complete after a successful
+// password authentication before being logged in
+const (
+	loginStepTOTP            = "totp"
+	loginStepTOTPEnroll      = "totp_enroll"
+	loginStepPasswordExpired = "password_expired"
+)
+
+// nextLoginStep returns the next step that the user with the given id must
+// complete before being logged in, or an empty string if there is none left.
+func nextLoginStep(c *server.Context, uid int64) string {
+	var totpEnabled, totpRequired, expired bool
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		user := h.User().Browse(env, []int64{uid})
+		totpEnabled = user.TOTPEnabled()
+		totpRequired = user.TOTPRequired()
+		expired = user.PasswordExpired()
+	})
+	if totpDone, _ := c.Session().Get("pending_totp").(bool); !totpDone {
+		switch {
+		case totpEnabled:
+			return loginStepTOTP
+		case totpRequired:
+			return loginStepTOTPEnroll
+		}
+	}
+	if expired {
+		return loginStepPasswordExpired
+	}
+	return ""
+}
+
+// continueLogin displays the page of the next step that the pending user must
+// complete, with the given additional values, or logs him in if there is none left.
+func continueLogin(c *server.Context, redirect string, values hweb.Context) {
+	uid, login := getPendingLogin(c)
+	ctx := hweb.Context{"redirect": redirect}
+	for k, v := range values {
+		ctx[k] = v
+	}
+	switch nextLoginStep(c, uid) {
+	case loginStepTOTP:
+		c.HTML(http.StatusOK, "web.login_totp", FrontendContext.Update(ctx))
+	case loginStepTOTPEnroll:
+		sess := c.Session()
+		secret, ok := sess.Get("pending_totp_secret").(string)
+		if !ok {
+			var err error
+			secret, err = totp.GenerateSecret()
+			if err != nil {
+				c.Error(err)
+				return
+			}
+			sess.Set("pending_totp_secret", secret)
+			sess.Save()
+		}
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			ctx["qr_code"] = h.User().Browse(env, []int64{uid}).TOTPQRCode(secret)
+		})
+		ctx["secret"] = secret
+		c.HTML(http.StatusOK, "web.login_totp_enroll", FrontendContext.Update(ctx))
+	case loginStepPasswordExpired:
+		c.HTML(http.StatusOK, "web.login_password_expired", FrontendContext.Update(ctx))
+	default:
+		finishLogin(c, uid, login, redirect)
+	}
+}
+
+// setPendingLogin stores in the session the user who has been authenticated
+// but who may still need to complete some steps before being logged in.
+func setPendingLogin(c *server.Context, uid int64, login string) {
+	sess := c.Session()
+	clearPendingLogin(c)
+	sess.Set("pending_uid", uid)
+	sess.Set("pending_login", login)
+	sess.Save()
+}
 
+// getPendingLogin returns the uid and login of the user who is
+// currently logging in, or 0 if there is none.
+func getPendingLogin(c *server.Context) (int64, string) {
 	sess := c.Session()
+	uid, ok := sess.Get("pending_uid").(int64)
+	if !ok {
+		return 0, ""
+	}
+	login, _ := sess.Get("pending_login").(string)
+	return uid, login
+}
+
+// clearPendingLogin removes the pending login data from the session
+func clearPendingLogin(c *server.Context) {
+	sess := c.Session()
+	for _, key := range []string{"pending_uid", "pending_login", "pending_totp", "pending_totp_secret"} {
+		sess.Delete(key)
+	}
+}
+
+// finishLogin logs the given user in the current session
+// and redirects him to the given URL.
+func finishLogin(c *server.Context, uid int64, login, redirect string) {
+	sess := c.Session()
+	clearPendingLogin(c)
 	sess.Set("uid", uid)
 	sess.Set("login", login)
-	// TODO Manage session_id
-	sess.Set("ID", int64(1))
+	sess.Set("ID", openSession(c, uid))
 	sess.Save()
-	redirect := c.DefaultPostForm("redirect", "/web")
 	c.Redirect(http.StatusSeeOther, redirect)
 }
 
+// openSession creates a new server-side session for the given
+// user and the current client, and returns its ID.
+func openSession(c *server.Context, uid int64) string {
+	var sessionID string
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		sessionID = h.UserSession().NewSet(env).Open(h.User().Browse(env, []int64{uid}), c.ClientIP(), c.Request.UserAgent())
+	})
+	return sessionID
+}
+
+// clearSession logs out the current client. The current impersonation,
+// if any, is recorded as stopped.
+func clearSession(c *server.Context) {
+	recordImpersonationStop(c)
+	sess := c.Session()
+	sess.Delete("uid")
+	sess.Delete("ID")
+	sess.Delete("login")
+	sess.Delete("impersonator_uid")
+	sess.Delete("impersonator_login")
+	sess.Save()
+}
+
+// userContext returns the context of the user with the given id.
+func userContext(uid int64) *types.Context {
+	var ctx *types.Context
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		ctx = h.User().Browse(env, []int64{uid}).ContextGet()
+	})
+	return ctx
+}
+
+// apiKeyIDKey is the key of the request context holding the id of
+// the API key that authenticated the current request, if any.
+const apiKeyIDKey = "api_key_id"
+
+// apiKeyReadRoutes are the POST routes which can be called with a read-only
+// API key, either because they only read data, or because they check the
+// scope of the key against the model method they call.
+var apiKeyReadRoutes = map[string]bool{
+	"/web/session/modules":          true,
+	"/web/session/get_session_info": true,
+	"/web/proxy/load":               true,
+	"/web/dataset/search_read":      true,
+	"/web/dataset/call_button":      true,
+	"/web/action/load":              true,
+	"/web/action/run":               true,
+	"/web/menu/load_needaction":     true,
+}
+
+// apiKeyReadRoutePrefixes are the prefixes of the POST routes which can be
+// called with a read-only API key, as in apiKeyReadRoutes.
+var apiKeyReadRoutePrefixes = []string{
+	"/web/dataset/call_kw/",
+	"/web/webclient/",
+}
+
+// isAPIKeyReadRoute returns true if the current request can be made with a read-only API key
+func isAPIKeyReadRoute(c *server.Context) bool {
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		return true
+	}
+	path := strings.TrimSuffix(c.Request.URL.Path, "/")
+	if apiKeyReadRoutes[path] {
+		return true
+	}
+	for _, prefix := range apiKeyReadRoutePrefixes {
+		if strings.HasPrefix(c.Request.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token of the 'Authorization: Bearer' header
+// of the current request, or an empty string if there is none.
+func bearerToken(c *server.Context) string {
+	auth := c.Request.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// apiKeyLogin authenticates the current request with the given API key.
+// The user is only logged in for this request: the session is not saved.
+func apiKeyLogin(c *server.Context, key string) {
+	var (
+		uid, keyID   int64
+		login, scope string
+	)
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		apiKey := h.UserAPIKey().NewSet(env).Check(key)
+		if apiKey.IsEmpty() {
+			return
+		}
+		uid, login, keyID, scope = apiKey.User().ID(), apiKey.User().Login(), apiKey.ID(), apiKey.Scope()
+	})
+	if uid == 0 {
+		log.Warn("Invalid API key", "ip", c.ClientIP())
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set(apiKeyIDKey, keyID)
+	if scope != "write" && !isAPIKeyReadRoute(c) {
+		log.Warn("Read-only API key used on a write route", "key", keyID, "path", c.Request.URL.Path, "ip", c.ClientIP())
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	sess := c.Session()
+	sess.Set("uid", uid)
+	sess.Set("login", login)
+}
+
+// checkAPIKeyScope returns true if the current request may call the given method.
+// If the request is authenticated by an API key whose scope does not allow this
+// method, it aborts the request with a 403 status and returns false.
+func checkAPIKeyScope(c *server.Context, method string) bool {
+	keyID, ok := c.Get(apiKeyIDKey)
+	if !ok {
+		return true
+	}
+	var allowed bool
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		allowed = h.UserAPIKey().Browse(env, []int64{keyID.(int64)}).AllowsMethod(method)
+	})
+	if !allowed {
+		c.AbortWithStatus(http.StatusForbidden)
+	}
+	return allowed
+}
+
 // LoginRequired is a middleware that redirects to login page
 // non logged in users.
+//
+// Requests with an 'Authorization: Bearer' header are authenticated with
+// the API key of this header instead of the session cookie. Read-only API
+// keys are rejected with a 403 status on routes which may modify data.
 func LoginRequired(c *server.Context) {
-	if c.Session().Get("uid") == nil {
+	if key := bearerToken(c); key != "" {
+		apiKeyLogin(c, key)
+		return
+	}
+	sess := c.Session()
+	if sess.Get("uid") == nil {
+		c.Redirect(http.StatusSeeOther, "/web/login")
+		c.Abort()
+		return
+	}
+	sessionID, _ := sess.Get("ID").(string)
+	var valid bool
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		// The server-side session belongs to the admin while impersonating another user
+		owner, ok := sess.Get("impersonator_uid").(int64)
+		if !ok {
+			owner = sess.Get("uid").(int64)
+		}
+		session := h.UserSession().NewSet(env).Check(sessionID)
+		valid = !session.IsEmpty() && session.User().ID() == owner
+	})
+	if !valid {
+		// The session has expired or has been revoked
+		clearSession(c)
 		c.Redirect(http.StatusSeeOther, "/web/login")
 		c.Abort()
 	}
@@ -253,7 +253,17 @@ func init() {
 	})
 	root.AddController(http.MethodGet, "/web/login", LoginGet)
 	root.AddController(http.MethodPost, "/web/login", LoginPost)
+	root.AddController(http.MethodPost, "/web/login/continue", LoginContinuePost)
+	root.AddController(http.MethodPost, "/web/login/totp", LoginTOTPPost)
+	root.AddController(http.MethodPost, "/web/login/totp_enroll", LoginTOTPEnrollPost)
+	root.AddController(http.MethodPost, "/web/login/password_expired", LoginPasswordExpiredPost)
+	root.AddController(http.MethodGet, "/web/login/oauth", LoginOAuth)
+	root.AddController(http.MethodGet, "/web/login/oauth/callback", LoginOAuthCallback)
+	root.AddController(http.MethodGet, "/web/reset_password", ResetPasswordGet)
+	root.AddController(http.MethodPost, "/web/reset_password", ResetPasswordPost)
 	root.AddController(http.MethodGet, "/web/binary/company_logo", CompanyLogo)
+	root.AddController(http.MethodGet, "/web/share/:token", Share)
+	root.AddController(http.MethodPost, "/web/share/:token", Share)
 	assets := root.AddGroup("/web/assets")
 	{
 		assets.AddController(http.MethodGet, "/common.css", AssetsCommonCSS)
@@ -269,6 +279,8 @@ func init() {
 		web.AddController(http.MethodGet, "/", WebClient)
 		web.AddController(http.MethodGet, "/image", Image)
 		web.AddController(http.MethodGet, "/menu/:menu_id", MenuImage)
+		web.AddController(http.MethodGet, "/content/:id", Content)
+		web.AddController(http.MethodPost, "/binary/upload_attachment", Upload)
 
 		sess := web.AddGroup("/session")
 		{
@@ -276,6 +288,8 @@ func init() {
 			sess.AddController(http.MethodPost, "/get_session_info", GetSessionInfo)
 			sess.AddController(http.MethodGet, "/logout", Logout)
 			sess.AddController(http.MethodPost, "/change_password", ChangePassword)
+			sess.AddController(http.MethodPost, "/impersonate", Impersonate)
+			sess.AddController(http.MethodPost, "/stop_impersonation", StopImpersonation)
 		}
 
 		proxy := web.AddGroup("/proxy")
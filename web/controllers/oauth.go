@@ -0,0 +1,139 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/hexya-erp/hexya-base/base"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/server"
+	"github.com/hexya-erp/hexya/hexya/tools/hweb"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// LoginOAuth redirects the client to the login page of the OAuth provider
+// given by the 'provider' query parameter.
+func LoginOAuth(c *server.Context) {
+	providerID, _ := strconv.ParseInt(c.Query("provider"), 10, 64)
+	redirect := c.DefaultQuery("redirect", "/web")
+	state := base.NewOAuthRandomString()
+	nonce := base.NewOAuthRandomString()
+	verifier := base.NewOAuthRandomString()
+	var (
+		authURL string
+		err     error
+	)
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		provider := h.OAuthProvider().Browse(env, []int64{providerID})
+		if provider.IsEmpty() || !provider.Active() {
+			err = fmt.Errorf("unknown OAuth provider %d", providerID)
+			return
+		}
+		authURL, err = provider.AuthorizationURL(oauthRedirectURI(c), state, nonce, verifier)
+	})
+	if err != nil {
+		log.Warn("Unable to start OAuth login", "provider", providerID, "error", err)
+		c.HTML(http.StatusOK, "web.login", loginPageContext(hweb.Context{
+			"error": "Unable to connect to the authentication provider",
+		}))
+		return
+	}
+	sess := c.Session()
+	sess.Set("oauth_provider", providerID)
+	sess.Set("oauth_state", state)
+	sess.Set("oauth_nonce", nonce)
+	sess.Set("oauth_verifier", verifier)
+	sess.Set("oauth_redirect", redirect)
+	sess.Save()
+	c.Redirect(http.StatusSeeOther, authURL)
+}
+
+// LoginOAuthCallback is called when the OAuth provider redirects
+// the client back after he logged in.
+func LoginOAuthCallback(c *server.Context) {
+	sess := c.Session()
+	providerID, _ := sess.Get("oauth_provider").(int64)
+	state, _ := sess.Get("oauth_state").(string)
+	nonce, _ := sess.Get("oauth_nonce").(string)
+	verifier, _ := sess.Get("oauth_verifier").(string)
+	redirect, ok := sess.Get("oauth_redirect").(string)
+	if !ok {
+		redirect = "/web"
+	}
+	for _, key := range []string{"oauth_provider", "oauth_state", "oauth_nonce", "oauth_verifier", "oauth_redirect"} {
+		sess.Delete(key)
+	}
+	sess.Save()
+	loginError := func(msg string) {
+		c.HTML(http.StatusOK, "web.login", loginPageContext(hweb.Context{
+			"error":    msg,
+			"redirect": redirect,
+		}))
+	}
+	switch {
+	case state == "" || c.Query("state") != state:
+		loginError("Invalid authentication request. Please try again.")
+		return
+	case c.Query("error") != "":
+		log.Info("OAuth login refused by provider", "provider", providerID, "error", c.Query("error"),
+			"description", c.Query("error_description"))
+		loginError("Authentication refused by the provider")
+		return
+	}
+	var (
+		uid   int64
+		login string
+		err   error
+	)
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		provider := h.OAuthProvider().Browse(env, []int64{providerID}).WithContext("client_ip", c.ClientIP())
+		uid, err = provider.Authenticate(c.Query("code"), oauthRedirectURI(c), verifier, nonce)
+		if err == nil {
+			login = h.User().Browse(env, []int64{uid}).Login()
+		}
+	})
+	if err != nil {
+		msg := "You do not have access to this database. Please contact your administrator."
+		if _, ok := err.(base.AccountLockedError); ok {
+			msg = "Too many failed login attempts. Please try again later."
+		}
+		loginError(msg)
+		return
+	}
+	setPendingLogin(c, uid, login)
+	continueLogin(c, redirect, nil)
+}
+
+// oauthRedirectURI returns the URI to which OAuth providers
+// must redirect clients after they logged in.
+func oauthRedirectURI(c *server.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/web/login/oauth/callback", scheme, c.Request.Host)
+}
+
+// loginPageContext returns the context to render the login page with,
+// including the given values and the OAuth providers to display.
+func loginPageContext(values hweb.Context) hweb.Context {
+	var providers []hweb.Context
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		for _, provider := range h.OAuthProvider().NewSet(env).SearchAll().Records() {
+			providers = append(providers, hweb.Context{
+				"id":   provider.ID(),
+				"name": provider.Name(),
+			})
+		}
+	})
+	ctx := hweb.Context{"oauth_providers": providers}
+	for k, v := range values {
+		ctx[k] = v
+	}
+	return FrontendContext.Update(ctx)
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/server"
+	"github.com/hexya-erp/hexya/hexya/tools/hweb"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// ResetPasswordGet displays the form to request a password reset email or,
+// if the URL has a token, the form to choose a new password.
+func ResetPasswordGet(c *server.Context) {
+	token := c.DefaultQuery("token", "")
+	if token == "" {
+		c.HTML(http.StatusOK, "web.reset_password_request", FrontendContext.Update(hweb.Context{}))
+		return
+	}
+	var login string
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		login = h.User().NewSet(env).CheckSignupToken(token).Login()
+	})
+	if login == "" {
+		c.HTML(http.StatusOK, "web.reset_password_request", FrontendContext.Update(hweb.Context{
+			"error": "This link is invalid or has expired. Please request a new one.",
+		}))
+		return
+	}
+	c.HTML(http.StatusOK, "web.reset_password", FrontendContext.Update(hweb.Context{
+		"token": token,
+		"login": login,
+	}))
+}
+
+// ResetPasswordPost sends a password reset email to the given login or,
+// if the form has a token, sets the new password of the token's user.
+func ResetPasswordPost(c *server.Context) {
+	token := c.DefaultPostForm("token", "")
+	if token == "" {
+		login := c.DefaultPostForm("login", "")
+		var err error
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			err = h.User().NewSet(env).WithContext("client_ip", c.ClientIP()).RequestPasswordReset(login)
+		})
+		if err != nil {
+			c.HTML(http.StatusTooManyRequests, "web.reset_password_request", FrontendContext.Update(hweb.Context{
+				"error": "Too many password reset requests. Please try again later.",
+			}))
+			return
+		}
+		c.HTML(http.StatusOK, "web.reset_password_request", FrontendContext.Update(hweb.Context{
+			"message": "If an account matches this login, an email with a link to reset its password will be sent shortly.",
+		}))
+		return
+	}
+	newPassword := c.DefaultPostForm("new_password", "")
+	confirmPassword := c.DefaultPostForm("confirm_pwd", "")
+	var (
+		errors []string
+		login  string
+	)
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		users := h.User().NewSet(env).WithContext("client_ip", c.ClientIP())
+		user := users.CheckSignupToken(token)
+		login = user.Login()
+		if newPassword != confirmPassword {
+			errors = []string{users.T("The new password and its confirmation must be identical.")}
+			return
+		}
+		errors = users.ResetPasswordWithToken(token, newPassword)
+	})
+	if len(errors) > 0 {
+		c.HTML(http.StatusOK, "web.reset_password", FrontendContext.Update(hweb.Context{
+			"token":  token,
+			"login":  login,
+			"errors": errors,
+		}))
+		return
+	}
+	c.HTML(http.StatusOK, "web.login", loginPageContext(hweb.Context{
+		"login":    login,
+		"message":  "Your password has been set. You can now log in.",
+		"redirect": "/web",
+	}))
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/hexya-erp/hexya-base/base"
 	"github.com/hexya-erp/hexya/hexya/models"
 	"github.com/hexya-erp/hexya/hexya/models/security"
 	"github.com/hexya-erp/hexya/hexya/models/types"
@@ -20,21 +21,25 @@ import (
 
 // SessionInfo gathers all information about the current session
 type SessionInfo struct {
-	SessionID   int64                  `json:"session_id"`
+	SessionID   string                 `json:"session_id"`
 	UID         int64                  `json:"uid"`
 	UserContext map[string]interface{} `json:"user_context"`
 	DB          string                 `json:"db"`
 	UserName    string                 `json:"username"`
 	CompanyID   int64                  `json:"company_id"`
 	Name        string                 `json:"name"`
+	// StorageWarning is displayed by the web client when the storage
+	// usage of the user or their company is close to the quota.
+	StorageWarning string `json:"storage_warning,omitempty"`
 }
 
 // GetSessionInfoStruct returns a struct with information about the given session
 func GetSessionInfoStruct(sess sessions.Session) *SessionInfo {
 	var (
-		userContext *types.Context
-		companyID   int64
-		userName    string
+		userContext    *types.Context
+		companyID      int64
+		userName       string
+		storageWarning string
 	)
 	if sess.Get("uid") != nil {
 		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
@@ -42,15 +47,18 @@ func GetSessionInfoStruct(sess sessions.Session) *SessionInfo {
 			userContext = user.ContextGet()
 			companyID = user.Company().ID()
 			userName = user.Name()
+			storageWarning = user.WithNewContext(userContext).StorageWarning()
 		})
+		sessionID, _ := sess.Get("ID").(string)
 		return &SessionInfo{
-			SessionID:   sess.Get("ID").(int64),
-			UID:         sess.Get("uid").(int64),
-			UserContext: userContext.ToMap(),
-			DB:          viper.GetString("DB.Name"),
-			UserName:    sess.Get("login").(string),
-			CompanyID:   companyID,
-			Name:        userName,
+			SessionID:      sessionID,
+			UID:            sess.Get("uid").(int64),
+			UserContext:    userContext.ToMap(),
+			DB:             viper.GetString("DB.Name"),
+			UserName:       sess.Get("login").(string),
+			CompanyID:      companyID,
+			Name:           userName,
+			StorageWarning: storageWarning,
 		}
 	}
 	return nil
@@ -72,11 +80,13 @@ func Modules(c *server.Context) {
 
 // Logout the current user and redirect to login page
 func Logout(c *server.Context) {
-	sess := c.Session()
-	sess.Delete("uid")
-	sess.Delete("ID")
-	sess.Delete("login")
-	sess.Save()
+	stopImpersonation(c)
+	if sessionID, ok := c.Session().Get("ID").(string); ok {
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.UserSession().NewSet(env).Revoke(sessionID)
+		})
+	}
+	clearSession(c)
 	redirect := c.DefaultQuery("redirect", "/web/login")
 	c.Redirect(http.StatusSeeOther, redirect)
 }
@@ -89,8 +99,13 @@ type ChangePasswordData struct {
 	} `json:"fields"`
 }
 
-// ChangePassword is called by the client to change the current user password
+// ChangePassword is called by the client to change the current user password.
+// It cannot be called with an API key, since it checks the current password.
 func ChangePassword(c *server.Context) {
+	if _, ok := c.Get(apiKeyIDKey); ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
 	uid := c.Session().Get("uid").(int64)
 	var params ChangePasswordData
 	c.BindRPCParams(&params)
@@ -106,15 +121,35 @@ func ChangePassword(c *server.Context) {
 		}
 	}
 	res := make(gin.H)
+	ctx := userContext(uid).WithKey("client_ip", c.ClientIP())
 	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
-		rs := h.User().NewSet(env)
-		if strings.TrimSpace(oldPassword) == "" ||
-			strings.TrimSpace(newPassword) == "" ||
-			strings.TrimSpace(confirmPassword) == "" {
-			log.Panic(rs.T("You cannot leave any password empty."))
+		rs := h.User().NewSet(env).WithNewContext(ctx)
+		user := rs.Sudo().Browse([]int64{uid})
+		// Errors are returned by form field so that the client can display them
+		fieldErrors := make(map[string]string)
+		switch {
+		case strings.TrimSpace(oldPassword) == "":
+			fieldErrors["old_pwd"] = rs.T("Please enter your current password.")
+		default:
+			switch user.VerifyPassword(oldPassword).(type) {
+			case nil:
+			case base.AccountLockedError:
+				fieldErrors["old_pwd"] = rs.T("Too many failed attempts, please try again later.")
+			default:
+				fieldErrors["old_pwd"] = rs.T("The old password you provided is incorrect, your password was not changed.")
+			}
+		}
+		if msgs := user.CheckPasswordPolicy(newPassword); len(msgs) > 0 {
+			fieldErrors["new_password"] = strings.Join(msgs, "\n")
 		}
 		if newPassword != confirmPassword {
-			log.Panic(rs.T("The new password and its confirmation must be identical."))
+			fieldErrors["confirm_pwd"] = rs.T("The new password and its confirmation must be identical.")
+		}
+		if len(fieldErrors) > 0 {
+			res["title"] = rs.T("Change Password")
+			res["error"] = rs.T("Your password could not be changed.")
+			res["fields"] = fieldErrors
+			return
 		}
 		if rs.ChangePassword(oldPassword, newPassword) {
 			res["new_password"] = newPassword
@@ -122,5 +157,12 @@ func ChangePassword(c *server.Context) {
 		}
 		log.Panic(rs.T("Error, password not changed !"))
 	})
+	if _, ok := res["new_password"]; ok && err == nil {
+		// Changing the password has revoked all the sessions of the user,
+		// including this one, so we open a new one for this client.
+		sess := c.Session()
+		sess.Set("ID", openSession(c, uid))
+		sess.Save()
+	}
 	c.RPC(http.StatusOK, res, err)
 }
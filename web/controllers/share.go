@@ -0,0 +1,67 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/hexya-erp/hexya-base/base"
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/server"
+	"github.com/hexya-erp/hexya/pool/h"
+)
+
+// sharePasswordForm is the page displayed to visitors of a password protected share link
+const sharePasswordForm = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"/><title>Protected Document</title></head>
+<body>
+<form method="post">
+<p>This document is protected by a password.</p>
+<input type="password" name="password" autofocus="autofocus"/>
+<button type="submit">Download</button>
+</form>
+</body>
+</html>`
+
+// Share serves the attachment of the share link with the given token, without
+// requiring a session. Password protected links expect the password in the
+// 'password' field of a POST form.
+//
+// Wrong passwords are throttled for each link and each IP address like login
+// attempts. Requests are rejected with a 429 status while the client must wait.
+//
+// Each granted request is counted as a download, including byte range requests.
+func Share(c *server.Context) {
+	var (
+		result   string
+		attachID int64
+	)
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		var link h.AttachmentShareLinkSet
+		link, result = h.AttachmentShareLink().NewSet(env).Access(c.Param("token"), c.PostForm("password"),
+			c.ClientIP())
+		if result == base.ShareAccessOK {
+			attachID = link.Attachment().ID()
+		}
+	})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	switch result {
+	case base.ShareAccessOK:
+		serveAttachment(c, security.SuperUserID, attachID)
+	case base.ShareAccessPassword:
+		c.Data(http.StatusUnauthorized, "text/html; charset=utf-8", []byte(sharePasswordForm))
+	case base.ShareAccessThrottled:
+		c.AbortWithStatus(http.StatusTooManyRequests)
+	case base.ShareAccessRevoked, base.ShareAccessExpired, base.ShareAccessExhausted, base.ShareAccessQuarantined:
+		c.AbortWithStatus(http.StatusGone)
+	default:
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
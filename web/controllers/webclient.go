@@ -151,11 +151,12 @@ func getMenuTree(menus []*menus.Menu, lang string) []Menu {
 
 // WebClient is the controller for the application main page
 func WebClient(c *server.Context) {
-	var lang string
+	var lang, userName string
 	if c.Session().Get("uid") != nil {
 		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
 			user := h.User().Search(env, q.User().ID().Equals(c.Session().Get("uid").(int64)))
 			lang = user.ContextGet().GetString("lang")
+			userName = user.Name()
 		})
 	}
 	rootMenu := Menu{
@@ -188,6 +189,10 @@ func WebClient(c *server.Context) {
 		"backendCompiledCSS": backendCSSRoute,
 		"backendJS":          BackendJS,
 	}
+	if impersonator, ok := c.Session().Get("impersonator_login").(string); ok {
+		data["impersonator"] = impersonator
+		data["impersonated_name"] = userName
+	}
 	templateName := strings.TrimPrefix(path.Join(lang, "web.webclient_bootstrap"), "/")
 	c.HTML(http.StatusOK, templateName, data)
 }
@@ -0,0 +1,145 @@
+// Copyright 2018 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package web
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models"
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/hexya/server"
+	"github.com/hexya-erp/hexya/pool/h"
+	"github.com/hexya-erp/hexya/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+// performShareRequest requests the share link with the given token and returns the
+// response. If password is not empty, it is posted as the password form. If byteRange
+// is not empty, it is sent as the Range header.
+func performShareRequest(token, password, byteRange string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/web/share/"+token, nil)
+	if password != "" {
+		form := url.Values{"password": {password}}
+		req = httptest.NewRequest(http.MethodPost, "/web/share/"+token, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	w := httptest.NewRecorder()
+	server.GetServer().ServeHTTP(w, req)
+	return w
+}
+
+// shareLinkTokens creates share links to the given attachment and returns their tokens
+// by name. The 'revoked' link is revoked and the 'expired' one has expired.
+func shareLinkTokens(attach h.AttachmentSet) map[string]string {
+	links := map[string]h.AttachmentShareLinkSet{
+		"public":   attach.CreateShareLink(dates.DateTime{}, 0, ""),
+		"password": attach.CreateShareLink(dates.DateTime{}, 0, "s3cret"),
+		"once":     attach.CreateShareLink(dates.DateTime{}, 1, ""),
+		"revoked":  attach.CreateShareLink(dates.DateTime{}, 0, ""),
+		"expired":  attach.CreateShareLink(dates.DateTime{Time: time.Now().Add(-time.Hour)}, 0, ""),
+	}
+	links["revoked"].ActionRevoke()
+	tokens := make(map[string]string)
+	for name, link := range links {
+		tokens[name] = link.Token()
+	}
+	return tokens
+}
+
+func TestShare(t *testing.T) {
+	bootStrapControllers()
+	Convey("Testing share links", t, func() {
+		viper.Set("DataDir", os.TempDir())
+		var (
+			attachID int64
+			tokens   map[string]string
+		)
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			attach := h.Attachment().Create(env, &h.AttachmentData{
+				Name:       "shared.txt",
+				DatasFname: "shared.txt",
+				Datas:      base64.StdEncoding.EncodeToString([]byte("Shared content")),
+			})
+			attachID = attach.ID()
+			tokens = shareLinkTokens(attach)
+		}), ShouldBeNil)
+		defer models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			attach := h.Attachment().Browse(env, []int64{attachID})
+			var keys []string
+			for _, link := range attach.ShareLinks().Records() {
+				keys = append(keys, fmt.Sprintf("share:%d", link.ID()))
+			}
+			h.AuthLog().Search(env, q.AuthLog().Login().In(keys)).Unlink()
+			attach.Unlink()
+		})
+		downloads := func(name string) int {
+			var count int
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				id, _ := strconv.ParseInt(strings.Split(tokens[name], ".")[0], 10, 64)
+				count = h.AttachmentShareLink().Browse(env, []int64{id}).DownloadCount()
+			})
+			return count
+		}
+		Convey("Valid links serve the file", func() {
+			w := performShareRequest(tokens["public"], "", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "Shared content")
+			So(w.Header().Get("Cache-Control"), ShouldEqual, "no-store")
+			So(downloads("public"), ShouldEqual, 1)
+		})
+		Convey("Byte ranges are served and counted", func() {
+			w := performShareRequest(tokens["public"], "", "bytes=2-5")
+			So(w.Code, ShouldEqual, http.StatusPartialContent)
+			So(w.Body.String(), ShouldEqual, "ared")
+			So(downloads("public"), ShouldEqual, 1)
+		})
+		Convey("Invalid tokens are not found", func() {
+			So(performShareRequest("1.0.invalid", "", "").Code, ShouldEqual, http.StatusNotFound)
+			So(performShareRequest(tokens["public"]+"x", "", "").Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Password protected links ask for the password", func() {
+			w := performShareRequest(tokens["password"], "", "")
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Body.String(), ShouldContainSubstring, `name="password"`)
+			So(performShareRequest(tokens["password"], "wrong", "").Code, ShouldEqual, http.StatusUnauthorized)
+			w = performShareRequest(tokens["password"], "s3cret", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "Shared content")
+			Convey("and throttle wrong passwords", func() {
+				for i := 0; i < 3; i++ {
+					So(performShareRequest(tokens["password"], "wrong", "").Code, ShouldEqual, http.StatusUnauthorized)
+				}
+				So(performShareRequest(tokens["password"], "s3cret", "").Code, ShouldEqual, http.StatusTooManyRequests)
+			})
+		})
+		Convey("Unavailable links are gone", func() {
+			So(performShareRequest(tokens["revoked"], "", "").Code, ShouldEqual, http.StatusGone)
+			So(performShareRequest(tokens["expired"], "", "").Code, ShouldEqual, http.StatusGone)
+			So(performShareRequest(tokens["once"], "", "").Code, ShouldEqual, http.StatusOK)
+			So(performShareRequest(tokens["once"], "", "").Code, ShouldEqual, http.StatusGone)
+		})
+		Convey("Quarantined files are not served", func() {
+			So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				env.Cr().Execute("UPDATE attachment SET quarantined = TRUE WHERE id = ?", attachID)
+			}), ShouldBeNil)
+			w := performShareRequest(tokens["public"], "", "")
+			So(w.Code, ShouldEqual, http.StatusGone)
+			So(w.Body.String(), ShouldNotContainSubstring, "Shared content")
+		})
+	})
+}
@@ -172,6 +172,19 @@ function ReloadContext (parent, action) {
 }
 core.action_registry.add("reload_context", ReloadContext);
 
+/**
+ * Client action to log in as the user given in the context
+ * (impersonate_uid), then reload the whole interface.
+ */
+function Impersonate (parent, action) {
+    var context = action.context || {};
+    ajax.rpc("/web/session/impersonate", {user_id: context.impersonate_uid}).then(function() {
+        redirect('/web');
+    });
+    return $.Deferred();
+}
+core.action_registry.add("impersonate", Impersonate);
+
 
 // nvd3 customization
 //-------------------------------------------------------------------------
@@ -12,6 +12,8 @@ var session = require('web.session');
 var SystrayMenu = require('web.SystrayMenu');
 var UserMenu = require('web.UserMenu');
 
+var _t = core._t;
+
 return AbstractWebClient.extend({
     events: {
         'click .oe_logo_edit_admin': 'logo_edit',
@@ -52,6 +54,9 @@ return AbstractWebClient.extend({
         return $.when(systray_menu_loaded, user_menu_loaded).then(function() {
             self.menu.start();
             self.bind_hashchange();
+            if (session.storage_warning) {
+                self.do_warn(_t("Storage Quota"), session.storage_warning, true);
+            }
         });
 
     },
@@ -22,7 +22,12 @@ var ChangePassword = Widget.extend({ // FIXME
           self.rpc("/web/session/change_password",{
                'fields': $("form[name=change_password_form]").serializeArray()
           }).done(function(result) {
+               self.clear_field_errors();
                if (result.error) {
+                  if (result.fields) {
+                      self.display_field_errors(result.fields);
+                      return;
+                  }
                   self.display_error(result);
                   return;
                } else {
@@ -31,6 +36,22 @@ var ChangePassword = Widget.extend({ // FIXME
           });
        });
     },
+    clear_field_errors: function () {
+        this.$('.o_password_error').remove();
+        this.$('.o_form_input').removeClass('o_field_invalid');
+    },
+    display_field_errors: function (fields) {
+        var self = this;
+        _.each(fields, function (message, name) {
+            var $input = self.$('input[name=' + name + ']');
+            $input.addClass('o_field_invalid');
+            var $error = $('<div class="text-danger o_password_error"/>');
+            _.each(message.split('\n'), function (line) {
+                $error.append($('<div/>').text(line));
+            });
+            $error.insertAfter($input);
+        });
+    },
     display_error: function (error) {
         return new Dialog(this, {
             size: 'medium',
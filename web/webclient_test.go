@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 
 	_ "github.com/hexya-erp/hexya-base/web/controllers"
@@ -18,6 +19,15 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// bootStrapOnce makes sure that the controllers are bootstrapped only once,
+// whatever the tests which are run.
+var bootStrapOnce sync.Once
+
+// bootStrapControllers registers the controllers in the server
+func bootStrapControllers() {
+	bootStrapOnce.Do(controllers.BootStrap)
+}
+
 func login() *http.Cookie {
 	req := httptest.NewRequest(http.MethodPost, "/web/login", strings.NewReader(url.Values{
 		"login":    []string{"admin"},
@@ -51,7 +61,7 @@ func performRequest(path string, data map[string]interface{}) *httptest.Response
 }
 
 func TestWebClient(t *testing.T) {
-	controllers.BootStrap()
+	bootStrapControllers()
 	Convey("Testing web client", t, func() {
 		/*
 			Convey("Read", func() {